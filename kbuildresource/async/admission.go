@@ -0,0 +1,142 @@
+package async
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+const (
+	admissionSampleInterval = time.Second     // 采样队列长度和依赖响应时间的间隔
+	admissionLatencyWeight  = 0.3             // 响应时间的指数移动平均中最新一次采样的权重
+	admissionHighWatermark  = 0.8             // 本实例的并发额度用完时，排队请求数超过容量的这个比例就开始拒绝
+	minRetryAfter           = time.Second     // 建议客户端重试的最短等待时间
+	maxRetryAfter           = time.Minute     // 建议客户端重试的最长等待时间
+	dependencyRetryAfter    = 5 * time.Second // 依赖响应慢时建议客户端重试的等待时间
+	failedLatency           = time.Minute     // 依赖调用失败时按照这个响应时间计算
+)
+
+// 准入控制，受理请求之前判断是否过载，过载时返回429，避免排队的请求无限增长：
+// 1. redis或者mysql的响应时间超过阈值，新的请求很可能超时，直接拒绝
+// 2. 所有实例共享的排队请求数达到容量上限
+// 3. 本实例的并发额度已经用完，并且排队请求数超过容量的高水位
+// 队列长度和响应时间由后台定期采样，没有过载时受理请求不需要访问redis和mysql
+type admissionController struct {
+	lock         sync.RWMutex
+	queueDepth   int64         // 所有队列中排队的请求数
+	redisLatency time.Duration // redis响应时间的移动平均
+	mysqlLatency time.Duration // mysql响应时间的移动平均
+	sampled      bool          // 是否已经采样过，采样之前不拒绝请求
+}
+
+func newAdmissionController() *admissionController {
+	return &admissionController{}
+}
+
+// 判断是否可以受理请求，过载时返回429错误
+// inflight和concurrency是请求类型在本实例上正在执行的请求数和并发数，没有单独限制的类型使用整个实例的
+func (a *admissionController) Admit(inflight int, concurrency int) error {
+	// 只在锁内读取采样结果，计算重试时间需要访问redis，放在锁外面，不阻塞采样
+	a.lock.RLock()
+	sampled, queueDepth, redisLatency, mysqlLatency := a.sampled, a.queueDepth, a.redisLatency, a.mysqlLatency
+	a.lock.RUnlock()
+	if !sampled {
+		return nil
+	}
+	if conf.Conf.RedisLatencyThreshold > 0 && redisLatency > conf.Conf.RedisLatencyThreshold {
+		return common.NewTooManyRequestsError(dependencyRetryAfter, "server is overloaded, redis latency %v exceeds %v", redisLatency, conf.Conf.RedisLatencyThreshold)
+	}
+	if conf.Conf.MySQLLatencyThreshold > 0 && mysqlLatency > conf.Conf.MySQLLatencyThreshold {
+		return common.NewTooManyRequestsError(dependencyRetryAfter, "server is overloaded, mysql latency %v exceeds %v", mysqlLatency, conf.Conf.MySQLLatencyThreshold)
+	}
+	capacity := int64(conf.Conf.RequestQueueCapacity)
+	if capacity <= 0 {
+		return nil
+	}
+	if queueDepth >= capacity {
+		return common.NewTooManyRequestsError(retryAfter(queueDepth, concurrency), "server is overloaded, %d requests are queued, capacity is %d", queueDepth, capacity)
+	}
+	if inflight >= concurrency && float64(queueDepth) >= float64(capacity)*admissionHighWatermark {
+		return common.NewTooManyRequestsError(retryAfter(queueDepth, concurrency), "server is overloaded, all %d slots are busy and %d requests are queued", concurrency, queueDepth)
+	}
+	return nil
+}
+
+// 估计排队的请求减少到可以受理新请求的时间：所有实例每执行完一轮，排队的请求就减少一轮
+func retryAfter(queueDepth int64, concurrency int) time.Duration {
+	average, err := cache.GetAverageRequestExecution()
+	if err != nil || average <= 0 || concurrency <= 0 {
+		return minRetryAfter
+	}
+	slots := int64(concurrency * countLiveInstances())
+	overflow := queueDepth - int64(float64(conf.Conf.RequestQueueCapacity)*admissionHighWatermark) + 1
+	rounds := (overflow + slots - 1) / slots
+	after := time.Duration(rounds) * average
+	if after < minRetryAfter {
+		return minRetryAfter
+	}
+	if after > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return after
+}
+
+// 定期采样队列长度和依赖的响应时间，直到ctx结束
+func (a *admissionController) startSampling(ctx context.Context, queue RequestQueue) {
+	t := time.NewTicker(admissionSampleInterval)
+	defer t.Stop()
+	for {
+		a.sample(queue)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *admissionController) sample(queue RequestQueue) {
+	redisLatency := measureLatency(cache.Ping)
+	mysqlLatency := measureLatency(models.Ping)
+	var depth int64
+	backlog, err := queue.Backlog()
+	if err != nil {
+		logrus.Error("ERROR: sample request queue depth failed, err: ", err)
+	}
+	for _, count := range backlog {
+		depth += count
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err == nil {
+		a.queueDepth = depth
+	}
+	if !a.sampled {
+		a.redisLatency, a.mysqlLatency = redisLatency, mysqlLatency
+		a.sampled = true
+		return
+	}
+	a.redisLatency = movingAverage(a.redisLatency, redisLatency)
+	a.mysqlLatency = movingAverage(a.mysqlLatency, mysqlLatency)
+}
+
+// 测量一次调用的响应时间，调用失败时返回failedLatency
+func measureLatency(ping func() error) time.Duration {
+	start := time.Now()
+	if err := ping(); err != nil {
+		logrus.Error("ERROR: ping failed, err: ", err)
+		return failedLatency
+	}
+	return time.Since(start)
+}
+
+func movingAverage(average time.Duration, sample time.Duration) time.Duration {
+	return time.Duration(admissionLatencyWeight*float64(sample) + (1-admissionLatencyWeight)*float64(average))
+}
@@ -0,0 +1,130 @@
+package async
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+const (
+	cancelCheckInterval = 5 * time.Second // 订阅的通知可能丢失，定期检查正在执行的请求是否被取消
+	canceledMessage     = "request canceled"
+)
+
+// 取消请求，可以在任意实例上调用：
+// 1. 在redis中标记请求已经取消，并通知所有实例
+// 2. 还没有开始执行的请求直接结束，读取到它的实例会跳过
+// 3. 正在执行的请求由执行它的实例中断，处理器负责撤销已经完成的部分工作，然后结束请求
+// 返回请求当前的状态，请求不存在时返回nil
+func CancelRequest(requestID string) (*models.Request, error) {
+	request, err := GetRequest(requestID)
+	if err != nil || request == nil {
+		return request, err
+	}
+	if common.IsTerminalRequestStatus(request.Status) {
+		return nil, common.NewConflictError("request %s has already finished with status %s", requestID, request.Status)
+	}
+	err = cache.SetRequestCanceled(requestID)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("INFO: request %s has been marked canceled", requestID)
+	cached, err := cache.GetRequestByNameAndRequestType(request.Name, request.RequestType)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if cached != nil && cached.RequestID == requestID && cached.Status == common.RequestStatusPending {
+		// 还没有开始执行，直接结束；队列中的消息在读取时跳过
+		// 读取之后请求可能已经开始执行，检查状态和删除在redis中原子地完成，开始执行的请求由执行它的实例中断
+		removed, err := cache.DeletePendingRequest(cached)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			markRequestCanceled(cached)
+			err = models.UpdateRequestStatus(cached)
+			if err != nil {
+				return nil, err
+			}
+			request.Status = cached.Status
+			request.Message = cached.Message
+			request.InstanceName = ""
+		}
+	}
+	return request, nil
+}
+
+// 请求是否已经被取消
+func IsRequestCanceled(request *models.Request) (bool, error) {
+	if request.RequestID == "" {
+		return false, nil
+	}
+	return cache.IsRequestCanceled(request.RequestID)
+}
+
+// 把被取消的请求的状态设置为canceled，并从缓存中删除
+func FinishCanceledRequest(request *models.Request) error {
+	markRequestCanceled(request)
+	err := cache.DeleteRequest(request)
+	if err != nil {
+		return err
+	}
+	return models.UpdateRequestStatus(request)
+}
+
+func markRequestCanceled(request *models.Request) {
+	request.Status = common.RequestStatusCanceled
+	if request.Message == "" {
+		request.Message = canceledMessage
+	}
+}
+
+// 中断本实例上正在执行的请求
+func (r *RequestController) interrupt(requestID string) {
+	if value, ok := r.running.Load(requestID); ok {
+		logrus.Infof("INFO: interrupt request %s because it has been canceled", requestID)
+		value.(*runningRequest).cancel(ErrRequestCanceled)
+	}
+}
+
+// 监听请求取消的通知，中断本实例上正在执行的请求
+func (r *RequestController) startWatchCancels() {
+	pubsub := cache.SubscribeRequestCancel()
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+	t := time.NewTicker(cancelCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			r.interrupt(message.Payload)
+		case <-t.C:
+			requestIDs := make([]string, 0)
+			r.running.Range(func(key, value interface{}) bool {
+				requestIDs = append(requestIDs, key.(string))
+				return true
+			})
+			if len(requestIDs) == 0 {
+				continue
+			}
+			canceled, err := cache.ListCanceledRequests(requestIDs)
+			if err != nil {
+				logrus.Error("ERROR: check canceled requests failed, err: ", err)
+				continue
+			}
+			for _, requestID := range canceled {
+				r.interrupt(requestID)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+)
+
+// 只包含执行请求需要的字段的控制器
+func newTestController(t *testing.T, queue RequestQueue) *RequestController {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &RequestController{
+		limitChan:    make(chan struct{}, 1),
+		typeLimits:   make(map[string]chan struct{}),
+		held:         make(map[string][]*cache.QueueMessage),
+		wakeCh:       make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+		queue:        queue,
+		scheduler:    newFairScheduler(nil),
+		instanceName: "a",
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func TestCancelInterruptsRunningRequest(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	request := newTestRequest("r1", "ci", 5)
+	lease, err := acquireRequestLease(request, r.instanceName)
+	if err != nil || lease == nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	defer lease.Release()
+	ctx := r.startRunning(request, lease)
+	defer r.stopRunning(request)
+	go r.startWatchCancels()
+
+	// 订阅建立之前的通知会丢失，定期检查也能发现，这里重复发送直到请求被中断
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		if err = cache.SetRequestCanceled(request.RequestID); err != nil {
+			t.Fatalf("cancel failed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if cause := context.Cause(ctx); cause != ErrRequestCanceled {
+		t.Fatalf("expect request to be interrupted by cancel, got %v", cause)
+	}
+	if canceled, err := IsRequestCanceled(request); err != nil || !canceled {
+		t.Errorf("expect request to be marked canceled, got %v, err: %v", canceled, err)
+	}
+}
+
+func TestInterruptAll(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	contexts := make([]context.Context, 0)
+	for _, id := range []string{"r1", "r2"} {
+		request := newTestRequest(id, "ci", 5)
+		lease, err := acquireRequestLease(request, r.instanceName)
+		if err != nil || lease == nil {
+			t.Fatalf("acquire lease failed: %v", err)
+		}
+		defer lease.Release()
+		contexts = append(contexts, r.startRunning(request, lease))
+	}
+	r.interruptAll(ErrRequestShutdown)
+	for _, ctx := range contexts {
+		if cause := context.Cause(ctx); cause != ErrRequestShutdown {
+			t.Errorf("expect request to be interrupted by shutdown, got %v", cause)
+		}
+	}
+}
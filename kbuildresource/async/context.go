@@ -0,0 +1,99 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 执行请求的context被取消的原因，处理器通过context.Cause区分
+var (
+	// 请求被用户取消，处理器撤销已经完成的部分工作，请求的状态转换为canceled
+	ErrRequestCanceled = errors.New("request canceled")
+	// 实例停机，处理器不写入结束状态，请求由其他实例重新执行
+	ErrRequestShutdown = errors.New("request controller is shutting down")
+	// 请求的租约或者实例的存活租约丢失，请求已经或者即将被其他实例认领，处理器不能再写入任何状态
+	ErrRequestLeaseLost = errors.New("request lease lost")
+)
+
+// 超过截止时间或者请求类型的超时时间时，context.Cause返回context.DeadlineExceeded
+
+// 请求的执行期限：请求类型的超时时间和请求的截止时间中较早的一个，都没有时返回false
+func requestDeadline(request *models.Request, start time.Time) (time.Time, bool) {
+	var deadline time.Time
+	timeout, ok := conf.Conf.RequestTimeouts[request.RequestType]
+	if !ok {
+		timeout = conf.Conf.RequestTimeout
+	}
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	if request.Deadline != nil && (deadline.IsZero() || request.Deadline.Before(deadline)) {
+		deadline = *request.Deadline
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// 正在本实例上执行的请求
+type runningRequest struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   context.CancelFunc // 释放执行期限的定时器
+}
+
+// 登记正在执行的请求，返回请求执行使用的context：
+// 请求被取消、超过执行期限、租约丢失或者实例停机时context被取消
+func (r *RequestController) startRunning(request *models.Request, lease *requestLease) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	running := &runningRequest{ctx: ctx, cancel: cancel, stop: func() {}}
+	if deadline, ok := requestDeadline(request, time.Now()); ok {
+		ctx, running.stop = context.WithDeadline(ctx, deadline)
+	}
+	r.running.Store(request.RequestID, running)
+	go func() {
+		select {
+		case <-lease.Lost():
+			cancel(ErrRequestLeaseLost)
+		case <-running.ctx.Done():
+		}
+	}()
+	return ctx
+}
+
+func (r *RequestController) stopRunning(request *models.Request) {
+	if value, ok := r.running.LoadAndDelete(request.RequestID); ok {
+		running := value.(*runningRequest)
+		running.stop()
+		running.cancel(nil)
+	}
+}
+
+// 中断本实例上所有正在执行的请求
+func (r *RequestController) interruptAll(cause error) {
+	r.running.Range(func(key, value interface{}) bool {
+		logrus.Infof("INFO: interrupt request %s, cause: %v", key, cause)
+		value.(*runningRequest).cancel(cause)
+		return true
+	})
+}
+
+// 等待正在执行的请求完成，超时返回false
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/conf"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	timeouts := conf.Conf.RequestTimeouts
+	timeout := conf.Conf.RequestTimeout
+	defer func() {
+		conf.Conf.RequestTimeouts = timeouts
+		conf.Conf.RequestTimeout = timeout
+	}()
+	conf.Conf.RequestTimeout = time.Hour
+	conf.Conf.RequestTimeouts = map[string]time.Duration{"test_create": time.Minute}
+	start := time.Now()
+	soon := start.Add(time.Second)
+	late := start.Add(2 * time.Hour)
+	cases := []struct {
+		requestType string
+		deadline    *time.Time
+		expect      time.Time
+	}{
+		{"test_create", nil, start.Add(time.Minute)},
+		{"test_delete", nil, start.Add(time.Hour)},
+		// 截止时间和超时时间中较早的一个
+		{"test_create", &soon, soon},
+		{"test_create", &late, start.Add(time.Minute)},
+	}
+	for _, c := range cases {
+		request := newTestRequest("r1", "ci", 5)
+		request.RequestType = c.requestType
+		request.Deadline = c.deadline
+		deadline, ok := requestDeadline(request, start)
+		if !ok || !deadline.Equal(c.expect) {
+			t.Errorf("%s with deadline %v: expect %v, got %v", c.requestType, c.deadline, c.expect, deadline)
+		}
+	}
+	conf.Conf.RequestTimeout = 0
+	conf.Conf.RequestTimeouts = nil
+	if _, ok := requestDeadline(newTestRequest("r1", "ci", 5), start); ok {
+		t.Error("expect no deadline without timeout")
+	}
+}
+
+func TestStartRunningAfterDeadline(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	request := newTestRequest("r1", "ci", 5)
+	deadline := time.Now().Add(-time.Second)
+	request.Deadline = &deadline
+	lease, err := acquireRequestLease(request, r.instanceName)
+	if err != nil || lease == nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	defer lease.Release()
+	// 排队期间已经超过截止时间，开始执行时ctx已经结束，处理器据此直接失败
+	ctx := r.startRunning(request, lease)
+	defer r.stopRunning(request)
+	if ctx.Err() == nil || context.Cause(ctx) != context.DeadlineExceeded {
+		t.Errorf("expect context to be done with deadline exceeded, got %v", context.Cause(ctx))
+	}
+}
+
+func TestLeaseMaxHoldInterruptsExecution(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	request := newTestRequest("r1", "ci", 5)
+	if ok, err := cache.AcquireRequestLease(request.RequestID, "a/owner", RequestLeaseTTL); err != nil || !ok {
+		t.Fatalf("acquire lease failed: %v, err: %v", ok, err)
+	}
+	lease := newRequestLease(request, "a/owner", 10*time.Millisecond, 30*time.Millisecond)
+	go lease.keepRenewing()
+	defer lease.Release()
+	ctx := r.startRunning(request, lease)
+	defer r.stopRunning(request)
+
+	// 持有租约超过最长时长后当作租约丢失，执行被中断
+	select {
+	case <-lease.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect lease to be lost after max hold")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect execution to be interrupted")
+	}
+	if context.Cause(ctx) != ErrRequestLeaseLost {
+		t.Errorf("expect lease lost, got %v", context.Cause(ctx))
+	}
+}
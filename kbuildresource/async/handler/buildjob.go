@@ -8,21 +8,29 @@ import (
 	"bryson.foundation/kbuildresource/dto"
 	"bryson.foundation/kbuildresource/models"
 	"bryson.foundation/kbuildresource/utils"
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
-	"time"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"net"
+	"net/http"
 )
 
 type BuildJobHandler struct {
 }
 
 func init() {
-	async.RegisterRequestHandler(common.BuildJobPrefix, &BuildJobHandler{})
+	async.RegisterRequestHandlerV2(common.BuildJobPrefix, &BuildJobHandler{})
 
 }
 
-func (b *BuildJobHandler) PreExec(requestDTO interface{}, requestType string, values map[string]interface{}) error {
+func (b *BuildJobHandler) PreExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) error {
 	buildJobDTO, ok := requestDTO.(*dto.BuildJobDTO)
 	if !ok {
 		logrus.Error("ERROR: BuildJobHandler PreExec requestDTO is not a type of dto.BuildJobDTO")
@@ -34,9 +42,16 @@ func (b *BuildJobHandler) PreExec(requestDTO interface{}, requestType string, va
 		if buildJobDTO.ReName {
 			buildJobDTO.Name = buildJobDTO.Name + "-" + utils.CreateRandomString(5)
 		}
-		return buildjob.VerifyBuildJobDTO(buildJobDTO)
+		err := buildjob.VerifyBuildJobDTO(buildJobDTO)
+		if err != nil {
+			return err
+		}
+		// 确定集群，只指定了网络区域的在区域内选择
+		return buildjob.ScheduleBuildJob(buildJobDTO)
+	case common.BuildJobDeleteRequestType:
+		return preExecDelete(buildJobDTO)
 	default:
-		return fmt.Errorf("invalid reqeusType %s",requestType)
+		return common.NewBadRequestError("invalid reqeusType %s", requestType)
 	}
 }
 
@@ -48,24 +63,47 @@ func (b *BuildJobHandler) SetInstanceName(requestDTO interface{}, instanceName s
 	buildJobDTO.InstanceName = instanceName
 }
 
-func (b *BuildJobHandler) MakeRequest(requestDTO interface{}, requestType string, values map[string]interface{}) (*models.Request, error) {
+func (b *BuildJobHandler) SetRequestID(requestDTO interface{}, requestID string) {
+	buildJobDTO, ok := requestDTO.(*dto.BuildJobDTO)
+	if !ok {
+		logrus.Error("ERROR: BuildJobHandler SetRequestID requestDTO is not a type of dto.BuildJobDTO")
+		return
+	}
+	buildJobDTO.RequestID = requestID
+}
+
+func (b *BuildJobHandler) MakeRequest(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (*models.Request, error) {
 	buildJobDTO, ok := requestDTO.(*dto.BuildJobDTO)
 	if !ok {
 		logrus.Error("ERROR: BuildJobHandler PreExec requestDTO is not a type of dto.BuildJobDTO")
 		return nil, fmt.Errorf("buildJobHandler PreExec requestDTO is not a type of dto.BuildJobDTO")
 	}
+	if buildJobDTO.Priority == 0 {
+		buildJobDTO.Priority = common.DefaultRequestPriority
+	}
 	buildJobDTOJsonData, err := json.Marshal(buildJobDTO)
 	if err != nil {
 		return nil, fmt.Errorf("marshal requestDTO failed")
 	}
 
 	request := &models.Request{
+		RequestID:   buildJobDTO.RequestID,
 		Name:        buildJobDTO.Name,
 		Status:      common.RequestStatusPending,
 		RequestType: requestType,
+		ClusterName: buildJobDTO.ClusterName,
+		Namespace:   buildJobDTO.Namespace,
+		Priority:    buildJobDTO.Priority,
+		NotBefore:   buildJobDTO.NotBefore,
+		Deadline:    buildJobDTO.Deadline,
 		InstanceName: buildJobDTO.InstanceName,
 		RequestDTO:   string(buildJobDTOJsonData),
 	}
+	// 先在mysql中持久化请求，保证请求ID可以一直查询到
+	_, err = models.AddRequest(request)
+	if err != nil {
+		return nil, err
+	}
 	// 放入cache中并返回
 	err = cache.AddRequest(request)
 	if err != nil {
@@ -75,55 +113,182 @@ func (b *BuildJobHandler) MakeRequest(requestDTO interface{}, requestType string
 	return request, nil
 }
 
-func (b *BuildJobHandler) AsyncExec(request *models.Request, limitChan <-chan struct{}) {
-	time.Sleep(10 * time.Second)
-	defer func() {
-		<-limitChan
-	}()
-	switch request.RequestType {
-	case common.BuildJobCreateRequestType:
-		err := transferRequestStatus(request, common.RequestStatusExecuting)
+// ctx在请求被取消、超过执行期限、租约丢失或者实例停机时被取消，原因见execRequest
+func (b *BuildJobHandler) AsyncExec(ctx context.Context, request *models.Request) {
+	// 请求在排队期间可能被取消了，比如同名的删除请求会取消排队中的创建请求
+	canceled, err := async.IsRequestCanceled(request)
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		return
+	}
+	if canceled {
+		logrus.Infof("INFO: request %s/%s has been canceled, skip", request.RequestType, request.Name)
+		err = transferRequestStatus(request, common.RequestStatusCanceled)
 		if err != nil {
 			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			return
 		}
-		buildJobDTO := &dto.BuildJobDTO{}
-		err = json.Unmarshal([]byte(request.RequestDTO), buildJobDTO)
-		if err != nil {
-			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			err = transferRequestStatus(request, common.RequestStatusFailed)
-			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			return
+		return
+	}
+	switch request.RequestType {
+	case common.BuildJobCreateRequestType:
+		execRequest(ctx, request, buildjob.CreatePod, undoCreatePod)
+	case common.BuildJobDeleteRequestType:
+		// 已经删除的pod无法恢复，不需要撤销
+		execRequest(ctx, request, buildjob.DeletePod, nil)
+	default:
+		return
+	}
+}
+
+// 执行请求，并根据执行结果转换请求的状态，执行器因为ctx被取消而失败时根据原因处理：
+// 1. 请求被取消：调用undo撤销已经完成的部分工作，请求的状态转换为canceled
+// 2. 超过执行期限：调用undo撤销已经完成的部分工作，请求的状态转换为failed
+// 3. 实例停机或者租约丢失：请求会被其他实例重新执行，不撤销也不写入状态
+// 执行器已经成功完成时，之后才到达的取消和超时不再撤销，照常记录成功
+// 执行失败时，可以重试的错误交给async.RetryRequest重新调度，永久错误直接失败
+// 集群和命名空间的许可由控制器在分发请求之前获取，保证所有实例加起来不超过并发限制
+func execRequest(ctx context.Context, request *models.Request, exec func(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error, undo func(buildJobDTO *dto.BuildJobDTO) error) {
+	if ctx.Err() != nil {
+		// 排队期间已经超过截止时间的请求直接失败，不再转换为executing，也不调用执行器
+		finishInterruptedRequest(ctx, request, nil, nil)
+		return
+	}
+	err := transferRequestStatus(request, common.RequestStatusExecuting)
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		if _, err = async.RetryRequest(request, classifyError(err)); err != nil {
+			logrus.Error("ERROR: retry request failed, err: ", err)
 		}
-		err = buildjob.CreatePod(buildJobDTO)
-		if err != nil {
-			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			err = transferRequestStatus(request, common.RequestStatusFailed)
-			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			return
+		return
+	}
+	buildJobDTO := &dto.BuildJobDTO{}
+	err = json.Unmarshal([]byte(request.RequestDTO), buildJobDTO)
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		err = transferRequestStatus(request, common.RequestStatusFailed)
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		return
+	}
+	err = exec(ctx, buildJobDTO)
+	if err != nil && ctx.Err() != nil {
+		finishInterruptedRequest(ctx, request, buildJobDTO, undo)
+		return
+	}
+	if err == nil && context.Cause(ctx) == async.ErrRequestLeaseLost {
+		// 租约丢失后不能再写入任何状态，认领请求的实例重新执行时会发现工作已经完成
+		logrus.Infof("INFO: request %s/%s finished after its lease was lost, skip", request.RequestType, request.Name)
+		return
+	}
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		failRequest(request, err)
+		return
+	}
+	err = transferRequestStatus(request, common.RequestStatusSuccess)
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+		return
+	}
+	logrus.Info("INFO: finish AsyncExec")
+}
+
+// 处理执行过程中被中断的请求，buildJobDTO为nil表示还没有开始执行，不需要撤销
+func finishInterruptedRequest(ctx context.Context, request *models.Request, buildJobDTO *dto.BuildJobDTO, undo func(buildJobDTO *dto.BuildJobDTO) error) {
+	cause := context.Cause(ctx)
+	logrus.Infof("INFO: request %s/%s has been interrupted during execution, cause: %v", request.RequestType, request.Name, cause)
+	if cause == async.ErrRequestShutdown || cause == async.ErrRequestLeaseLost {
+		return
+	}
+	status := common.RequestStatusCanceled
+	if cause != async.ErrRequestCanceled {
+		status = common.RequestStatusFailed
+		request.Message = "deadline exceeded"
+		if buildJobDTO == nil {
+			request.Message = "deadline exceeded before execution"
 		}
-		err = transferRequestStatus(request, common.RequestStatusSuccess)
-		if err != nil {
-			logrus.Error("ERROR: AsyncExec failed, err: ", err)
-			return
+	}
+	if undo != nil && buildJobDTO != nil {
+		if undoErr := undo(buildJobDTO); undoErr != nil {
+			logrus.Error("ERROR: undo interrupted request failed, err: ", undoErr)
+			request.Message = fmt.Sprintf("%s, but undo failed: %v", cause, undoErr)
 		}
-		logrus.Info("INFO: finish AsyncExec")
-	default:
+	}
+	err := transferRequestStatus(request, status)
+	if err != nil {
+		logrus.Error("ERROR: AsyncExec failed, err: ", err)
+	}
+}
+
+// 执行失败，可以重试的错误重新调度，永久错误直接失败
+func failRequest(request *models.Request, err error) {
+	err = classifyError(err)
+	retried, retryErr := async.RetryRequest(request, err)
+	if retryErr != nil {
+		logrus.Error("ERROR: retry request failed, err: ", retryErr)
+	}
+	if retried {
 		return
 	}
+	request.Message = err.Error()
+	err = transferRequestStatus(request, common.RequestStatusFailed)
+	logrus.Error("ERROR: AsyncExec failed, err: ", err)
 }
 
-func (b *BuildJobHandler) PostAsyncExec(request *models.Request, requestType string, values map[string]interface{}) error {
+// 区分可以重试的错误：集群api超时、限流、暂时不可用，网络错误，mysql连接断开、死锁、锁等待超时等
+// 参数错误、资源冲突等其他错误重试也不会成功，当作永久错误
+func classifyError(err error) error {
+	if err == nil || common.IsRetryableError(err) {
+		return err
+	}
+	if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err) {
+		return common.NewRetryableError(err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return common.NewRetryableError(err)
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1040, 1205, 1213: // too many connections, lock wait timeout, deadlock
+			return common.NewRetryableError(err)
+		}
+	}
+	return err
+}
+
+// 撤销被中断的创建请求：删除集群中的pod以及mysql中的pod记录，其他请求创建的同名pod不删除
+func undoCreatePod(buildJobDTO *dto.BuildJobDTO) error {
+	pod, err := models.GetPodByName(buildJobDTO.Name)
+	if err != nil {
+		return err
+	}
+	if pod == nil || pod.RequestID != buildJobDTO.RequestID {
+		return nil
+	}
+	return buildjob.DeletePod(context.Background(), buildJobDTO)
+}
+
+func (b *BuildJobHandler) PostAsyncExec(ctx context.Context, request *models.Request, requestType string, values map[string]interface{}) error {
 	return nil
 }
 
-func (b *BuildJobHandler) SyncExec(requestDTO interface{}, requestType string, values map[string]interface{}) (interface{}, error) {
+func (b *BuildJobHandler) SyncExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (interface{}, error) {
 	buildJobDTO , ok := requestDTO.(*dto.BuildJobDTO)
 	if !ok {
 		logrus.Error("ERROR: BuildJobHandler PreExec requestDTO is not a type of dto.BuildJobDTO")
 		return nil, fmt.Errorf("buildJobHandler PreExec requestDTO is not a type of dto.BuildJobDTO")
 	}
-	err := buildjob.CreatePod(buildJobDTO)
+	var err error
+	switch requestType {
+	case common.BuildJobCreateRequestType:
+		err = buildjob.CreatePod(ctx, buildJobDTO)
+	case common.BuildJobDeleteRequestType:
+		err = buildjob.DeletePod(ctx, buildJobDTO)
+	default:
+		err = fmt.Errorf("invalid reqeusType %s", requestType)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -135,37 +300,100 @@ func (b *BuildJobHandler) MakeAsyncResponse(requestDTO interface{}, requestType
 }
 
 //  要根据请求当前所处的状态（executing和pending）进行区分处理，这里为方便，统一都接管
-func (b *BuildJobHandler) HandleTakeOverRequest(request *models.Request, newInstanceName string) error {
+//  删除请求是幂等的（只做逻辑删除），实例在删除过程中死掉后被重新执行也没有问题
+func (b *BuildJobHandler) HandleTakeOverRequest(ctx context.Context, request *models.Request, newInstanceName string) error {
 	request.Status = common.RequestStatusPending
 	return async.HandleCacheDataForTakeOverPendingRequest(request, newInstanceName)
 }
 
+// 请求状态流转，mysql中的请求记录和redis中的实时状态同步更新，结束的请求从redis中删除
 func transferRequestStatus(request *models.Request, status string) error {
 	if request.Status == status {
 		return nil
 	}
+	// 租约丢失说明请求已经被其他实例认领，不能再写入状态
+	err := async.CheckRequestLease(request)
+	if err != nil {
+		return err
+	}
 	if status == common.RequestStatusExecuting {
 		logrus.Info("INFO: transfer request status to executing")
 		request.Status = common.RequestStatusExecuting
-		return cache.UpdateRequest(request)
+		err = cache.UpdateRequest(request)
+		if err != nil {
+			return err
+		}
+		return models.UpdateRequestStatus(request)
 	}
 	if status == common.RequestStatusFailed {
 		// 更新状态，删除cache,并转到dao层
 		logrus.Info("INFO: transfer request status to failed")
 		request.Status = common.RequestStatusFailed
-		err := cache.DeleteRequest(request)
+		err = cache.DeleteRequest(request)
 		if err != nil {
 			return err
 		}
 		// 转到dao层，
-		_, err = models.AddRequest(request)
-		return err
+		return models.UpdateRequestStatus(request)
+	}
+	if status == common.RequestStatusCanceled {
+		logrus.Info("INFO: transfer request status to canceled")
+		err = async.FinishCanceledRequest(request)
+		if err != nil {
+			return err
+		}
+		return nil
 	}
 	if status == common.RequestStatusSuccess {
-		//直接从cache里面删除
 		logrus.Info("INFO: finish request and delete from redis")
-		return cache.DeleteRequest(request)
+		request.Status = common.RequestStatusSuccess
+		err = cache.DeleteRequest(request)
+		if err != nil {
+			return err
+		}
+		return models.UpdateRequestStatus(request)
 	}
 	return nil
 }
 
+// 删除请求的前置处理：
+// 1. 同名的创建请求还在排队（pending），直接取消掉，不再创建，pod还没有创建，删除请求直接完成，返回async.ErrRequestFinished
+// 2. 同名的创建请求正在执行（executing），拒绝删除，让调用方稍后重试，避免删除和创建交叉执行
+// 3. 没有创建请求，pod也不存在或者已经删除，返回不存在
+func preExecDelete(buildJobDTO *dto.BuildJobDTO) error {
+	createRequest, err := cache.GetRequestByNameAndRequestType(buildJobDTO.Name, common.BuildJobCreateRequestType)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if createRequest != nil {
+		switch createRequest.Status {
+		case common.RequestStatusPending:
+			logrus.Infof("INFO: cancel pending create request of buildJob %s", buildJobDTO.Name)
+			canceled, err := async.CancelRequest(createRequest.RequestID)
+			if err != nil && common.StatusCodeOf(err) != http.StatusConflict {
+				return err
+			}
+			if err == nil && canceled != nil {
+				if canceled.Status == common.RequestStatusCanceled {
+					return async.ErrRequestFinished
+				}
+				// 取消前创建请求已经开始执行，由执行它的实例中断并撤销
+				return common.NewConflictError("buildJob %s is being created, please retry later", buildJobDTO.Name)
+			}
+			// 取消前创建请求已经结束，按pod的状态删除
+		case common.RequestStatusExecuting:
+			return common.NewConflictError("buildJob %s is being created, please retry later", buildJobDTO.Name)
+		}
+	}
+	pod, err := models.GetPodByName(buildJobDTO.Name)
+	if err != nil {
+		return err
+	}
+	if pod == nil || pod.IsDelete == "1" {
+		return common.NewNotFoundError("buildJob %s not found", buildJobDTO.Name)
+	}
+	// 删除请求和创建请求在同一个命名空间中排队，并且受同一个集群的并发限制
+	buildJobDTO.Namespace = pod.Namespace
+	buildJobDTO.ClusterName = pod.ClusterName
+	return nil
+}
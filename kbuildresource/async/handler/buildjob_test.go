@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/astaxie/beego/orm"
+	"github.com/go-redis/redis"
+	_ "github.com/mattn/go-sqlite3"
+
+	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+)
+
+var registerTestDB sync.Once
+
+// 使用sqlite内存数据库代替mysql，每个测试开始时清空所有表
+func newTestDB(t *testing.T) {
+	registerTestDB.Do(func() {
+		if err := orm.RegisterDataBase("default", "sqlite3", "file::memory:?cache=shared"); err != nil {
+			t.Fatalf("register database failed: %v", err)
+		}
+		orm.RegisterModel(new(models.Container), new(models.Pod), new(models.Request), new(models.DeadLetter))
+		if err := orm.RunSyncdb("default", false, false); err != nil {
+			t.Fatalf("create tables failed: %v", err)
+		}
+	})
+	o := orm.NewOrm()
+	for _, table := range []string{"container", "pod", "request", "dead_letter"} {
+		if _, err := o.Raw("delete from " + table).Exec(); err != nil {
+			t.Fatalf("clear table %s failed: %v", table, err)
+		}
+	}
+}
+
+// 启动一个进程内的redis，测试结束后恢复原来的客户端
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+	// 请求的全局查询只遍历实例a的缓存
+	cache.RegisterInstanceNameLister(func() ([]string, error) { return []string{"a"}, nil })
+	t.Cleanup(func() { cache.RegisterInstanceNameLister(cache.GetInstanceNameList) })
+	return s
+}
+
+// 已经受理、等待执行的创建请求，mysql和缓存中都有记录
+func newTestRequest(t *testing.T, name string) *models.Request {
+	data, _ := json.Marshal(&dto.BuildJobDTO{Name: name, Namespace: "ci", ClusterName: "test"})
+	request := &models.Request{
+		RequestID:    name + "-id",
+		Name:         name,
+		Status:       common.RequestStatusPending,
+		RequestType:  common.BuildJobCreateRequestType,
+		Namespace:    "ci",
+		Priority:     common.DefaultRequestPriority,
+		InstanceName: "a",
+		RequestDTO:   string(data),
+	}
+	if _, err := models.AddRequest(request); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+	if err := cache.AddRequest(request); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	return request
+}
+
+// mysql中请求的状态，以及缓存中是否还有这个请求
+func statusOf(t *testing.T, request *models.Request) (string, bool) {
+	stored, err := models.GetRequestByRequestID(request.RequestID)
+	if err != nil || stored == nil {
+		t.Fatalf("get request failed: %v", err)
+	}
+	_, err = cache.GetRequestByNameAndRequestTypeAndInstanceName(request.Name, request.RequestType, request.InstanceName)
+	return stored.Status, err == nil
+}
+
+func TestPreExecDeleteCancelsPendingCreate(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	create := newTestRequest(t, "agent-1")
+	// pod还没有创建，删除请求直接完成，不需要入队
+	if err := preExecDelete(&dto.BuildJobDTO{Name: "agent-1"}); err != async.ErrRequestFinished {
+		t.Fatalf("expect delete to be finished, got %v", err)
+	}
+	// 排队中的创建请求被标记为取消并从cache中删除，不会再执行，mysql中记录为canceled
+	if canceled, err := async.IsRequestCanceled(create); err != nil || !canceled {
+		t.Errorf("expect create request to be canceled, got %v, err: %v", canceled, err)
+	}
+	stored, err := models.GetRequestByRequestID("agent-1-id")
+	if err != nil || stored == nil || stored.Status != common.RequestStatusCanceled {
+		t.Errorf("expect canceled create request in mysql, got %+v, err: %v", stored, err)
+	}
+}
+
+func TestPreExecDelete(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	executing := &models.Request{
+		Name:         "agent-executing",
+		Status:       common.RequestStatusExecuting,
+		RequestType:  common.BuildJobCreateRequestType,
+		InstanceName: "a",
+	}
+	if err := cache.AddRequest(executing); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	for _, pod := range []*models.Pod{{Name: "agent-running", Namespace: "ci", ClusterName: "test", IsDelete: "0"}, {Name: "agent-deleted", IsDelete: "1"}} {
+		if _, err := models.AddPod(pod); err != nil {
+			t.Fatalf("add pod failed: %v", err)
+		}
+	}
+	cases := []struct {
+		name     string
+		accepted bool
+	}{
+		// 创建请求正在执行，删除和创建不能交叉执行
+		{"agent-executing", false},
+		{"agent-running", true},
+		{"agent-deleted", false},
+		{"agent-unknown", false},
+	}
+	for _, c := range cases {
+		buildJobDTO := &dto.BuildJobDTO{Name: c.name}
+		err := preExecDelete(buildJobDTO)
+		if c.accepted != (err == nil) {
+			t.Errorf("%s: expect accepted %v, got err: %v", c.name, c.accepted, err)
+		}
+		// 删除请求和pod在同一个命名空间排队，并且受同一个集群的并发限制
+		if c.accepted && (buildJobDTO.Namespace != "ci" || buildJobDTO.ClusterName != "test") {
+			t.Errorf("%s: expect namespace and cluster of the pod, got %s/%s", c.name, buildJobDTO.Namespace, buildJobDTO.ClusterName)
+		}
+	}
+	// 被拒绝的删除不影响正在执行的创建请求
+	if _, err := cache.GetRequestByNameAndRequestTypeAndInstanceName("agent-executing", common.BuildJobCreateRequestType, "a"); err != nil {
+		t.Errorf("expect executing create request to stay in cache, got %v", err)
+	}
+}
+
+func TestExecRequestCanceled(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	cases := []struct {
+		desc    string
+		execErr bool // 执行器是否因为取消而失败
+		status  string
+		undone  bool
+	}{
+		// 执行器因为取消而失败，撤销已经完成的工作
+		{"canceled during exec", true, common.RequestStatusCanceled, true},
+		// 执行器已经成功完成，之后才到达的取消不撤销，照常记录成功
+		{"canceled after exec", false, common.RequestStatusSuccess, false},
+	}
+	for i, c := range cases {
+		request := newTestRequest(t, fmt.Sprintf("agent-canceled-%d", i))
+		ctx, cancel := context.WithCancelCause(context.Background())
+		undone := false
+		exec := func(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+			cancel(async.ErrRequestCanceled)
+			if c.execErr {
+				return ctx.Err()
+			}
+			return nil
+		}
+		undo := func(buildJobDTO *dto.BuildJobDTO) error {
+			undone = true
+			return nil
+		}
+		execRequest(ctx, request, exec, undo)
+		status, cached := statusOf(t, request)
+		if status != c.status || cached || undone != c.undone {
+			t.Errorf("%s: expect status %s, undone %v and removed from cache, got %s, undone %v, cached %v",
+				c.desc, c.status, c.undone, status, undone, cached)
+		}
+	}
+}
+
+func TestExecRequestLeaseLostAfterExec(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	request := newTestRequest(t, "agent-lease-lost")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	exec := func(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+		cancel(async.ErrRequestLeaseLost)
+		return nil
+	}
+	execRequest(ctx, request, exec, nil)
+	// 租约丢失后不再写入任何状态，由认领请求的实例处理
+	if status, cached := statusOf(t, request); status != common.RequestStatusExecuting || !cached {
+		t.Errorf("expect request to stay executing, got %s, cached %v", status, cached)
+	}
+}
+
+func TestExecRequestFailed(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	request := newTestRequest(t, "agent-failed")
+	exec := func(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+		return errors.New("invalid image")
+	}
+	execRequest(context.Background(), request, exec, nil)
+	stored, _ := models.GetRequestByRequestID(request.RequestID)
+	if stored.Status != common.RequestStatusFailed || stored.Message != "invalid image" {
+		t.Errorf("expect request to fail with the error, got %s: %s", stored.Status, stored.Message)
+	}
+}
+
+func TestExecRequestDeadlineExceeded(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	request := newTestRequest(t, "agent-deadline")
+	deadline := time.Now().Add(-time.Second)
+	request.Deadline = &deadline
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	executed := false
+	exec := func(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+		executed = true
+		return nil
+	}
+	execRequest(ctx, request, exec, nil)
+	// 排队期间已经超过截止时间，不调用执行器，直接失败
+	stored, _ := models.GetRequestByRequestID(request.RequestID)
+	if executed || stored.Status != common.RequestStatusFailed || stored.Message != "deadline exceeded before execution" {
+		t.Errorf("expect request to fail before execution, got executed %v, %s: %s", executed, stored.Status, stored.Message)
+	}
+	if _, cached := statusOf(t, request); cached {
+		t.Error("expect request to be removed from cache")
+	}
+}
+
+func TestUndoCreatePodKeepsPodOfOtherRequest(t *testing.T) {
+	newTestDB(t)
+	if _, err := models.AddPod(&models.Pod{Name: "agent-1", ClusterName: "test", IsDelete: "0", RequestID: "other-id"}); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	// 创建请求因为同名pod已经存在而失败，撤销时不能删除其他请求创建的pod
+	if err := undoCreatePod(&dto.BuildJobDTO{Name: "agent-1", RequestID: "agent-1-id"}); err != nil {
+		t.Fatalf("undo create pod failed: %v", err)
+	}
+	pod, err := models.GetPodByName("agent-1")
+	if err != nil || pod == nil || pod.IsDelete != "0" {
+		t.Errorf("expect pod of other request to be kept, got %+v, err: %v", pod, err)
+	}
+}
@@ -0,0 +1,91 @@
+package async
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+)
+
+// 停机时把本实例缓存中还没有结束的请求交给一个存活的实例，在请求控制器Shutdown之后、从实例列表中移除之前调用
+// 1. 持久化的队列中请求还在共享队列里，任何实例都可以执行，只需要把缓存转到peer名下，状态查询仍然可以查到；
+// 租约还有效的请求正在其他实例上执行，执行者把状态写到本实例的缓存中，不能移走，由执行者结束后删除
+// 2. 本地队列中的请求随实例一起消失，通知peer立即接管，由peer重新放入它的队列，没有实例收到通知时返回错误
+// 返回错误时请求没有全部交出去，调用方不能把自己从实例列表中移除，由其他实例把自己当作死亡实例接管
+func (r *RequestController) HandOff(peer string) error {
+	if peer == "" || peer == r.instanceName {
+		return fmt.Errorf("invalid peer %s to hand off requests", peer)
+	}
+	if !r.queue.Durable() {
+		logrus.Infof("INFO: notify instance %s to take over requests of %s", peer, r.instanceName)
+		receivers, err := cache.PublishRequestHandOff(r.instanceName, peer)
+		if err != nil {
+			return err
+		}
+		if receivers == 0 {
+			return fmt.Errorf("no instance received the hand off to %s", peer)
+		}
+		return nil
+	}
+	requests, err := cache.GetAllRequestByInstanceName(r.instanceName)
+	if err != nil {
+		return err
+	}
+	handedOff := 0
+	for _, request := range requests {
+		owner, _, err := cache.GetRequestLease(request.RequestID)
+		if err != nil {
+			return err
+		}
+		if owner != "" {
+			logrus.Infof("INFO: request %s is executing by %s, skip handing it off", request.RequestID, owner)
+			continue
+		}
+		requestHandler, err := getHandlerFromRequestType(request.RequestType)
+		if err != nil {
+			logrus.Error("ERROR: ", err)
+			continue
+		}
+		err = requestHandler.HandleTakeOverRequest(context.Background(), request, peer)
+		if err == ErrRequestTakenOver {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		handedOff++
+	}
+	logrus.Infof("INFO: hand off %d requests from %s to %s", handedOff, r.instanceName, peer)
+	return nil
+}
+
+// 监听其他实例停机时的交接通知，交给本实例的请求立即接管
+func (r *RequestController) startWatchHandOffs() {
+	pubsub := cache.SubscribeRequestHandOff()
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			from, to, err := cache.ParseRequestHandOff(message.Payload)
+			if err != nil {
+				logrus.Error("ERROR: ", err)
+				continue
+			}
+			if to != r.instanceName {
+				continue
+			}
+			err = r.TakeOverRequest(from, r.instanceName, 0)
+			if err != nil {
+				logrus.Errorf("ERROR: take over requests of %s failed, err: %v", from, err)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
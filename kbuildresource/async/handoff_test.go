@@ -0,0 +1,106 @@
+package async
+
+import (
+	"context"
+	"testing"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+func (h *testHandler) HandleTakeOverRequest(ctx context.Context, request *models.Request, newInstanceName string) error {
+	return HandleCacheDataForTakeOverPendingRequest(request, newInstanceName)
+}
+
+func TestHandOffSkipsLeasedRequests(t *testing.T) {
+	newTestRedis(t)
+	RegisterRequestHandlerV2("test", &testHandler{})
+	t.Cleanup(func() { delete(requestHandlerMap, "test") })
+	r := newTestController(t, newRedisRequestQueue("a"))
+	waiting := newTestRequest("r1", "ci", 5)
+	executing := newTestRequest("r2", "ci", 5)
+	for _, request := range []*models.Request{waiting, executing} {
+		if err := cache.AddRequest(request); err != nil {
+			t.Fatalf("cache request failed: %v", err)
+		}
+	}
+	// r2正在实例c上执行
+	lease, err := acquireRequestLease(newTestRequest("r2", "ci", 5), "c")
+	if err != nil || lease == nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	defer lease.Release()
+
+	if err = r.HandOff("b"); err != nil {
+		t.Fatalf("hand off failed: %v", err)
+	}
+	if _, err = cache.GetRequestByNameAndRequestTypeAndInstanceName("r1", "test_create", "b"); err != nil {
+		t.Errorf("expect waiting request to be handed off to b, err: %v", err)
+	}
+	// 执行者继续把状态写到a的缓存中，不能移走
+	if _, err = cache.GetRequestByNameAndRequestTypeAndInstanceName("r2", "test_create", "a"); err != nil {
+		t.Errorf("expect executing request to stay on a, err: %v", err)
+	}
+}
+
+func TestHandOffWithoutReceivers(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	// 没有实例收到通知时返回错误，调用方保留在实例列表中
+	if err := r.HandOff("b"); err == nil {
+		t.Fatal("expect error when no instance received the hand off")
+	}
+	pubsub := cache.SubscribeRequestHandOff()
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	if err := r.HandOff("b"); err != nil {
+		t.Fatalf("hand off failed: %v", err)
+	}
+	message, err := pubsub.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("receive hand off failed: %v", err)
+	}
+	if from, to, err := cache.ParseRequestHandOff(message.Payload); err != nil || from != "a" || to != "b" {
+		t.Errorf("expect hand off from a to b, got %s -> %s, err: %v", from, to, err)
+	}
+}
+
+func TestTakeOverRequestWithStaleToken(t *testing.T) {
+	s := newTestRedis(t)
+	RegisterRequestHandlerV2("test", &testHandler{})
+	t.Cleanup(func() { delete(requestHandlerMap, "test") })
+	if err := cache.AddRequest(newTestRequest("r1", "ci", 5)); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	// 持有token为2的meta锁的实例已经开始接管a
+	s.Set(cache.GenFenceKey(cache.GenRequestKey(common.BuildJobPrefix, "a")), "2")
+
+	// 锁已经过期的旧持有者停止接管，请求留在a的缓存中
+	b := newTestController(t, newMemoryRequestQueue(10))
+	b.instanceName = "b"
+	if err := b.TakeOverRequest("a", "b", 1); err != cache.ErrStaleFencingToken {
+		t.Fatalf("expect stale token to be rejected, got %v", err)
+	}
+	if _, err := cache.GetRequestByNameAndRequestTypeAndInstanceName("r1", "test_create", "a"); err != nil {
+		t.Fatalf("expect r1 to stay on a, err: %v", err)
+	}
+	// 被判定死亡的实例a恢复后不带token写入自己的缓存列表，也被拒绝
+	if err := cache.AddRequest(newTestRequest("r2", "ci", 5)); err != cache.ErrStaleFencingToken {
+		t.Errorf("expect unfenced write of a to be rejected, got %v", err)
+	}
+
+	c := newTestController(t, newMemoryRequestQueue(10))
+	c.instanceName = "c"
+	if err := c.TakeOverRequest("a", "c", 2); err != nil {
+		t.Fatalf("take over failed: %v", err)
+	}
+	if _, err := cache.GetRequestByNameAndRequestTypeAndInstanceName("r1", "test_create", "c"); err != nil {
+		t.Errorf("expect r1 to be moved to c, err: %v", err)
+	}
+	if index, _ := c.queue.IndexOf(newTestRequest("r1", "ci", 5)); index != 0 {
+		t.Errorf("expect r1 to be queued on c, got %d", index)
+	}
+}
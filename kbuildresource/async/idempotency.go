@@ -0,0 +1,136 @@
+package async
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+const (
+	idempotencyReserveTTL = time.Minute    // 受理过程中占用幂等键的时长
+	idempotencyRecordTTL  = 24 * time.Hour // 受理完成后redis中保留幂等记录的时长，过期后从mysql中查询
+)
+
+// 计算请求内容的指纹，需要在注入instanceName、requestID之前计算
+func fingerprintOf(requestDTO interface{}, requestType string) (string, error) {
+	data, err := json.Marshal(requestDTO)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(requestType+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// 查询幂等键是否已经受理过，先查redis再查mysql，没有受理过返回nil
+// 幂等键正在被其他请求占用，或者相同的幂等键对应了不同的请求内容时返回错误
+func lookupIdempotencyKey(key string, requestType string, fingerprint string) (*AcceptResult, error) {
+	record, err := cache.GetIdempotencyKey(requestType, key)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record, err = models.GetIdempotencyKey(requestType, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if record == nil {
+		return nil, nil
+	}
+	if record.Fingerprint != fingerprint {
+		return nil, common.NewStatusError(http.StatusUnprocessableEntity, "Idempotency-Key %s has been used by a different request", key)
+	}
+	if record.RequestID == "" {
+		return nil, common.NewConflictError("request with Idempotency-Key %s is in progress, please retry later", key)
+	}
+	return replayIdempotencyKey(record)
+}
+
+// 根据幂等记录还原第一次的受理结果，异步请求返回请求当前的状态
+func replayIdempotencyKey(record *models.IdempotencyKey) (*AcceptResult, error) {
+	logrus.Infof("INFO: replay request %s for Idempotency-Key %s", record.RequestID, record.Key)
+	result := &AcceptResult{
+		RequestID: record.RequestID,
+		Async:     record.Async,
+		Replayed:  true,
+		Data:      json.RawMessage(record.Response),
+	}
+	if record.Async {
+		request, err := GetRequest(record.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		if request == nil {
+			return nil, common.NewNotFoundError("request %s of Idempotency-Key %s not found", record.RequestID, record.Key)
+		}
+		result.Request = request
+	}
+	return result, nil
+}
+
+// 占用幂等键，占用失败说明有并发的相同请求
+func reserveIdempotencyKey(key string, requestType string, fingerprint string) error {
+	record := &models.IdempotencyKey{
+		Key:         key,
+		RequestType: requestType,
+		Fingerprint: fingerprint,
+	}
+	success, err := cache.ReserveIdempotencyKey(record, idempotencyReserveTTL)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return common.NewConflictError("request with Idempotency-Key %s is in progress, please retry later", key)
+	}
+	return nil
+}
+
+// 受理失败时释放幂等键，客户端可以修正请求后继续使用
+func releaseIdempotencyKey(key string, requestType string) {
+	if err := cache.DeleteIdempotencyKey(requestType, key); err != nil {
+		logrus.Error("ERROR: release Idempotency-Key failed, err: ", err)
+	}
+}
+
+// 幂等记录保存失败时撤销受理：取消异步请求后释放幂等键，客户端可以用相同的幂等键重试
+// 同步执行的请求或者取消失败的请求已经无法撤销，保留幂等键的占用，避免重试时重复受理
+func undoAcceptedRequest(key string, requestType string, result *AcceptResult) {
+	if !result.Async {
+		return
+	}
+	if _, err := CancelRequest(result.RequestID); err != nil {
+		logrus.Errorf("ERROR: cancel request %s failed, err: %v", result.RequestID, err)
+		return
+	}
+	releaseIdempotencyKey(key, requestType)
+}
+
+// 受理成功后记录幂等键，redis用于快速查询，mysql用于长期保存
+// 先写redis，覆盖占用时的记录，保证redis中的记录过期之前一定可以重放
+func recordIdempotencyKey(key string, requestType string, fingerprint string, result *AcceptResult) error {
+	response, err := json.Marshal(result.Data)
+	if err != nil {
+		return err
+	}
+	record := &models.IdempotencyKey{
+		Key:         key,
+		RequestType: requestType,
+		Fingerprint: fingerprint,
+		RequestID:   result.RequestID,
+		Async:       result.Async,
+		Response:    string(response),
+	}
+	if err = cache.SetIdempotencyKey(record, idempotencyRecordTTL); err != nil {
+		return err
+	}
+	_, err = models.AddIdempotencyKey(record)
+	return err
+}
@@ -0,0 +1,154 @@
+package async
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 错误对应的http状态码，不是StatusError时返回0
+func statusCodeOf(err error) int {
+	if statusError, ok := err.(*common.StatusError); ok {
+		return statusError.Code
+	}
+	return 0
+}
+
+func TestFingerprintOf(t *testing.T) {
+	a, _ := fingerprintOf(&dto.BuildJobDTO{Name: "agent-1", Namespace: "ci"}, common.BuildJobCreateRequestType)
+	b, _ := fingerprintOf(&dto.BuildJobDTO{Name: "agent-1", Namespace: "ci"}, common.BuildJobCreateRequestType)
+	c, _ := fingerprintOf(&dto.BuildJobDTO{Name: "agent-1", Namespace: "release"}, common.BuildJobCreateRequestType)
+	d, _ := fingerprintOf(&dto.BuildJobDTO{Name: "agent-1", Namespace: "ci"}, common.BuildJobDeleteRequestType)
+	if a != b || a == c || a == d {
+		t.Errorf("expect fingerprint to depend only on content and request type, got %s %s %s %s", a, b, c, d)
+	}
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	newTestDB(t)
+	s := newTestRedis(t)
+	requestType := common.BuildJobCreateRequestType
+	if result, err := lookupIdempotencyKey("k1", requestType, "f1"); err != nil || result != nil {
+		t.Fatalf("expect unused key, got %+v, err: %v", result, err)
+	}
+	if err := reserveIdempotencyKey("k1", requestType, "f1"); err != nil {
+		t.Fatalf("reserve key failed: %v", err)
+	}
+	// 受理过程中，相同的幂等键并发提交被拒绝
+	if err := reserveIdempotencyKey("k1", requestType, "f1"); statusCodeOf(err) != http.StatusConflict {
+		t.Errorf("expect conflict while key is reserved, got %v", err)
+	}
+	if _, err := lookupIdempotencyKey("k1", requestType, "f1"); statusCodeOf(err) != http.StatusConflict {
+		t.Errorf("expect conflict while request is in progress, got %v", err)
+	}
+
+	addTestRequest(t, "r1", "agent-1")
+	accepted := &AcceptResult{RequestID: "r1", Async: true, Data: &dto.BuildJobDTO{Name: "agent-1"}}
+	if err := recordIdempotencyKey("k1", requestType, "f1", accepted); err != nil {
+		t.Fatalf("record key failed: %v", err)
+	}
+	// 重放第一次的受理结果，带上请求当前的状态
+	result, err := lookupIdempotencyKey("k1", requestType, "f1")
+	if err != nil || result == nil || !result.Replayed || result.RequestID != "r1" || result.Request == nil || result.Request.Status != common.RequestStatusPending {
+		t.Fatalf("expect r1 to be replayed, got %+v, err: %v", result, err)
+	}
+	replayed := &dto.BuildJobDTO{}
+	if data, _ := json.Marshal(result.Data); json.Unmarshal(data, replayed) != nil || replayed.Name != "agent-1" {
+		t.Errorf("expect original response to be replayed, got %+v", result.Data)
+	}
+	// 相同的幂等键对应了不同的请求内容
+	if _, err = lookupIdempotencyKey("k1", requestType, "f2"); statusCodeOf(err) != http.StatusUnprocessableEntity {
+		t.Errorf("expect unprocessable entity for different request, got %v", err)
+	}
+
+	// redis中的记录过期后从mysql中查询，任意实例上都可以重放
+	s.FastForward(idempotencyRecordTTL + time.Second)
+	result, err = lookupIdempotencyKey("k1", requestType, "f1")
+	if err != nil || result == nil || result.RequestID != "r1" {
+		t.Errorf("expect r1 to be replayed from mysql, got %+v, err: %v", result, err)
+	}
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	requestType := common.BuildJobCreateRequestType
+	if err := reserveIdempotencyKey("k1", requestType, "f1"); err != nil {
+		t.Fatalf("reserve key failed: %v", err)
+	}
+	// 受理失败后释放，修正请求后可以继续使用同一个幂等键
+	releaseIdempotencyKey("k1", requestType)
+	if result, err := lookupIdempotencyKey("k1", requestType, "f2"); err != nil || result != nil {
+		t.Errorf("expect released key to be unused, got %+v, err: %v", result, err)
+	}
+	if err := reserveIdempotencyKey("k1", requestType, "f2"); err != nil {
+		t.Errorf("expect released key to be reserved again, got %v", err)
+	}
+}
+
+// 受理时生成请求并放入缓存的处理器
+type acceptHandler struct {
+	RequestHandlerV2
+	t         *testing.T
+	requestID string
+}
+
+func (h *acceptHandler) SetInstanceName(requestDTO interface{}, instanceName string) {}
+
+func (h *acceptHandler) SetRequestID(requestDTO interface{}, requestID string) {
+	h.requestID = requestID
+}
+
+func (h *acceptHandler) PreExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) error {
+	return nil
+}
+
+func (h *acceptHandler) MakeRequest(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (*models.Request, error) {
+	return addTestRequest(h.t, h.requestID, "agent-1"), nil
+}
+
+func (h *acceptHandler) PostAsyncExec(ctx context.Context, request *models.Request, requestType string, values map[string]interface{}) error {
+	return nil
+}
+
+func (h *acceptHandler) MakeAsyncResponse(requestDTO interface{}, requestType string, values map[string]interface{}) interface{} {
+	return requestDTO
+}
+
+func TestAcceptRequestUndoneWhenIdempotencyKeyNotRecorded(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	r.admission = newAdmissionController()
+	h := &acceptHandler{t: t}
+	RegisterRequestHandlerV2("accept", h)
+	t.Cleanup(func() { delete(requestHandlerMap, "accept") })
+	// mysql写入幂等记录失败
+	o := orm.NewOrm()
+	if _, err := o.Raw("create trigger reject_idempotency_key before insert on idempotency_key begin select raise(abort, 'insert rejected'); end").Exec(); err != nil {
+		t.Fatalf("create trigger failed: %v", err)
+	}
+	t.Cleanup(func() { o.Raw("drop trigger reject_idempotency_key").Exec() })
+
+	result, err := r.AcceptRequest(context.Background(), "dto", "accept_create", "k1")
+	if statusCodeOf(err) != http.StatusServiceUnavailable {
+		t.Fatalf("expect accept to fail, got %+v, err: %v", result, err)
+	}
+	// 已经受理的请求被取消，不会执行
+	request, err := models.GetRequestByRequestID(h.requestID)
+	if err != nil || request == nil || request.Status != common.RequestStatusCanceled {
+		t.Errorf("expect request to be canceled, got %+v, err: %v", request, err)
+	}
+	// 幂等键被释放，客户端可以用相同的幂等键重试
+	if result, err := lookupIdempotencyKey("k1", "accept_create", "f1"); err != nil || result != nil {
+		t.Errorf("expect key to be released, got %+v, err: %v", result, err)
+	}
+}
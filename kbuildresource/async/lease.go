@@ -0,0 +1,131 @@
+package async
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/models"
+	"bryson.foundation/kbuildresource/utils"
+)
+
+const (
+	RequestLeaseTTL      = 15 * time.Second // 租约有效期，持有者死亡后最多经过这么久请求就可以被其他实例认领
+	requestRenewInterval = 5 * time.Second  // 每5秒续期一次
+	requestLeaseMaxHold  = 30 * time.Minute // 一次执行最多持有租约的时长，超过后不再续期，卡住的执行会被其他实例认领
+)
+
+// 请求的租约，执行请求期间不断续期，租约丢失后请求可以被其他实例认领重新执行
+type requestLease struct {
+	request       *models.Request
+	owner         string
+	renewInterval time.Duration
+	maxHold       time.Duration
+	stopCh        chan struct{}
+	lostCh        chan struct{}
+	stopOnce      sync.Once
+	lostOnce      sync.Once
+}
+
+// 获取请求的租约并开始续期，租约被其他执行者持有时返回nil
+// 每次执行都使用新的owner，同一个实例上卡住的执行也可以被认领
+func acquireRequestLease(request *models.Request, instanceName string) (*requestLease, error) {
+	if request.RequestID == "" {
+		return nil, fmt.Errorf("request %s has no requestID", request.Name)
+	}
+	owner := fmt.Sprintf("%s/%s", instanceName, utils.CreateUUID())
+	ok, err := cache.AcquireRequestLease(request.RequestID, owner, RequestLeaseTTL)
+	if err != nil || !ok {
+		return nil, err
+	}
+	request.LeaseOwner = owner
+	lease := newRequestLease(request, owner, requestRenewInterval, requestLeaseMaxHold)
+	go lease.keepRenewing()
+	return lease, nil
+}
+
+func newRequestLease(request *models.Request, owner string, renewInterval time.Duration, maxHold time.Duration) *requestLease {
+	return &requestLease{
+		request:       request,
+		owner:         owner,
+		renewInterval: renewInterval,
+		maxHold:       maxHold,
+		stopCh:        make(chan struct{}),
+		lostCh:        make(chan struct{}),
+	}
+}
+
+// 持有租约超过maxHold时不再续期，同时当作租约丢失中断执行，避免卡住的执行和认领后的执行同时进行
+func (l *requestLease) keepRenewing() {
+	t := time.NewTicker(l.renewInterval)
+	defer t.Stop()
+	deadline := time.Now().Add(l.maxHold)
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-t.C:
+			if time.Now().After(deadline) {
+				logrus.Errorf("ERROR: request %s has held lease for more than %v, stop renewing", l.request.RequestID, l.maxHold)
+				l.lostOnce.Do(func() { close(l.lostCh) })
+				return
+			}
+			ok, err := cache.RenewRequestLease(l.request.RequestID, l.owner, RequestLeaseTTL)
+			if err != nil {
+				// redis暂时不可用，租约还没有过期，下次再试
+				logrus.Errorf("ERROR: renew lease of request %s failed, err: %v", l.request.RequestID, err)
+				continue
+			}
+			if !ok {
+				logrus.Errorf("ERROR: lease of request %s has been lost", l.request.RequestID)
+				l.lostOnce.Do(func() { close(l.lostCh) })
+				return
+			}
+		}
+	}
+}
+
+// 租约丢失时关闭
+func (l *requestLease) Lost() <-chan struct{} {
+	return l.lostCh
+}
+
+// 停止续期并释放租约，返回租约在释放前是否还属于自己
+func (l *requestLease) Release() bool {
+	l.stopOnce.Do(func() { close(l.stopCh) })
+	ok, err := cache.ReleaseRequestLease(l.request.RequestID, l.owner)
+	if err != nil {
+		logrus.Errorf("ERROR: release lease of request %s failed, err: %v", l.request.RequestID, err)
+		return false
+	}
+	return ok
+}
+
+// 检查请求的租约还属于当前的执行者，处理器在写入请求的结果之前调用，避免被认领后重复写入
+// 没有租约的请求（比如同步执行的请求）直接返回nil
+func CheckRequestLease(request *models.Request) error {
+	if request.LeaseOwner == "" {
+		return nil
+	}
+	owner, _, err := cache.GetRequestLease(request.RequestID)
+	if err != nil {
+		return err
+	}
+	if owner != request.LeaseOwner {
+		return fmt.Errorf("lease of request %s has been lost", request.RequestID)
+	}
+	return nil
+}
+
+// 判断请求的租约是否已经过期，过期的请求可以被任意实例认领
+func isRequestLeaseExpired(request *models.Request) bool {
+	owner, _, err := cache.GetRequestLease(request.RequestID)
+	if err != nil {
+		logrus.Errorf("ERROR: get lease of request %s failed, err: %v", request.RequestID, err)
+		return false
+	}
+	return owner == ""
+}
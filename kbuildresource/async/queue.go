@@ -0,0 +1,414 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+const (
+	RedisRequestQueue  = "redis"  // 基于redis stream的共享队列，所有实例共同消费，默认使用
+	MemoryRequestQueue = "memory" // 基于内存的本地队列，实例崩溃后依赖扫描死亡实例的缓存来接管
+
+	queueIdleInterval = 500 * time.Millisecond // 所有队列都为空时，等待一段时间再读取
+	queueClaimMinIdle = 10 * time.Second       // 认领消息时要求的最小空闲时间，避免和刚刚读取消息的实例冲突
+	queueClaimBatch   = 100
+	delayPollInterval = time.Second // 检查延迟队列中是否有到期请求的间隔
+)
+
+// 请求队列，保存已经受理、等待执行的请求
+// 队列按照命名空间和优先级划分，同一个命名空间中优先级高的先执行，不同命名空间之间由调度器决定先后
+type RequestQueue interface {
+	// 请求入队
+	Push(request *models.Request) error
+	// 请求在at之后才能被读取，用于重试等需要延迟执行的请求
+	PushDelayed(request *models.Request, at time.Time) error
+	// 阻塞读取一个请求，队列关闭或者ctx结束时返回nil
+	Pop(ctx context.Context, scheduler RequestScheduler) (*cache.QueueMessage, error)
+	// 请求执行完成后确认，确认后的请求不会再被其他实例认领
+	Ack(message *cache.QueueMessage) error
+	// 把已经读取但是没有执行完成的请求放回队列，其他实例可以立即读取，比如停机时被中断的请求
+	Requeue(message *cache.QueueMessage) error
+	// 认领空闲时间较长并且isClaimable返回true的请求，比如租约已经过期的请求
+	// 返回的请求的InstanceName是原来的消费者，不支持认领的队列返回nil，由调用方自己接管死亡实例的请求
+	Claim(isClaimable func(request *models.Request) bool) ([]*cache.QueueMessage, error)
+	// 查询各个队列中还没有开始执行的请求数
+	Backlog() (map[cache.QueueName]int64, error)
+	// 查询请求所在的队列中排在它前面的请求数，请求不在排队时返回-1
+	IndexOf(request *models.Request) (int64, error)
+	// 是否持久化，持久化的队列在实例崩溃后可以通过Claim接管
+	Durable() bool
+	// 关闭队列，之后不能再入队
+	Close()
+}
+
+// 根据配置创建请求队列
+func NewRequestQueue(queueType string, consumer string) (RequestQueue, error) {
+	switch queueType {
+	case "", RedisRequestQueue:
+		return newRedisRequestQueue(consumer), nil
+	case MemoryRequestQueue:
+		return newMemoryRequestQueue(conf.Conf.RequestQueueCapacity), nil
+	default:
+		return nil, fmt.Errorf("invalid request queue type %s", queueType)
+	}
+}
+
+// 基于redis stream和消费组的共享队列，每个实例是一个消费者
+type redisRequestQueue struct {
+	consumer  string
+	lock      sync.Mutex
+	groups    map[cache.QueueName]bool // 已经创建了消费组的队列
+	delayedAt time.Time                // 上一次检查延迟队列的时间
+}
+
+func newRedisRequestQueue(consumer string) *redisRequestQueue {
+	return &redisRequestQueue{consumer: consumer, groups: make(map[cache.QueueName]bool)}
+}
+
+// 每个队列的消费组只需要创建一次，redis暂时不可用时下次再试
+func (q *redisRequestQueue) ensureGroup(queue cache.QueueName) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.groups[queue] {
+		return nil
+	}
+	if err := cache.CreateRequestQueueGroup(queue); err != nil {
+		return err
+	}
+	q.groups[queue] = true
+	return nil
+}
+
+func (q *redisRequestQueue) Push(request *models.Request) error {
+	if err := q.ensureGroup(cache.QueueNameOf(request)); err != nil {
+		return err
+	}
+	_, err := cache.PushRequestToQueue(request)
+	return err
+}
+
+func (q *redisRequestQueue) PushDelayed(request *models.Request, at time.Time) error {
+	if err := q.ensureGroup(cache.QueueNameOf(request)); err != nil {
+		return err
+	}
+	return cache.PushRequestToDelayQueue(request, at)
+}
+
+// 把延迟队列中到期的请求转移到请求队列中，所有实例都会转移，转移是原子的
+func (q *redisRequestQueue) moveDueRequests() {
+	if time.Since(q.delayedAt) < delayPollInterval {
+		return
+	}
+	q.delayedAt = time.Now()
+	count, err := cache.MoveDueRequestsToQueue(q.delayedAt)
+	if err != nil {
+		logrus.Error("ERROR: move due requests to queue failed, err: ", err)
+		return
+	}
+	if count > 0 {
+		logrus.Infof("INFO: move %d due requests from delay queue to request queue", count)
+	}
+}
+
+func (q *redisRequestQueue) Pop(ctx context.Context, scheduler RequestScheduler) (*cache.QueueMessage, error) {
+	for ctx.Err() == nil {
+		q.moveDueRequests()
+		queues, err := cache.ListRequestQueues()
+		if err != nil {
+			return nil, err
+		}
+		for _, queue := range orderQueues(queues, scheduler) {
+			if err = q.ensureGroup(queue); err != nil {
+				return nil, err
+			}
+			message, err := cache.ReadRequestFromQueue(q.consumer, queue)
+			if err != nil {
+				return nil, err
+			}
+			if message != nil {
+				scheduler.Served(queue.Namespace)
+				return message, nil
+			}
+			// 没有新的请求，队列中也没有正在执行的请求时从索引中移除
+			if err = cache.RemoveRequestQueueIfEmpty(queue); err != nil {
+				logrus.Errorf("ERROR: remove empty queue %s failed, err: %v", queue, err)
+			}
+		}
+		select {
+		case <-time.After(queueIdleInterval):
+		case <-ctx.Done():
+		}
+	}
+	return nil, nil
+}
+
+func (q *redisRequestQueue) Ack(message *cache.QueueMessage) error {
+	return cache.AckRequestInQueue(message.Queue, message.ID)
+}
+
+// 重新入队后再确认原来的消息，重新入队的请求排在队尾
+func (q *redisRequestQueue) Requeue(message *cache.QueueMessage) error {
+	if err := q.Push(message.Request); err != nil {
+		return err
+	}
+	return cache.AckRequestInQueue(message.Queue, message.ID)
+}
+
+func (q *redisRequestQueue) Claim(isClaimable func(request *models.Request) bool) ([]*cache.QueueMessage, error) {
+	queues, err := cache.ListRequestQueues()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*cache.QueueMessage, 0)
+	for _, queue := range queues {
+		messages, err := q.claim(queue, isClaimable)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, messages...)
+	}
+	return result, nil
+}
+
+func (q *redisRequestQueue) claim(queue cache.QueueName, isClaimable func(request *models.Request) bool) ([]*cache.QueueMessage, error) {
+	if err := q.ensureGroup(queue); err != nil {
+		return nil, err
+	}
+	pending, err := cache.ListPendingRequestsInQueue(queue, queueClaimBatch)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	owners := make(map[string]string) // 消息ID -> 原来的消费者
+	for _, p := range pending {
+		if p.Idle < queueClaimMinIdle {
+			continue
+		}
+		ids = append(ids, p.Id)
+		owners[p.Id] = p.Consumer
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	candidates, err := cache.GetRequestsInQueue(q.consumer, queue, ids)
+	if err != nil {
+		return nil, err
+	}
+	ids = ids[:0]
+	for _, candidate := range candidates {
+		if isClaimable(candidate.Request) {
+			ids = append(ids, candidate.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	// 多个实例同时认领时，XCLAIM保证每条消息只会转给其中一个
+	messages, err := cache.ClaimRequestsInQueue(q.consumer, queue, queueClaimMinIdle, ids)
+	if err != nil {
+		return nil, err
+	}
+	// 请求可能已经被接管过，缓存在原来的消费者下面
+	for _, message := range messages {
+		message.Request.InstanceName = owners[message.ID]
+	}
+	return messages, nil
+}
+
+func (q *redisRequestQueue) Backlog() (map[cache.QueueName]int64, error) {
+	queues, err := cache.ListRequestQueues()
+	if err != nil {
+		return nil, err
+	}
+	backlog := make(map[cache.QueueName]int64, len(queues))
+	for _, queue := range queues {
+		count, err := cache.CountWaitingRequestsInQueue(queue)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			backlog[queue] = count
+		}
+	}
+	return backlog, nil
+}
+
+func (q *redisRequestQueue) IndexOf(request *models.Request) (int64, error) {
+	messages, err := cache.ListWaitingRequestsInQueue(cache.QueueNameOf(request))
+	if err != nil {
+		return -1, err
+	}
+	for i, message := range messages {
+		if message.Request.RequestID == request.RequestID {
+			return int64(i), nil
+		}
+	}
+	return -1, nil
+}
+
+func (q *redisRequestQueue) Durable() bool {
+	return true
+}
+
+func (q *redisRequestQueue) Close() {
+}
+
+// 按照调度顺序排列队列：先按照调度器排列命名空间，同一个命名空间中优先级高的在前
+func orderQueues(queues []cache.QueueName, scheduler RequestScheduler) []cache.QueueName {
+	byNamespace := make(map[string][]cache.QueueName)
+	namespaces := make([]string, 0)
+	for _, queue := range queues {
+		if _, ok := byNamespace[queue.Namespace]; !ok {
+			namespaces = append(namespaces, queue.Namespace)
+		}
+		byNamespace[queue.Namespace] = append(byNamespace[queue.Namespace], queue)
+	}
+	ordered := make([]cache.QueueName, 0, len(queues))
+	for _, namespace := range scheduler.Order(namespaces) {
+		sameNamespace := byNamespace[namespace]
+		sort.Slice(sameNamespace, func(i, j int) bool {
+			return sameNamespace[i].Priority > sameNamespace[j].Priority
+		})
+		ordered = append(ordered, sameNamespace...)
+	}
+	return ordered
+}
+
+// 基于内存的本地队列
+type memoryRequestQueue struct {
+	lock     sync.Mutex
+	queues   map[cache.QueueName][]*models.Request
+	size     int
+	capacity int
+	closed   bool
+	notifyCh chan struct{} // 有新的请求入队或者队列关闭
+}
+
+func newMemoryRequestQueue(capacity int) *memoryRequestQueue {
+	return &memoryRequestQueue{
+		queues:   make(map[cache.QueueName][]*models.Request),
+		capacity: capacity,
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (q *memoryRequestQueue) Push(request *models.Request) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return fmt.Errorf("request queue has been closed")
+	}
+	if q.size >= q.capacity {
+		return fmt.Errorf("request queue is full")
+	}
+	queue := cache.QueueNameOf(request)
+	q.queues[queue] = append(q.queues[queue], request)
+	q.size++
+	q.notify()
+	return nil
+}
+
+// 本地的延迟队列不持久化，实例崩溃后依赖扫描死亡实例的缓存来接管
+func (q *memoryRequestQueue) PushDelayed(request *models.Request, at time.Time) error {
+	time.AfterFunc(time.Until(at), func() {
+		if err := q.Push(request); err != nil {
+			logrus.Errorf("ERROR: push delayed request %s failed, err: %v", request.RequestID, err)
+		}
+	})
+	return nil
+}
+
+func (q *memoryRequestQueue) notify() {
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryRequestQueue) Pop(ctx context.Context, scheduler RequestScheduler) (*cache.QueueMessage, error) {
+	for {
+		q.lock.Lock()
+		if q.closed {
+			q.lock.Unlock()
+			return nil, nil
+		}
+		queues := make([]cache.QueueName, 0, len(q.queues))
+		for queue := range q.queues {
+			queues = append(queues, queue)
+		}
+		ordered := orderQueues(queues, scheduler)
+		if len(ordered) > 0 {
+			queue := ordered[0]
+			request := q.queues[queue][0]
+			q.queues[queue] = q.queues[queue][1:]
+			if len(q.queues[queue]) == 0 {
+				delete(q.queues, queue)
+			}
+			q.size--
+			q.lock.Unlock()
+			scheduler.Served(queue.Namespace)
+			return &cache.QueueMessage{Queue: queue, Request: request}, nil
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.notifyCh:
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+func (q *memoryRequestQueue) Ack(message *cache.QueueMessage) error {
+	return nil
+}
+
+// 本地队列只在停机时放回请求，这时队列已经关闭，缓存中的请求交给其他实例接管后重新入队
+func (q *memoryRequestQueue) Requeue(message *cache.QueueMessage) error {
+	return nil
+}
+
+func (q *memoryRequestQueue) Claim(isClaimable func(request *models.Request) bool) ([]*cache.QueueMessage, error) {
+	return nil, nil
+}
+
+func (q *memoryRequestQueue) Backlog() (map[cache.QueueName]int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	backlog := make(map[cache.QueueName]int64, len(q.queues))
+	for queue, requests := range q.queues {
+		backlog[queue] = int64(len(requests))
+	}
+	return backlog, nil
+}
+
+func (q *memoryRequestQueue) IndexOf(request *models.Request) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, queued := range q.queues[cache.QueueNameOf(request)] {
+		if queued.RequestID == request.RequestID {
+			return int64(i), nil
+		}
+	}
+	return -1, nil
+}
+
+func (q *memoryRequestQueue) Durable() bool {
+	return false
+}
+
+func (q *memoryRequestQueue) Close() {
+	logrus.Info("INFO: close memory request queue")
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.notify()
+}
@@ -0,0 +1,96 @@
+package async
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/coordination"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 请求的排队情况
+type QueuePosition struct {
+	Request          *models.Request
+	Queued           bool          // 是否还在排队，开始执行或者已经结束的请求为false
+	NamespaceAhead   int64         // 同一个命名空间中排在前面的请求数
+	Ahead            int64         // 估计所有命名空间中排在前面的请求数
+	Backlog          int64         // 所有命名空间排队的请求数
+	Slots            int           // 所有存活实例的并发数之和
+	AverageExecution time.Duration // 请求的平均执行时长，没有记录时为0
+	EstimatedStartAt *time.Time    // 估计的开始执行时间，没有执行记录时为nil
+}
+
+// 查询请求的排队位置，并估计开始执行的时间；请求不存在时返回nil
+// 同一个命名空间中，优先级更高的请求和同优先级更早入队的请求排在前面；
+// 其他命名空间按照权重比例在这段时间内执行的请求也排在前面，最多是它们排队的请求数
+func (r *RequestController) GetQueuePosition(requestID string) (*QueuePosition, error) {
+	request, err := GetRequest(requestID)
+	if err != nil || request == nil {
+		return nil, err
+	}
+	position := &QueuePosition{Request: request}
+	index, err := r.queue.IndexOf(request)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 {
+		return position, nil
+	}
+	position.Queued = true
+	backlog, err := r.queue.Backlog()
+	if err != nil {
+		return nil, err
+	}
+	queue := cache.QueueNameOf(request)
+	position.NamespaceAhead = index
+	others := make(map[string]int64)
+	for name, count := range backlog {
+		position.Backlog += count
+		if name.Namespace != queue.Namespace {
+			others[name.Namespace] += count
+		} else if name.Priority > queue.Priority {
+			position.NamespaceAhead += count
+		}
+	}
+	position.Ahead = position.NamespaceAhead
+	weight := r.scheduler.Weight(queue.Namespace)
+	for namespace, count := range others {
+		share := int64(math.Floor(float64(position.NamespaceAhead+1) * r.scheduler.Weight(namespace) / weight))
+		if share > count {
+			share = count
+		}
+		position.Ahead += share
+	}
+
+	position.Slots = cap(r.limitChan) * countLiveInstances()
+	position.AverageExecution, err = cache.GetAverageRequestExecution()
+	if err != nil {
+		return nil, err
+	}
+	if position.AverageExecution > 0 {
+		// 所有实例的并发额度每执行完一轮，前面的请求就减少一轮
+		rounds := position.Ahead / int64(position.Slots)
+		startAt := time.Now().Add(time.Duration(rounds) * position.AverageExecution)
+		position.EstimatedStartAt = &startAt
+	}
+	return position, nil
+}
+
+func countLiveInstances() int {
+	instanceNames, err := coordination.Default().Members(context.Background())
+	if err != nil {
+		return 1
+	}
+	count := 0
+	for _, instanceName := range instanceNames {
+		if alive, _ := coordination.Default().Alive(context.Background(), instanceName); alive {
+			count++
+		}
+	}
+	if count == 0 {
+		return 1
+	}
+	return count
+}
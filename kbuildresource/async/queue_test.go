@@ -0,0 +1,95 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/models"
+)
+
+func newTestRequest(id string, namespace string, priority int) *models.Request {
+	return &models.Request{
+		RequestID:    id,
+		Name:         id,
+		RequestType:  "test_create",
+		Namespace:    namespace,
+		Priority:     priority,
+		InstanceName: "a",
+	}
+}
+
+func TestRedisQueueClaimAfterLeaseExpired(t *testing.T) {
+	s := newTestRedis(t)
+	now := time.Now()
+	s.SetTime(now)
+	a := newRedisRequestQueue("a")
+	if err := a.Push(newTestRequest("r1", "ci", 5)); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	message, err := a.Pop(context.TODO(), newFairScheduler(nil))
+	if err != nil || message == nil {
+		t.Fatalf("pop failed: %+v, err: %v", message, err)
+	}
+	lease, err := acquireRequestLease(message.Request, "a")
+	if err != nil || lease == nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	lease.stopOnce.Do(func() { close(lease.stopCh) }) // 模拟实例a死亡，不再续期
+
+	b := newRedisRequestQueue("b")
+	claim := func() []*cache.QueueMessage {
+		messages, err := b.Claim(isRequestLeaseExpired)
+		if err != nil {
+			t.Fatalf("claim failed: %v", err)
+		}
+		return messages
+	}
+	// 刚刚读取的请求空闲时间不够，不能认领
+	if messages := claim(); len(messages) != 0 {
+		t.Fatalf("expect nothing to be claimed before min idle, got %v", messages)
+	}
+	// 空闲时间足够，但是租约还有效，执行者可能只是执行得比较慢
+	s.SetTime(now.Add(queueClaimMinIdle))
+	if messages := claim(); len(messages) != 0 {
+		t.Fatalf("expect nothing to be claimed while lease is valid, got %v", messages)
+	}
+	// 租约过期后可以被认领，认领结果中记录原来的消费者
+	s.FastForward(RequestLeaseTTL)
+	messages := claim()
+	if len(messages) != 1 || messages[0].Request.RequestID != "r1" || messages[0].Consumer != "b" || messages[0].Request.InstanceName != "a" {
+		t.Fatalf("expect b to claim r1 from a, got %v", messages)
+	}
+	// 认领后的请求由b执行，空闲时间重新计算，其他实例不能立即再认领
+	if messages = claim(); len(messages) != 0 {
+		t.Errorf("expect claimed request not to be claimed again, got %v", messages)
+	}
+}
+
+func TestCheckRequestLease(t *testing.T) {
+	s := newTestRedis(t)
+	request := newTestRequest("r1", "ci", 5)
+	lease, err := acquireRequestLease(request, "a")
+	if err != nil || lease == nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	defer lease.Release()
+	if err = CheckRequestLease(request); err != nil {
+		t.Errorf("expect lease to be held, got %v", err)
+	}
+	// 租约被其他执行者持有时不能再获取，也不能再写入请求的结果
+	if other, err := acquireRequestLease(newTestRequest("r1", "ci", 5), "b"); err != nil || other != nil {
+		t.Errorf("expect lease of other owner not to be acquired, got %v, err: %v", other, err)
+	}
+	s.Set(cache.GenRequestLeaseKey("buildjob", "r1"), "b/other")
+	if err = CheckRequestLease(request); err == nil {
+		t.Error("expect error after lease lost")
+	}
+	if lease.Release() {
+		t.Error("expect release to report lease lost")
+	}
+	if owner, _ := s.Get(cache.GenRequestLeaseKey("buildjob", "r1")); owner != "b/other" {
+		t.Errorf("expect lease of other owner not to be released, got %s", owner)
+	}
+}
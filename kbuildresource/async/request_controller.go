@@ -1,36 +1,80 @@
 package async
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/prometheus/common/log"
+	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
 
 	"bryson.foundation/kbuildresource/cache"
 	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
 	"bryson.foundation/kbuildresource/models"
+	"bryson.foundation/kbuildresource/utils"
 )
 
 type RequestController struct {
 	limitChan chan struct{} //用于控制并发，可以用协程池来做
+	typeLimits map[string]chan struct{} // 各个请求类型的并发额度，没有配置的类型只受limitChan限制
+	heldLock sync.Mutex
+	held map[string][]*cache.QueueMessage // 请求类型 -> 额度用完时读取到的请求，不确认，额度空出来后按照读取的顺序执行
+	wakeCh chan struct{} // 有暂存请求的类型空出额度时通知读取循环
+	admission *admissionController // 准入控制，过载时拒绝新的请求
 	stopCh chan struct{} // 控制器停止通道
-	requestChannel chan *models.Request
+	queue RequestQueue // 等待执行的请求队列
+	scheduler RequestScheduler // 决定多个命名空间的请求的执行顺序
 	instanceName string // 对应的实例的名字
-	stopping int // 表明是否是正在停止中
+	running sync.Map // 正在本实例上执行的请求，请求ID -> *runningRequest
+	inflight sync.WaitGroup // 正在执行的请求数，停机时等待它们完成
+	draining atomic.Bool // 正在停机，不再受理新的请求
+	fenced atomic.Bool // 实例的存活租约已经丢失，不再执行和确认任何请求
+	ctx context.Context // 控制器停止时取消
+	cancel context.CancelFunc
 }
 
+const (
+	queueClaimInterval = 5 * time.Second // 认领死亡实例请求的间隔
+	requestDeferDelay = time.Second // 集群或者命名空间的许可用完时，请求延迟这么久再重新读取
+)
+
 var r *RequestController
-var requestHandlerMap = make(map[string]RequestHandler, 0) //保存了各种请求类型的处理器，实现依赖反转，避免每次新生成一种处理器，都要修改函数
+var requestHandlerMap = make(map[string]RequestHandlerV2, 0) //保存了各种请求类型的处理器，实现依赖反转，避免每次新生成一种处理器，都要修改函数
 
 func NewRequestController(instanceName string) *RequestController {
+	queue, err := NewRequestQueue(conf.Conf.RequestQueue, instanceName)
+	if err != nil {
+		logrus.Fatal("ERROR: create request queue failed, err: ", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	concurrency := conf.Conf.RequestConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	typeLimits := make(map[string]chan struct{}, len(conf.Conf.RequestConcurrencies))
+	for requestType, typeConcurrency := range conf.Conf.RequestConcurrencies {
+		if typeConcurrency > concurrency {
+			typeConcurrency = concurrency
+		}
+		typeLimits[requestType] = make(chan struct{}, typeConcurrency)
+	}
 	r = &RequestController{
-		limitChan:      make(chan struct{}, 100), // 这个要控制小点，避免造成数据库连接过多
+		limitChan:      make(chan struct{}, concurrency), // 这个要控制小点，避免造成数据库连接过多
+		typeLimits: typeLimits,
+		held: make(map[string][]*cache.QueueMessage),
+		wakeCh: make(chan struct{}, 1),
+		admission: newAdmissionController(),
 		stopCh:         make(chan struct{}),
-		requestChannel: make(chan *models.Request, 2000),
-		stopping: 0,
+		queue: queue,
+		scheduler: newFairScheduler(conf.Conf.NamespaceWeights),
 		instanceName: instanceName,
+		ctx: ctx,
+		cancel: cancel,
 	}
 	return r
 }
@@ -41,59 +85,556 @@ func GetRequestController() *RequestController {
 
 // 启动请求控制器
 func (r *RequestController) StartUp() {
-	for request := range r.requestChannel {
-		if r.stopping == 1 {
-			log.Info("INFO: request controller is stopping skip exec request")
+	if r.queue.Durable() {
+		go r.startClaimRequests()
+	}
+	go r.startWatchCancels()
+	go r.startWatchHandOffs()
+	go r.admission.startSampling(r.ctx, r.queue)
+	r.consume()
+}
+
+// 读取并执行请求，直到控制器停止
+func (r *RequestController) consume() {
+	for r.acquire() {
+		// 暂存的请求比队列中的请求先读取，额度空出来后优先执行
+		if message := r.takeHeld(); message != nil {
+			r.dispatch(message, true)
 			continue
 		}
-		r.limitChan <- struct{}{}
-		logrus.Infof("INFO: receive request %s and start handle", request.Name)
-		requestHandler,_ := getHandlerFromRequestType(request.RequestType)
-		go requestHandler.AsyncExec(request, r.limitChan)
+		// 有空闲的并发额度才读取请求，读取后执行不了的请求其他实例也拿不到
+		message, err := r.pop()
+		if err != nil {
+			<-r.limitChan
+			logrus.Error("ERROR: pop request from queue failed, err: ", err)
+			r.sleep(time.Second)
+			continue
+		}
+		if r.ctx.Err() != nil {
+			// 正在停止，已经读取但是没有确认的请求会被其他实例认领
+			<-r.limitChan
+			logrus.Info("INFO: request controller is stopping skip exec request")
+			break
+		}
+		if message == nil {
+			<-r.limitChan
+			if r.woken() {
+				continue
+			}
+			// 队列已经关闭
+			logrus.Info("INFO: request controller is stopping skip exec request")
+			break
+		}
+		r.dispatch(message, false)
 	}
-	logrus.Info("INFO: finish requestChannel")
+	r.releaseHeld()
+	logrus.Info("INFO: finish request queue")
 	close(r.stopCh) // 通知shutdown函数继续执行
 }
 
+// 从队列中读取请求，有暂存请求的类型空出额度时提前返回nil
+func (r *RequestController) pop() (*cache.QueueMessage, error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.wakeCh:
+			cancel()
+			// 读取循环据此区分是被唤醒还是队列关闭
+			r.wake()
+		case <-ctx.Done():
+		}
+	}()
+	return r.queue.Pop(ctx, r.scheduler)
+}
+
+func (r *RequestController) wake() {
+	select {
+	case r.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// 是否因为暂存请求的类型空出了额度而被唤醒
+func (r *RequestController) woken() bool {
+	select {
+	case <-r.wakeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// 获取一个并发额度，控制器停止时返回false
+func (r *RequestController) acquire() bool {
+	select {
+	case r.limitChan <- struct{}{}:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// 获取请求类型的并发额度，不阻塞；没有单独限制的类型直接返回true
+// 额度用完或者已经有暂存的同类型请求时暂存这个请求，返回false；暂存的请求不确认，保持它在队列中的顺序和优先级
+func (r *RequestController) acquireTypeOrHold(message *cache.QueueMessage) bool {
+	requestType := message.Request.RequestType
+	typeLimit, ok := r.typeLimits[requestType]
+	if !ok {
+		return true
+	}
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+	if len(r.held[requestType]) == 0 {
+		select {
+		case typeLimit <- struct{}{}:
+			return true
+		default:
+		}
+	}
+	r.held[requestType] = append(r.held[requestType], message)
+	return false
+}
+
+// 取出一个已经空出额度的类型最早暂存的请求，同时获取它的类型额度；没有时返回nil
+func (r *RequestController) takeHeld() *cache.QueueMessage {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+	for requestType, held := range r.held {
+		select {
+		case r.typeLimits[requestType] <- struct{}{}:
+		default:
+			continue
+		}
+		message := held[0]
+		if len(held) == 1 {
+			delete(r.held, requestType)
+		} else {
+			r.held[requestType] = held[1:]
+		}
+		return message
+	}
+	return nil
+}
+
+// 停止读取后处理暂存的请求：放回队列由其他实例立即执行，已经隔离时不再写入，由其他实例认领
+func (r *RequestController) releaseHeld() {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+	for requestType, held := range r.held {
+		for _, message := range held {
+			if !r.fenced.Load() {
+				r.requeue(message)
+			}
+		}
+		delete(r.held, requestType)
+	}
+}
+
+func (r *RequestController) releaseType(requestType string) {
+	typeLimit, ok := r.typeLimits[requestType]
+	if !ok {
+		return
+	}
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+	<-typeLimit
+	if len(r.held[requestType]) > 0 {
+		r.wake()
+	}
+}
+
+// 过载时拒绝新的请求，单独限制并发的请求类型按照它自己的并发额度判断
+func (r *RequestController) admit(requestType string) error {
+	inflight, concurrency := len(r.limitChan), cap(r.limitChan)
+	if typeLimit, ok := r.typeLimits[requestType]; ok {
+		inflight, concurrency = len(typeLimit), cap(typeLimit)
+	}
+	return r.admission.Admit(inflight, concurrency)
+}
+
+func (r *RequestController) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.ctx.Done():
+	}
+}
+
+// 执行请求，调用前需要先获取并发额度，处理器执行完成后释放额度，然后确认请求
+// typeAcquired表示已经获取了请求类型的额度，比如暂存的请求
+func (r *RequestController) dispatch(message *cache.QueueMessage, typeAcquired bool) {
+	request := message.Request
+	logrus.Infof("INFO: receive request %s and start handle", request.Name)
+	requestHandler, err := getHandlerFromRequestType(request.RequestType)
+	if err != nil {
+		if typeAcquired {
+			r.releaseType(request.RequestType)
+		}
+		<-r.limitChan
+		logrus.Error("ERROR: ", err)
+		r.ack(message)
+		return
+	}
+	if r.fenced.Load() {
+		// 不确认，请求由其他实例接管
+		if typeAcquired {
+			r.releaseType(request.RequestType)
+		}
+		<-r.limitChan
+		return
+	}
+	if !typeAcquired && !r.acquireTypeOrHold(message) {
+		// 不占着全局的并发额度等待，其他类型的请求可以继续执行
+		<-r.limitChan
+		logrus.Infof("INFO: hold request %s until concurrency of request type %s is available", request.RequestID, request.RequestType)
+		return
+	}
+	permits, err := acquireRequestPermits(request)
+	if err != nil || permits == nil {
+		// 集群或者命名空间的许可用完时同样让出额度，不占着额度和租约等待其他实例释放许可
+		r.releaseType(request.RequestType)
+		<-r.limitChan
+		reason := fmt.Sprintf("permits of cluster %s and namespace %s are exhausted", request.ClusterName, request.Namespace)
+		if err != nil {
+			reason = fmt.Sprintf("acquire permits failed, err: %v", err)
+		}
+		r.deferRequest(message, reason)
+		return
+	}
+	r.inflight.Add(1)
+	go func() {
+		defer r.inflight.Done()
+		defer r.releaseType(request.RequestType)
+		defer permits.Release()
+		lease, err := acquireRequestLease(request, r.instanceName)
+		if err != nil || lease == nil {
+			// 租约被其他执行者持有，由持有者负责确认；获取失败的请求在租约过期后会被重新认领
+			<-r.limitChan
+			logrus.Errorf("ERROR: acquire lease of request %s failed, err: %v", request.RequestID, err)
+			return
+		}
+		adopted, err := r.adoptRequest(request)
+		if err != nil || !adopted {
+			<-r.limitChan
+			if err != nil {
+				// 请求的租约释放后可以被其他实例认领
+				logrus.Errorf("ERROR: find cached request %s failed, err: %v", request.RequestID, err)
+				lease.Release()
+				return
+			}
+			// 缓存中已经没有这个请求，说明请求已经结束或者被取消
+			logrus.Infof("INFO: request %s has finished, skip", request.RequestID)
+			if lease.Release() {
+				r.ack(message)
+			}
+			return
+		}
+		start := time.Now()
+		ctx := r.startRunning(request, lease)
+		requestHandler.AsyncExec(ctx, request)
+		cause := context.Cause(ctx)
+		r.stopRunning(request)
+		<-r.limitChan
+		if err := cache.RecordRequestExecution(time.Since(start)); err != nil {
+			logrus.Error("ERROR: record request execution failed, err: ", err)
+		}
+		if cause == ErrRequestShutdown {
+			// 停机时被中断的请求没有结束，释放租约后放回队列，由其他实例立即重新执行
+			if lease.Release() {
+				logrus.Infof("INFO: request %s interrupted by shutdown, requeue it for other instances", request.RequestID)
+				r.requeue(message)
+			}
+			return
+		}
+		if cause == ErrRequestLeaseLost {
+			// 请求或者实例的租约丢失，请求已经或者即将被其他实例认领，不确认也不放回队列
+			lease.Release()
+			logrus.Errorf("ERROR: lease of request %s lost during execution, skip ack", request.RequestID)
+			return
+		}
+		if !lease.Release() {
+			// 租约已经丢失，请求已经被其他实例认领，由认领者负责确认
+			logrus.Errorf("ERROR: lease of request %s lost during execution, skip ack", request.RequestID)
+			return
+		}
+		if request.RetryAt != nil {
+			r.retry(request)
+		}
+		r.ack(message)
+	}()
+}
+
+// 处理器通过RetryRequest决定重试的请求，放入延迟队列，到期后重新执行
+func (r *RequestController) retry(request *models.Request) {
+	retryAt := *request.RetryAt
+	request.RetryAt = nil
+	if err := r.queue.PushDelayed(request, retryAt); err != nil {
+		logrus.Errorf("ERROR: push request %s to delay queue failed, err: %v", request.RequestID, err)
+		abandonRequest(request, err)
+	}
+}
+
+// 找到请求在缓存中所在的实例，执行过程中的状态写到这个实例的缓存中
+// 受理请求的实例可能已经停机，并把缓存中的请求交给了其他实例；缓存中没有这个请求时返回false
+func (r *RequestController) adoptRequest(request *models.Request) (bool, error) {
+	cached, err := cache.GetRequestByNameAndRequestTypeAndInstanceName(request.Name, request.RequestType, request.InstanceName)
+	if err == redis.Nil {
+		cached, err = cache.GetRequestByNameAndRequestType(request.Name, request.RequestType)
+	}
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if cached == nil || cached.RequestID != request.RequestID {
+		return false, nil
+	}
+	request.InstanceName = cached.InstanceName
+	return true, nil
+}
+
+// 把已经读取但是没有执行完成的请求放回队列
+func (r *RequestController) requeue(message *cache.QueueMessage) {
+	message.Request.Status = common.RequestStatusPending
+	if err := r.queue.Requeue(message); err != nil {
+		// 放回失败的请求在租约过期后会被其他实例认领
+		logrus.Errorf("ERROR: requeue request %s failed, err: %v", message.Request.RequestID, err)
+	}
+}
+
+// 暂时执行不了的请求延迟后重新入队，确认原来的消息，让出并发额度给其他请求
+func (r *RequestController) deferRequest(message *cache.QueueMessage, reason string) {
+	logrus.Infof("INFO: defer request %s for %v, %s", message.Request.RequestID, requestDeferDelay, reason)
+	if err := r.queue.PushDelayed(message.Request, time.Now().Add(requestDeferDelay)); err != nil {
+		// 不确认，请求空闲一段时间后会被重新认领
+		logrus.Errorf("ERROR: defer request %s failed, err: %v", message.Request.RequestID, err)
+		return
+	}
+	r.ack(message)
+}
+
+func (r *RequestController) ack(message *cache.QueueMessage) {
+	if err := r.queue.Ack(message); err != nil {
+		logrus.Errorf("ERROR: ack request %s failed, err: %v", message.Request.Name, err)
+	}
+}
+
+// 周期性认领租约已经过期的请求，包括死亡实例的请求和卡住的请求
+func (r *RequestController) startClaimRequests() {
+	t := time.NewTicker(queueClaimInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := r.claimRequests()
+			if err != nil {
+				logrus.Error("ERROR: claim requests failed, err: ", err)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *RequestController) claimRequests() error {
+	messages, err := r.queue.Claim(isRequestLeaseExpired)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		ownerInstanceName := message.Request.InstanceName
+		logrus.Infof("INFO: claim request %s whose lease has expired from instance %s", message.Request.Name, ownerInstanceName)
+		// 以原来的实例缓存中的状态为准，缓存中不存在说明请求已经结束或者被取消
+		request, err := cache.GetRequestByNameAndRequestTypeAndInstanceName(message.Request.Name, message.Request.RequestType, ownerInstanceName)
+		if err == redis.Nil {
+			r.ack(message)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if request.RequestID != message.Request.RequestID {
+			// 同名的请求已经是新的请求了，旧的请求已经结束
+			r.ack(message)
+			continue
+		}
+		requestHandler, err := getHandlerFromRequestType(request.RequestType)
+		if err != nil {
+			r.ack(message)
+			continue
+		}
+		err = requestHandler.HandleTakeOverRequest(r.ctx, request, r.instanceName)
+		if err != nil && err != ErrRequestTakenOver {
+			return err
+		}
+		// 缓存已经被转到其他实例名下时照常执行，dispatch时会找到缓存所在的实例
+		message.Request = request
+		if !r.acquire() {
+			return nil
+		}
+		r.dispatch(message, false)
+	}
+	return nil
+}
+
+// 停止请求控制器：不再读取新的请求，等待正在执行的请求完成
+// 超过停机宽限期还没有完成的请求会被中断，context.Cause为ErrRequestShutdown，由其他实例重新执行
 func (r *RequestController) Shutdown() {
 	logrus.Info("INFO: shutdown requestController")
-	// sleep 一小段时间，保证收到的请求都入channel了
+	r.draining.Store(true)
+	// sleep 一小段时间，保证收到的请求都入队了
 	time.Sleep(2 * time.Second)
-	r.stopping = 1 // 表明正在关闭
-	close(r.requestChannel) // 关闭requestChannel,促使requestHandler里面的for range循环可以在遍历完成之后结束
-	<-r.stopCh // 等待requestHandle处理完成的信号，当close(r.stopCh)时可以结束
+	r.cancel() // 表明正在关闭，不再读取新的请求
+	r.queue.Close()
+	<-r.stopCh // 等待请求控制器停止的信号，当close(r.stopCh)时可以结束
+	if waitTimeout(&r.inflight, conf.Conf.ShutdownGracePeriod) {
+		return
+	}
+	logrus.Infof("INFO: requests are still running after %v, interrupt them", conf.Conf.ShutdownGracePeriod)
+	r.interruptAll(ErrRequestShutdown)
+	r.inflight.Wait()
+}
+
+// 实例的存活租约丢失后隔离自己：不再受理和读取请求，立即中断正在执行的请求，
+// context.Cause为ErrRequestLeaseLost，处理器不再写入任何状态，请求由确认实例死亡的其他实例接管
+func (r *RequestController) Fence() {
+	if r.fenced.Swap(true) {
+		return
+	}
+	logrus.Infof("INFO: fence requestController of instance %s", r.instanceName)
+	r.draining.Store(true)
+	r.cancel()
+	r.queue.Close()
+	r.interruptAll(ErrRequestLeaseLost)
+}
+
+// 是否已经隔离，隔离后不能再交接请求
+func (r *RequestController) Fenced() bool {
+	return r.fenced.Load()
+}
+
+// 是否使用持久化的队列，持久化的队列中死亡实例的请求会被自动认领，不需要扫描死亡实例的缓存
+func (r *RequestController) QueueDurable() bool {
+	return r.queue.Durable()
+}
+
+// 请求的受理结果
+type AcceptResult struct {
+	RequestID string          // 请求ID，用于查询请求状态
+	Async     bool            // 是否异步受理，false表示已经同步执行完成
+	Replayed  bool            // 是否是根据幂等键返回的第一次的受理结果
+	Request   *models.Request // 异步受理时生成的请求
+	Data      interface{}     // 返回给客户端的数据
 }
 
 // 请求管理器对外提供的接收请求的接口
 // @Param requestDTO interface{} 请求传输对象，主要包含用户传入的参数
 // @Param requestType string 请求类型，用于分派请求到对应的处理器
-// return interface{} 请求处理的返回结果
-func (r *RequestController) AcceptRequest(requestDTO interface{}, requestType string) (interface{}, error) {
-	requestHandler, _ := getHandlerFromRequestType(requestType)
+// @Param idempotencyKey string 幂等键，为空表示不做幂等处理；相同的幂等键在任意实例上重复提交都返回第一次的受理结果
+// return *AcceptResult 请求的受理结果，异步受理时可以通过RequestID查询请求状态
+func (r *RequestController) AcceptRequest(ctx context.Context, requestDTO interface{}, requestType string, idempotencyKey string) (*AcceptResult, error) {
+	if idempotencyKey == "" {
+		return r.acceptRequest(ctx, requestDTO, requestType)
+	}
+	fingerprint, err := fingerprintOf(requestDTO, requestType)
+	if err != nil {
+		return nil, err
+	}
+	result, err := lookupIdempotencyKey(idempotencyKey, requestType, fingerprint)
+	if err != nil || result != nil {
+		return result, err
+	}
+	err = reserveIdempotencyKey(idempotencyKey, requestType, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	result, err = r.acceptRequest(ctx, requestDTO, requestType)
+	if err != nil {
+		releaseIdempotencyKey(idempotencyKey, requestType)
+		return nil, err
+	}
+	// 幂等记录没有保存下来时，客户端重试会被重复受理，撤销本次受理并返回错误
+	err = recordIdempotencyKey(idempotencyKey, requestType, fingerprint, result)
+	if err != nil {
+		logrus.Error("ERROR: record Idempotency-Key failed, err: ", err)
+		undoAcceptedRequest(idempotencyKey, requestType, result)
+		return nil, common.NewStatusError(http.StatusServiceUnavailable, "record Idempotency-Key %s failed: %v, please retry later", idempotencyKey, err)
+	}
+	return result, nil
+}
+
+func (r *RequestController) acceptRequest(ctx context.Context, requestDTO interface{}, requestType string) (*AcceptResult, error) {
+	requestHandler, err := getHandlerFromRequestType(requestType)
+	if err != nil {
+		return nil, common.NewBadRequestError("%s", err.Error())
+	}
+	if r.draining.Load() {
+		return nil, common.NewStatusError(http.StatusServiceUnavailable, "instance %s is shutting down, please retry", r.instanceName)
+	}
+	err = r.admit(requestType)
+	if err != nil {
+		logrus.Error("ERROR: reject request because of overload, err: ", err)
+		return nil, err
+	}
 	values := make(map[string]interface{}, 0)
+	requestID := utils.CreateUUID()
 	requestHandler.SetInstanceName(requestDTO, r.instanceName)
-	err := requestHandler.PreExec(requestDTO, requestType, values)
+	requestHandler.SetRequestID(requestDTO, requestID)
+	err = requestHandler.PreExec(ctx, requestDTO, requestType, values)
+	if err == ErrRequestFinished {
+		return &AcceptResult{RequestID: requestID, Async: false, Data: requestHandler.MakeAsyncResponse(requestDTO, requestType, values)}, nil
+	}
 	if err != nil {
-		return requestDTO, err
+		return nil, err
 	}
-	request, err := requestHandler.MakeRequest(requestDTO, requestType, values)
+	request, err := requestHandler.MakeRequest(ctx, requestDTO, requestType, values)
 	if err != nil {
 		logrus.Error("ERROR: MakeRequest failed, try to use SyncExec")
-		return requestHandler.SyncExec(requestDTO, requestType, values)
+		data, err := requestHandler.SyncExec(ctx, requestDTO, requestType, values)
+		if err != nil {
+			return nil, err
+		}
+		return &AcceptResult{RequestID: requestID, Async: false, Data: data}, nil
+	}
+	if request.NotBefore != nil && request.NotBefore.After(time.Now()) {
+		// 还没有到开始时间，先放入延迟队列，到期后再进入请求队列
+		err = r.queue.PushDelayed(request, *request.NotBefore)
+	} else {
+		err = r.queue.Push(request)
+	}
+	if err != nil {
+		logrus.Error("ERROR: push request to queue failed, err: ", err)
+		abandonRequest(request, err)
+		return nil, common.NewStatusError(http.StatusServiceUnavailable, "push request to queue failed: %v", err)
 	}
-	go r.sendRequestToChannel(request)
-	err = requestHandler.PostAsyncExec(request, requestType, values)
+	err = requestHandler.PostAsyncExec(ctx, request, requestType, values)
 	if err != nil {
 		logrus.Error("ERROR: posyAsyncExec failed, err: ", err)
 	}
-	return requestDTO, nil
+	return &AcceptResult{
+		RequestID: request.RequestID,
+		Async:     true,
+		Request:   request,
+		Data:      requestHandler.MakeAsyncResponse(requestDTO, requestType, values),
+	}, nil
 }
 
-func (r *RequestController) sendRequestToChannel(request *models.Request) {
-	r.requestChannel <- request
+// 请求没有入队，不会再被执行，直接结束掉
+func abandonRequest(request *models.Request, cause error) {
+	request.Status = common.RequestStatusFailed
+	request.Message = cause.Error()
+	if err := cache.DeleteRequest(request); err != nil {
+		logrus.Error("ERROR: delete request from cache failed, err: ", err)
+	}
+	if err := models.UpdateRequestStatus(request); err != nil {
+		logrus.Error("ERROR: update request status failed, err: ", err)
+	}
 }
 
-func (r *RequestController) TakeOverRequest(deadInstanceName string, newInstanceName string) error {
+// 接管deadInstanceName缓存中的请求，fencingToken为持有meta锁时锁的fencing token，没有持有锁时为0
+// 锁已经过期并被其他实例重新获取时，缓存的写入返回cache.ErrStaleFencingToken，停止接管
+func (r *RequestController) TakeOverRequest(deadInstanceName string, newInstanceName string, fencingToken int64) error {
 	logrus.Infof("INFO: start takeover request of instance %s", deadInstanceName)
 	requests, err := cache.GetAllRequestByInstanceName(deadInstanceName)
 	if err != nil {
@@ -106,11 +647,20 @@ func (r *RequestController) TakeOverRequest(deadInstanceName string, newInstance
 		if err != nil {
 			return err
 		}
-		err = requestHandler.HandleTakeOverRequest(request, r.instanceName)
+		request.FencingToken = fencingToken
+		err = requestHandler.HandleTakeOverRequest(context.Background(), request, r.instanceName)
+		request.FencingToken = 0
+		if err == ErrRequestTakenOver {
+			logrus.Infof("INFO: request %s has been taken over by another instance, skip", request.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = r.queue.Push(request)
 		if err != nil {
 			return err
 		}
-		go r.sendRequestToChannel(request)
 	}
 	return nil
 }
@@ -121,6 +671,8 @@ func handleCacheDataForTakeOver(request *models.Request, newInstanceName string)
 	if err != nil {
 		return err
 	}
+	// fencing token只用于死亡实例的缓存，本实例的缓存记录了token后自己不带token的写入都会被拒绝
+	request.FencingToken = 0
 	request.InstanceName = newInstanceName
 	request.Status = common.RequestStatusPending // 这里简单假设，所有的都是需要重新执行的
 	err = cache.AddRequest(request)
@@ -130,11 +682,16 @@ func handleCacheDataForTakeOver(request *models.Request, newInstanceName string)
 	return nil
 }
 
+// 注册旧的请求处理器，通过适配器转换成RequestHandlerV2
 func RegisterRequestHandler(requestType string, requestHandler RequestHandler) {
+	requestHandlerMap[requestType] = AdaptRequestHandler(requestHandler)
+}
+
+func RegisterRequestHandlerV2(requestType string, requestHandler RequestHandlerV2) {
 	requestHandlerMap[requestType] = requestHandler
 }
 
-func getHandlerFromRequestType(requestType string) (RequestHandler, error) {
+func getHandlerFromRequestType(requestType string) (RequestHandlerV2, error) {
 	s := strings.Split(requestType, "_")
 	// 使用依赖反转进行替换
 	//switch s[0] {
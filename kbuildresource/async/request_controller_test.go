@@ -0,0 +1,218 @@
+package async
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 测试使用的处理器，创建请求阻塞到release被关闭，记录执行过的请求
+type testHandler struct {
+	RequestHandlerV2
+	release  chan struct{}
+	lock     sync.Mutex
+	executed []string
+}
+
+func (h *testHandler) AsyncExec(ctx context.Context, request *models.Request) {
+	if request.RequestType == "test_create" {
+		select {
+		case <-h.release:
+		case <-ctx.Done():
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.executed = append(h.executed, request.RequestID)
+}
+
+func (h *testHandler) Executed(requestID string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, executed := range h.executed {
+		if executed == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 注册测试的处理器，读取并执行队列中的请求直到测试结束
+func startTestController(t *testing.T, r *RequestController) *testHandler {
+	h := &testHandler{release: make(chan struct{})}
+	RegisterRequestHandlerV2("test", h)
+	t.Cleanup(func() { delete(requestHandlerMap, "test") })
+	go r.consume()
+	t.Cleanup(func() {
+		r.cancel()
+		r.queue.Close()
+		<-r.stopCh
+		r.inflight.Wait()
+	})
+	return h
+}
+
+// 请求入队，同时放入实例的缓存中
+func pushTestRequest(t *testing.T, r *RequestController, request *models.Request) {
+	if err := cache.AddRequest(request); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	if err := r.queue.Push(request); err != nil {
+		t.Fatalf("push request failed: %v", err)
+	}
+}
+
+func TestSaturatedTypeDoesNotBlockOtherTypes(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	r.limitChan = make(chan struct{}, 2)
+	r.typeLimits["test_create"] = make(chan struct{}, 1)
+	for _, id := range []string{"c1", "c2"} {
+		pushTestRequest(t, r, newTestRequest(id, "ci", 5))
+	}
+	deleteRequest := newTestRequest("d1", "ci", 5)
+	deleteRequest.RequestType = "test_delete"
+	pushTestRequest(t, r, deleteRequest)
+	h := startTestController(t, r)
+
+	// c1占满创建请求的额度，排在后面的c2暂存起来，不占着全局的额度，删除请求可以执行
+	waitFor(t, "delete request to be executed", func() bool { return h.Executed("d1") })
+	if h.Executed("c1") || h.Executed("c2") {
+		t.Fatal("expect create requests to be blocked")
+	}
+	if len(r.typeLimits["test_create"]) != 1 {
+		t.Errorf("expect only c1 to hold the create slot, got %d", len(r.typeLimits["test_create"]))
+	}
+
+	// c1结束后，暂存的c2接着执行
+	close(h.release)
+	waitFor(t, "create requests to be executed", func() bool { return h.Executed("c1") && h.Executed("c2") })
+}
+
+func TestSaturatedTypeKeepsOrder(t *testing.T) {
+	newTestRedis(t)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	r.limitChan = make(chan struct{}, 3)
+	r.typeLimits["test_create"] = make(chan struct{}, 1)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		pushTestRequest(t, r, newTestRequest(id, "ci", 5))
+	}
+	h := startTestController(t, r)
+
+	// 额度用完时读取到的请求暂存在本地，不确认也不进入延迟队列，按照读取的顺序等待额度
+	waitFor(t, "requests to be held", func() bool {
+		r.heldLock.Lock()
+		defer r.heldLock.Unlock()
+		return len(r.held["test_create"]) == 2
+	})
+	r.heldLock.Lock()
+	held := r.held["test_create"]
+	if held[0].Request.RequestID != "c2" || held[1].Request.RequestID != "c3" {
+		t.Errorf("expect c2 and c3 to be held in order, got %s and %s", held[0].Request.RequestID, held[1].Request.RequestID)
+	}
+	r.heldLock.Unlock()
+
+	close(h.release)
+	waitFor(t, "create requests to be executed", func() bool { return h.Executed("c3") })
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.executed) != 3 || h.executed[0] != "c1" || h.executed[1] != "c2" || h.executed[2] != "c3" {
+		t.Errorf("expect requests to be executed in order, got %v", h.executed)
+	}
+}
+
+func TestExhaustedPermitsDeferRequest(t *testing.T) {
+	newTestRedis(t)
+	old := conf.Conf
+	conf.Conf.NamespaceConcurrency = 0
+	conf.Conf.NamespaceConcurrencies = map[string]int{"ci": 1}
+	t.Cleanup(func() { conf.Conf = old })
+	// 其他实例占用了命名空间唯一的许可
+	key := cache.GenNamespaceSemaphoreKey("buildjob", "ci")
+	if ok, err := cache.AcquireSemaphore(key, "b/other", 1, time.Minute); err != nil || !ok {
+		t.Fatalf("acquire permit failed: %v, err: %v", ok, err)
+	}
+	r := newTestController(t, newMemoryRequestQueue(10))
+	request := newTestRequest("d1", "ci", 5)
+	request.RequestType = "test_delete"
+	pushTestRequest(t, r, request)
+	h := startTestController(t, r)
+
+	// 许可用完时请求延迟后重新入队，不占着唯一的并发额度等待，其他命名空间的请求可以执行
+	waitFor(t, "request to be read", func() bool {
+		index, _ := r.queue.IndexOf(request)
+		return index == -1
+	})
+	other := newTestRequest("d2", "dev", 5)
+	other.RequestType = "test_delete"
+	pushTestRequest(t, r, other)
+	waitFor(t, "request of other namespace to be executed", func() bool { return h.Executed("d2") })
+	if h.Executed("d1") {
+		t.Fatal("expect request to be deferred while permits are exhausted")
+	}
+	if err := cache.ReleaseSemaphore(key, "b/other"); err != nil {
+		t.Fatalf("release permit failed: %v", err)
+	}
+	waitFor(t, "request to be executed", func() bool { return h.Executed("d1") })
+	// 执行完成后释放许可
+	waitFor(t, "permit to be released", func() bool {
+		ok, _ := cache.AcquireSemaphore(key, "b/other", 1, time.Minute)
+		return ok
+	})
+}
+
+// PreExec中已经完成的请求，不生成请求也不入队
+type finishedHandler struct {
+	RequestHandlerV2
+}
+
+func (h *finishedHandler) SetInstanceName(requestDTO interface{}, instanceName string) {}
+
+func (h *finishedHandler) SetRequestID(requestDTO interface{}, requestID string) {}
+
+func (h *finishedHandler) PreExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) error {
+	return ErrRequestFinished
+}
+
+func (h *finishedHandler) MakeAsyncResponse(requestDTO interface{}, requestType string, values map[string]interface{}) interface{} {
+	return requestDTO
+}
+
+func TestAcceptRequestFinishedInPreExec(t *testing.T) {
+	r := newTestController(t, newMemoryRequestQueue(10))
+	r.admission = newAdmissionController()
+	RegisterRequestHandlerV2("finished", &finishedHandler{})
+	t.Cleanup(func() { delete(requestHandlerMap, "finished") })
+
+	result, err := r.AcceptRequest(context.Background(), "dto", "finished_delete", "")
+	if err != nil {
+		t.Fatalf("accept request failed: %v", err)
+	}
+	if result.Async || result.Request != nil || result.Data != "dto" {
+		t.Errorf("expect a sync result, got %+v", result)
+	}
+	backlog, err := r.queue.Backlog()
+	if err != nil {
+		t.Fatalf("get backlog failed: %v", err)
+	}
+	for queueName, count := range backlog {
+		if count != 0 {
+			t.Errorf("expect nothing to be queued, got %d in %s", count, queueName)
+		}
+	}
+}
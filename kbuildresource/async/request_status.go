@@ -0,0 +1,64 @@
+package async
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+const (
+	MaxWaitTimeout   = 60 * time.Second // 长轮询最多等待的时间
+	waitPollInterval = 500 * time.Millisecond
+)
+
+// 根据请求ID查询请求，mysql中保存了请求的完整记录，redis中保存了还没有结束的请求所在的实例
+// 请求不存在时返回nil
+func GetRequest(requestID string) (*models.Request, error) {
+	request, err := models.GetRequestByRequestID(requestID)
+	if err != nil || request == nil {
+		return request, err
+	}
+	if common.IsTerminalRequestStatus(request.Status) {
+		return request, nil
+	}
+	// 还没有结束的请求，以redis中的实时状态为准
+	cached, err := cache.GetRequestByNameAndRequestType(request.Name, request.RequestType)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if cached != nil && cached.RequestID == request.RequestID {
+		request.Status = cached.Status
+		request.InstanceName = cached.InstanceName
+	}
+	owner, ttl, err := cache.GetRequestLease(request.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		request.LeaseOwner = owner
+		request.LeaseExpireAt = time.Now().Add(ttl)
+	}
+	return request, nil
+}
+
+// 等待请求结束，最多等待timeout的时长，超时后返回请求当前的状态
+func WaitRequest(requestID string, timeout time.Duration) (*models.Request, error) {
+	if timeout > MaxWaitTimeout {
+		timeout = MaxWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		request, err := GetRequest(requestID)
+		if err != nil || request == nil {
+			return request, err
+		}
+		if common.IsTerminalRequestStatus(request.Status) || !time.Now().Before(deadline) {
+			return request, nil
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
@@ -0,0 +1,135 @@
+package async
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/astaxie/beego/orm"
+	"github.com/go-redis/redis"
+	_ "github.com/mattn/go-sqlite3"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+var registerTestDB sync.Once
+
+// 使用sqlite内存数据库代替mysql，每个测试开始时清空所有表
+func newTestDB(t *testing.T) {
+	registerTestDB.Do(func() {
+		if err := orm.RegisterDataBase("default", "sqlite3", "file::memory:?cache=shared"); err != nil {
+			t.Fatalf("register database failed: %v", err)
+		}
+		orm.RegisterModel(new(models.Request), new(models.IdempotencyKey), new(models.DeadLetter))
+		if err := orm.RunSyncdb("default", false, false); err != nil {
+			t.Fatalf("create tables failed: %v", err)
+		}
+	})
+	o := orm.NewOrm()
+	for _, table := range []string{"request", "idempotency_key", "dead_letter"} {
+		if _, err := o.Raw("delete from " + table).Exec(); err != nil {
+			t.Fatalf("clear table %s failed: %v", table, err)
+		}
+	}
+}
+
+// 启动一个进程内的redis，测试结束后恢复原来的客户端
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+	// 请求的全局查询只遍历实例a的缓存
+	cache.RegisterInstanceNameLister(func() ([]string, error) { return []string{"a"}, nil })
+	t.Cleanup(func() { cache.RegisterInstanceNameLister(cache.GetInstanceNameList) })
+	return s
+}
+
+// 已经受理的请求，mysql和实例a的缓存中都有记录
+func addTestRequest(t *testing.T, requestID string, name string) *models.Request {
+	request := &models.Request{
+		RequestID:    requestID,
+		Name:         name,
+		Status:       common.RequestStatusPending,
+		RequestType:  common.BuildJobCreateRequestType,
+		InstanceName: "a",
+	}
+	if _, err := models.AddRequest(request); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+	if err := cache.AddRequest(request); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	return request
+}
+
+func TestGetRequest(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	if request, err := GetRequest("unknown"); err != nil || request != nil {
+		t.Fatalf("expect nil for unknown request, got %+v, err: %v", request, err)
+	}
+
+	// 还没有结束的请求以redis中的实时状态为准
+	request := addTestRequest(t, "r1", "agent-1")
+	request.Status = common.RequestStatusExecuting
+	if err := cache.UpdateRequest(request); err != nil {
+		t.Fatalf("update cached request failed: %v", err)
+	}
+	got, err := GetRequest("r1")
+	if err != nil || got == nil || got.Status != common.RequestStatusExecuting || got.InstanceName != "a" {
+		t.Fatalf("expect r1 to be executing on a, got %+v, err: %v", got, err)
+	}
+
+	// 请求结束后，redis中同名的新请求不影响它的状态
+	request.Status = common.RequestStatusFailed
+	request.Message = "invalid image"
+	if err = models.UpdateRequestStatus(request); err != nil {
+		t.Fatalf("update request failed: %v", err)
+	}
+	if err = cache.DeleteRequest(request); err != nil {
+		t.Fatalf("delete cached request failed: %v", err)
+	}
+	addTestRequest(t, "r2", "agent-1")
+	got, err = GetRequest("r1")
+	if err != nil || got == nil || got.Status != common.RequestStatusFailed || got.Message != "invalid image" || got.InstanceName != "" {
+		t.Errorf("expect r1 to stay failed, got %+v, err: %v", got, err)
+	}
+}
+
+func TestWaitRequest(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	request := addTestRequest(t, "r1", "agent-1")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		request.Status = common.RequestStatusSuccess
+		cache.DeleteRequest(request)
+		models.UpdateRequestStatus(request)
+	}()
+	// 请求结束后立即返回，不用等到超时
+	start := time.Now()
+	got, err := WaitRequest("r1", 5*time.Second)
+	if err != nil || got == nil || got.Status != common.RequestStatusSuccess {
+		t.Fatalf("expect r1 to succeed, got %+v, err: %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("expect to return once request finished, took %v", elapsed)
+	}
+
+	// 超时后返回请求当前的状态
+	addTestRequest(t, "r2", "agent-2")
+	got, err = WaitRequest("r2", 100*time.Millisecond)
+	if err != nil || got == nil || got.Status != common.RequestStatusPending {
+		t.Errorf("expect r2 to be pending after timeout, got %+v, err: %v", got, err)
+	}
+	if got, err = WaitRequest("unknown", time.Second); err != nil || got != nil {
+		t.Errorf("expect nil for unknown request, got %+v, err: %v", got, err)
+	}
+}
@@ -0,0 +1,151 @@
+package async
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 处理请求执行失败的错误，处理器在执行失败时调用：
+// 1. 可以重试的错误，还有剩余次数时，按照指数退避加随机抖动的时间设置request.RetryAt，请求的状态回到pending，
+//    处理器返回后由执行它的请求控制器放入延迟队列
+// 2. 可以重试的错误，次数已经用完时，请求转入死信并结束为failed
+// 3. 永久错误返回false，由处理器自己结束请求
+// 返回true表示请求已经被重新调度或者转入死信，处理器不需要再处理
+func RetryRequest(request *models.Request, cause error) (bool, error) {
+	retryable := common.IsRetryableError(cause)
+	request.Attempts++
+	request.Errors = append(request.Errors, &models.RequestError{
+		Attempt:   request.Attempts,
+		Error:     cause.Error(),
+		Retryable: retryable,
+		Time:      time.Now(),
+	})
+	if !retryable {
+		return false, nil
+	}
+	// 租约丢失说明请求已经被其他实例认领，由认领者负责
+	err := CheckRequestLease(request)
+	if err != nil {
+		return false, err
+	}
+	if request.Attempts >= conf.Conf.RequestMaxAttempts {
+		return true, deadLetterRequest(request, cause)
+	}
+	delay := retryBackoff(request.Attempts)
+	logrus.Infof("INFO: request %s failed with retryable error, retry after %v, attempts: %d, err: %v",
+		request.RequestID, delay, request.Attempts, cause)
+	request.Status = common.RequestStatusPending
+	request.Message = fmt.Sprintf("attempt %d failed, retry after %v: %v", request.Attempts, delay, cause)
+	err = cache.UpdateRequest(request)
+	if err != nil {
+		return false, err
+	}
+	retryAt := time.Now().Add(delay)
+	request.RetryAt = &retryAt
+	// mysql中的状态只用于查询，写入失败不影响重试
+	if err = models.UpdateRequestAttempts(request); err != nil {
+		logrus.Error("ERROR: update request attempts failed, err: ", err)
+	}
+	return true, nil
+}
+
+// 第attempt次失败后的等待时间：base*2^(attempt-1)，不超过上限，再取[d/2, d]之间的随机值，避免大量请求同时重试
+func retryBackoff(attempt int) time.Duration {
+	backoff := conf.Conf.RequestRetryBackoff
+	maxBackoff := conf.Conf.RequestRetryMaxBackoff
+	if backoff <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt && (maxBackoff <= 0 || backoff < maxBackoff); i++ {
+		backoff *= 2
+	}
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// 重试次数用完的请求转入死信，请求结束为failed
+func deadLetterRequest(request *models.Request, cause error) error {
+	logrus.Errorf("ERROR: request %s failed after %d attempts, move to dead letter, err: %v", request.RequestID, request.Attempts, cause)
+	errorHistory, err := json.Marshal(request.Errors)
+	if err != nil {
+		return err
+	}
+	_, err = models.AddDeadLetter(&models.DeadLetter{
+		RequestID:   request.RequestID,
+		Name:        request.Name,
+		RequestType: request.RequestType,
+		Namespace:   request.Namespace,
+		Attempts:    request.Attempts,
+		LastError:   cause.Error(),
+		Errors:      string(errorHistory),
+	})
+	if err != nil {
+		return err
+	}
+	request.Status = common.RequestStatusFailed
+	request.Message = fmt.Sprintf("failed after %d attempts: %v", request.Attempts, cause)
+	err = cache.DeleteRequest(request)
+	if err != nil {
+		return err
+	}
+	return models.UpdateRequestAttempts(request)
+}
+
+// 把死信中的请求重新入队，请求ID不变，执行次数和错误历史清零；返回重新入队的请求，死信不存在时返回nil
+func (r *RequestController) RequeueDeadLetter(requestID string) (*models.Request, error) {
+	deadLetter, err := models.GetDeadLetterByRequestID(requestID)
+	if err != nil || deadLetter == nil {
+		return nil, err
+	}
+	request, err := models.GetRequestByRequestID(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, common.NewNotFoundError("request %s of dead letter not found", requestID)
+	}
+	// 同名的请求还没有结束时不能重新入队，避免和它交叉执行
+	cached, err := cache.GetRequestByNameAndRequestType(request.Name, request.RequestType)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if cached != nil {
+		return nil, common.NewConflictError("request %s of %s is still %s, please retry later", cached.RequestID, request.Name, cached.Status)
+	}
+	request.Status = common.RequestStatusPending
+	request.Message = "requeued from dead letter"
+	request.Attempts = 0
+	request.Errors = nil
+	request.InstanceName = r.instanceName
+	err = models.UpdateRequestAttempts(request)
+	if err != nil {
+		return nil, err
+	}
+	err = cache.AddRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	err = r.queue.Push(request)
+	if err != nil {
+		abandonRequest(request, err)
+		return nil, err
+	}
+	logrus.Infof("INFO: requeue request %s from dead letter", requestID)
+	if err = models.DeleteDeadLetterByRequestID(requestID); err != nil {
+		logrus.Error("ERROR: delete dead letter failed, err: ", err)
+	}
+	return request, nil
+}
@@ -0,0 +1,186 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 设置重试的配置，测试结束后恢复
+func setRetryConf(t *testing.T, maxAttempts int, backoff time.Duration, maxBackoff time.Duration) {
+	old := conf.Conf
+	conf.Conf.RequestMaxAttempts = maxAttempts
+	conf.Conf.RequestRetryBackoff = backoff
+	conf.Conf.RequestRetryMaxBackoff = maxBackoff
+	t.Cleanup(func() { conf.Conf = old })
+}
+
+func TestRetryBackoff(t *testing.T) {
+	setRetryConf(t, 5, time.Second, 8*time.Second)
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		// 不超过上限
+		{10, 8 * time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			// 取[d/2, d]之间的随机值
+			if backoff := retryBackoff(c.attempt); backoff < c.max/2 || backoff > c.max {
+				t.Fatalf("expect backoff of attempt %d in [%v, %v], got %v", c.attempt, c.max/2, c.max, backoff)
+			}
+		}
+	}
+}
+
+func TestRetryRequest(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	setRetryConf(t, 3, 20*time.Millisecond, time.Second)
+	queue := newMemoryRequestQueue(10)
+	controller := newTestController(t, queue)
+	request := newTestRequest("r1", "ci", 5)
+	if _, err := models.AddRequest(request); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+
+	// 永久错误不重试，由处理器自己结束请求
+	retried, err := RetryRequest(request, errors.New("invalid image"))
+	if err != nil || retried {
+		t.Fatalf("expect permanent error not to be retried, got %v, err: %v", retried, err)
+	}
+
+	// 可以重试的错误回到pending，等待退避时间后重新入队
+	retried, err = RetryRequest(request, common.NewRetryableError(errors.New("connection refused")))
+	if err != nil || !retried {
+		t.Fatalf("expect retryable error to be retried, got %v, err: %v", retried, err)
+	}
+	if request.Status != common.RequestStatusPending || request.Attempts != 2 || len(request.Errors) != 2 || request.RetryAt == nil {
+		t.Errorf("unexpected request after retry: %+v", request)
+	}
+	cached, err := cache.GetRequestByNameAndRequestTypeAndInstanceName(request.Name, request.RequestType, request.InstanceName)
+	if err != nil || cached.Attempts != 2 || cached.Status != common.RequestStatusPending {
+		t.Errorf("expect attempts to be cached, got %+v, err: %v", cached, err)
+	}
+	// 处理器返回后，执行请求的控制器把请求放入延迟队列
+	if index, _ := queue.IndexOf(request); index != -1 {
+		t.Errorf("expect request not to be queued by RetryRequest, got index %d", index)
+	}
+	controller.retry(request)
+	if request.RetryAt != nil {
+		t.Error("expect retry time to be cleared after requeue")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	message, err := queue.Pop(ctx, newFairScheduler(nil))
+	if err != nil || message == nil || message.Request.RequestID != request.RequestID {
+		t.Fatalf("expect request to be requeued after backoff, got %+v, err: %v", message, err)
+	}
+
+	// 次数用完后转入死信，请求结束为failed
+	retried, err = RetryRequest(request, common.NewRetryableError(errors.New("connection refused")))
+	if err != nil || !retried {
+		t.Fatalf("expect request to be dead lettered, got %v, err: %v", retried, err)
+	}
+	deadLetter, err := models.GetDeadLetterByRequestID(request.RequestID)
+	if err != nil || deadLetter == nil || deadLetter.Attempts != 3 || deadLetter.LastError != "connection refused" {
+		t.Fatalf("expect dead letter after 3 attempts, got %+v, err: %v", deadLetter, err)
+	}
+	stored, _ := models.GetRequestByRequestID(request.RequestID)
+	if stored.Status != common.RequestStatusFailed || stored.Attempts != 3 {
+		t.Errorf("expect request to fail after 3 attempts, got %+v", stored)
+	}
+	if _, err = cache.GetRequestByNameAndRequestTypeAndInstanceName(request.Name, request.RequestType, request.InstanceName); err == nil {
+		t.Error("expect dead lettered request to be removed from cache")
+	}
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	setRetryConf(t, 1, time.Millisecond, time.Millisecond)
+	queue := newMemoryRequestQueue(10)
+	controller := newTestController(t, queue)
+	request := newTestRequest("r1", "ci", 5)
+	if _, err := models.AddRequest(request); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+	if retried, err := RetryRequest(request, common.NewRetryableError(errors.New("timeout"))); err != nil || !retried {
+		t.Fatalf("expect request to be dead lettered, got %v, err: %v", retried, err)
+	}
+
+	requeued, err := controller.RequeueDeadLetter(request.RequestID)
+	if err != nil || requeued == nil || requeued.Attempts != 0 || requeued.Status != common.RequestStatusPending {
+		t.Fatalf("expect request to be requeued with attempts reset, got %+v, err: %v", requeued, err)
+	}
+	if deadLetter, _ := models.GetDeadLetterByRequestID(request.RequestID); deadLetter != nil {
+		t.Error("expect dead letter to be deleted")
+	}
+	if index, _ := queue.IndexOf(request); index != 0 {
+		t.Errorf("expect request to be queued, got index %d", index)
+	}
+	// 请求还没有结束时不能再次重新入队
+	if _, err = models.AddDeadLetter(&models.DeadLetter{RequestID: request.RequestID, Name: request.Name}); err != nil {
+		t.Fatalf("add dead letter failed: %v", err)
+	}
+	if _, err = controller.RequeueDeadLetter(request.RequestID); common.StatusCodeOf(err) != 409 {
+		t.Errorf("expect conflict while request is pending, got %v", err)
+	}
+}
+
+// 第一次执行返回可以重试的错误，之后执行成功
+type retryHandler struct {
+	RequestHandlerV2
+	lock     sync.Mutex
+	attempts int
+}
+
+func (h *retryHandler) AsyncExec(ctx context.Context, request *models.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.attempts++
+	if h.attempts == 1 {
+		RetryRequest(request, common.NewRetryableError(errors.New("connection refused")))
+	}
+}
+
+func (h *retryHandler) Attempts() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.attempts
+}
+
+func TestDispatchRequeuesRetriedRequest(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	setRetryConf(t, 3, 20*time.Millisecond, time.Second)
+	r := newTestController(t, newMemoryRequestQueue(10))
+	h := &retryHandler{}
+	RegisterRequestHandlerV2("retry", h)
+	t.Cleanup(func() { delete(requestHandlerMap, "retry") })
+	request := newTestRequest("r1", "ci", 5)
+	request.RequestType = "retry_create"
+	pushTestRequest(t, r, request)
+	go r.consume()
+	t.Cleanup(func() {
+		r.cancel()
+		r.queue.Close()
+		<-r.stopCh
+		r.inflight.Wait()
+	})
+
+	// 处理器决定重试后，控制器把请求放入延迟队列，退避之后重新执行
+	waitFor(t, "request to be retried", func() bool { return h.Attempts() == 2 })
+}
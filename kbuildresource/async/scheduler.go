@@ -0,0 +1,77 @@
+package async
+
+import (
+	"sort"
+	"sync"
+)
+
+// 请求调度器，多个命名空间都有请求在排队时，决定先执行哪个命名空间的请求
+type RequestScheduler interface {
+	// 按照调度的先后顺序排列命名空间
+	Order(namespaces []string) []string
+	// 命名空间的一个请求开始执行
+	Served(namespace string)
+	// 命名空间的调度权重
+	Weight(namespace string) float64
+}
+
+// 加权公平调度：每个命名空间维护一个虚拟时间，每执行一个请求虚拟时间增加1/权重，虚拟时间最小的命名空间先执行
+// 长时间没有请求的命名空间重新有请求时，虚拟时间追平到当前最小值，避免积累的额度一次性抢占其他命名空间
+// 每个实例独立调度，所有实例都按照同样的规则调度，整体上也是公平的
+type fairScheduler struct {
+	lock         sync.Mutex
+	weights      map[string]float64
+	virtualTimes map[string]float64
+}
+
+func newFairScheduler(weights map[string]float64) *fairScheduler {
+	return &fairScheduler{
+		weights:      weights,
+		virtualTimes: make(map[string]float64),
+	}
+}
+
+func (s *fairScheduler) Weight(namespace string) float64 {
+	if weight, ok := s.weights[namespace]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (s *fairScheduler) Order(namespaces []string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(namespaces) == 0 {
+		return namespaces
+	}
+	minTime := -1.0
+	for _, namespace := range namespaces {
+		if t, ok := s.virtualTimes[namespace]; ok && (minTime < 0 || t < minTime) {
+			minTime = t
+		}
+	}
+	if minTime < 0 {
+		minTime = 0
+	}
+	for _, namespace := range namespaces {
+		if t, ok := s.virtualTimes[namespace]; !ok || t < minTime {
+			s.virtualTimes[namespace] = minTime
+		}
+	}
+	ordered := make([]string, len(namespaces))
+	copy(ordered, namespaces)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ti, tj := s.virtualTimes[ordered[i]], s.virtualTimes[ordered[j]]
+		if ti != tj {
+			return ti < tj
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
+
+func (s *fairScheduler) Served(namespace string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.virtualTimes[namespace] += 1 / s.Weight(namespace)
+}
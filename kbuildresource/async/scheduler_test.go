@@ -0,0 +1,109 @@
+package async
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// 依次读取n个请求，返回请求ID
+func popAll(t *testing.T, q RequestQueue, scheduler RequestScheduler, n int) []string {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		message, err := q.Pop(context.TODO(), scheduler)
+		if err != nil || message == nil {
+			t.Fatalf("pop failed: %+v, err: %v", message, err)
+		}
+		ids = append(ids, message.Request.RequestID)
+	}
+	return ids
+}
+
+func TestFairSchedulerWeights(t *testing.T) {
+	s := newFairScheduler(map[string]float64{"a": 2})
+	served := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		namespace := s.Order([]string{"a", "b"})[0]
+		s.Served(namespace)
+		served[namespace]++
+	}
+	// a的权重是b的两倍，执行的请求数也是两倍
+	if served["a"] != 20 || served["b"] != 10 {
+		t.Errorf("expect a:b = 20:10, got %v", served)
+	}
+
+	// 长时间没有请求的命名空间追平到当前的最小虚拟时间，不能一次性抢占其他命名空间
+	served = make(map[string]int)
+	for i := 0; i < 6; i++ {
+		namespace := s.Order([]string{"a", "b", "c"})[0]
+		s.Served(namespace)
+		served[namespace]++
+	}
+	if served["c"] > 3 {
+		t.Errorf("expect new namespace c not to monopolize, got %v", served)
+	}
+}
+
+func TestMemoryQueueOrder(t *testing.T) {
+	q := newMemoryRequestQueue(10)
+	for _, request := range []struct {
+		id        string
+		namespace string
+		priority  int
+	}{
+		{"a1", "a", 5},
+		{"a2", "a", 5},
+		{"a3", "a", 9},
+		{"b1", "b", 1},
+		{"b2", "b", 1},
+	} {
+		if err := q.Push(newTestRequest(request.id, request.namespace, request.priority)); err != nil {
+			t.Fatalf("push %s failed: %v", request.id, err)
+		}
+	}
+	if index, _ := q.IndexOf(newTestRequest("a2", "a", 5)); index != 1 {
+		t.Errorf("expect a2 to be the second in its queue, got %d", index)
+	}
+	backlog, _ := q.Backlog()
+	if len(backlog) != 3 {
+		t.Errorf("expect 3 queues in backlog, got %v", backlog)
+	}
+
+	// 命名空间之间轮流执行，同一个命名空间中优先级高的先执行，同优先级先入队的先执行
+	ids := popAll(t, q, newFairScheduler(nil), 5)
+	if strings.Join(ids, ",") != "a3,b1,a1,b2,a2" {
+		t.Errorf("unexpected order %v", ids)
+	}
+	if index, _ := q.IndexOf(newTestRequest("a2", "a", 5)); index != -1 {
+		t.Errorf("expect a2 not to be queued, got %d", index)
+	}
+}
+
+func TestRedisQueueOrder(t *testing.T) {
+	newTestRedis(t)
+	q := newRedisRequestQueue("a")
+	for _, request := range []struct {
+		id        string
+		namespace string
+		priority  int
+	}{
+		{"a1", "a", 5},
+		{"a2", "a", 9},
+		{"b1", "b", 5},
+	} {
+		if err := q.Push(newTestRequest(request.id, request.namespace, request.priority)); err != nil {
+			t.Fatalf("push %s failed: %v", request.id, err)
+		}
+	}
+	if index, err := q.IndexOf(newTestRequest("a1", "a", 5)); err != nil || index != 0 {
+		t.Errorf("expect a1 to be the first in its queue, got %d, err: %v", index, err)
+	}
+	ids := popAll(t, q, newFairScheduler(nil), 3)
+	if strings.Join(ids, ",") != "a2,b1,a1" {
+		t.Errorf("unexpected order %v", ids)
+	}
+	backlog, err := q.Backlog()
+	if err != nil || len(backlog) != 0 {
+		t.Errorf("expect empty backlog, got %v, err: %v", backlog, err)
+	}
+}
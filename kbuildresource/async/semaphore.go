@@ -0,0 +1,130 @@
+package async
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+	"bryson.foundation/kbuildresource/utils"
+)
+
+const (
+	permitTTL           = 15 * time.Second // 许可的有效期，持有者死亡后最多经过这么久许可被回收
+	permitRenewInterval = 5 * time.Second  // 每5秒续期一次
+)
+
+// 分布式信号量的一个许可
+type semaphorePermit struct {
+	key   string
+	limit int
+}
+
+// 请求执行期间持有的许可，集群和命名空间的并发数在所有实例之间共享
+// 许可不断续期，持有者死亡后许可过期，其他实例获取许可时回收
+type RequestPermits struct {
+	request  *models.Request
+	holder   string
+	permits  []*semaphorePermit
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// 请求需要的许可：先集群后命名空间，所有实例按照同样的顺序获取
+func requestPermitsOf(request *models.Request) []*semaphorePermit {
+	permits := make([]*semaphorePermit, 0, 2)
+	if request.ClusterName != "" {
+		limit, ok := conf.Conf.ClusterConcurrencies[request.ClusterName]
+		if !ok {
+			limit = conf.Conf.ClusterConcurrency
+		}
+		if limit > 0 {
+			permits = append(permits, &semaphorePermit{key: cache.GenClusterSemaphoreKey(common.BuildJobPrefix, request.ClusterName), limit: limit})
+		}
+	}
+	if request.Namespace != "" {
+		limit, ok := conf.Conf.NamespaceConcurrencies[request.Namespace]
+		if !ok {
+			limit = conf.Conf.NamespaceConcurrency
+		}
+		if limit > 0 {
+			permits = append(permits, &semaphorePermit{key: cache.GenNamespaceSemaphoreKey(common.BuildJobPrefix, request.Namespace), limit: limit})
+		}
+	}
+	return permits
+}
+
+// 获取请求需要的所有许可，许可用完时返回nil，不等待
+// 控制器在分发请求之前获取，获取不到时请求延迟后重新入队，执行完成后Release；不需要许可的请求也返回非nil，Release是空操作
+func acquireRequestPermits(request *models.Request) (*RequestPermits, error) {
+	p := &RequestPermits{
+		request: request,
+		holder:  fmt.Sprintf("%s/%s", request.InstanceName, utils.CreateUUID()),
+		permits: requestPermitsOf(request),
+		stopCh:  make(chan struct{}),
+	}
+	if len(p.permits) == 0 {
+		return p, nil
+	}
+	ok, err := p.tryAcquire()
+	if err != nil || !ok {
+		return nil, err
+	}
+	go p.keepRenewing()
+	return p, nil
+}
+
+// 按顺序获取所有许可，有一个获取不到时释放已经获取的，避免占着许可等待
+func (p *RequestPermits) tryAcquire() (bool, error) {
+	for i, permit := range p.permits {
+		ok, err := cache.AcquireSemaphore(permit.key, p.holder, permit.limit, permitTTL)
+		if err != nil || !ok {
+			p.release(p.permits[:i])
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (p *RequestPermits) keepRenewing() {
+	t := time.NewTicker(permitRenewInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+			for _, permit := range p.permits {
+				ok, err := cache.RenewSemaphore(permit.key, p.holder, permitTTL)
+				if err != nil {
+					logrus.Errorf("ERROR: renew permit of %s failed, err: %v", permit.key, err)
+					continue
+				}
+				if !ok {
+					// 许可已经被回收，并发数可能短暂超过限制，不影响请求继续执行
+					logrus.Errorf("ERROR: permit of %s held by request %s has expired", permit.key, p.request.RequestID)
+				}
+			}
+		}
+	}
+}
+
+// 停止续期并释放所有许可
+func (p *RequestPermits) Release() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+	p.release(p.permits)
+}
+
+func (p *RequestPermits) release(permits []*semaphorePermit) {
+	for _, permit := range permits {
+		if err := cache.ReleaseSemaphore(permit.key, p.holder); err != nil {
+			// 释放失败的许可过期后会被回收
+			logrus.Errorf("ERROR: release permit of %s failed, err: %v", permit.key, err)
+		}
+	}
+}
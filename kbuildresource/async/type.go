@@ -3,6 +3,8 @@ package async
 import (
 	"bryson.foundation/kbuildresource/cache"
 	"bryson.foundation/kbuildresource/models"
+	"context"
+	"errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,26 +22,102 @@ type RequestHandler interface {
 	SyncExec(requestDTO interface{}, requestType string, values map[string]interface{}) (interface{}, error)
 	// 给requestDTO 设置请求的instanceName
 	SetInstanceName(requestDTO interface{}, instanceName string)
+	// 给requestDTO 设置请求ID，MakeRequest时需要把它注入到request中，客户端用它来查询请求状态
+	SetRequestID(requestDTO interface{}, requestID string)
 	// 用于生成异步执行的Response,返回给客户端，用于处理信息，隐藏一些没有必要返回给客户端的信息，同步的场景会直接处理返回值
 	MakeAsyncResponse(requestDTO interface{}, requestType string, values map[string]interface{}) interface{}
 	// 用于处理从deadInstance中接管request请求
 	HandleTakeOverRequest(request *models.Request, newInstanceName string) error
 }
 
+// 支持context的请求处理器，ctx用于传递取消、超时和停机信号：
+// 受理阶段的ctx来自http请求；执行阶段的ctx在请求被取消、超过期限、实例停机或者租约丢失时被取消，原因通过context.Cause获取
+type RequestHandlerV2 interface {
+	// 同RequestHandler.PreExec
+	PreExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) error
+	// 同RequestHandler.MakeRequest
+	MakeRequest(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (*models.Request, error)
+	// 异步执行请求，返回后请求控制器释放并发额度，不再需要处理器自己释放
+	AsyncExec(ctx context.Context, request *models.Request)
+	// 同RequestHandler.PostAsyncExec
+	PostAsyncExec(ctx context.Context, request *models.Request, requestType string, values map[string]interface{}) error
+	// 同RequestHandler.SyncExec
+	SyncExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (interface{}, error)
+	// 同RequestHandler.SetInstanceName
+	SetInstanceName(requestDTO interface{}, instanceName string)
+	// 同RequestHandler.SetRequestID
+	SetRequestID(requestDTO interface{}, requestID string)
+	// 同RequestHandler.MakeAsyncResponse
+	MakeAsyncResponse(requestDTO interface{}, requestType string, values map[string]interface{}) interface{}
+	// 同RequestHandler.HandleTakeOverRequest
+	HandleTakeOverRequest(ctx context.Context, request *models.Request, newInstanceName string) error
+}
+
+// 把旧的处理器适配成RequestHandlerV2，旧的处理器感知不到ctx
+type requestHandlerAdapter struct {
+	handler RequestHandler
+}
+
+func AdaptRequestHandler(handler RequestHandler) RequestHandlerV2 {
+	return &requestHandlerAdapter{handler: handler}
+}
+
+func (a *requestHandlerAdapter) PreExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) error {
+	return a.handler.PreExec(requestDTO, requestType, values)
+}
+
+func (a *requestHandlerAdapter) MakeRequest(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (*models.Request, error) {
+	return a.handler.MakeRequest(requestDTO, requestType, values)
+}
+
+// 旧的处理器执行完成后会释放一个并发额度，这里给它一个单独的额度，真正的额度由请求控制器释放
+func (a *requestHandlerAdapter) AsyncExec(ctx context.Context, request *models.Request) {
+	limitChan := make(chan struct{}, 1)
+	limitChan <- struct{}{}
+	a.handler.AsyncExec(request, limitChan)
+}
+
+func (a *requestHandlerAdapter) PostAsyncExec(ctx context.Context, request *models.Request, requestType string, values map[string]interface{}) error {
+	return a.handler.PostAsyncExec(request, requestType, values)
+}
+
+func (a *requestHandlerAdapter) SyncExec(ctx context.Context, requestDTO interface{}, requestType string, values map[string]interface{}) (interface{}, error) {
+	return a.handler.SyncExec(requestDTO, requestType, values)
+}
+
+func (a *requestHandlerAdapter) SetInstanceName(requestDTO interface{}, instanceName string) {
+	a.handler.SetInstanceName(requestDTO, instanceName)
+}
+
+func (a *requestHandlerAdapter) SetRequestID(requestDTO interface{}, requestID string) {
+	a.handler.SetRequestID(requestDTO, requestID)
+}
+
+func (a *requestHandlerAdapter) MakeAsyncResponse(requestDTO interface{}, requestType string, values map[string]interface{}) interface{} {
+	return a.handler.MakeAsyncResponse(requestDTO, requestType, values)
+}
+
+func (a *requestHandlerAdapter) HandleTakeOverRequest(ctx context.Context, request *models.Request, newInstanceName string) error {
+	return a.handler.HandleTakeOverRequest(request, newInstanceName)
+}
+
+// PreExec中请求已经处理完成，比如删除时取消了还在排队的创建请求，不需要再生成请求入队
+var ErrRequestFinished = errors.New("request has been finished in PreExec")
+
+// 接管时请求已经不在原来实例的缓存中，说明已经被其他实例接管，不需要再放入队列
+var ErrRequestTakenOver = errors.New("request has been taken over by another instance")
+
 // 接收Pending request时需要做的处理，这是通用广场
+// 请求已经被其他实例接管时返回ErrRequestTakenOver，fencing token过期时返回cache.ErrStaleFencingToken
 func HandleCacheDataForTakeOverPendingRequest(request *models.Request, newInstanceName string) error {
-	// 在原本的redis hash 里面进行删除， 在新的列表里面添加
-	err := cache.DeleteRequest(request)
+	// 在原本的redis hash 里面删除，同时在新的列表里面添加，并设置新的instanceName
+	moved, err := cache.MoveRequest(request, newInstanceName)
 	if err != nil {
 		logrus.Error("ERROR: take over job failed, error: ", err)
 		return err
 	}
-	// 设置新的instanceName
-	request.InstanceName = newInstanceName
-	err = cache.AddRequest(request)
-	if err != nil {
-		logrus.Error("ERROR: take over job failed, error: ", err)
-		return err
+	if !moved {
+		return ErrRequestTakenOver
 	}
 	return nil
 }
\ No newline at end of file
@@ -1,12 +1,18 @@
 package buildjob
 
 import (
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
 	"bryson.foundation/kbuildresource/dto"
 	"bryson.foundation/kbuildresource/models"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/astaxie/beego/orm"
+	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
 	"strings"
-	"time"
 )
 
 func CreateBuildJob(buildJobDTO *dto.BuildJobDTO) error {
@@ -16,45 +22,231 @@ func CreateBuildJob(buildJobDTO *dto.BuildJobDTO) error {
 	if err != nil {
 		return err
 	}
-	err = CreatePod(buildJobDTO)
+	err = ScheduleBuildJob(buildJobDTO)
+	if err != nil {
+		return err
+	}
+	err = CreatePod(context.TODO(), buildJobDTO)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func VerifyBuildJobDTO(buildJobDTO *dto.BuildJobDTO) error {
-	logrus.Info("INFO: verifyBuildJobDTO")
-	//time.Sleep(1 * time.Second)
+// 创建pod：先在mysql中记录pod，再通过集群对应的执行器真正创建，最后回写执行器返回的状态
+func CreatePod(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+	logrus.Info("INFO: CreatePod")
+	executor, err := GetPodExecutor(buildJobDTO.ClusterName)
+	if err != nil {
+		return err
+	}
+	pod, err := createPodFromBuildJobDTO(buildJobDTO)
+	if err != nil {
+		return err
+	}
+	state, err := executor.CreatePod(ctx, buildJobDTO)
+	if err != nil {
+		logrus.Errorf("ERROR: executor create pod %s failed, error: %v", buildJobDTO.Name, err)
+		pod.Status = "Failed"
+		pod.Message = err.Error()
+		if updateErr := models.UpdatePodStatus(pod); updateErr != nil {
+			logrus.Error("ERROR: update pod status failed, error: ", updateErr)
+		}
+		return err
+	}
+	pod.Status = state.Status
+	pod.NodeIP = state.NodeIP
+	pod.Message = state.Message
+	err = models.UpdatePodStatus(pod)
+	if err != nil {
+		return err
+	}
+	logrus.Info("INFO: finish CreatePod")
 	return nil
 }
 
-func CreatePod(buildJobDTO *dto.BuildJobDTO) error {
-	logrus.Info("INFO: CreatePod")
-	_, err := createPodFromBuildJobDTO(buildJobDTO)
+func DeleteBuildJob(buildJobDTO *dto.BuildJobDTO) error {
+	return DeletePod(context.TODO(), buildJobDTO)
+}
+
+// 删除pod，pod不存在或者已经被删除时直接返回成功，保证被其他实例接管后重复执行也没有问题
+func DeletePod(ctx context.Context, buildJobDTO *dto.BuildJobDTO) error {
+	logrus.Info("INFO: DeletePod")
+	pod, err := models.GetPodByName(buildJobDTO.Name)
 	if err != nil {
-		logrus.Info("INFO: finish CreatePod")
+		return err
+	}
+	if pod == nil || pod.IsDelete == "1" {
+		logrus.Infof("INFO: pod %s not exists or has been deleted, skip", buildJobDTO.Name)
 		return nil
 	}
-	return err
+	executor, err := GetPodExecutor(pod.ClusterName)
+	if err != nil {
+		return err
+	}
+	err = executor.DeletePod(ctx, pod.Namespace, pod.Name)
+	if err != nil {
+		logrus.Errorf("ERROR: executor delete pod %s failed, error: %v", pod.Name, err)
+		return err
+	}
+	affected, err := models.DeletePodByName(buildJobDTO.Name)
+	if err != nil {
+		logrus.Error("ERROR: delete pod from mysql failed, error: ", err)
+		return err
+	}
+	logrus.Infof("INFO: finish DeletePod %s, affected %d", buildJobDTO.Name, affected)
+	return nil
 }
 
+// 在mysql中记录pod，请求被接管后重复执行时复用同一个请求创建的记录，其他请求创建的同名pod返回冲突
 func createPodFromBuildJobDTO(buildJobDTO *dto.BuildJobDTO) (*models.Pod, error) {
+	existed, err := models.GetPodByName(buildJobDTO.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existed != nil && existed.IsDelete == "0" {
+		if buildJobDTO.RequestID == "" || existed.RequestID != buildJobDTO.RequestID {
+			return nil, common.NewConflictError("buildJob %s already exists", buildJobDTO.Name)
+		}
+		logrus.Infof("INFO: pod %s already created by request %s", buildJobDTO.Name, buildJobDTO.RequestID)
+		return existed, nil
+	}
 	pod := &models.Pod{
-		Name:        buildJobDTO.Name,
-		ClusterName: buildJobDTO.ClusterName,
-		Labels:      strings.Join(buildJobDTO.Labels, ","),
-		Namespace:   buildJobDTO.Namespace,
-		Status:      "Pending",
-		NodeIP:      "",
-		IsDelete:    "0",
-		Containers:  buildJobDTO.Containers,
+		Name:           buildJobDTO.Name,
+		ClusterName:    buildJobDTO.ClusterName,
+		Labels:         strings.Join(buildJobDTO.Labels, ","),
+		Namespace:      buildJobDTO.Namespace,
+		Status:         "Pending",
+		NodeIP:         "",
+		IsDelete:       "0",
+		Containers:     buildJobDTO.Containers,
+		ScheduleReason: buildJobDTO.ScheduleReason,
+		RequestID:      buildJobDTO.RequestID,
 	}
-	_, err := models.AddPod(pod)
+	_, err = models.AddPod(pod)
 	if err != nil {
 		logrus.Error("ERROR: add pod to mysql failed, error: ", err)
+		return nil, err
 	}
-	time.Sleep(1 * time.Second)
 	logrus.Info("INFO: finish create pod")
 	return pod, nil
-}
\ No newline at end of file
+}
+
+// 查询构建任务的状态，先查redis里面正在处理的请求，再用mysql里面的数据进行补充
+// 如果请求和pod都不存在，返回nil
+func GetBuildJobStatus(name string) (*dto.BuildJobStatusDTO, error) {
+	status := &dto.BuildJobStatusDTO{Name: name}
+	found := false
+
+	// redis里面保存的是还没有结束的请求，所有实例的hash都需要检索
+	request, err := getCachedBuildJobRequest(name)
+	if err != nil {
+		return nil, err
+	}
+	if request != nil {
+		found = true
+		status.RequestID = request.RequestID
+		status.RequestType = request.RequestType
+		status.RequestStatus = request.Status
+		status.InstanceName = request.InstanceName
+		status.Message = request.Message
+	} else {
+		// 已经结束的请求，从mysql中查询最后的状态
+		request, err = models.GetLatestBuildJobRequestByName(name)
+		if err != nil && err != orm.ErrNoRows {
+			return nil, err
+		}
+		if request != nil {
+			found = true
+			status.RequestID = request.RequestID
+			status.RequestType = request.RequestType
+			status.RequestStatus = request.Status
+			status.Message = request.Message
+		}
+	}
+
+	pod, err := models.GetPodByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if pod != nil && pod.IsDelete == "1" {
+		found = true
+		// 已经删除的构建任务不再返回pod删除前的状态
+		status.Deleted = true
+		if status.RequestStatus == "" {
+			status.RequestType = common.BuildJobDeleteRequestType
+			status.RequestStatus = common.RequestStatusSuccess
+		}
+	} else if pod != nil {
+		found = true
+		// pod存在而请求已经不在redis和mysql中，说明是历史数据，请求已经执行成功
+		if status.RequestStatus == "" {
+			status.RequestType = common.BuildJobCreateRequestType
+			status.RequestStatus = common.RequestStatusSuccess
+		}
+		status.PodStatus = pod.Status
+		status.NodeIP = pod.NodeIP
+		if pod.Message != "" {
+			status.Message = pod.Message
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return status, nil
+}
+
+// redis里面同一个构建任务可能同时有创建和删除请求，取最近受理的一个
+func getCachedBuildJobRequest(name string) (*models.Request, error) {
+	var latest *models.Request
+	for _, requestType := range []string{common.BuildJobCreateRequestType, common.BuildJobDeleteRequestType} {
+		request, err := cache.GetRequestByNameAndRequestType(name, requestType)
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if request != nil && (latest == nil || request.ID > latest.ID) {
+			latest = request
+		}
+	}
+	return latest, nil
+}
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// 分页查询构建任务，多查一条用于判断是否还有下一页
+func ListBuildJobs(q *models.PodQuery) (*dto.BuildJobListDTO, error) {
+	limit := q.Limit
+	q.Limit = limit + 1
+	pods, err := models.ListPods(q)
+	q.Limit = limit
+	if err != nil {
+		return nil, err
+	}
+	result := &dto.BuildJobListDTO{Items: pods}
+	if len(pods) > limit {
+		result.Items = pods[:limit]
+		result.NextCursor = EncodePodCursor(models.NewPodCursor(pods[limit-1], q.SortBy))
+	}
+	return result, nil
+}
+
+// 游标对调用方是不透明的，用base64编码
+func EncodePodCursor(cursor *models.PodCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodePodCursor(s string) (*models.PodCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s", s)
+	}
+	cursor := &models.PodCursor{}
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor %s", s)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,314 @@
+package buildjob
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/astaxie/beego/orm"
+	"github.com/go-redis/redis"
+	_ "github.com/mattn/go-sqlite3"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+)
+
+var registerTestDB sync.Once
+
+func newTestBuildJobDTO() *dto.BuildJobDTO {
+	return &dto.BuildJobDTO{
+		RequestID:   "r1",
+		ClusterName: "test",
+		Name:        "agent-1",
+		Namespace:   "ci",
+		Labels:      []string{"linux", "docker"},
+		Containers: []*models.Container{
+			{
+				Name:       "jnlp",
+				Image:      "jenkins/inbound-agent:4.3",
+				CMDs:       "jenkins-agent,-url",
+				RequestCPU: "500m",
+				LimitCPU:   "1",
+				RequestMem: "512Mi",
+				LimitMem:   "1Gi",
+			},
+		},
+	}
+}
+
+// 使用sqlite内存数据库代替mysql，每个测试开始时清空所有表
+func newTestDB(t *testing.T) {
+	registerTestDB.Do(func() {
+		if err := orm.RegisterDataBase("default", "sqlite3", "file::memory:?cache=shared"); err != nil {
+			t.Fatalf("register database failed: %v", err)
+		}
+		orm.RegisterModel(new(models.Container), new(models.Pod), new(models.Request), new(models.Cluster), new(models.Schedule))
+		if err := orm.RunSyncdb("default", false, false); err != nil {
+			t.Fatalf("create tables failed: %v", err)
+		}
+	})
+	o := orm.NewOrm()
+	for _, table := range []string{"container", "pod", "request", "cluster", "schedule"} {
+		if _, err := o.Raw("delete from " + table).Exec(); err != nil {
+			t.Fatalf("clear table %s failed: %v", table, err)
+		}
+	}
+}
+
+// 启动一个进程内的redis，测试结束后恢复原来的客户端
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+	// 请求的全局查询只遍历实例a的缓存
+	cache.RegisterInstanceNameLister(func() ([]string, error) { return []string{"a"}, nil })
+	t.Cleanup(func() { cache.RegisterInstanceNameLister(cache.GetInstanceNameList) })
+	return s
+}
+
+func TestGetBuildJobStatus(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	if status, err := GetBuildJobStatus("agent-1"); err != nil || status != nil {
+		t.Fatalf("expect nil status for unknown build job, got %+v, err: %v", status, err)
+	}
+
+	// 正在处理的请求从redis中查询，带上处理请求的实例
+	request := &models.Request{
+		Name:         "agent-1",
+		Status:       common.RequestStatusExecuting,
+		RequestType:  common.BuildJobCreateRequestType,
+		InstanceName: "a",
+	}
+	if err := cache.AddRequest(request); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	status, err := GetBuildJobStatus("agent-1")
+	if err != nil || status == nil || status.RequestStatus != common.RequestStatusExecuting || status.InstanceName != "a" || status.PodStatus != "" {
+		t.Fatalf("expect executing request on a, got %+v, err: %v", status, err)
+	}
+
+	// 请求成功之后从redis中删除，只剩下pod的记录
+	if err = cache.DeleteRequest(request); err != nil {
+		t.Fatalf("delete cached request failed: %v", err)
+	}
+	if _, err = models.AddPod(&models.Pod{Name: "agent-1", Status: "Running", NodeIP: "10.0.0.1", IsDelete: "0"}); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	status, err = GetBuildJobStatus("agent-1")
+	if err != nil || status == nil || status.RequestStatus != common.RequestStatusSuccess || status.InstanceName != "" ||
+		status.PodStatus != "Running" || status.NodeIP != "10.0.0.1" {
+		t.Errorf("expect succeeded request with running pod, got %+v, err: %v", status, err)
+	}
+}
+
+func TestGetBuildJobStatusFailed(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	// 失败的请求落到mysql中，没有pod
+	request := &models.Request{
+		Name:        "agent-1",
+		Message:     "quota exceeded",
+		Status:      common.RequestStatusFailed,
+		RequestType: common.BuildJobCreateRequestType,
+	}
+	if _, err := models.AddRequest(request); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+	status, err := GetBuildJobStatus("agent-1")
+	if err != nil || status == nil || status.RequestStatus != common.RequestStatusFailed || status.Message != "quota exceeded" || status.PodStatus != "" {
+		t.Errorf("expect failed request without pod, got %+v, err: %v", status, err)
+	}
+}
+
+func TestGetBuildJobStatusDeleted(t *testing.T) {
+	newTestDB(t)
+	newTestRedis(t)
+	RegisterPodExecutor("a", NewSimulatedExecutor())
+	if _, err := models.AddPod(&models.Pod{Name: "agent-1", ClusterName: "a", Status: "Running", NodeIP: "10.0.0.1", IsDelete: "0"}); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	create := &models.Request{RequestID: "create-id", Name: "agent-1", Status: common.RequestStatusSuccess, RequestType: common.BuildJobCreateRequestType}
+	if _, err := models.AddRequest(create); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+
+	// 排队中的删除请求比已经成功的创建请求新
+	remove := &models.Request{RequestID: "delete-id", Name: "agent-1", Status: common.RequestStatusPending,
+		RequestType: common.BuildJobDeleteRequestType, InstanceName: "a"}
+	if _, err := models.AddRequest(remove); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+	if err := cache.AddRequest(remove); err != nil {
+		t.Fatalf("cache request failed: %v", err)
+	}
+	status, err := GetBuildJobStatus("agent-1")
+	if err != nil || status == nil || status.RequestID != "delete-id" || status.RequestStatus != common.RequestStatusPending ||
+		status.Deleted || status.PodStatus != "Running" {
+		t.Fatalf("expect pending delete of running pod, got %+v, err: %v", status, err)
+	}
+
+	// 删除完成后明确返回已经删除，不再返回删除前的pod状态
+	if err = DeletePod(context.TODO(), &dto.BuildJobDTO{Name: "agent-1"}); err != nil {
+		t.Fatalf("delete pod failed: %v", err)
+	}
+	remove.Status = common.RequestStatusSuccess
+	if err = cache.DeleteRequest(remove); err != nil {
+		t.Fatalf("delete cached request failed: %v", err)
+	}
+	if err = models.UpdateRequestStatus(remove); err != nil {
+		t.Fatalf("update request failed: %v", err)
+	}
+	status, err = GetBuildJobStatus("agent-1")
+	if err != nil || status == nil || status.RequestID != "delete-id" || status.RequestStatus != common.RequestStatusSuccess ||
+		!status.Deleted || status.PodStatus != "" || status.NodeIP != "" {
+		t.Errorf("expect deleted buildJob, got %+v, err: %v", status, err)
+	}
+}
+
+func TestDeletePod(t *testing.T) {
+	newTestDB(t)
+	RegisterPodExecutor("a", NewSimulatedExecutor())
+	if _, err := models.AddPod(&models.Pod{Name: "agent-1", ClusterName: "a", Status: "Running", IsDelete: "0"}); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	// 删除被其他实例接管后可能重复执行，第二次删除同样返回成功
+	for i := 0; i < 2; i++ {
+		if err := DeletePod(context.TODO(), &dto.BuildJobDTO{Name: "agent-1"}); err != nil {
+			t.Fatalf("delete pod failed: %v", err)
+		}
+	}
+	pod, err := models.GetPodByName("agent-1")
+	if err != nil || pod == nil || pod.IsDelete != "1" {
+		t.Errorf("expect pod to be marked deleted, got %+v, err: %v", pod, err)
+	}
+}
+
+func TestCreatePodIdempotent(t *testing.T) {
+	newTestDB(t)
+	RegisterPodExecutor("test", NewKubernetesExecutor(fake.NewClientset()))
+	// 请求被接管后重复执行，复用同一个请求创建的pod
+	for i := 0; i < 2; i++ {
+		if err := CreatePod(context.TODO(), newTestBuildJobDTO()); err != nil {
+			t.Fatalf("create pod failed: %v", err)
+		}
+	}
+	pod, err := models.GetPodByName("agent-1")
+	if err != nil || pod == nil || pod.RequestID != "r1" {
+		t.Fatalf("expect pod created by r1, got %+v, err: %v", pod, err)
+	}
+	// 其他请求不能复用同名的pod
+	other := newTestBuildJobDTO()
+	other.RequestID = "r2"
+	if err := CreatePod(context.TODO(), other); common.StatusCodeOf(err) != http.StatusConflict {
+		t.Errorf("expect conflict for pod created by another request, got %v", err)
+	}
+}
+
+func TestGetPodExecutor(t *testing.T) {
+	newTestDB(t)
+	if _, err := GetPodExecutor("prod-1"); common.StatusCodeOf(err) != http.StatusNotFound {
+		t.Fatalf("expect not found for unregistered cluster, got %v", err)
+	}
+	if _, err := models.AddCluster(&models.Cluster{Name: "prod-1", ExecutorType: "simulated"}); err != nil {
+		t.Fatalf("add cluster failed: %v", err)
+	}
+	// 被禁用的集群依然可以获取执行器，配置没有变化时复用缓存的执行器
+	executor, err := GetPodExecutor("prod-1")
+	if err != nil {
+		t.Fatalf("get executor failed: %v", err)
+	}
+	if cached, err := GetPodExecutor("prod-1"); err != nil || cached != executor {
+		t.Errorf("expect cached executor, got %v, err: %v", cached, err)
+	}
+	InvalidatePodExecutor("prod-1")
+}
+
+// 按页读取所有构建任务的名字，每一页都通过游标的编码和解码衔接
+func listAllBuildJobs(t *testing.T, q *models.PodQuery) [][]string {
+	pages := make([][]string, 0)
+	for {
+		result, err := ListBuildJobs(q)
+		if err != nil {
+			t.Fatalf("list buildJobs failed: %v", err)
+		}
+		names := make([]string, 0, len(result.Items))
+		for _, pod := range result.Items {
+			names = append(names, pod.Name)
+		}
+		pages = append(pages, names)
+		if result.NextCursor == "" {
+			return pages
+		}
+		if q.Cursor, err = DecodePodCursor(result.NextCursor); err != nil {
+			t.Fatalf("decode cursor failed: %v", err)
+		}
+	}
+}
+
+func TestListBuildJobs(t *testing.T) {
+	newTestDB(t)
+	pods := []*models.Pod{
+		{Name: "agent-3", ClusterName: "a", Namespace: "ci", Status: "Running", IsDelete: "0"},
+		{Name: "agent-1", ClusterName: "a", Namespace: "ci", Status: "Pending", IsDelete: "0"},
+		{Name: "agent-4", ClusterName: "a", Namespace: "ci", Status: "Running", IsDelete: "0"},
+		{Name: "agent-2", ClusterName: "a", Namespace: "ci", Status: "Running", IsDelete: "0",
+			Containers: []*models.Container{{Name: "jnlp", Image: "jenkins/inbound-agent:4.3"}}},
+		{Name: "agent-5", ClusterName: "b", Namespace: "ci", Status: "Running", IsDelete: "0"},
+		{Name: "agent-6", ClusterName: "a", Namespace: "ci", Status: "Running", IsDelete: "1"},
+	}
+	for _, pod := range pods {
+		if _, err := models.AddPod(pod); err != nil {
+			t.Fatalf("add pod failed: %v", err)
+		}
+	}
+	cases := []struct {
+		desc  string
+		q     *models.PodQuery
+		pages string
+	}{
+		{"by id", &models.PodQuery{SortBy: "id", Limit: 3}, "agent-3,agent-1,agent-4|agent-2,agent-5"},
+		{"by name desc", &models.PodQuery{SortBy: "name", Desc: true, Limit: 2}, "agent-5,agent-4|agent-3,agent-2|agent-1"},
+		{"cluster and status", &models.PodQuery{ClusterName: "a", Status: "Running", SortBy: "name", Limit: 2}, "agent-2,agent-3|agent-4"},
+		{"include deleted", &models.PodQuery{ClusterName: "a", IncludeDeleted: true, SortBy: "name", Desc: true, Limit: 10}, "agent-6,agent-4,agent-3,agent-2,agent-1"},
+		{"empty", &models.PodQuery{Namespace: "release", SortBy: "id", Limit: 10}, ""},
+	}
+	for _, c := range cases {
+		pages := make([]string, 0)
+		for _, names := range listAllBuildJobs(t, c.q) {
+			pages = append(pages, strings.Join(names, ","))
+		}
+		if got := strings.Join(pages, "|"); got != c.pages {
+			t.Errorf("%s: expect pages %s, got %s", c.desc, c.pages, got)
+		}
+	}
+
+	// 只有要求展开时才加载containers
+	result, err := ListBuildJobs(&models.PodQuery{Status: "Running", ClusterName: "a", SortBy: "name", Limit: 1, WithContainers: true})
+	if err != nil || len(result.Items) != 1 || len(result.Items[0].Containers) != 1 || result.Items[0].Containers[0].Name != "jnlp" {
+		t.Errorf("expect agent-2 with its containers, got %+v, err: %v", result, err)
+	}
+}
+
+func TestDecodePodCursor(t *testing.T) {
+	cursor := &models.PodCursor{SortValue: "agent-1", ID: 7}
+	decoded, err := DecodePodCursor(EncodePodCursor(cursor))
+	if err != nil || *decoded != *cursor {
+		t.Errorf("expect cursor %+v, got %+v, err: %v", cursor, decoded, err)
+	}
+	for _, s := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err = DecodePodCursor(s); err == nil {
+			t.Errorf("expect error for invalid cursor %s", s)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package buildjob
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/cluster"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/sirupsen/logrus"
+)
+
+// pod执行器，负责在集群中真正创建和删除pod
+// 实现需要保证幂等，请求被其他实例接管后会重复执行
+type PodExecutor interface {
+	// 创建pod，pod已经存在时直接返回当前的状态
+	CreatePod(ctx context.Context, buildJobDTO *dto.BuildJobDTO) (*PodState, error)
+	// 删除pod，pod不存在时返回成功
+	DeletePod(ctx context.Context, namespace string, name string) error
+}
+
+// 可选接口，执行器实现它来报告集群的健康状态，选择集群时会过滤掉不健康的集群
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// 可选接口，执行器实现它来监听集群中pod的变化，reconciler用它把pod状态同步回mysql
+type PodWatcher interface {
+	// 监听本服务创建的pod，pod或者pod的事件发生变化时调用handler，阻塞直到ctx结束
+	WatchPods(ctx context.Context, handler PodEventHandler) error
+}
+
+type PodEventHandler func(update *PodStatusUpdate)
+
+// 集群中pod的变化，字段为空表示没有变化
+type PodStatusUpdate struct {
+	Namespace       string
+	Name            string
+	Status          string
+	NodeIP          string
+	Message         string
+	ContainerStates map[string]string // 容器名 -> 状态
+	Deleted         bool              // pod已经从集群中删除
+}
+
+// 执行器返回的pod状态，会回写到mysql的pod表中
+type PodState struct {
+	Status  string
+	NodeIP  string
+	Message string
+}
+
+// 缓存的执行器，集群配置更新后需要重新创建
+type executorEntry struct {
+	executor    PodExecutor
+	gmtModified time.Time
+}
+
+var (
+	executorLock       sync.Mutex
+	executors          = make(map[string]*executorEntry) // 集群名 -> 根据集群注册信息创建的执行器
+	registeredExecutor = make(map[string]PodExecutor)    // 集群名 -> 手动注册的执行器
+)
+
+// 手动注册某个集群的执行器，优先级高于集群注册信息，主要用于测试和本地开发
+func RegisterPodExecutor(clusterName string, executor PodExecutor) {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	registeredExecutor[clusterName] = executor
+}
+
+// 获取集群对应的执行器，根据集群注册信息创建并缓存，集群配置更新后重新创建
+// 被禁用的集群依然可以获取执行器，用于删除已经存在的pod
+func GetPodExecutor(clusterName string) (PodExecutor, error) {
+	executorLock.Lock()
+	executor, ok := registeredExecutor[clusterName]
+	executorLock.Unlock()
+	if ok {
+		return executor, nil
+	}
+	c, err := cluster.GetCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	if entry, ok := executors[clusterName]; ok && entry.gmtModified.Equal(c.GmtModified) {
+		return entry.executor, nil
+	}
+	executor, err = newPodExecutor(c)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("INFO: create %s executor for cluster %s", c.ExecutorType, clusterName)
+	executors[clusterName] = &executorEntry{executor: executor, gmtModified: c.GmtModified}
+	return executor, nil
+}
+
+// 删除缓存的执行器，集群被删除时调用
+func InvalidatePodExecutor(clusterName string) {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	delete(executors, clusterName)
+}
+
+func newPodExecutor(c *models.Cluster) (PodExecutor, error) {
+	switch c.ExecutorType {
+	case cluster.KubernetesExecutorType:
+		return NewKubernetesExecutorFromCluster(c.APIEndpoint, c.CredentialsRef)
+	case cluster.SimulatedExecutorType:
+		return NewSimulatedExecutor(), nil
+	default:
+		return nil, fmt.Errorf("invalid executor type %s of cluster %s", c.ExecutorType, c.Name)
+	}
+}
@@ -0,0 +1,276 @@
+package buildjob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	ManagedByLabelKey   = "app.kubernetes.io/managed-by"
+	ManagedByLabelValue = "kbuildresource"
+	BuildJobLabelKey    = "kbuildresource/buildjob"
+	RequestIDLabelKey   = "kbuildresource/request-id" // 创建pod的请求ID，同一个请求重复执行时复用pod
+	// 构建任务的标签是jenkins slave的标签，不满足kubernetes label的格式，放在annotation中
+	LabelsAnnotationKey = "kbuildresource/labels"
+
+	podResyncPeriod = 10 * time.Minute // 定期全量同步，避免漏掉事件
+)
+
+// 基于client-go在kubernetes集群中创建pod
+type kubernetesExecutor struct {
+	clientset kubernetes.Interface
+}
+
+func NewKubernetesExecutor(clientset kubernetes.Interface) PodExecutor {
+	return &kubernetesExecutor{clientset: clientset}
+}
+
+// 根据集群注册信息创建执行器，apiEndpoint和kubeconfig都为空时使用in-cluster配置
+func NewKubernetesExecutorFromCluster(apiEndpoint string, kubeconfig string) (PodExecutor, error) {
+	config, err := clientcmd.BuildConfigFromFlags(apiEndpoint, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewKubernetesExecutor(clientset), nil
+}
+
+func (k *kubernetesExecutor) CreatePod(ctx context.Context, buildJobDTO *dto.BuildJobDTO) (*PodState, error) {
+	pod, err := buildPodFromBuildJobDTO(buildJobDTO)
+	if err != nil {
+		return nil, err
+	}
+	created, err := k.clientset.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// 请求被接管后重复执行，pod已经创建过了；不是同一个请求创建的pod不能复用
+		logrus.Infof("INFO: pod %s/%s already exists", pod.Namespace, pod.Name)
+		created, err = k.clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err == nil && (buildJobDTO.RequestID == "" || created.Labels[RequestIDLabelKey] != buildJobDTO.RequestID) {
+			return nil, common.NewConflictError("pod %s/%s already exists and was not created by request %s", pod.Namespace, pod.Name, buildJobDTO.RequestID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return podStateOf(created), nil
+}
+
+func (k *kubernetesExecutor) DeletePod(ctx context.Context, namespace string, name string) error {
+	err := k.clientset.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// 通过查询apiserver的版本判断集群是否可以访问
+func (k *kubernetesExecutor) CheckHealth(ctx context.Context) error {
+	_, err := k.clientset.Discovery().ServerVersion()
+	return err
+}
+
+// 通过informer监听本服务创建的pod以及pod的事件
+func (k *kubernetesExecutor) WatchPods(ctx context.Context, handler PodEventHandler) error {
+	podFactory := informers.NewSharedInformerFactoryWithOptions(k.clientset, podResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = ManagedByLabelKey + "=" + ManagedByLabelValue
+		}))
+	podInformer := podFactory.Core().V1().Pods().Informer()
+	podLister := podFactory.Core().V1().Pods().Lister()
+	// 标签选择器之外再按标签过滤一次，不是所有的watch实现都会按选择器过滤
+	_, err := podInformer.AddEventHandler(toolscache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*corev1.Pod)
+			return ok && pod.Labels[ManagedByLabelKey] == ManagedByLabelValue
+		},
+		Handler: toolscache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if pod, ok := obj.(*corev1.Pod); ok {
+					handler(podStatusUpdateOf(pod))
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if pod, ok := newObj.(*corev1.Pod); ok {
+					handler(podStatusUpdateOf(pod))
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if pod, ok := obj.(*corev1.Pod); ok {
+					handler(&PodStatusUpdate{Namespace: pod.Namespace, Name: pod.Name, Deleted: true})
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// 事件没有pod的标签，只处理本服务创建的pod的事件
+	eventFactory := informers.NewSharedInformerFactoryWithOptions(k.clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = "involvedObject.kind=Pod"
+		}))
+	eventInformer := eventFactory.Core().V1().Events().Informer()
+	onEvent := func(obj interface{}) {
+		event, ok := obj.(*corev1.Event)
+		if !ok || event.InvolvedObject.Kind != "Pod" {
+			return
+		}
+		if _, err := podLister.Pods(event.InvolvedObject.Namespace).Get(event.InvolvedObject.Name); err != nil {
+			return
+		}
+		handler(&PodStatusUpdate{
+			Namespace: event.InvolvedObject.Namespace,
+			Name:      event.InvolvedObject.Name,
+			Message:   event.Reason + ": " + event.Message,
+		})
+	}
+	_, err = eventInformer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: onEvent,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onEvent(newObj)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	podFactory.Start(ctx.Done())
+	eventFactory.Start(ctx.Done())
+	defer podFactory.Shutdown()
+	defer eventFactory.Shutdown()
+	if !toolscache.WaitForCacheSync(ctx.Done(), podInformer.HasSynced, eventInformer.HasSynced) {
+		return fmt.Errorf("wait for informer cache sync failed")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func podStatusUpdateOf(pod *corev1.Pod) *PodStatusUpdate {
+	state := podStateOf(pod)
+	update := &PodStatusUpdate{
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		Status:          state.Status,
+		NodeIP:          state.NodeIP,
+		Message:         state.Message,
+		ContainerStates: make(map[string]string, len(pod.Status.ContainerStatuses)),
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		update.ContainerStates[status.Name] = containerStateOf(status.State)
+	}
+	return update
+}
+
+func containerStateOf(state corev1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return "Running"
+	case state.Terminated != nil:
+		return fmt.Sprintf("Terminated: %s (exit code %d)", state.Terminated.Reason, state.Terminated.ExitCode)
+	case state.Waiting != nil:
+		return "Waiting: " + state.Waiting.Reason
+	default:
+		return "Unknown"
+	}
+}
+
+// 把构建任务转换成kubernetes的pod
+func buildPodFromBuildJobDTO(buildJobDTO *dto.BuildJobDTO) (*corev1.Pod, error) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      buildJobDTO.Name,
+			Namespace: buildJobDTO.Namespace,
+			Labels: map[string]string{
+				ManagedByLabelKey: ManagedByLabelValue,
+				BuildJobLabelKey:  buildJobDTO.Name,
+				RequestIDLabelKey: buildJobDTO.RequestID,
+			},
+			Annotations: map[string]string{
+				LabelsAnnotationKey: strings.Join(buildJobDTO.Labels, ","),
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+		},
+	}
+	for _, c := range buildJobDTO.Containers {
+		container, err := buildContainer(c)
+		if err != nil {
+			return nil, err
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod, nil
+}
+
+func buildContainer(c *models.Container) (corev1.Container, error) {
+	container := corev1.Container{
+		Name:  c.Name,
+		Image: c.Image,
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{},
+			Limits:   corev1.ResourceList{},
+		},
+	}
+	if c.CMDs != "" {
+		container.Command = strings.Split(c.CMDs, ",")
+	}
+	quantities := []struct {
+		value string
+		name  corev1.ResourceName
+		list  corev1.ResourceList
+	}{
+		{c.RequestCPU, corev1.ResourceCPU, container.Resources.Requests},
+		{c.RequestMem, corev1.ResourceMemory, container.Resources.Requests},
+		{c.LimitCPU, corev1.ResourceCPU, container.Resources.Limits},
+		{c.LimitMem, corev1.ResourceMemory, container.Resources.Limits},
+	}
+	for _, q := range quantities {
+		if q.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return container, err
+		}
+		q.list[q.name] = quantity
+	}
+	return container, nil
+}
+
+func podStateOf(pod *corev1.Pod) *PodState {
+	state := &PodState{
+		Status:  string(pod.Status.Phase),
+		NodeIP:  pod.Status.HostIP,
+		Message: pod.Status.Message,
+	}
+	if state.Status == "" {
+		state.Status = string(corev1.PodPending)
+	}
+	return state
+}
@@ -0,0 +1,173 @@
+package buildjob
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"bryson.foundation/kbuildresource/common"
+)
+
+// fake clientset在list和watch之间发生的变化会丢失，测试需要等pod的watch建立之后再修改pod
+func podWatchStarted(clientset *fake.Clientset) <-chan struct{} {
+	started := make(chan struct{})
+	var once sync.Once
+	clientset.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return false, nil, err
+		}
+		once.Do(func() { close(started) })
+		return true, w, nil
+	})
+	return started
+}
+
+func TestKubernetesExecutorCreatePod(t *testing.T) {
+	clientset := fake.NewClientset()
+	executor := NewKubernetesExecutor(clientset)
+
+	state, err := executor.CreatePod(context.TODO(), newTestBuildJobDTO())
+	if err != nil {
+		t.Fatalf("create pod failed: %v", err)
+	}
+	if state.Status != string(corev1.PodPending) {
+		t.Errorf("expect status Pending, got %s", state.Status)
+	}
+
+	pod, err := clientset.CoreV1().Pods("ci").Get(context.TODO(), "agent-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get pod failed: %v", err)
+	}
+	if pod.Labels[ManagedByLabelKey] != ManagedByLabelValue || pod.Labels[BuildJobLabelKey] != "agent-1" {
+		t.Errorf("unexpected labels %v", pod.Labels)
+	}
+	if pod.Annotations[LabelsAnnotationKey] != "linux,docker" {
+		t.Errorf("unexpected annotations %v", pod.Annotations)
+	}
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("expect restartPolicy Never, got %s", pod.Spec.RestartPolicy)
+	}
+	if len(pod.Spec.Containers) != 1 {
+		t.Fatalf("expect 1 container, got %d", len(pod.Spec.Containers))
+	}
+	container := pod.Spec.Containers[0]
+	if container.Image != "jenkins/inbound-agent:4.3" || len(container.Command) != 2 {
+		t.Errorf("unexpected container %v", container)
+	}
+	if cpu := container.Resources.Requests[corev1.ResourceCPU]; cpu.String() != "500m" {
+		t.Errorf("expect request cpu 500m, got %s", cpu.String())
+	}
+	if mem := container.Resources.Limits[corev1.ResourceMemory]; mem.String() != "1Gi" {
+		t.Errorf("expect limit memory 1Gi, got %s", mem.String())
+	}
+}
+
+func TestKubernetesExecutorCreatePodAlreadyExists(t *testing.T) {
+	existed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: "ci", Labels: map[string]string{RequestIDLabelKey: "r1"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, HostIP: "10.0.0.1"},
+	}
+	executor := NewKubernetesExecutor(fake.NewClientset(existed))
+
+	// 同一个请求重复执行，复用已经创建的pod
+	state, err := executor.CreatePod(context.TODO(), newTestBuildJobDTO())
+	if err != nil {
+		t.Fatalf("create existed pod should succeed, got %v", err)
+	}
+	if state.Status != string(corev1.PodRunning) || state.NodeIP != "10.0.0.1" {
+		t.Errorf("expect state of existed pod, got %+v", state)
+	}
+	// 其他请求创建的同名pod不能复用
+	other := newTestBuildJobDTO()
+	other.RequestID = "r2"
+	if _, err = executor.CreatePod(context.TODO(), other); common.StatusCodeOf(err) != http.StatusConflict {
+		t.Errorf("expect conflict for pod created by another request, got %v", err)
+	}
+}
+
+func TestKubernetesExecutorDeletePod(t *testing.T) {
+	clientset := fake.NewClientset()
+	executor := NewKubernetesExecutor(clientset)
+	if _, err := executor.CreatePod(context.TODO(), newTestBuildJobDTO()); err != nil {
+		t.Fatalf("create pod failed: %v", err)
+	}
+
+	if err := executor.DeletePod(context.TODO(), "ci", "agent-1"); err != nil {
+		t.Fatalf("delete pod failed: %v", err)
+	}
+	pods, err := clientset.CoreV1().Pods("ci").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list pods failed: %v", err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("expect no pods, got %d", len(pods.Items))
+	}
+	// 重复删除不报错
+	if err := executor.DeletePod(context.TODO(), "ci", "agent-1"); err != nil {
+		t.Errorf("delete not existed pod should succeed, got %v", err)
+	}
+}
+
+func TestKubernetesExecutorWatchPods(t *testing.T) {
+	clientset := fake.NewClientset()
+	executor := NewKubernetesExecutor(clientset)
+	started := podWatchStarted(clientset)
+	updates := make(chan *PodStatusUpdate, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go executor.(PodWatcher).WatchPods(ctx, func(update *PodStatusUpdate) {
+		updates <- update
+	})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for pod watch timeout")
+	}
+
+	if _, err := executor.CreatePod(context.TODO(), newTestBuildJobDTO()); err != nil {
+		t.Fatalf("create pod failed: %v", err)
+	}
+	// 不是本服务创建的pod不需要处理
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "ci"}}
+	if _, err := clientset.CoreV1().Pods("ci").Create(context.TODO(), other, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create pod failed: %v", err)
+	}
+
+	select {
+	case update := <-updates:
+		if update.Name != "agent-1" || update.Status != string(corev1.PodPending) {
+			t.Errorf("unexpected update %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for pod update timeout")
+	}
+
+	pod, _ := clientset.CoreV1().Pods("ci").Get(context.TODO(), "agent-1", metav1.GetOptions{})
+	pod.Status = corev1.PodStatus{
+		Phase:  corev1.PodRunning,
+		HostIP: "10.0.0.2",
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "jnlp", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		},
+	}
+	if _, err := clientset.CoreV1().Pods("ci").UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update pod status failed: %v", err)
+	}
+	select {
+	case update := <-updates:
+		if update.Status != string(corev1.PodRunning) || update.NodeIP != "10.0.0.2" || update.ContainerStates["jnlp"] != "Running" {
+			t.Errorf("unexpected update %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for pod update timeout")
+	}
+}
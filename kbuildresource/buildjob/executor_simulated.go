@@ -0,0 +1,52 @@
+package buildjob
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/dto"
+)
+
+const simulatedCreateDelay = 1 * time.Second // 模拟创建pod的耗时
+
+// 模拟的执行器，不依赖真实集群，用于本地开发
+type simulatedExecutor struct {
+	lock sync.Mutex
+	pods map[string]*PodState // namespace/name -> 状态
+}
+
+func NewSimulatedExecutor() PodExecutor {
+	return &simulatedExecutor{pods: make(map[string]*PodState)}
+}
+
+func (s *simulatedExecutor) CreatePod(ctx context.Context, buildJobDTO *dto.BuildJobDTO) (*PodState, error) {
+	key := buildJobDTO.Namespace + "/" + buildJobDTO.Name
+	s.lock.Lock()
+	state, ok := s.pods[key]
+	s.lock.Unlock()
+	if ok {
+		return state, nil
+	}
+	select {
+	case <-time.After(simulatedCreateDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	state = &PodState{
+		Status:  "Running",
+		NodeIP:  "127.0.0.1",
+		Message: "simulated pod",
+	}
+	s.lock.Lock()
+	s.pods[key] = state
+	s.lock.Unlock()
+	return state, nil
+}
+
+func (s *simulatedExecutor) DeletePod(ctx context.Context, namespace string, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pods, namespace+"/"+name)
+	return nil
+}
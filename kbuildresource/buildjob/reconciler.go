@@ -0,0 +1,181 @@
+package buildjob
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	reconcileInterval  = 30 * time.Second // 同步集群列表的间隔
+	watchRetryInterval = 10 * time.Second // 监听失败后重试的间隔
+)
+
+// 监听各个集群中pod的变化，把pod的状态、节点ip、容器状态和最新的事件信息回写到mysql
+// 多个实例只需要一个实例运行，由选主选出的master调用Start，失去master身份时调用Stop
+type PodReconciler struct {
+	lock    sync.Mutex
+	cancel  context.CancelFunc       // 不为nil表示正在运行
+	watches map[string]*clusterWatch // 集群名 -> 正在进行的监听
+}
+
+type clusterWatch struct {
+	executor PodExecutor
+	cancel   context.CancelFunc
+}
+
+func NewPodReconciler() *PodReconciler {
+	return &PodReconciler{
+		watches: make(map[string]*clusterWatch),
+	}
+}
+
+// 开始监听，不阻塞，重复调用没有影响；ctx被取消或者调用Stop时停止监听
+func (r *PodReconciler) Start(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	logrus.Info("INFO: start pod reconciler")
+	go r.run(ctx)
+}
+
+// 停止所有集群的监听
+func (r *PodReconciler) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.cancel = nil
+	for clusterName, watch := range r.watches {
+		watch.cancel()
+		delete(r.watches, clusterName)
+	}
+	logrus.Info("INFO: stop pod reconciler")
+}
+
+func (r *PodReconciler) run(ctx context.Context) {
+	t := time.NewTicker(reconcileInterval)
+	defer t.Stop()
+	for {
+		r.syncClusters(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// 根据集群注册信息启动或者停止监听，集群配置更新导致执行器变化时重新监听
+func (r *PodReconciler) syncClusters(ctx context.Context) {
+	clusters, err := models.ListClusters()
+	if err != nil {
+		logrus.Error("ERROR: list clusters failed, error: ", err)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	expected := make(map[string]PodExecutor, len(clusters))
+	for _, c := range clusters {
+		executor, err := GetPodExecutor(c.Name)
+		if err != nil {
+			logrus.Errorf("ERROR: get executor of cluster %s failed, error: %v", c.Name, err)
+			continue
+		}
+		if _, ok := executor.(PodWatcher); !ok {
+			continue
+		}
+		expected[c.Name] = executor
+	}
+	for clusterName, watch := range r.watches {
+		if executor, ok := expected[clusterName]; !ok || executor != watch.executor {
+			logrus.Infof("INFO: stop watching pods of cluster %s", clusterName)
+			watch.cancel()
+			delete(r.watches, clusterName)
+		}
+	}
+	for clusterName, executor := range expected {
+		if _, ok := r.watches[clusterName]; ok {
+			continue
+		}
+		watchCtx, cancel := context.WithCancel(ctx)
+		r.watches[clusterName] = &clusterWatch{executor: executor, cancel: cancel}
+		logrus.Infof("INFO: start watching pods of cluster %s", clusterName)
+		go r.watch(watchCtx, clusterName, executor.(PodWatcher))
+	}
+}
+
+// 监听一个集群，出错后等待一段时间重试，直到ctx结束
+func (r *PodReconciler) watch(ctx context.Context, clusterName string, watcher PodWatcher) {
+	handler := func(update *PodStatusUpdate) {
+		if err := r.handle(clusterName, update); err != nil {
+			logrus.Errorf("ERROR: reconcile pod %s/%s of cluster %s failed, error: %v",
+				update.Namespace, update.Name, clusterName, err)
+		}
+	}
+	for {
+		err := watcher.WatchPods(ctx, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Errorf("ERROR: watch pods of cluster %s failed, error: %v", clusterName, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// 把集群中pod的变化回写到mysql，mysql中不存在或者已经删除的pod忽略
+func (r *PodReconciler) handle(clusterName string, update *PodStatusUpdate) error {
+	pod, err := models.GetActivePod(clusterName, update.Namespace, update.Name)
+	if err != nil {
+		return err
+	}
+	if pod == nil {
+		return nil
+	}
+	if update.Deleted {
+		// pod在集群中被删除，但是构建任务还没有删除，标记出来方便排查
+		pod.Status = "Deleted"
+		pod.Message = "pod has been deleted from cluster"
+		return models.UpdatePodStatus(pod)
+	}
+	changed := false
+	if update.Status != "" && update.Status != pod.Status {
+		pod.Status = update.Status
+		changed = true
+	}
+	if update.NodeIP != "" && update.NodeIP != pod.NodeIP {
+		pod.NodeIP = update.NodeIP
+		changed = true
+	}
+	if update.Message != "" && update.Message != pod.Message {
+		pod.Message = update.Message
+		changed = true
+	}
+	if changed {
+		if err = models.UpdatePodStatus(pod); err != nil {
+			return err
+		}
+	}
+	for containerName, state := range update.ContainerStates {
+		if err = models.UpdateContainerState(pod.ID, containerName, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package buildjob
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"bryson.foundation/kbuildresource/models"
+)
+
+func addTestActivePod(t *testing.T, clusterName string) *models.Pod {
+	pod := &models.Pod{
+		Name:        "agent-1",
+		ClusterName: clusterName,
+		Namespace:   "ci",
+		Status:      "Pending",
+		IsDelete:    "0",
+		Containers:  []*models.Container{{Name: "jnlp", Image: "jenkins/inbound-agent:4.3"}},
+	}
+	if _, err := models.AddPod(pod); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	return pod
+}
+
+func storedContainerState(t *testing.T, podID int, name string) string {
+	var state string
+	err := orm.NewOrm().Raw("select state from container where pod_id = ? and name = ?", podID, name).QueryRow(&state)
+	if err != nil {
+		t.Fatalf("query container state failed: %v", err)
+	}
+	return state
+}
+
+func TestPodReconcilerHandle(t *testing.T) {
+	newTestDB(t)
+	pod := addTestActivePod(t, "a")
+	r := NewPodReconciler()
+
+	update := &PodStatusUpdate{Namespace: "ci", Name: "agent-1", Status: "Running", NodeIP: "10.0.0.2",
+		ContainerStates: map[string]string{"jnlp": "Running"}}
+	if err := r.handle("a", update); err != nil {
+		t.Fatalf("handle update failed: %v", err)
+	}
+	stored, err := models.GetActivePod("a", "ci", "agent-1")
+	if err != nil || stored == nil || stored.Status != "Running" || stored.NodeIP != "10.0.0.2" {
+		t.Fatalf("expect running pod on 10.0.0.2, got %+v, err: %v", stored, err)
+	}
+	if state := storedContainerState(t, pod.ID, "jnlp"); state != "Running" {
+		t.Errorf("expect container state Running, got %s", state)
+	}
+
+	// 其他集群中同名的pod不影响mysql中的记录
+	if err = r.handle("b", &PodStatusUpdate{Namespace: "ci", Name: "agent-1", Status: "Failed"}); err != nil {
+		t.Fatalf("handle update failed: %v", err)
+	}
+	// 构建任务还没有删除时pod被删除，标记出来
+	if err = r.handle("a", &PodStatusUpdate{Namespace: "ci", Name: "agent-1", Deleted: true}); err != nil {
+		t.Fatalf("handle update failed: %v", err)
+	}
+	stored, err = models.GetActivePod("a", "ci", "agent-1")
+	if err != nil || stored == nil || stored.Status != "Deleted" || stored.IsDelete != "0" {
+		t.Errorf("expect pod to be marked as deleted from cluster, got %+v, err: %v", stored, err)
+	}
+}
+
+func TestPodReconciler(t *testing.T) {
+	newTestDB(t)
+	clientset := fake.NewClientset()
+	started := podWatchStarted(clientset)
+	executor := NewKubernetesExecutor(clientset)
+	RegisterPodExecutor("reconcile-1", executor)
+	if _, err := models.AddCluster(&models.Cluster{Name: "reconcile-1", ExecutorType: "kubernetes", Enabled: true}); err != nil {
+		t.Fatalf("add cluster failed: %v", err)
+	}
+	addTestActivePod(t, "reconcile-1")
+
+	r := NewPodReconciler()
+	r.Start(context.Background())
+	defer r.Stop()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for pod watch timeout")
+	}
+	buildJobDTO := newTestBuildJobDTO()
+	buildJobDTO.ClusterName = "reconcile-1"
+	if _, err := executor.CreatePod(context.TODO(), buildJobDTO); err != nil {
+		t.Fatalf("create pod failed: %v", err)
+	}
+	pod, err := clientset.CoreV1().Pods("ci").Get(context.TODO(), "agent-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get pod failed: %v", err)
+	}
+	pod.Status = corev1.PodStatus{Phase: corev1.PodRunning, HostIP: "10.0.0.3"}
+	if _, err = clientset.CoreV1().Pods("ci").UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update pod status failed: %v", err)
+	}
+
+	// 集群中pod的状态最终同步到mysql
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored, err := models.GetActivePod("reconcile-1", "ci", "agent-1")
+		if err == nil && stored != nil && stored.Status == "Running" && stored.NodeIP == "10.0.0.3" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect pod status to be reconciled, got %+v, err: %v", stored, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
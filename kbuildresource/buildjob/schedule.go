@@ -0,0 +1,185 @@
+package buildjob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	scheduleCheckInterval = 10 * time.Second // 检查到期计划的间隔
+	maxScheduleNameLength = 128              // 计划名的最大长度
+)
+
+// 提交一次计划触发的构建任务，idempotencyKey保证同一次触发只会受理一次
+type ScheduleSubmitter func(ctx context.Context, buildJobDTO *dto.BuildJobDTO, idempotencyKey string) (string, error)
+
+// 创建周期性的构建任务计划，第一次触发的时间是notBefore（不指定时为现在）之后的第一个cron时间点
+func CreateSchedule(buildJobDTO *dto.BuildJobDTO) (*models.Schedule, error) {
+	err := VerifyBuildJobDTO(buildJobDTO)
+	if err != nil {
+		return nil, err
+	}
+	existed, err := models.GetScheduleByName(buildJobDTO.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existed != nil {
+		return nil, common.NewConflictError("schedule %s already exists", buildJobDTO.Name)
+	}
+	schedule, err := cron.ParseStandard(buildJobDTO.Cron)
+	if err != nil {
+		return nil, common.NewBadRequestError("invalid cron %s, err: %v", buildJobDTO.Cron, err)
+	}
+	start := time.Now()
+	if buildJobDTO.NotBefore != nil && buildJobDTO.NotBefore.After(start) {
+		start = *buildJobDTO.NotBefore
+	}
+	// 每次触发的构建任务使用固定的名字，不再重新命名，也不再延迟
+	buildJobDTO.ReName = false
+	buildJobDTO.NotBefore = nil
+	data, err := json.Marshal(buildJobDTO)
+	if err != nil {
+		return nil, err
+	}
+	m := &models.Schedule{
+		Name:       buildJobDTO.Name,
+		Cron:       buildJobDTO.Cron,
+		Namespace:  buildJobDTO.Namespace,
+		RequestDTO: string(data),
+		NextRunAt:  schedule.Next(start),
+	}
+	_, err = models.AddSchedule(m)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("INFO: create schedule %s with cron %s, next run at %v", m.Name, m.Cron, m.NextRunAt)
+	return m, nil
+}
+
+// 删除计划，已经触发的构建任务不受影响
+func DeleteSchedule(id int) error {
+	m, err := models.GetScheduleByID(id)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return common.NewNotFoundError("schedule %d not found", id)
+	}
+	return models.DeleteSchedule(id)
+}
+
+// 按照计划触发构建任务，多个实例只需要一个实例运行，由选主选出的master调用Start，失去master身份时调用Stop
+// 每次触发先以 计划ID-触发时间 为幂等键提交，再通过比较next_run_at更新下一次触发的时间：
+// master切换时新的master重复提交同一次触发也只会受理一次，整个集群每次触发只创建一个构建任务
+type ScheduleRunner struct {
+	lock   sync.Mutex
+	cancel context.CancelFunc // 不为nil表示正在运行
+	submit ScheduleSubmitter
+}
+
+func NewScheduleRunner(submit ScheduleSubmitter) *ScheduleRunner {
+	return &ScheduleRunner{submit: submit}
+}
+
+// 开始触发计划，不阻塞，重复调用没有影响；ctx被取消或者调用Stop时停止触发
+func (r *ScheduleRunner) Start(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	logrus.Info("INFO: start schedule runner")
+	go r.run(ctx)
+}
+
+func (r *ScheduleRunner) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.cancel = nil
+	logrus.Info("INFO: stop schedule runner")
+}
+
+func (r *ScheduleRunner) run(ctx context.Context) {
+	t := time.NewTicker(scheduleCheckInterval)
+	defer t.Stop()
+	for {
+		r.runDueSchedules(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (r *ScheduleRunner) runDueSchedules(ctx context.Context) {
+	now := time.Now()
+	schedules, err := models.ListDueSchedules(now)
+	if err != nil {
+		logrus.Error("ERROR: list due schedules failed, err: ", err)
+		return
+	}
+	for _, schedule := range schedules {
+		if ctx.Err() != nil {
+			return
+		}
+		err = r.runSchedule(ctx, schedule, now)
+		if err != nil {
+			logrus.Errorf("ERROR: run schedule %s failed, err: %v", schedule.Name, err)
+		}
+	}
+}
+
+// 触发一次计划；过载等可以重试的错误下次再触发，参数错误等永久错误记录下来，跳过这一次触发
+// 错过的多次触发只补一次，下一次触发的时间是现在之后的第一个cron时间点
+func (r *ScheduleRunner) runSchedule(ctx context.Context, m *models.Schedule, now time.Time) error {
+	schedule, err := cron.ParseStandard(m.Cron)
+	if err != nil {
+		return err
+	}
+	runAt := m.NextRunAt
+	buildJobDTO := &dto.BuildJobDTO{}
+	err = json.Unmarshal([]byte(m.RequestDTO), buildJobDTO)
+	if err != nil {
+		return err
+	}
+	buildJobDTO.Name = fmt.Sprintf("%s-%d", m.Name, runAt.Unix())
+	buildJobDTO.Cron = ""
+	idempotencyKey := fmt.Sprintf("schedule-%d-%d", m.ID, runAt.Unix())
+	requestID, err := r.submit(ctx, buildJobDTO, idempotencyKey)
+	if err != nil {
+		code := common.StatusCodeOf(err)
+		if code >= http.StatusInternalServerError || code == http.StatusTooManyRequests {
+			return err
+		}
+	}
+	m.LastRequestID = requestID
+	m.LastError = ""
+	if err != nil {
+		m.LastError = err.Error()
+	}
+	ok, err := models.FinishScheduleRun(m, runAt, schedule.Next(now))
+	if err != nil {
+		return err
+	}
+	if ok {
+		logrus.Infof("INFO: run schedule %s at %v, request: %s, err: %s", m.Name, runAt, requestID, m.LastError)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package buildjob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 已经到期的计划，每小时整点触发
+func newTestSchedule(t *testing.T, runAt time.Time) *models.Schedule {
+	data, _ := json.Marshal(newTestBuildJobDTO())
+	m := &models.Schedule{Name: "nightly", Cron: "0 * * * *", Namespace: "ci", RequestDTO: string(data), NextRunAt: runAt}
+	if _, err := models.AddSchedule(m); err != nil {
+		t.Fatalf("add schedule failed: %v", err)
+	}
+	// sqlite驱动按自己的格式保存time.Time，原生sql的时间参数是mysql的datetime格式，统一成后者才能比较
+	if _, err := orm.NewOrm().Raw("update schedule set next_run_at = ? where id = ?", runAt, m.ID).Exec(); err != nil {
+		t.Fatalf("update schedule failed: %v", err)
+	}
+	return m
+}
+
+// 记录每次提交的幂等键和构建任务名
+type testSubmitter struct {
+	lock  sync.Mutex
+	keys  []string
+	names []string
+	err   error
+}
+
+func (s *testSubmitter) submit(ctx context.Context, buildJobDTO *dto.BuildJobDTO, idempotencyKey string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = append(s.keys, idempotencyKey)
+	s.names = append(s.names, buildJobDTO.Name)
+	if s.err != nil {
+		return "", s.err
+	}
+	return "request-" + idempotencyKey, nil
+}
+
+func TestRunSchedule(t *testing.T) {
+	newTestDB(t)
+	runAt := time.Date(2026, 1, 1, 8, 0, 0, 0, time.Local)
+	m := newTestSchedule(t, runAt)
+	s := &testSubmitter{}
+	runner := NewScheduleRunner(s.submit)
+
+	// 错过了多次触发，只补一次，下一次触发的时间是现在之后的第一个整点
+	now := runAt.Add(150 * time.Minute)
+	if err := runner.runSchedule(context.TODO(), m, now); err != nil {
+		t.Fatalf("run schedule failed: %v", err)
+	}
+	key := fmt.Sprintf("schedule-%d-%d", m.ID, runAt.Unix())
+	if len(s.keys) != 1 || s.keys[0] != key || s.names[0] != fmt.Sprintf("nightly-%d", runAt.Unix()) {
+		t.Fatalf("expect one run with fixed idempotency key and name, got %v %v", s.keys, s.names)
+	}
+	stored, _ := models.GetScheduleByID(m.ID)
+	if !stored.NextRunAt.Equal(runAt.Add(3*time.Hour)) || stored.LastRequestID != "request-"+s.keys[0] || stored.LastRunAt == nil || !stored.LastRunAt.Equal(runAt) {
+		t.Errorf("unexpected schedule after run: %+v", stored)
+	}
+	if due, _ := models.ListDueSchedules(now); len(due) != 0 {
+		t.Errorf("expect no due schedules after run, got %d", len(due))
+	}
+}
+
+func TestRunScheduleErrors(t *testing.T) {
+	newTestDB(t)
+	runAt := time.Date(2026, 1, 1, 8, 0, 0, 0, time.Local)
+	m := newTestSchedule(t, runAt)
+	s := &testSubmitter{err: common.NewTooManyRequestsError(time.Second, "overloaded")}
+	runner := NewScheduleRunner(s.submit)
+
+	// 过载等可以重试的错误不更新下一次触发的时间，下次检查时以同样的幂等键再触发
+	if err := runner.runSchedule(context.TODO(), m, runAt); err == nil {
+		t.Fatal("expect retryable error to be returned")
+	}
+	if stored, _ := models.GetScheduleByID(m.ID); !stored.NextRunAt.Equal(runAt) {
+		t.Fatalf("expect next run not to move, got %v", stored.NextRunAt)
+	}
+
+	// 永久错误记录下来，跳过这一次触发
+	s.err = common.NewBadRequestError("invalid image")
+	if err := runner.runSchedule(context.TODO(), m, runAt); err != nil {
+		t.Fatalf("expect permanent error to be recorded, got %v", err)
+	}
+	stored, _ := models.GetScheduleByID(m.ID)
+	if !stored.NextRunAt.Equal(runAt.Add(time.Hour)) || stored.LastError != "invalid image" {
+		t.Errorf("expect run to be skipped with error, got %+v", stored)
+	}
+	if len(s.keys) != 2 || s.keys[0] != s.keys[1] {
+		t.Errorf("expect retry with the same idempotency key, got %v", s.keys)
+	}
+
+	// 其他错误都当作服务端错误，下次再触发
+	s.err = errors.New("connection refused")
+	if err := runner.runSchedule(context.TODO(), stored, runAt.Add(time.Hour)); err == nil {
+		t.Error("expect unknown error to be returned")
+	}
+}
+
+func TestFinishScheduleRunCAS(t *testing.T) {
+	newTestDB(t)
+	runAt := time.Date(2026, 1, 1, 8, 0, 0, 0, time.Local)
+	m := newTestSchedule(t, runAt)
+	// master切换时两个实例读到了同一次触发，提交使用同样的幂等键，只有一个实例能更新下一次触发的时间
+	old := *m
+	ok, err := models.FinishScheduleRun(m, runAt, runAt.Add(time.Hour))
+	if err != nil || !ok {
+		t.Fatalf("expect first finish to succeed, got %v, err: %v", ok, err)
+	}
+	ok, err = models.FinishScheduleRun(&old, runAt, runAt.Add(2*time.Hour))
+	if err != nil || ok {
+		t.Fatalf("expect stale finish to be rejected, got %v, err: %v", ok, err)
+	}
+	if stored, _ := models.GetScheduleByID(m.ID); !stored.NextRunAt.Equal(runAt.Add(time.Hour)) {
+		t.Errorf("expect next run set by the first finish, got %v", stored.NextRunAt)
+	}
+}
@@ -0,0 +1,233 @@
+package buildjob
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	healthCheckTimeout = 3 * time.Second
+	healthCacheTTL     = 30 * time.Second // 健康检查结果的缓存时长，避免每次选择集群都访问apiserver
+)
+
+// 集群打分器，只指定网络区域时用来在区域内选择集群
+type ClusterScorer interface {
+	Name() string
+	// 返回[0, 100]的分数，分数越高越优先；返回error表示集群不可选
+	Score(c *models.Cluster) (float64, error)
+}
+
+type weightedScorer struct {
+	scorer ClusterScorer
+	weight float64
+}
+
+var (
+	scorerLock sync.RWMutex
+	scorers    = make([]*weightedScorer, 0)
+)
+
+func init() {
+	RegisterClusterScorer(&freeCapacityScorer{}, 1)
+	RegisterClusterScorer(&pendingRequestScorer{}, 1)
+	RegisterClusterScorer(newHealthScorer(), 1)
+}
+
+// 注册打分器，集群的总分是所有打分器分数的加权平均
+func RegisterClusterScorer(scorer ClusterScorer, weight float64) {
+	scorerLock.Lock()
+	defer scorerLock.Unlock()
+	scorers = append(scorers, &weightedScorer{scorer: scorer, weight: weight})
+}
+
+// 确定构建任务所在的集群：
+// 指定了集群的直接使用，并校验集群和网络区域是否一致；只指定网络区域的，在区域内选择得分最高的集群
+// 选择的原因记录在ScheduleReason中，最终会写到pod表中
+func ScheduleBuildJob(buildJobDTO *dto.BuildJobDTO) error {
+	if buildJobDTO.ClusterName != "" {
+		if buildJobDTO.NetworkZone != "" {
+			c, err := models.GetClusterByName(buildJobDTO.ClusterName)
+			if err != nil {
+				return err
+			}
+			if c != nil && c.NetworkZone != buildJobDTO.NetworkZone {
+				return common.NewValidationError([]*common.FieldError{newFieldError("clusterName", buildJobDTO.ClusterName,
+					fmt.Sprintf("cluster is in networkZone %s, not %s", c.NetworkZone, buildJobDTO.NetworkZone))})
+			}
+		}
+		buildJobDTO.ScheduleReason = "cluster specified by request"
+		return nil
+	}
+	c, reason, err := SelectCluster(buildJobDTO.NetworkZone)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("INFO: schedule buildJob %s to cluster %s, %s", buildJobDTO.Name, c.Name, reason)
+	buildJobDTO.ClusterName = c.Name
+	buildJobDTO.ScheduleReason = reason
+	return nil
+}
+
+type clusterScore struct {
+	cluster *models.Cluster
+	score   float64
+	details []string
+}
+
+// 在网络区域中选择得分最高的集群，返回选择的集群和原因
+func SelectCluster(networkZone string) (*models.Cluster, string, error) {
+	clusters, err := models.ListEnabledClustersByZone(networkZone)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(clusters) == 0 {
+		return nil, "", common.NewValidationError([]*common.FieldError{newFieldError("networkZone", networkZone, "no enabled cluster in networkZone")})
+	}
+	scorerLock.RLock()
+	defer scorerLock.RUnlock()
+	candidates := make([]*clusterScore, 0, len(clusters))
+	filtered := make([]string, 0)
+	for _, c := range clusters {
+		candidate, err := scoreCluster(c)
+		if err != nil {
+			filtered = append(filtered, fmt.Sprintf("%s(%s)", c.Name, err.Error()))
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil, "", common.NewStatusError(http.StatusServiceUnavailable, "no available cluster in networkZone %s: %s", networkZone, strings.Join(filtered, ", "))
+	}
+	// 分数相同时按集群注册的顺序
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	selected := candidates[0]
+	reason := fmt.Sprintf("networkZone %s: selected %s with score %.1f (%s)", networkZone, selected.cluster.Name,
+		selected.score, strings.Join(selected.details, ", "))
+	if len(candidates) > 1 {
+		others := make([]string, 0, len(candidates)-1)
+		for _, candidate := range candidates[1:] {
+			others = append(others, fmt.Sprintf("%s=%.1f", candidate.cluster.Name, candidate.score))
+		}
+		reason += "; others: " + strings.Join(others, ", ")
+	}
+	if len(filtered) > 0 {
+		reason += "; filtered: " + strings.Join(filtered, ", ")
+	}
+	return selected.cluster, reason, nil
+}
+
+func scoreCluster(c *models.Cluster) (*clusterScore, error) {
+	result := &clusterScore{cluster: c, details: make([]string, 0, len(scorers))}
+	totalWeight := 0.0
+	for _, ws := range scorers {
+		score, err := ws.scorer.Score(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ws.scorer.Name(), err.Error())
+		}
+		result.score += score * ws.weight
+		totalWeight += ws.weight
+		result.details = append(result.details, fmt.Sprintf("%s=%.1f", ws.scorer.Name(), score))
+	}
+	if totalWeight > 0 {
+		result.score = result.score / totalWeight
+	}
+	return result, nil
+}
+
+// 按空闲容量打分，容量用完的集群不可选
+type freeCapacityScorer struct{}
+
+func (f *freeCapacityScorer) Name() string {
+	return "capacity"
+}
+
+func (f *freeCapacityScorer) Score(c *models.Cluster) (float64, error) {
+	if c.Capacity <= 0 {
+		return 0, fmt.Errorf("no capacity")
+	}
+	active, err := models.CountActivePodsByCluster(c.Name)
+	if err != nil {
+		return 0, err
+	}
+	free := int64(c.Capacity) - active
+	if free <= 0 {
+		return 0, fmt.Errorf("capacity %d is full", c.Capacity)
+	}
+	return float64(free) * 100 / float64(c.Capacity), nil
+}
+
+// 按集群中排队的请求数打分，排队越多分数越低
+type pendingRequestScorer struct{}
+
+func (p *pendingRequestScorer) Name() string {
+	return "pending"
+}
+
+func (p *pendingRequestScorer) Score(c *models.Cluster) (float64, error) {
+	pending, err := models.CountUnfinishedRequestsByCluster(c.Name)
+	if err != nil {
+		return 0, err
+	}
+	return 100 / float64(1+pending), nil
+}
+
+// 按集群健康状态打分，不健康的集群不可选；执行器没有实现HealthChecker的当作健康
+type healthScorer struct {
+	lock    sync.Mutex
+	results map[string]*healthResult
+}
+
+type healthResult struct {
+	err       error
+	checkedAt time.Time
+}
+
+func newHealthScorer() *healthScorer {
+	return &healthScorer{results: make(map[string]*healthResult)}
+}
+
+func (h *healthScorer) Name() string {
+	return "health"
+}
+
+func (h *healthScorer) Score(c *models.Cluster) (float64, error) {
+	h.lock.Lock()
+	result, ok := h.results[c.Name]
+	h.lock.Unlock()
+	if !ok || time.Since(result.checkedAt) > healthCacheTTL {
+		result = &healthResult{err: checkClusterHealth(c), checkedAt: time.Now()}
+		h.lock.Lock()
+		h.results[c.Name] = result
+		h.lock.Unlock()
+	}
+	if result.err != nil {
+		return 0, fmt.Errorf("unhealthy: %s", result.err.Error())
+	}
+	return 100, nil
+}
+
+func checkClusterHealth(c *models.Cluster) error {
+	executor, err := GetPodExecutor(c.Name)
+	if err != nil {
+		return err
+	}
+	checker, ok := executor.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return checker.CheckHealth(ctx)
+}
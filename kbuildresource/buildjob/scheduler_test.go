@@ -0,0 +1,117 @@
+package buildjob
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 健康检查总是失败的执行器
+type unhealthyExecutor struct {
+	PodExecutor
+}
+
+func (u *unhealthyExecutor) CheckHealth(ctx context.Context) error {
+	return errors.New("apiserver unreachable")
+}
+
+func addTestClusters(t *testing.T, clusters ...*models.Cluster) {
+	for _, c := range clusters {
+		if c.ExecutorType == "" {
+			c.ExecutorType = "simulated"
+		}
+		if _, err := models.AddCluster(c); err != nil {
+			t.Fatalf("add cluster failed: %v", err)
+		}
+	}
+}
+
+func addTestPods(t *testing.T, clusterName string, count int) {
+	for i := 0; i < count; i++ {
+		pod := &models.Pod{Name: clusterName + "-agent-" + string(rune('a'+i)), ClusterName: clusterName, IsDelete: "0"}
+		if _, err := models.AddPod(pod); err != nil {
+			t.Fatalf("add pod failed: %v", err)
+		}
+	}
+}
+
+func TestSelectCluster(t *testing.T) {
+	newTestDB(t)
+	RegisterPodExecutor("select-5", &unhealthyExecutor{PodExecutor: NewSimulatedExecutor()})
+	addTestClusters(t,
+		&models.Cluster{Name: "select-1", NetworkZone: "zone-a", Capacity: 4, Enabled: true},
+		&models.Cluster{Name: "select-2", NetworkZone: "zone-a", Capacity: 4, Enabled: true},
+		&models.Cluster{Name: "select-3", NetworkZone: "zone-a", Capacity: 2, Enabled: true},
+		&models.Cluster{Name: "select-4", NetworkZone: "zone-a", Capacity: 4, Enabled: false},
+		&models.Cluster{Name: "select-5", NetworkZone: "zone-a", Capacity: 4, Enabled: true},
+		&models.Cluster{Name: "select-6", NetworkZone: "zone-b", Capacity: 4, Enabled: true},
+	)
+	addTestPods(t, "select-1", 2)
+	addTestPods(t, "select-3", 2)
+
+	// 空闲容量最多的集群得分最高，容量用完和不健康的集群被过滤，禁用的集群不参与选择
+	c, reason, err := SelectCluster("zone-a")
+	if err != nil || c.Name != "select-2" {
+		t.Fatalf("expect select-2, got %+v, err: %v", c, err)
+	}
+	for _, s := range []string{"others: select-1=83.3", "select-3(capacity: capacity 2 is full)", "select-5(health: unhealthy: apiserver unreachable)"} {
+		if !strings.Contains(reason, s) {
+			t.Errorf("expect reason to contain %q, got %s", s, reason)
+		}
+	}
+	if strings.Contains(reason, "select-4") || strings.Contains(reason, "select-6") {
+		t.Errorf("expect only enabled clusters in zone-a, got %s", reason)
+	}
+
+	// 排队的请求多了之后分数降低
+	for _, id := range []string{"r1", "r2", "r3"} {
+		request := &models.Request{RequestID: id, Name: id, ClusterName: "select-2", Status: common.RequestStatusPending}
+		if _, err = models.AddRequest(request); err != nil {
+			t.Fatalf("add request failed: %v", err)
+		}
+	}
+	if c, _, err = SelectCluster("zone-a"); err != nil || c.Name != "select-1" {
+		t.Errorf("expect select-1 after requests are queued on select-2, got %+v, err: %v", c, err)
+	}
+}
+
+func TestSelectClusterUnavailable(t *testing.T) {
+	newTestDB(t)
+	addTestClusters(t, &models.Cluster{Name: "full-1", NetworkZone: "zone-a", Capacity: 1, Enabled: true})
+	addTestPods(t, "full-1", 1)
+	if _, _, err := SelectCluster("zone-b"); common.StatusCodeOf(err) != http.StatusBadRequest {
+		t.Errorf("expect bad request for zone without clusters, got %v", err)
+	}
+	if _, _, err := SelectCluster("zone-a"); common.StatusCodeOf(err) != http.StatusServiceUnavailable {
+		t.Errorf("expect service unavailable when all clusters are full, got %v", err)
+	}
+}
+
+func TestScheduleBuildJob(t *testing.T) {
+	newTestDB(t)
+	addTestClusters(t, &models.Cluster{Name: "schedule-1", NetworkZone: "zone-a", Capacity: 4, Enabled: true})
+
+	buildJobDTO := newTestBuildJobDTO()
+	buildJobDTO.ClusterName = "schedule-1"
+	buildJobDTO.NetworkZone = "zone-b"
+	if err := ScheduleBuildJob(buildJobDTO); common.StatusCodeOf(err) != http.StatusBadRequest {
+		t.Errorf("expect bad request when cluster is not in networkZone, got %v", err)
+	}
+
+	buildJobDTO.NetworkZone = "zone-a"
+	if err := ScheduleBuildJob(buildJobDTO); err != nil || buildJobDTO.ScheduleReason != "cluster specified by request" {
+		t.Errorf("expect specified cluster to be used, got reason %q, err: %v", buildJobDTO.ScheduleReason, err)
+	}
+
+	// 只指定网络区域时在区域内选择集群
+	buildJobDTO.ClusterName = ""
+	if err := ScheduleBuildJob(buildJobDTO); err != nil || buildJobDTO.ClusterName != "schedule-1" ||
+		!strings.HasPrefix(buildJobDTO.ScheduleReason, "networkZone zone-a: selected schedule-1") {
+		t.Errorf("expect schedule-1 to be selected, got %+v, err: %v", buildJobDTO, err)
+	}
+}
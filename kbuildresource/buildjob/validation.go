@@ -0,0 +1,165 @@
+package buildjob
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"bryson.foundation/kbuildresource/cluster"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// 镜像地址的格式，参考docker distribution的reference语法：[domain[:port]/]path[:tag][@digest]
+var imageReferenceRegexp = func() *regexp.Regexp {
+	domainComponent := `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domain := domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+	nameComponent := `[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*`
+	tag := `[\w][\w.-]{0,127}`
+	digest := `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	return regexp.MustCompile(`^(?:` + domain + `/)?` + nameComponent + `(?:/` + nameComponent + `)*` +
+		`(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// 校验构建任务参数，返回所有出错的字段
+func VerifyBuildJobDTO(buildJobDTO *dto.BuildJobDTO) error {
+	logrus.Info("INFO: verifyBuildJobDTO")
+	fieldErrors := validateBuildJobDTO(buildJobDTO)
+	if len(fieldErrors) > 0 {
+		return common.NewValidationError(fieldErrors)
+	}
+	// 集群不存在或者被禁用时尽早失败，不进入执行队列；只指定网络区域的在选择集群时处理
+	if buildJobDTO.ClusterName == "" {
+		return nil
+	}
+	if _, err := cluster.GetAvailableCluster(buildJobDTO.ClusterName); err != nil {
+		if common.StatusCodeOf(err) == http.StatusInternalServerError {
+			return err
+		}
+		return common.NewValidationError([]*common.FieldError{newFieldError("clusterName", buildJobDTO.ClusterName, err.Error())})
+	}
+	return nil
+}
+
+func validateBuildJobDTO(buildJobDTO *dto.BuildJobDTO) []*common.FieldError {
+	fieldErrors := make([]*common.FieldError, 0)
+	// pod名需要满足DNS-1123 subdomain
+	for _, msg := range validation.IsDNS1123Subdomain(buildJobDTO.Name) {
+		fieldErrors = append(fieldErrors, newFieldError("name", buildJobDTO.Name, msg))
+	}
+	if buildJobDTO.ClusterName == "" && buildJobDTO.NetworkZone == "" {
+		fieldErrors = append(fieldErrors, newFieldError("clusterName", buildJobDTO.ClusterName, "clusterName or networkZone is required"))
+	}
+	if buildJobDTO.Namespace == "" {
+		fieldErrors = append(fieldErrors, newFieldError("namespace", buildJobDTO.Namespace, "is required"))
+	} else {
+		for _, msg := range validation.IsDNS1123Label(buildJobDTO.Namespace) {
+			fieldErrors = append(fieldErrors, newFieldError("namespace", buildJobDTO.Namespace, msg))
+		}
+	}
+	// 0表示使用默认优先级
+	if buildJobDTO.Priority != 0 && (buildJobDTO.Priority < common.MinRequestPriority || buildJobDTO.Priority > common.MaxRequestPriority) {
+		fieldErrors = append(fieldErrors, newFieldError("priority", buildJobDTO.Priority,
+			fmt.Sprintf("must be between %d and %d", common.MinRequestPriority, common.MaxRequestPriority)))
+	}
+	if buildJobDTO.Deadline != nil && !buildJobDTO.Deadline.After(time.Now()) {
+		fieldErrors = append(fieldErrors, newFieldError("deadline", buildJobDTO.Deadline, "must be in the future"))
+	}
+	if buildJobDTO.Deadline != nil && buildJobDTO.NotBefore != nil && !buildJobDTO.Deadline.After(*buildJobDTO.NotBefore) {
+		fieldErrors = append(fieldErrors, newFieldError("deadline", buildJobDTO.Deadline, "must be after notBefore"))
+	}
+	if buildJobDTO.Cron != "" {
+		if _, err := cron.ParseStandard(buildJobDTO.Cron); err != nil {
+			fieldErrors = append(fieldErrors, newFieldError("cron", buildJobDTO.Cron, err.Error()))
+		}
+		// 每次触发的截止时间都不一样，周期性的计划不支持截止时间
+		if buildJobDTO.Deadline != nil {
+			fieldErrors = append(fieldErrors, newFieldError("deadline", buildJobDTO.Deadline, "is not supported with cron"))
+		}
+		// 每次触发的构建任务名为 name-触发时间戳，需要留出后缀的长度
+		if len(buildJobDTO.Name) > maxScheduleNameLength {
+			fieldErrors = append(fieldErrors, newFieldError("name", buildJobDTO.Name, fmt.Sprintf("must be no more than %d characters with cron", maxScheduleNameLength)))
+		}
+	}
+	if len(buildJobDTO.Containers) == 0 {
+		fieldErrors = append(fieldErrors, newFieldError("containers", nil, "at least one container is required"))
+	}
+	containerNames := make(map[string]bool, len(buildJobDTO.Containers))
+	for i, container := range buildJobDTO.Containers {
+		path := fmt.Sprintf("containers[%d]", i)
+		if container == nil {
+			fieldErrors = append(fieldErrors, newFieldError(path, nil, "must not be null"))
+			continue
+		}
+		fieldErrors = append(fieldErrors, validateContainer(path, container)...)
+		if containerNames[container.Name] {
+			fieldErrors = append(fieldErrors, newFieldError(path+".name", container.Name, "duplicated container name"))
+		}
+		containerNames[container.Name] = true
+	}
+	return fieldErrors
+}
+
+func validateContainer(path string, container *models.Container) []*common.FieldError {
+	fieldErrors := make([]*common.FieldError, 0)
+	for _, msg := range validation.IsDNS1123Label(container.Name) {
+		fieldErrors = append(fieldErrors, newFieldError(path+".name", container.Name, msg))
+	}
+	if container.Image == "" {
+		fieldErrors = append(fieldErrors, newFieldError(path+".image", container.Image, "is required"))
+	} else if !imageReferenceRegexp.MatchString(container.Image) {
+		fieldErrors = append(fieldErrors, newFieldError(path+".image", container.Image, "invalid image reference"))
+	}
+	fieldErrors = append(fieldErrors, validateResource(path, "CPU", container.RequestCPU, container.LimitCPU)...)
+	fieldErrors = append(fieldErrors, validateResource(path, "Mem", container.RequestMem, container.LimitMem)...)
+	return fieldErrors
+}
+
+// 校验资源的请求值和限制值，都可以不填，填了必须是合法的kubernetes quantity，且请求值不能大于限制值
+func validateResource(path string, resourceName string, request string, limit string) []*common.FieldError {
+	fieldErrors := make([]*common.FieldError, 0)
+	requestField := path + ".request" + resourceName
+	limitField := path + ".limit" + resourceName
+	requestQuantity, requestErr := parseQuantity(request)
+	if requestErr != nil {
+		fieldErrors = append(fieldErrors, newFieldError(requestField, request, requestErr.Error()))
+	}
+	limitQuantity, limitErr := parseQuantity(limit)
+	if limitErr != nil {
+		fieldErrors = append(fieldErrors, newFieldError(limitField, limit, limitErr.Error()))
+	}
+	if requestQuantity != nil && limitQuantity != nil && requestQuantity.Cmp(*limitQuantity) > 0 {
+		fieldErrors = append(fieldErrors, newFieldError(requestField, request, fmt.Sprintf("must be less than or equal to %s %s", limitField, limit)))
+	}
+	return fieldErrors
+}
+
+// 空字符串表示没有设置，返回nil
+func parseQuantity(value string) (*resource.Quantity, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quantity, eg: 500m, 2, 512Mi, 1Gi")
+	}
+	if quantity.Sign() < 0 {
+		return nil, fmt.Errorf("must be greater than or equal to 0")
+	}
+	return &quantity, nil
+}
+
+func newFieldError(field string, value interface{}, message string) *common.FieldError {
+	return &common.FieldError{
+		Field:   field,
+		Value:   value,
+		Message: message,
+	}
+}
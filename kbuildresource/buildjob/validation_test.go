@@ -0,0 +1,123 @@
+package buildjob
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 出错的字段名，按出现的顺序
+func fieldsOf(buildJobDTO *dto.BuildJobDTO) []string {
+	fields := make([]string, 0)
+	for _, fieldError := range validateBuildJobDTO(buildJobDTO) {
+		fields = append(fields, fieldError.Field)
+	}
+	return fields
+}
+
+func TestValidateBuildJobName(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"agent-1", true},
+		{"agent.linux-1", true},
+		{"a", true},
+		{"1agent", true},
+		{strings.Repeat("a", 253), true},
+		{"", false},
+		{"Agent-1", false},
+		{"agent_1", false},
+		{"-agent", false},
+		{"agent-", false},
+		{"agent..1", false},
+		{"agent 1", false},
+		{strings.Repeat("a", 254), false},
+	}
+	for _, c := range cases {
+		buildJobDTO := newTestBuildJobDTO()
+		buildJobDTO.Name = c.name
+		fields := fieldsOf(buildJobDTO)
+		if c.valid && len(fields) != 0 {
+			t.Errorf("expect name %q to be accepted, got errors on %v", c.name, fields)
+		}
+		if !c.valid && (len(fields) == 0 || fields[0] != "name") {
+			t.Errorf("expect name %q to be rejected, got errors on %v", c.name, fields)
+		}
+	}
+}
+
+func TestValidateNamespaceAndContainerName(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"ci", true},
+		{"ci-linux-1", true},
+		{strings.Repeat("a", 63), true},
+		{"ci.linux", false},
+		{"CI", false},
+		{"ci_linux", false},
+		{"-ci", false},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, c := range cases {
+		buildJobDTO := newTestBuildJobDTO()
+		buildJobDTO.Namespace = c.name
+		fields := fieldsOf(buildJobDTO)
+		if c.valid != (len(fields) == 0) {
+			t.Errorf("namespace %q: expect valid %v, got errors on %v", c.name, c.valid, fields)
+		}
+		if !c.valid && fields[0] != "namespace" {
+			t.Errorf("namespace %q: expect error on namespace, got %v", c.name, fields)
+		}
+
+		buildJobDTO = newTestBuildJobDTO()
+		buildJobDTO.Containers[0].Name = c.name
+		fields = fieldsOf(buildJobDTO)
+		if c.valid != (len(fields) == 0) {
+			t.Errorf("container name %q: expect valid %v, got errors on %v", c.name, c.valid, fields)
+		}
+		if !c.valid && fields[0] != "containers[0].name" {
+			t.Errorf("container name %q: expect error on containers[0].name, got %v", c.name, fields)
+		}
+	}
+}
+
+func TestValidateBuildJobDTO(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	cases := []struct {
+		desc   string
+		modify func(buildJobDTO *dto.BuildJobDTO)
+		fields []string
+	}{
+		{"valid", func(buildJobDTO *dto.BuildJobDTO) {}, nil},
+		{"network zone only", func(buildJobDTO *dto.BuildJobDTO) {
+			buildJobDTO.ClusterName = ""
+			buildJobDTO.NetworkZone = "zone-a"
+		}, nil},
+		{"no cluster", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.ClusterName = "" }, []string{"clusterName"}},
+		{"no namespace", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Namespace = "" }, []string{"namespace"}},
+		{"priority", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Priority = 10 }, []string{"priority"}},
+		{"deadline", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Deadline = &past }, []string{"deadline"}},
+		{"cron", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Cron = "every minute" }, []string{"cron"}},
+		{"no containers", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Containers = nil }, []string{"containers"}},
+		{"image", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Containers[0].Image = "jenkins/Agent:4.3" }, []string{"containers[0].image"}},
+		{"quantity", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Containers[0].LimitMem = "1G1" }, []string{"containers[0].limitMem"}},
+		{"request greater than limit", func(buildJobDTO *dto.BuildJobDTO) { buildJobDTO.Containers[0].RequestCPU = "2" }, []string{"containers[0].requestCPU"}},
+		{"duplicated container", func(buildJobDTO *dto.BuildJobDTO) {
+			buildJobDTO.Containers = append(buildJobDTO.Containers, &models.Container{Name: "jnlp", Image: "busybox"})
+		}, []string{"containers[1].name"}},
+	}
+	for _, c := range cases {
+		buildJobDTO := newTestBuildJobDTO()
+		c.modify(buildJobDTO)
+		fields := fieldsOf(buildJobDTO)
+		if strings.Join(fields, ",") != strings.Join(c.fields, ",") {
+			t.Errorf("%s: expect errors on %v, got %v", c.desc, c.fields, fields)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"fmt"
+	"github.com/go-redis/redis"
+	"time"
+)
+
+const (
+	requestCancelTTL = 24 * time.Hour // 取消标记的保存时长，超过后请求一定已经结束
+)
+
+var (
+	requestCancelChannel = GenRequestCancelChannel(common.BuildJobPrefix)
+	// 缓存中的请求还是同一个请求并且还在排队时才删除，和开始执行时的状态转换互斥
+	deletePendingRequestScript = redis.NewScript(checkFencingTokenLua + `
+local data = redis.call("HGET", KEYS[2], ARGV[2])
+if not data then
+	return 0
+end
+local request = cjson.decode(data)
+if request.requestId ~= ARGV[3] or request.status ~= ARGV[4] then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[2])
+return 1`)
+)
+
+// 请求还在排队时从实例的缓存列表中删除，返回是否删除；请求已经开始执行或者已经不在缓存中时返回false
+// fencing token的检查同AddRequest
+func DeletePendingRequest(m *models.Request) (bool, error) {
+	requestKey := GenRequestKey(common.BuildJobPrefix, m.InstanceName)
+	result, err := deletePendingRequestScript.Run(RedisClient, []string{GenFenceKey(requestKey), requestKey},
+		m.FencingToken, GenFieldByRequest(m), m.RequestID, common.RequestStatusPending).Int64()
+	if err != nil {
+		return false, err
+	}
+	if result < 0 {
+		return false, ErrStaleFencingToken
+	}
+	return result == 1, nil
+}
+
+// 标记请求已经被取消，并通知所有实例
+func SetRequestCanceled(requestID string) error {
+	err := RedisClient.Set(GenRequestCancelKey(common.BuildJobPrefix, requestID), "1", requestCancelTTL).Err()
+	if err != nil {
+		return err
+	}
+	return RedisClient.Publish(requestCancelChannel, requestID).Err()
+}
+
+func IsRequestCanceled(requestID string) (bool, error) {
+	count, err := RedisClient.Exists(GenRequestCancelKey(common.BuildJobPrefix, requestID)).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// 批量查询请求是否被取消，返回被取消的请求ID
+func ListCanceledRequests(requestIDs []string) ([]string, error) {
+	pipe := RedisClient.Pipeline()
+	cmds := make([]*redis.IntCmd, len(requestIDs))
+	for i, requestID := range requestIDs {
+		cmds[i] = pipe.Exists(GenRequestCancelKey(common.BuildJobPrefix, requestID))
+	}
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	canceled := make([]string, 0)
+	for i, cmd := range cmds {
+		if cmd.Val() > 0 {
+			canceled = append(canceled, requestIDs[i])
+		}
+	}
+	return canceled, nil
+}
+
+// 订阅请求取消的通知，消息内容是请求ID
+func SubscribeRequestCancel() *redis.PubSub {
+	return RedisClient.Subscribe(requestCancelChannel)
+}
+
+func GenRequestCancelKey(prefix string, requestID string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, "cancels", requestID)
+}
+
+func GenRequestCancelChannel(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "cancel-events")
+}
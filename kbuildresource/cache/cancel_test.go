@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/common"
+)
+
+func TestDeletePendingRequest(t *testing.T) {
+	newTestRedis(t)
+	pending := newTestCachedRequest("r1", "a", 0)
+	pending.Status = common.RequestStatusPending
+	if err := AddRequest(pending); err != nil {
+		t.Fatalf("add request failed: %v", err)
+	}
+
+	// 读取之后请求已经开始执行，不能删除
+	executing := *pending
+	executing.Status = common.RequestStatusExecuting
+	if err := UpdateRequest(&executing); err != nil {
+		t.Fatalf("update request failed: %v", err)
+	}
+	if removed, err := DeletePendingRequest(pending); err != nil || removed {
+		t.Errorf("expect executing request not to be removed, got %v, err: %v", removed, err)
+	}
+
+	// 同名的请求已经换成了另一个请求
+	other := *pending
+	other.RequestID = "r1-other"
+	if err := UpdateRequest(&other); err != nil {
+		t.Fatalf("update request failed: %v", err)
+	}
+	if removed, err := DeletePendingRequest(pending); err != nil || removed {
+		t.Errorf("expect request of other id not to be removed, got %v, err: %v", removed, err)
+	}
+
+	if err := UpdateRequest(pending); err != nil {
+		t.Fatalf("update request failed: %v", err)
+	}
+	if removed, err := DeletePendingRequest(pending); err != nil || !removed {
+		t.Fatalf("expect pending request to be removed, got %v, err: %v", removed, err)
+	}
+	if _, err := GetRequestByNameAndRequestTypeAndInstanceName("r1", "buildjob_create", "a"); err != redis.Nil {
+		t.Errorf("expect r1 to be removed, got %v", err)
+	}
+	if removed, err := DeletePendingRequest(pending); err != nil || removed {
+		t.Errorf("expect removed request not to be removed again, got %v, err: %v", removed, err)
+	}
+}
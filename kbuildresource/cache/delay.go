@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strings"
+	"time"
+)
+
+const (
+	delayQueueBatch = 100 // 每次最多转移的到期请求数
+)
+
+var (
+	delayQueueKey        = GenDelayQueueKey(common.BuildJobPrefix)
+	delayQueuePayloadKey = GenDelayQueuePayloadKey(common.BuildJobPrefix)
+
+	// 把到期的请求转移到对应的请求队列中，整个转移是原子的，多个实例同时转移也不会重复或者丢失
+	// 成员的格式为 队列名|请求ID，请求内容保存在单独的hash中
+	moveDueRequestsScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]))
+for _, member in ipairs(due) do
+	local payload = redis.call("HGET", KEYS[2], member)
+	local queue = string.match(member, "^(.*)|[^|]*$")
+	if payload and queue then
+		redis.call("XADD", ARGV[3] .. queue, "*", ARGV[4], payload)
+		redis.call("SADD", KEYS[3], queue)
+	end
+	redis.call("ZREM", KEYS[1], member)
+	redis.call("HDEL", KEYS[2], member)
+end
+return #due`)
+)
+
+// 请求在at之后才重新进入请求队列，同一个请求只会有一个延迟的副本
+func PushRequestToDelayQueue(m *models.Request, at time.Time) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	member := genDelayQueueMember(m)
+	pipe := RedisClient.TxPipeline()
+	pipe.HSet(delayQueuePayloadKey, member, data)
+	pipe.ZAdd(delayQueueKey, redis.Z{Score: float64(at.UnixNano() / int64(time.Millisecond)), Member: member})
+	_, err = pipe.Exec()
+	return err
+}
+
+// 把已经到期的请求转移到请求队列中，返回转移的请求数
+func MoveDueRequestsToQueue(now time.Time) (int64, error) {
+	return moveDueRequestsScript.Run(RedisClient,
+		[]string{delayQueueKey, delayQueuePayloadKey, requestQueueIndexKey},
+		now.UnixNano()/int64(time.Millisecond), delayQueueBatch,
+		GenRequestQueueKeyPrefix(common.BuildJobPrefix),
+		requestQueueField).Int64()
+}
+
+// 统计延迟队列中等待重新入队的请求数
+func CountDelayedRequests() (int64, error) {
+	count, err := RedisClient.ZCard(delayQueueKey).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+func genDelayQueueMember(m *models.Request) string {
+	return fmt.Sprintf("%s|%s", QueueNameOf(m), strings.Replace(m.RequestID, "|", "", -1))
+}
+
+func GenDelayQueueKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "delay-queue")
+}
+
+func GenDelayQueuePayloadKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "delay-payloads")
+}
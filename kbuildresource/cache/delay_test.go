@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"bryson.foundation/kbuildresource/models"
+)
+
+func TestMoveDueRequestsToQueue(t *testing.T) {
+	newTestRedis(t)
+	now := time.Now()
+	queue := QueueName{Namespace: "ci", Priority: 5}
+	if err := CreateRequestQueueGroup(queue); err != nil {
+		t.Fatalf("create group failed: %v", err)
+	}
+	due := &models.Request{RequestID: "due", Namespace: "ci", Priority: 5}
+	later := &models.Request{RequestID: "later", Namespace: "ci", Priority: 5}
+	if err := PushRequestToDelayQueue(due, now.Add(-time.Second)); err != nil {
+		t.Fatalf("push due failed: %v", err)
+	}
+	if err := PushRequestToDelayQueue(later, now.Add(time.Minute)); err != nil {
+		t.Fatalf("push later failed: %v", err)
+	}
+	// 同一个请求只保留一个延迟的副本
+	if err := PushRequestToDelayQueue(due, now.Add(-time.Second)); err != nil {
+		t.Fatalf("push due again failed: %v", err)
+	}
+	if count, err := CountDelayedRequests(); err != nil || count != 2 {
+		t.Fatalf("expect 2 delayed requests, got %d, err: %v", count, err)
+	}
+
+	// 只转移到期的请求
+	moved, err := MoveDueRequestsToQueue(now)
+	if err != nil || moved != 1 {
+		t.Fatalf("expect 1 request to be moved, got %d, err: %v", moved, err)
+	}
+	message, err := ReadRequestFromQueue("a", queue)
+	if err != nil || message == nil || message.Request.RequestID != "due" {
+		t.Fatalf("expect due request in queue, got %+v, err: %v", message, err)
+	}
+	if message, _ = ReadRequestFromQueue("a", queue); message != nil {
+		t.Fatalf("expect later request not to be moved, got %+v", message)
+	}
+	if count, _ := CountDelayedRequests(); count != 1 {
+		t.Errorf("expect 1 delayed request left, got %d", count)
+	}
+
+	moved, err = MoveDueRequestsToQueue(now.Add(time.Minute))
+	if err != nil || moved != 1 {
+		t.Fatalf("expect later request to be moved, got %d, err: %v", moved, err)
+	}
+	if queues, _ := ListRequestQueues(); len(queues) != 1 || queues[0] != queue {
+		t.Errorf("expect queue to be indexed, got %v", queues)
+	}
+}
@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strings"
+)
+
+var (
+	requestHandOffChannel = GenRequestHandOffChannel(common.BuildJobPrefix)
+)
+
+// 通知实例to接管实例from缓存中的请求，返回收到通知的实例数
+func PublishRequestHandOff(from string, to string) (int64, error) {
+	return RedisClient.Publish(requestHandOffChannel, from+" "+to).Result()
+}
+
+func SubscribeRequestHandOff() *redis.PubSub {
+	return RedisClient.Subscribe(requestHandOffChannel)
+}
+
+func ParseRequestHandOff(payload string) (string, string, error) {
+	fields := strings.Fields(payload)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("invalid hand off message %s", payload)
+	}
+	return fields[0], fields[1], nil
+}
+
+func GenRequestHandOffChannel(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "handoff-events")
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"time"
+)
+
+// 占用幂等键，只有一个实例可以占用成功，占用期间其他实例使用相同的幂等键会被拒绝
+func ReserveIdempotencyKey(m *models.IdempotencyKey, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	return RedisClient.SetNX(GenIdempotencyKey(common.BuildJobPrefix, m.RequestType, m.Key), data, ttl).Result()
+}
+
+// 保存受理完成的幂等记录
+func SetIdempotencyKey(m *models.IdempotencyKey, ttl time.Duration) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return RedisClient.Set(GenIdempotencyKey(common.BuildJobPrefix, m.RequestType, m.Key), data, ttl).Err()
+}
+
+// 不存在时返回nil
+func GetIdempotencyKey(requestType string, key string) (*models.IdempotencyKey, error) {
+	data, err := RedisClient.Get(GenIdempotencyKey(common.BuildJobPrefix, requestType, key)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &models.IdempotencyKey{}
+	if err = json.Unmarshal([]byte(data), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func DeleteIdempotencyKey(requestType string, key string) error {
+	return DelKey(GenIdempotencyKey(common.BuildJobPrefix, requestType, key))
+}
+
+func GenIdempotencyKey(prefix string, requestType string, key string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", prefix, "idempotency", requestType, key)
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"fmt"
+	"github.com/go-redis/redis"
+	"time"
+)
+
+var (
+	// 租约不存在或者属于owner时设置租约
+	acquireLeaseScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`)
+	// 租约属于owner时续期
+	renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	// 租约属于owner时删除
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// 获取请求的租约，租约被其他owner持有时返回false
+func AcquireRequestLease(requestID string, owner string, ttl time.Duration) (bool, error) {
+	return AcquireLease(GenRequestLeaseKey(common.BuildJobPrefix, requestID), owner, ttl)
+}
+
+// 续期请求的租约，租约已经过期或者被其他owner持有时返回false
+func RenewRequestLease(requestID string, owner string, ttl time.Duration) (bool, error) {
+	result, err := renewLeaseScript.Run(RedisClient, []string{GenRequestLeaseKey(common.BuildJobPrefix, requestID)},
+		owner, ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	return result == 1, err
+}
+
+// 释放请求的租约，租约已经不属于owner时返回false
+func ReleaseRequestLease(requestID string, owner string) (bool, error) {
+	return ReleaseLease(GenRequestLeaseKey(common.BuildJobPrefix, requestID), owner)
+}
+
+// 查询请求租约的持有者和剩余时间，租约不存在时owner为空
+func GetRequestLease(requestID string) (string, time.Duration, error) {
+	key := GenRequestLeaseKey(common.BuildJobPrefix, requestID)
+	pipe := RedisClient.Pipeline()
+	ownerCmd := pipe.Get(key)
+	ttlCmd := pipe.PTTL(key)
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return ownerCmd.Val(), ttlCmd.Val(), nil
+}
+
+// 获取key上的租约，租约不存在或者已经属于owner时设置有效期为ttl，被其他owner持有时返回false
+func AcquireLease(key string, owner string, ttl time.Duration) (bool, error) {
+	result, err := acquireLeaseScript.Run(RedisClient, []string{key}, owner, ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	return result == 1, err
+}
+
+// 释放key上的租约，租约已经不属于owner时返回false
+func ReleaseLease(key string, owner string) (bool, error) {
+	result, err := releaseLeaseScript.Run(RedisClient, []string{key}, owner).Int64()
+	return result == 1, err
+}
+
+// 查询key上租约的持有者，租约不存在时返回空字符串
+func GetLeaseOwner(key string) (string, error) {
+	owner, err := RedisClient.Get(key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+func GenRequestLeaseKey(prefix string, requestID string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, "leases", requestID)
+}
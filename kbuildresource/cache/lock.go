@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/utils"
+)
+
+// 持有锁期间的写操作带上fencing token，比已经写入过的token小的写操作会被拒绝
+// 锁过期后还在执行的旧持有者因此不会覆盖新持有者的写入
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+// 检查fencing token，KEYS[1]为记录最大token的key，ARGV[1]为本次写入的token，0表示没有持有锁
+// 还没有记录过token时不带token的写入不检查；一旦记录过，不带token的写入和token更小的写入一样被拒绝
+const checkFencingTokenLua = `
+local token = tonumber(ARGV[1])
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if token < current then
+	return -1
+end
+if token > current then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+`
+
+var (
+	// 锁不存在时以owner的身份加锁，并生成一个单调递增的fencing token
+	acquireLockScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0`)
+	// 锁属于owner时续期
+	extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	// 锁属于owner时删除
+	releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	// 带fencing token写入一个key
+	fencedSetScript = redis.NewScript(checkFencingTokenLua + `
+redis.call("SET", KEYS[2], ARGV[2])
+return 1`)
+)
+
+// 分布式锁，每次加锁都有唯一的owner和一个比之前所有持有者都大的fencing token
+type Lock struct {
+	Key   string
+	Owner string
+	Token int64
+}
+
+// 获取锁，非阻塞，锁被其他owner持有时返回nil
+func AcquireLock(key string, ttl time.Duration) (*Lock, error) {
+	owner := utils.CreateUUID()
+	token, err := acquireLockScript.Run(RedisClient, []string{key, GenFencingTokenKey(key)},
+		owner, ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, nil
+	}
+	return &Lock{Key: key, Owner: owner, Token: token}, nil
+}
+
+// 续期锁，锁已经过期或者被其他owner持有时返回false
+func (l *Lock) Extend(ttl time.Duration) (bool, error) {
+	result, err := extendLockScript.Run(RedisClient, []string{l.Key}, l.Owner, ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	return result == 1, err
+}
+
+// 释放锁，锁已经不属于owner时返回false，不会删除其他owner持有的锁
+func (l *Lock) Release() (bool, error) {
+	result, err := releaseLockScript.Run(RedisClient, []string{l.Key}, l.Owner).Int64()
+	return result == 1, err
+}
+
+// 带fencing token写入key，token小于已经写入过的token时返回ErrStaleFencingToken，token为0时同checkFencingTokenLua
+func SetWithFencingToken(key string, value interface{}, token int64) error {
+	result, err := fencedSetScript.Run(RedisClient, []string{GenFenceKey(key), key}, token, value).Int64()
+	if err != nil {
+		return err
+	}
+	if result < 0 {
+		return ErrStaleFencingToken
+	}
+	return nil
+}
+
+// 锁的fencing token计数器
+func GenFencingTokenKey(lockKey string) string {
+	return fmt.Sprintf("%s/%s", lockKey, "fencing-token")
+}
+
+// 记录写入key的最大fencing token
+func GenFenceKey(key string) string {
+	return fmt.Sprintf("%s/%s", key, "fence")
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"sort"
+	"time"
+)
+
+// 实例注册表：hash中保存实例的记录，zset中保存实例最后一次心跳的毫秒时间戳，每次更新都是原子的，不需要加锁
+var (
+	instanceRegistryKey   = GenInstanceRegistryKey(common.BuildJobPrefix)
+	instanceHeartbeatsKey = GenInstanceHeartbeatsKey(common.BuildJobPrefix)
+
+	// 实例还在注册表中时更新心跳时间，已经被移除的实例不会重新加入
+	heartbeatInstanceScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+	return 1
+end
+return 0`)
+)
+
+// 加入或者覆盖实例的记录
+func RegisterInstance(m *models.CoordinationMember) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	pipe := RedisClient.TxPipeline()
+	pipe.HSet(instanceRegistryKey, m.Name, data)
+	pipe.ZAdd(instanceHeartbeatsKey, redis.Z{Score: float64(toMillis(m.LastHeartbeat)), Member: m.Name})
+	_, err = pipe.Exec()
+	return err
+}
+
+// 更新实例的心跳时间，实例不在注册表中时返回false
+func HeartbeatInstance(name string, at time.Time) (bool, error) {
+	result, err := heartbeatInstanceScript.Run(RedisClient, []string{instanceRegistryKey, instanceHeartbeatsKey}, name, toMillis(at)).Int64()
+	return result == 1, err
+}
+
+func DeregisterInstance(name string) error {
+	pipe := RedisClient.TxPipeline()
+	pipe.HDel(instanceRegistryKey, name)
+	pipe.ZRem(instanceHeartbeatsKey, name)
+	_, err := pipe.Exec()
+	return err
+}
+
+// 查询注册表中所有实例的记录，按照启动的先后顺序排列
+func ListRegisteredInstances() ([]*models.CoordinationMember, error) {
+	pipe := RedisClient.Pipeline()
+	recordsCmd := pipe.HGetAll(instanceRegistryKey)
+	heartbeatsCmd := pipe.ZRangeWithScores(instanceHeartbeatsKey, 0, -1)
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	heartbeats := make(map[string]time.Time)
+	for _, z := range heartbeatsCmd.Val() {
+		name, _ := z.Member.(string)
+		heartbeats[name] = time.Unix(0, int64(z.Score)*int64(time.Millisecond))
+	}
+	members := make([]*models.CoordinationMember, 0, len(recordsCmd.Val()))
+	for name, data := range recordsCmd.Val() {
+		m := &models.CoordinationMember{}
+		if err := json.Unmarshal([]byte(data), m); err != nil {
+			return nil, err
+		}
+		m.Name = name
+		if heartbeat, ok := heartbeats[name]; ok {
+			m.LastHeartbeat = heartbeat
+		}
+		members = append(members, m)
+	}
+	SortMembers(members)
+	return members, nil
+}
+
+// 查询注册表中所有实例的名字，按照启动的先后顺序排列
+func GetInstanceNameList() ([]string, error) {
+	members, err := ListRegisteredInstances()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
+
+// 按照启动时间排序，启动时间相同时按照实例名排序
+func SortMembers(members []*models.CoordinationMember) {
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].StartedAt.Equal(members[j].StartedAt) {
+			return members[i].StartedAt.Before(members[j].StartedAt)
+		}
+		return members[i].Name < members[j].Name
+	})
+}
+
+func GenInstanceRegistryKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "instance-registry")
+}
+
+func GenInstanceHeartbeatsKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "instance-heartbeats")
+}
@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestQueueGroup = "workers" // 所有实例共用一个消费组，每个请求只会被一个实例消费
+	requestQueueField = "request" // 消息中保存请求的字段
+)
+
+var (
+	requestQueueIndexKey = GenRequestQueueIndexKey(common.BuildJobPrefix)
+	requestQueueStatsKey = GenRequestQueueStatsKey(common.BuildJobPrefix)
+
+	// 队列为空时从索引中移除，和入队的事务互斥，不会移除刚刚入队的队列
+	removeEmptyQueueScript = redis.NewScript(`
+if redis.call("XLEN", KEYS[1]) == 0 then
+	return redis.call("SREM", KEYS[2], ARGV[1])
+end
+return 0`)
+)
+
+// 每个命名空间的每个优先级是一个队列，队列名为namespace/priority，对应一个redis stream
+// 所有有请求的队列记录在索引中，读取时只需要遍历索引
+type QueueName struct {
+	Namespace string
+	Priority  int
+}
+
+func (n QueueName) String() string {
+	return fmt.Sprintf("%s/%d", n.Namespace, n.Priority)
+}
+
+func ParseQueueName(s string) (QueueName, error) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return QueueName{}, fmt.Errorf("invalid queue name %s", s)
+	}
+	priority, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return QueueName{}, fmt.Errorf("invalid queue name %s", s)
+	}
+	return QueueName{Namespace: s[:i], Priority: priority}, nil
+}
+
+func QueueNameOf(m *models.Request) QueueName {
+	return QueueName{Namespace: m.Namespace, Priority: m.Priority}
+}
+
+// 队列中的一条消息
+type QueueMessage struct {
+	ID       string          // redis stream中的消息ID
+	Queue    QueueName       // 消息所在的队列
+	Consumer string          // 当前消费者，即实例名
+	Request  *models.Request // 入队时的请求
+}
+
+// 创建消费组，消费组已经存在时直接返回成功
+func CreateRequestQueueGroup(queue QueueName) error {
+	err := RedisClient.Do("XGROUP", "CREATE", GenRequestQueueKey(common.BuildJobPrefix, queue), requestQueueGroup, "0", "MKSTREAM").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// 请求入队，同时记录到队列索引中
+func PushRequestToQueue(m *models.Request) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	queue := QueueNameOf(m)
+	pipe := RedisClient.TxPipeline()
+	idCmd := pipe.XAdd(&redis.XAddArgs{
+		Stream: GenRequestQueueKey(common.BuildJobPrefix, queue),
+		Values: map[string]interface{}{requestQueueField: data},
+	})
+	pipe.SAdd(requestQueueIndexKey, queue.String())
+	_, err = pipe.Exec()
+	if err != nil {
+		return "", err
+	}
+	return idCmd.Val(), nil
+}
+
+// 查询所有可能有请求的队列
+func ListRequestQueues() ([]QueueName, error) {
+	members, err := RedisClient.SMembers(requestQueueIndexKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	queues := make([]QueueName, 0, len(members))
+	for _, member := range members {
+		queue, err := ParseQueueName(member)
+		if err != nil {
+			continue
+		}
+		queues = append(queues, queue)
+	}
+	return queues, nil
+}
+
+// 队列中没有任何请求时从索引中移除
+func RemoveRequestQueueIfEmpty(queue QueueName) error {
+	return removeEmptyQueueScript.Run(RedisClient,
+		[]string{GenRequestQueueKey(common.BuildJobPrefix, queue), requestQueueIndexKey}, queue.String()).Err()
+}
+
+// 以consumer的身份从队列中读取一条新消息，不阻塞，没有消息时返回nil
+func ReadRequestFromQueue(consumer string, queue QueueName) (*QueueMessage, error) {
+	streams, err := RedisClient.XReadGroup(&redis.XReadGroupArgs{
+		Group:    requestQueueGroup,
+		Consumer: consumer,
+		Streams:  []string{GenRequestQueueKey(common.BuildJobPrefix, queue), ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			return newQueueMessage(consumer, queue, message)
+		}
+	}
+	return nil, nil
+}
+
+// 确认消息已经处理完成，并从队列中删除
+func AckRequestInQueue(queue QueueName, id string) error {
+	key := GenRequestQueueKey(common.BuildJobPrefix, queue)
+	pipe := RedisClient.TxPipeline()
+	pipe.XAck(key, requestQueueGroup, id)
+	pipe.Process(redis.NewCmd("XDEL", key, id)) // 当前版本的客户端没有封装XDEL
+	_, err := pipe.Exec()
+	return err
+}
+
+// 查询已经被消费但是还没有确认的消息
+func ListPendingRequestsInQueue(queue QueueName, count int64) ([]redis.XPendingExt, error) {
+	pending, err := RedisClient.XPendingExt(&redis.XPendingExtArgs{
+		Stream: GenRequestQueueKey(common.BuildJobPrefix, queue),
+		Group:  requestQueueGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return pending, err
+}
+
+// 根据消息ID查询消息，消息已经被删除时不返回
+func GetRequestsInQueue(consumer string, queue QueueName, ids []string) ([]*QueueMessage, error) {
+	key := GenRequestQueueKey(common.BuildJobPrefix, queue)
+	pipe := RedisClient.Pipeline()
+	cmds := make([]*redis.XMessageSliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.XRange(key, id, id)
+	}
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make([]*QueueMessage, 0, len(ids))
+	for _, cmd := range cmds {
+		for _, message := range cmd.Val() {
+			m, err := newQueueMessage(consumer, queue, message)
+			if err != nil {
+				continue
+			}
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// 把空闲时间超过minIdle的消息转给consumer，其他实例已经认领的消息不会返回
+func ClaimRequestsInQueue(consumer string, queue QueueName, minIdle time.Duration, ids []string) ([]*QueueMessage, error) {
+	messages, err := RedisClient.XClaim(&redis.XClaimArgs{
+		Stream:   GenRequestQueueKey(common.BuildJobPrefix, queue),
+		Group:    requestQueueGroup,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*QueueMessage, 0, len(messages))
+	for _, message := range messages {
+		m, err := newQueueMessage(consumer, queue, message)
+		if err != nil {
+			// 消息已经损坏，确认掉避免一直被认领
+			_ = AckRequestInQueue(queue, message.ID)
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// 查询队列中还没有被读取的请求，按照入队的顺序排列
+func ListWaitingRequestsInQueue(queue QueueName) ([]*QueueMessage, error) {
+	key := GenRequestQueueKey(common.BuildJobPrefix, queue)
+	messages, err := RedisClient.XRange(key, "-", "+").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	pending, err := ListPendingRequestsInQueue(queue, int64(len(messages)))
+	if err != nil {
+		return nil, err
+	}
+	delivered := make(map[string]bool, len(pending))
+	for _, p := range pending {
+		delivered[p.Id] = true
+	}
+	result := make([]*QueueMessage, 0, len(messages))
+	for _, message := range messages {
+		if delivered[message.ID] {
+			continue
+		}
+		m, err := newQueueMessage("", queue, message)
+		if err != nil {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// 统计队列中还没有被读取的请求数
+func CountWaitingRequestsInQueue(queue QueueName) (int64, error) {
+	key := GenRequestQueueKey(common.BuildJobPrefix, queue)
+	total, err := RedisClient.XLen(key).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	pending, err := RedisClient.XPending(key, requestQueueGroup).Result()
+	if err == redis.Nil {
+		return total, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return total - pending.Count, nil
+}
+
+// 记录一次请求的执行时长，用于估计排队请求的开始时间
+func RecordRequestExecution(d time.Duration) error {
+	pipe := RedisClient.TxPipeline()
+	pipe.HIncrBy(requestQueueStatsKey, "count", 1)
+	pipe.HIncrBy(requestQueueStatsKey, "total_ms", d.Nanoseconds()/int64(time.Millisecond))
+	_, err := pipe.Exec()
+	return err
+}
+
+// 请求的平均执行时长，没有记录时返回0
+func GetAverageRequestExecution() (time.Duration, error) {
+	values, err := RedisClient.HMGet(requestQueueStatsKey, "count", "total_ms").Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	count, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+	totalMS, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	if count <= 0 {
+		return 0, nil
+	}
+	return time.Duration(totalMS/count) * time.Millisecond, nil
+}
+
+func newQueueMessage(consumer string, queue QueueName, message redis.XMessage) (*QueueMessage, error) {
+	data, ok := message.Values[requestQueueField].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid message %s in request queue %s", message.ID, queue)
+	}
+	m := &models.Request{}
+	if err := json.Unmarshal([]byte(data), m); err != nil {
+		return nil, err
+	}
+	return &QueueMessage{ID: message.ID, Queue: queue, Consumer: consumer, Request: m}, nil
+}
+
+func GenRequestQueueKey(prefix string, queue QueueName) string {
+	return GenRequestQueueKeyPrefix(prefix) + queue.String()
+}
+
+// 所有请求队列的key的公共前缀
+func GenRequestQueueKeyPrefix(prefix string) string {
+	return fmt.Sprintf("%s/%s/", prefix, "queue")
+}
+
+func GenRequestQueueIndexKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "queue-index")
+}
+
+func GenRequestQueueStatsKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", prefix, "queue-stats")
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 启动一个进程内的redis，测试结束后恢复原来的客户端
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	client := RedisClient
+	RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		RedisClient.Close()
+		RedisClient = client
+	})
+	return s
+}
+
+func TestRequestQueue(t *testing.T) {
+	newTestRedis(t)
+	queue := QueueName{Namespace: "ci", Priority: 5}
+	if err := CreateRequestQueueGroup(queue); err != nil {
+		t.Fatalf("create group failed: %v", err)
+	}
+	// 消费组已经存在时也返回成功
+	if err := CreateRequestQueueGroup(queue); err != nil {
+		t.Fatalf("create existing group failed: %v", err)
+	}
+	for _, id := range []string{"r1", "r2"} {
+		if _, err := PushRequestToQueue(&models.Request{RequestID: id, Namespace: "ci", Priority: 5}); err != nil {
+			t.Fatalf("push %s failed: %v", id, err)
+		}
+	}
+	queues, err := ListRequestQueues()
+	if err != nil || len(queues) != 1 || queues[0] != queue {
+		t.Fatalf("expect queue %s in index, got %v, err: %v", queue, queues, err)
+	}
+
+	message, err := ReadRequestFromQueue("a", queue)
+	if err != nil || message == nil || message.Request.RequestID != "r1" || message.Consumer != "a" {
+		t.Fatalf("expect a to read r1, got %+v, err: %v", message, err)
+	}
+	// 已经被读取的请求不算在等待的请求中
+	if count, err := CountWaitingRequestsInQueue(queue); err != nil || count != 1 {
+		t.Errorf("expect 1 waiting request, got %d, err: %v", count, err)
+	}
+	waiting, err := ListWaitingRequestsInQueue(queue)
+	if err != nil || len(waiting) != 1 || waiting[0].Request.RequestID != "r2" {
+		t.Errorf("expect r2 to be waiting, got %v, err: %v", waiting, err)
+	}
+
+	// 每条消息只会被一个消费者读取
+	other, err := ReadRequestFromQueue("b", queue)
+	if err != nil || other == nil || other.Request.RequestID != "r2" {
+		t.Fatalf("expect b to read r2, got %+v, err: %v", other, err)
+	}
+	if empty, err := ReadRequestFromQueue("b", queue); err != nil || empty != nil {
+		t.Fatalf("expect empty queue, got %+v, err: %v", empty, err)
+	}
+
+	// 确认后的消息从队列中删除，队列为空时可以从索引中移除
+	if err = RemoveRequestQueueIfEmpty(queue); err != nil {
+		t.Fatalf("remove queue failed: %v", err)
+	}
+	if queues, _ = ListRequestQueues(); len(queues) != 1 {
+		t.Fatalf("expect queue with unacked requests to stay in index, got %v", queues)
+	}
+	for _, m := range []*QueueMessage{message, other} {
+		if err = AckRequestInQueue(queue, m.ID); err != nil {
+			t.Fatalf("ack %s failed: %v", m.ID, err)
+		}
+	}
+	if pending, err := ListPendingRequestsInQueue(queue, 10); err != nil || len(pending) != 0 {
+		t.Errorf("expect no pending requests after ack, got %v, err: %v", pending, err)
+	}
+	if err = RemoveRequestQueueIfEmpty(queue); err != nil {
+		t.Fatalf("remove queue failed: %v", err)
+	}
+	if queues, _ = ListRequestQueues(); len(queues) != 0 {
+		t.Errorf("expect empty queue to be removed from index, got %v", queues)
+	}
+}
+
+func TestClaimRequestsInQueue(t *testing.T) {
+	s := newTestRedis(t)
+	now := time.Now()
+	s.SetTime(now)
+	queue := QueueName{Namespace: "ci", Priority: 5}
+	if err := CreateRequestQueueGroup(queue); err != nil {
+		t.Fatalf("create group failed: %v", err)
+	}
+	if _, err := PushRequestToQueue(&models.Request{RequestID: "r1", Namespace: "ci", Priority: 5}); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	message, err := ReadRequestFromQueue("a", queue)
+	if err != nil || message == nil {
+		t.Fatalf("read failed: %+v, err: %v", message, err)
+	}
+
+	// 读取之后没有确认的消息记录了消费者和空闲时间
+	s.SetTime(now.Add(time.Minute))
+	pending, err := ListPendingRequestsInQueue(queue, 10)
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "a" || pending[0].Idle < time.Minute {
+		t.Fatalf("expect r1 to be pending on a for a minute, got %v, err: %v", pending, err)
+	}
+	claimed, err := ClaimRequestsInQueue("b", queue, time.Second, []string{message.ID})
+	if err != nil || len(claimed) != 1 || claimed[0].Request.RequestID != "r1" || claimed[0].Consumer != "b" {
+		t.Fatalf("expect b to claim r1, got %v, err: %v", claimed, err)
+	}
+	// 认领后消息属于新的消费者，空闲时间重新计算
+	pending, err = ListPendingRequestsInQueue(queue, 10)
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "b" || pending[0].Idle != 0 {
+		t.Errorf("expect r1 to be pending on b, got %v, err: %v", pending, err)
+	}
+	// 已经确认的消息不能再被认领
+	if err = AckRequestInQueue(queue, message.ID); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+	claimed, err = ClaimRequestsInQueue("c", queue, 0, []string{message.ID})
+	if err != nil || len(claimed) != 0 {
+		t.Errorf("expect acked message not to be claimed, got %v, err: %v", claimed, err)
+	}
+}
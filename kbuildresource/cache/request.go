@@ -10,10 +10,27 @@ import (
 )
 
 var (
-	instanceNameListKey = GenInstanceNameListKey(common.BuildJobPrefix)
+	// 查询所有实例的名字，默认读取redis中的实例注册表，协调后端不是redis时由协调后端注册
+	listInstanceNames = GetInstanceNameList
+
+	fencedAddRequestScript = redis.NewScript(checkFencingTokenLua + `
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+return 1`)
+	fencedDeleteRequestScript = redis.NewScript(checkFencingTokenLua + `
+redis.call("HDEL", KEYS[2], ARGV[2])
+return 1`)
+	// 原来的列表中没有这个请求时返回0，不写入新的列表
+	moveRequestScript = redis.NewScript(checkFencingTokenLua + `
+if redis.call("HDEL", KEYS[2], ARGV[2]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[3])
+return 1`)
 )
 
 // 添加一个请求到当前实例的缓存列表中
+// token小于这个实例的缓存已经写入过的token返回ErrStaleFencingToken
+// 缓存列表被接管过，记录了持有锁的实例的token之后，不带token的写入也返回ErrStaleFencingToken，比如被判定死亡后恢复的实例的写入
 func AddRequest(m *models.Request) error {
 	requestKey := GenRequestKey(common.BuildJobPrefix, m.InstanceName)
 	requestJsonData, err := json.Marshal(m)
@@ -21,25 +38,59 @@ func AddRequest(m *models.Request) error {
 		log.Error("ERROR: ", err)
 		return err
 	}
-	err = RedisClient.HSet(requestKey, GenFieldByRequest(m), requestJsonData).Err()
-	if err != nil {
-		return err
-	}
-	return nil
+	return runFencedRequestScript(fencedAddRequestScript, requestKey, m.FencingToken, GenFieldByRequest(m), requestJsonData)
 }
 
 func UpdateRequest(m *models.Request) error {
 	return AddRequest(m)
 }
 
+// 从实例的缓存列表中删除请求，fencing token的检查同AddRequest
 func DeleteRequest(m *models.Request) error{
 	requestKey := GenRequestKey(common.BuildJobPrefix, m.InstanceName)
-	return RedisClient.HDel(requestKey, GenFieldByRequest(m)).Err()
+	return runFencedRequestScript(fencedDeleteRequestScript, requestKey, m.FencingToken, GenFieldByRequest(m))
+}
+
+// 把请求从原来实例的缓存列表原子地转到newInstanceName的列表中，fencing token的检查同AddRequest
+// 请求已经不在原来的列表中，比如已经被其他实例转走，返回false
+func MoveRequest(m *models.Request, newInstanceName string) (bool, error) {
+	from := GenRequestKey(common.BuildJobPrefix, m.InstanceName)
+	to := GenRequestKey(common.BuildJobPrefix, newInstanceName)
+	moved := *m
+	moved.InstanceName = newInstanceName
+	requestJsonData, err := json.Marshal(&moved)
+	if err != nil {
+		return false, err
+	}
+	result, err := moveRequestScript.Run(RedisClient, []string{GenFenceKey(from), from, to},
+		m.FencingToken, GenFieldByRequest(m), requestJsonData).Int64()
+	if err != nil {
+		return false, err
+	}
+	if result < 0 {
+		return false, ErrStaleFencingToken
+	}
+	if result == 0 {
+		return false, nil
+	}
+	m.InstanceName = newInstanceName
+	return true, nil
+}
+
+func runFencedRequestScript(script *redis.Script, requestKey string, token int64, args ...interface{}) error {
+	result, err := script.Run(RedisClient, []string{GenFenceKey(requestKey), requestKey}, append([]interface{}{token}, args...)...).Int64()
+	if err != nil {
+		return err
+	}
+	if result < 0 {
+		return ErrStaleFencingToken
+	}
+	return nil
 }
 
 // 查询某个特定的请求，需要从全局查询
 func GetRequestByNameAndRequestType(name string, requestType string) (*models.Request, error) {
-	instanceNameList, err := GetInstanceNameList()
+	instanceNameList, err := listInstanceNames()
 	if err != nil {
 		return nil, err
 	}
@@ -87,33 +138,24 @@ func GetRequestByNameAndRequestTypeAndInstanceName(name string, requestType stri
 	return m, nil
 }
 
-func GetInstanceNameList() ([]string, error) {
-	instanceNameListJsonData, err := RedisClient.Get(instanceNameListKey).Result()
-	instanceNameList := make([]string, 0)
-	// 不存在，不用操作
-	if err == redis.Nil {
-		return instanceNameList, nil
-	} else if err != nil {
-		return nil, err
-	} else {
-		// 存在
-		err = json.Unmarshal([]byte(instanceNameListJsonData), &instanceNameList)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return instanceNameList, nil
+// 注册查询实例列表的函数，请求的全局查询遍历这些实例的缓存
+func RegisterInstanceNameLister(lister func() ([]string, error)) {
+	listInstanceNames = lister
 }
 
-
+// 实例是否存活，实例的存活key过期或者不存在表示实例已经死亡
+func IsInstanceLive(instanceName string) bool {
+	return !IsExpire(GenInstanceKey(common.BuildJobPrefix, instanceName))
+}
 
 // redis key键设置
 func GenMetaDistributeKey(prefix string) string {
 	return fmt.Sprintf("%s/%s", prefix, "meta")
 }
 
-func GenInstanceNameListKey(prefix string) string {
-	return fmt.Sprintf("%s/%s", prefix, "instance-name-list")
+// 主备任务的分布式锁
+func GenMasterKey(prefix string, jobName string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, "masters", jobName)
 }
 
 func GenRequestKey(prefix string, instanceName string) string {
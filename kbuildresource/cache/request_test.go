@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/models"
+)
+
+func newTestCachedRequest(name string, instanceName string, token int64) *models.Request {
+	return &models.Request{RequestID: name + "-id", Name: name, RequestType: "buildjob_create", InstanceName: instanceName, FencingToken: token}
+}
+
+func TestFencedRequestWrites(t *testing.T) {
+	newTestRedis(t)
+	// 没有被接管过的缓存列表不检查token
+	for _, name := range []string{"r1", "r2"} {
+		if err := AddRequest(newTestCachedRequest(name, "a", 0)); err != nil {
+			t.Fatalf("add %s failed: %v", name, err)
+		}
+	}
+	// 持有token为5的锁的实例b接管a的请求，a的缓存列表记录了token
+	moved, err := MoveRequest(newTestCachedRequest("r1", "a", 5), "b")
+	if err != nil || !moved {
+		t.Fatalf("expect r1 to be moved, got %v, err: %v", moved, err)
+	}
+
+	cases := []struct {
+		desc  string
+		token int64
+		err   error
+	}{
+		// 被判定死亡后恢复的实例a不带token写入
+		{"unfenced", 0, ErrStaleFencingToken},
+		// 锁过期之前的持有者
+		{"stale token", 4, ErrStaleFencingToken},
+		{"current token", 5, nil},
+		{"newer token", 6, nil},
+		// 更新的持有者写入之后，原来的token也过期了
+		{"superseded token", 5, ErrStaleFencingToken},
+	}
+	for _, c := range cases {
+		if err = AddRequest(newTestCachedRequest("r2", "a", c.token)); err != c.err {
+			t.Errorf("%s: expect add to return %v, got %v", c.desc, c.err, err)
+		}
+		if err = DeleteRequest(newTestCachedRequest("r3", "a", c.token)); err != c.err {
+			t.Errorf("%s: expect delete to return %v, got %v", c.desc, c.err, err)
+		}
+	}
+	if moved, err = MoveRequest(newTestCachedRequest("r2", "a", 0), "c"); err != ErrStaleFencingToken || moved {
+		t.Errorf("expect unfenced move to be rejected, got %v, err: %v", moved, err)
+	}
+
+	// 接管者自己的缓存列表没有记录token，不带token的写入不受影响
+	if err = UpdateRequest(newTestCachedRequest("r1", "b", 0)); err != nil {
+		t.Errorf("expect unfenced write to the new instance to succeed, got %v", err)
+	}
+	if _, err = GetRequestByNameAndRequestTypeAndInstanceName("r1", "buildjob_create", "a"); err != redis.Nil {
+		t.Errorf("expect r1 to be removed from a, got %v", err)
+	}
+}
+
+func TestSetWithFencingToken(t *testing.T) {
+	s := newTestRedis(t)
+	if err := SetWithFencingToken("meta", "v0", 0); err != nil {
+		t.Fatalf("expect unfenced set without recorded token to succeed, got %v", err)
+	}
+	if err := SetWithFencingToken("meta", "v2", 2); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	for _, token := range []int64{0, 1} {
+		if err := SetWithFencingToken("meta", "stale", token); err != ErrStaleFencingToken {
+			t.Errorf("expect token %d to be rejected, got %v", token, err)
+		}
+	}
+	if value, _ := s.Get("meta"); value != "v2" {
+		t.Errorf("expect stale writes not to overwrite, got %s", value)
+	}
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"time"
+)
+
+var (
+	// 先清理过期的许可，再判断是否还有剩余的许可；已经持有许可时只续期
+	// 许可保存在有序集合中，成员是持有者，分数是过期时间，持有者死亡后许可过期，下次获取时被回收
+	acquireSemaphoreScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) or redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], ARGV[4], ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[5])
+	return 1
+end
+return 0`)
+	// 许可还属于持有者时续期
+	renewSemaphoreScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	return 1
+end
+return 0`)
+)
+
+// 获取分布式信号量的一个许可，许可已经用完时返回false
+// limit是许可的总数，ttl是许可的有效期，持有者需要在过期之前续期
+func AcquireSemaphore(key string, holder string, limit int, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result, err := acquireSemaphoreScript.Run(RedisClient, []string{key},
+		holder, limit, toMillis(now), toMillis(now.Add(ttl)), ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	return result == 1, err
+}
+
+// 续期许可，许可已经过期被回收时返回false
+func RenewSemaphore(key string, holder string, ttl time.Duration) (bool, error) {
+	result, err := renewSemaphoreScript.Run(RedisClient, []string{key},
+		holder, toMillis(time.Now().Add(ttl)), ttl.Nanoseconds()/int64(time.Millisecond)).Int64()
+	return result == 1, err
+}
+
+func ReleaseSemaphore(key string, holder string) error {
+	return RedisClient.ZRem(key, holder).Err()
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func GenClusterSemaphoreKey(prefix string, clusterName string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, "semaphores/clusters", clusterName)
+}
+
+func GenNamespaceSemaphoreKey(prefix string, namespace string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, "semaphores/namespaces", namespace)
+}
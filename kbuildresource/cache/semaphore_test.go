@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	newTestRedis(t)
+	key := GenNamespaceSemaphoreKey("buildjob", "ci")
+	acquire := func(holder string) bool {
+		ok, err := AcquireSemaphore(key, holder, 2, time.Minute)
+		if err != nil {
+			t.Fatalf("acquire for %s failed: %v", holder, err)
+		}
+		return ok
+	}
+	if !acquire("a") || !acquire("b") {
+		t.Fatal("expect permits to be acquired within limit")
+	}
+	if acquire("c") {
+		t.Fatal("expect permits to be exhausted")
+	}
+	// 已经持有许可时再次获取只续期，不占用新的许可
+	if !acquire("a") {
+		t.Error("expect holder to acquire its own permit again")
+	}
+
+	// 释放后其他持有者可以获取
+	if err := ReleaseSemaphore(key, "a"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if !acquire("c") {
+		t.Error("expect permit to be acquired after release")
+	}
+	if ok, err := RenewSemaphore(key, "a", time.Minute); err != nil || ok {
+		t.Errorf("expect released permit not to be renewed, got %v, err: %v", ok, err)
+	}
+}
+
+func TestSemaphoreExpiry(t *testing.T) {
+	newTestRedis(t)
+	key := GenClusterSemaphoreKey("buildjob", "test")
+	if ok, err := AcquireSemaphore(key, "dead", 1, 50*time.Millisecond); err != nil || !ok {
+		t.Fatalf("acquire failed: %v, err: %v", ok, err)
+	}
+	if ok, _ := AcquireSemaphore(key, "alive", 1, time.Minute); ok {
+		t.Fatal("expect permit to be held before expiry")
+	}
+	// 持有者没有续期，许可过期后在下次获取时被回收
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := AcquireSemaphore(key, "alive", 1, time.Minute); err != nil || !ok {
+		t.Fatalf("expect expired permit to be reclaimed, got %v, err: %v", ok, err)
+	}
+	if ok, err := RenewSemaphore(key, "dead", time.Minute); err != nil || ok {
+		t.Errorf("expect reclaimed permit not to be renewed, got %v, err: %v", ok, err)
+	}
+	if ok, err := RenewSemaphore(key, "alive", time.Minute); err != nil || !ok {
+		t.Errorf("expect held permit to be renewed, got %v, err: %v", ok, err)
+	}
+}
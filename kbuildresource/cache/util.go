@@ -32,6 +32,7 @@ func RedisGetLock(lockName string, acquireTimeout time.Duration, lockTimeout tim
 	return false, fmt.Errorf("timeout")
 }
 
+// 不检查锁的持有者，可能删除其他持有者的锁，需要互斥的场景使用AcquireLock和Lock.Release
 func RedisReleaseLock(lockName string) bool {
 	_, err := RedisClient.Del(lockName).Result()
 	if err != nil && err != redis.Nil {
@@ -46,7 +47,7 @@ func IsExpire(key string) bool {
 	return RedisClient.TTL(key).Val() == -2 * time.Second || RedisClient.TTL(key).Val() == -1 * time.Second
 }
 
-// 获取锁，非阻塞
+// 获取锁，非阻塞；锁的值是常量，不能区分持有者，需要互斥的场景使用AcquireLock
 func LockKey(key string, lockLeaseTime time.Duration) (bool, error) {
 	success, err := RedisClient.SetNX(key, "1", lockLeaseTime).Result()
 	if err != nil {
@@ -63,7 +64,7 @@ func RenewExpiration(key string, lockLeaseTime time.Duration) error {
 	}
 	// 不存在或者没有续期成功
 	if !success && IsExpire(key) {
-		log.Info("INFO: instance %s retry get lock", key)
+		log.Infof("INFO: instance %s retry get lock", key)
 		_, err := LockKey(key, lockLeaseTime)
 		if err != nil {
 			return err
@@ -73,10 +74,29 @@ func RenewExpiration(key string, lockLeaseTime time.Duration) error {
 	return nil
 }
 
+// 设置key，已经存在时覆盖，并重新设置过期时间
+func SetKey(key string, ttl time.Duration) error {
+	return RedisClient.Set(key, "1", ttl).Err()
+}
+
+// 续期已经存在的key，key已经过期或者不存在时返回false，不会重新创建
+// 使用毫秒精度，存活租约的有效期不是整秒时不会被截断
+func ExtendExpiration(key string, ttl time.Duration) (bool, error) {
+	success, err := RedisClient.PExpire(key, ttl).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return success, nil
+}
+
 func DelKey(key string) error {
 	_, err := RedisClient.Del(key).Result()
 	if err != nil && err != redis.Nil {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+// 检查redis是否可用
+func Ping() error {
+	return RedisClient.Ping().Err()
+}
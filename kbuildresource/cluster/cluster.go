@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	KubernetesExecutorType = "kubernetes"
+	SimulatedExecutorType  = "simulated"
+)
+
+// 校验集群配置，返回所有出错的字段
+func VerifyCluster(m *models.Cluster) error {
+	fieldErrors := make([]*common.FieldError, 0)
+	for _, msg := range validation.IsDNS1123Label(m.Name) {
+		fieldErrors = append(fieldErrors, &common.FieldError{Field: "name", Value: m.Name, Message: msg})
+	}
+	if m.ExecutorType != KubernetesExecutorType && m.ExecutorType != SimulatedExecutorType {
+		fieldErrors = append(fieldErrors, &common.FieldError{Field: "executorType", Value: m.ExecutorType, Message: "must be kubernetes or simulated"})
+	}
+	if m.Capacity < 0 {
+		fieldErrors = append(fieldErrors, &common.FieldError{Field: "capacity", Value: m.Capacity, Message: "must be greater than or equal to 0"})
+	}
+	if len(fieldErrors) > 0 {
+		return common.NewValidationError(fieldErrors)
+	}
+	return nil
+}
+
+func CreateCluster(m *models.Cluster) error {
+	if m.ExecutorType == "" {
+		m.ExecutorType = KubernetesExecutorType
+	}
+	if err := VerifyCluster(m); err != nil {
+		return err
+	}
+	existed, err := models.GetClusterByName(m.Name)
+	if err != nil {
+		return err
+	}
+	if existed != nil {
+		return common.NewConflictError("cluster %s already exists", m.Name)
+	}
+	_, err = models.AddCluster(m)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("INFO: register cluster %s", m.Name)
+	return nil
+}
+
+// 更新集群配置，集群名不能修改
+func UpdateCluster(name string, m *models.Cluster) (*models.Cluster, error) {
+	existed, err := GetCluster(name)
+	if err != nil {
+		return nil, err
+	}
+	existed.APIEndpoint = m.APIEndpoint
+	existed.CredentialsRef = m.CredentialsRef
+	existed.ExecutorType = m.ExecutorType
+	existed.NetworkZone = m.NetworkZone
+	existed.Capacity = m.Capacity
+	existed.Enabled = m.Enabled
+	if existed.ExecutorType == "" {
+		existed.ExecutorType = KubernetesExecutorType
+	}
+	if err = VerifyCluster(existed); err != nil {
+		return nil, err
+	}
+	if err = models.UpdateCluster(existed); err != nil {
+		return nil, err
+	}
+	logrus.Infof("INFO: update cluster %s", name)
+	return existed, nil
+}
+
+// 删除集群，集群中还有构建任务时不允许删除，需要先禁用再等构建任务删除完
+func DeleteCluster(name string) error {
+	if _, err := GetCluster(name); err != nil {
+		return err
+	}
+	count, err := models.CountActivePodsByCluster(name)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewConflictError("cluster %s still has %d buildJobs", name, count)
+	}
+	_, err = models.DeleteClusterByName(name)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("INFO: delete cluster %s", name)
+	return nil
+}
+
+// 查询集群，不存在时返回404错误
+func GetCluster(name string) (*models.Cluster, error) {
+	m, err := models.GetClusterByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, common.NewNotFoundError("cluster %s not found", name)
+	}
+	return m, nil
+}
+
+// 查询可以创建构建任务的集群，集群不存在或者被禁用时返回错误
+func GetAvailableCluster(name string) (*models.Cluster, error) {
+	m, err := GetCluster(name)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Enabled {
+		return nil, common.NewBadRequestError("cluster %s is disabled", name)
+	}
+	return m, nil
+}
+
+func ListClusters() ([]*models.Cluster, error) {
+	return models.ListClusters()
+}
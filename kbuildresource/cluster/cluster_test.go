@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/astaxie/beego/orm"
+	_ "github.com/mattn/go-sqlite3"
+
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+)
+
+var registerTestDB sync.Once
+
+// 使用sqlite内存数据库代替mysql，每个测试开始时清空所有表
+func newTestDB(t *testing.T) {
+	registerTestDB.Do(func() {
+		if err := orm.RegisterDataBase("default", "sqlite3", "file::memory:?cache=shared"); err != nil {
+			t.Fatalf("register database failed: %v", err)
+		}
+		orm.RegisterModel(new(models.Container), new(models.Pod), new(models.Cluster))
+		if err := orm.RunSyncdb("default", false, false); err != nil {
+			t.Fatalf("create tables failed: %v", err)
+		}
+	})
+	o := orm.NewOrm()
+	for _, table := range []string{"container", "pod", "cluster"} {
+		if _, err := o.Raw("delete from " + table).Exec(); err != nil {
+			t.Fatalf("clear table %s failed: %v", table, err)
+		}
+	}
+}
+
+func TestVerifyCluster(t *testing.T) {
+	cases := []struct {
+		desc    string
+		cluster *models.Cluster
+		fields  []string
+	}{
+		{"valid", &models.Cluster{Name: "prod-1", ExecutorType: KubernetesExecutorType, Capacity: 10}, nil},
+		{"invalid name", &models.Cluster{Name: "Prod_1", ExecutorType: SimulatedExecutorType}, []string{"name"}},
+		{"all invalid", &models.Cluster{Name: "", ExecutorType: "docker", Capacity: -1}, []string{"name", "executorType", "capacity"}},
+	}
+	for _, c := range cases {
+		err := VerifyCluster(c.cluster)
+		if len(c.fields) == 0 {
+			if err != nil {
+				t.Errorf("%s: expect no error, got %v", c.desc, err)
+			}
+			continue
+		}
+		statusErr, ok := err.(*common.StatusError)
+		if !ok || statusErr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expect validation error, got %v", c.desc, err)
+			continue
+		}
+		fieldErrors, _ := statusErr.Details.([]*common.FieldError)
+		fields := make(map[string]bool)
+		for _, fieldError := range fieldErrors {
+			fields[fieldError.Field] = true
+		}
+		for _, field := range c.fields {
+			if !fields[field] {
+				t.Errorf("%s: expect error on field %s, got %v", c.desc, field, err)
+			}
+		}
+	}
+}
+
+func TestCreateCluster(t *testing.T) {
+	newTestDB(t)
+	m := &models.Cluster{Name: "prod-1", Capacity: 10, Enabled: true}
+	if err := CreateCluster(m); err != nil {
+		t.Fatalf("create cluster failed: %v", err)
+	}
+	// 没有指定执行器时默认使用kubernetes
+	created, err := GetCluster("prod-1")
+	if err != nil || created.ExecutorType != KubernetesExecutorType || created.Capacity != 10 {
+		t.Fatalf("expect kubernetes cluster prod-1, got %+v, err: %v", created, err)
+	}
+	if err = CreateCluster(&models.Cluster{Name: "prod-1"}); common.StatusCodeOf(err) != http.StatusConflict {
+		t.Errorf("expect conflict for duplicated cluster, got %v", err)
+	}
+	if _, err = GetCluster("prod-2"); common.StatusCodeOf(err) != http.StatusNotFound {
+		t.Errorf("expect not found for unknown cluster, got %v", err)
+	}
+}
+
+func TestUpdateCluster(t *testing.T) {
+	newTestDB(t)
+	if err := CreateCluster(&models.Cluster{Name: "prod-1", Capacity: 10, Enabled: true}); err != nil {
+		t.Fatalf("create cluster failed: %v", err)
+	}
+	updated, err := UpdateCluster("prod-1", &models.Cluster{Name: "ignored", ExecutorType: SimulatedExecutorType, Capacity: 5})
+	if err != nil || updated.Name != "prod-1" || updated.ExecutorType != SimulatedExecutorType || updated.Enabled {
+		t.Fatalf("expect disabled simulated cluster prod-1, got %+v, err: %v", updated, err)
+	}
+	// 被禁用的集群不能再创建构建任务
+	if _, err = GetAvailableCluster("prod-1"); common.StatusCodeOf(err) != http.StatusBadRequest {
+		t.Errorf("expect bad request for disabled cluster, got %v", err)
+	}
+	if _, err = UpdateCluster("prod-1", &models.Cluster{ExecutorType: "docker"}); common.StatusCodeOf(err) != http.StatusBadRequest {
+		t.Errorf("expect validation error for invalid executor type, got %v", err)
+	}
+}
+
+func TestDeleteCluster(t *testing.T) {
+	newTestDB(t)
+	if err := CreateCluster(&models.Cluster{Name: "prod-1", Enabled: true}); err != nil {
+		t.Fatalf("create cluster failed: %v", err)
+	}
+	pod := &models.Pod{Name: "agent-1", ClusterName: "prod-1", IsDelete: "0"}
+	if _, err := models.AddPod(pod); err != nil {
+		t.Fatalf("add pod failed: %v", err)
+	}
+	// 集群中还有构建任务时不允许删除
+	if err := DeleteCluster("prod-1"); common.StatusCodeOf(err) != http.StatusConflict {
+		t.Fatalf("expect conflict for cluster with buildJobs, got %v", err)
+	}
+	if _, err := models.DeletePodByName("agent-1"); err != nil {
+		t.Fatalf("delete pod failed: %v", err)
+	}
+	if err := DeleteCluster("prod-1"); err != nil {
+		t.Fatalf("delete cluster failed: %v", err)
+	}
+	if err := DeleteCluster("prod-1"); common.StatusCodeOf(err) != http.StatusNotFound {
+		t.Errorf("expect not found for deleted cluster, got %v", err)
+	}
+}
@@ -10,4 +10,18 @@ const (
 	RequestStatusExecuting string = "executing"
 	RequestStatusFailed string = "failed"
 	RequestStatusSuccess string = "success"
+	RequestStatusCanceled string = "canceled"
+
+	// request priority，数值越大越先执行
+	MinRequestPriority int = 1
+	MaxRequestPriority int = 9
+	DefaultRequestPriority int = 5
 )
+
+// 请求是否已经结束，结束的请求不会再发生状态变化
+func IsTerminalRequestStatus(status string) bool {
+	return status == RequestStatusFailed || status == RequestStatusSuccess || status == RequestStatusCanceled
+}
+
+// 实例的版本，编译时通过 -ldflags "-X bryson.foundation/kbuildresource/common.Version=xxx" 设置
+var Version = "dev"
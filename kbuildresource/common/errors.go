@@ -0,0 +1,121 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// 带有http状态码的错误，api层根据状态码返回真实的4xx/5xx
+type StatusError struct {
+	Code    int
+	Message string
+	Details interface{} // 错误详情，比如参数校验失败的字段列表
+	RetryAfter time.Duration // 大于0时返回Retry-After，告诉客户端多久之后重试
+}
+
+// 参数校验失败的字段
+type FieldError struct {
+	Field   string      `json:"field" description:"字段路径，eg: containers[0].requestCPU"`
+	Value   interface{} `json:"value" description:"字段的值"`
+	Message string      `json:"message" description:"错误原因"`
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+func NewStatusError(code int, format string, args ...interface{}) *StatusError {
+	return &StatusError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func NewBadRequestError(format string, args ...interface{}) *StatusError {
+	return NewStatusError(http.StatusBadRequest, format, args...)
+}
+
+func NewNotFoundError(format string, args ...interface{}) *StatusError {
+	return NewStatusError(http.StatusNotFound, format, args...)
+}
+
+func NewConflictError(format string, args ...interface{}) *StatusError {
+	return NewStatusError(http.StatusConflict, format, args...)
+}
+
+// 服务过载，返回429，客户端在retryAfter之后重试
+func NewTooManyRequestsError(retryAfter time.Duration, format string, args ...interface{}) *StatusError {
+	e := NewStatusError(http.StatusTooManyRequests, format, args...)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// 参数校验失败，返回400和所有出错的字段
+func NewValidationError(fieldErrors []*FieldError) *StatusError {
+	message := "invalid request"
+	if len(fieldErrors) > 0 {
+		message = fmt.Sprintf("invalid request: %s %s", fieldErrors[0].Field, fieldErrors[0].Message)
+		if len(fieldErrors) > 1 {
+			message += fmt.Sprintf(" (and %d more errors)", len(fieldErrors)-1)
+		}
+	}
+	return &StatusError{
+		Code:    http.StatusBadRequest,
+		Message: message,
+		Details: fieldErrors,
+	}
+}
+
+// 获取错误对应的http状态码，非StatusError都当作服务端错误
+func StatusCodeOf(err error) int {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// 获取错误建议的重试等待时间，没有时返回0
+func RetryAfterOf(err error) time.Duration {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.RetryAfter
+	}
+	return 0
+}
+
+// 获取错误的详情，没有详情返回nil
+func DetailsOf(err error) interface{} {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.Details
+	}
+	return nil
+}
+
+// 可以重试的错误，比如mysql、redis或者集群api暂时不可用，其他错误都当作永久错误
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+func NewRetryableError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+func IsRetryableError(err error) bool {
+	var retryableError *RetryableError
+	return errors.As(err, &retryableError)
+}
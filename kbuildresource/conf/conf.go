@@ -2,17 +2,158 @@ package conf
 
 import (
 	"github.com/astaxie/beego"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var Conf struct{
 	SQLPWD string
 	SQLCONN string
 	SQLUser string
+	RequestQueue string // 请求队列的类型，redis或者memory，默认redis
+	NamespaceWeights map[string]float64 // 命名空间的调度权重，没有配置的命名空间权重为1
+	RequestTimeout time.Duration // 请求执行的默认超时时间，0表示不限制
+	RequestTimeouts map[string]time.Duration // 各个请求类型的超时时间，覆盖默认值
+	ShutdownGracePeriod time.Duration // 停机时等待正在执行的请求完成的时间，超过后中断请求，由其他实例重新执行
+	RequestMaxAttempts int // 请求最多执行的次数，可以重试的错误超过后转入死信
+	RequestRetryBackoff time.Duration // 第一次重试的等待时间，之后每次翻倍
+	RequestRetryMaxBackoff time.Duration // 重试等待时间的上限
+	RequestConcurrency int // 每个实例同时执行的请求数
+	RequestConcurrencies map[string]int // 各个请求类型在每个实例上同时执行的请求数，不超过RequestConcurrency，没有配置的类型不单独限制
+	RequestQueueCapacity int // 所有实例共享的排队请求数上限，超过后拒绝新的请求
+	RedisLatencyThreshold time.Duration // redis的响应时间超过后拒绝新的请求
+	MySQLLatencyThreshold time.Duration // mysql的响应时间超过后拒绝新的请求
+	ClusterConcurrency int // 所有实例同时对一个集群执行的请求数，0表示不限制
+	ClusterConcurrencies map[string]int // 各个集群的并发数，覆盖默认值
+	NamespaceConcurrency int // 所有实例同时对一个命名空间执行的请求数，0表示不限制
+	NamespaceConcurrencies map[string]int // 各个命名空间的并发数，覆盖默认值
+	Coordination string // 实例协调（锁、存活租约、成员列表、选主）的后端，redis、etcd或者mysql，默认redis
+	EtcdEndpoints []string // etcd的地址，协调后端为etcd时使用
+	EtcdDialTimeout time.Duration // 连接etcd的超时时间
+	HeartbeatInterval time.Duration // 实例续期存活租约和心跳的间隔
+	HeartbeatTimeout time.Duration // 存活租约的有效期，超过后没有续期的实例进入怀疑状态，实例自己在超过后隔离自己
+	SuspectTimeout time.Duration // 检测者发现租约过期之后实例处于怀疑状态的时间，超过后确认死亡，由其他实例接管，不小于2*HeartbeatInterval
 }
 
 func init() {
 	Conf.SQLCONN = beego.AppConfig.String("sqlconn")
 	Conf.SQLPWD = beego.AppConfig.String("sqlpwd")
 	Conf.SQLUser = beego.AppConfig.String("sqluser")
+	Conf.RequestQueue = beego.AppConfig.DefaultString("requestqueue", "redis")
+	Conf.NamespaceWeights = parseNamespaceWeights(beego.AppConfig.Strings("namespaceweights"))
+	Conf.RequestTimeout = parseDuration("requesttimeout", beego.AppConfig.DefaultString("requesttimeout", "20m"))
+	Conf.RequestTimeouts = parseRequestTimeouts(beego.AppConfig.Strings("requesttimeouts"))
+	Conf.ShutdownGracePeriod = parseDuration("shutdowngraceperiod", beego.AppConfig.DefaultString("shutdowngraceperiod", "30s"))
+	Conf.RequestMaxAttempts = beego.AppConfig.DefaultInt("requestmaxattempts", 5)
+	Conf.RequestRetryBackoff = parseDuration("requestretrybackoff", beego.AppConfig.DefaultString("requestretrybackoff", "5s"))
+	Conf.RequestRetryMaxBackoff = parseDuration("requestretrymaxbackoff", beego.AppConfig.DefaultString("requestretrymaxbackoff", "5m"))
+	Conf.RequestConcurrency = beego.AppConfig.DefaultInt("requestconcurrency", 100)
+	Conf.RequestConcurrencies = parseConcurrencies(beego.AppConfig.Strings("requestconcurrencies"))
+	Conf.RequestQueueCapacity = beego.AppConfig.DefaultInt("requestqueuecapacity", 2000)
+	Conf.RedisLatencyThreshold = parseDuration("redislatencythreshold", beego.AppConfig.DefaultString("redislatencythreshold", "200ms"))
+	Conf.MySQLLatencyThreshold = parseDuration("mysqllatencythreshold", beego.AppConfig.DefaultString("mysqllatencythreshold", "500ms"))
+	Conf.ClusterConcurrency = beego.AppConfig.DefaultInt("clusterconcurrency", 20)
+	Conf.ClusterConcurrencies = parseConcurrencies(beego.AppConfig.Strings("clusterconcurrencies"))
+	Conf.NamespaceConcurrency = beego.AppConfig.DefaultInt("namespaceconcurrency", 0)
+	Conf.NamespaceConcurrencies = parseConcurrencies(beego.AppConfig.Strings("namespaceconcurrencies"))
+	Conf.Coordination = beego.AppConfig.DefaultString("coordination", "redis")
+	Conf.EtcdEndpoints = beego.AppConfig.DefaultStrings("etcdendpoints", []string{"127.0.0.1:2379"})
+	Conf.EtcdDialTimeout = parseDuration("etcddialtimeout", beego.AppConfig.DefaultString("etcddialtimeout", "5s"))
+	Conf.HeartbeatInterval = parseDuration("heartbeatinterval", beego.AppConfig.DefaultString("heartbeatinterval", "3s"))
+	Conf.HeartbeatTimeout = parseDuration("heartbeattimeout", beego.AppConfig.DefaultString("heartbeattimeout", "6s"))
+	Conf.SuspectTimeout = parseDuration("suspecttimeout", beego.AppConfig.DefaultString("suspecttimeout", "10s"))
+	if Conf.HeartbeatTimeout <= 0 {
+		logrus.Errorf("ERROR: invalid heartbeattimeout %v, use 6s", Conf.HeartbeatTimeout)
+		Conf.HeartbeatTimeout = 6 * time.Second
+	}
+	if Conf.HeartbeatInterval <= 0 || Conf.HeartbeatInterval >= Conf.HeartbeatTimeout {
+		// 至少在租约过期之前续期两次
+		logrus.Errorf("ERROR: heartbeatinterval %v should be less than heartbeattimeout %v, use %v", Conf.HeartbeatInterval, Conf.HeartbeatTimeout, Conf.HeartbeatTimeout/2)
+		Conf.HeartbeatInterval = Conf.HeartbeatTimeout / 2
+	}
+	if Conf.SuspectTimeout < 2*Conf.HeartbeatInterval {
+		// 续期失败的实例最晚在租约过期之后的2*heartbeatinterval隔离自己，怀疑期更短时可能在它停止执行之前接管
+		logrus.Errorf("ERROR: suspecttimeout %v should be at least twice heartbeatinterval %v, use %v", Conf.SuspectTimeout, Conf.HeartbeatInterval, 2*Conf.HeartbeatInterval)
+		Conf.SuspectTimeout = 2 * Conf.HeartbeatInterval
+	}
+	logrus.Infof("INFO: heartbeat every %v, lease expires after %v, instances are fenced at most %v after their last renewal and declared dead %v after their lease is seen expired",
+		Conf.HeartbeatInterval, Conf.HeartbeatTimeout, Conf.HeartbeatTimeout+2*Conf.HeartbeatInterval, Conf.SuspectTimeout)
+}
+
+// 解析命名空间的权重，格式为 namespace:weight;namespace:weight
+func parseNamespaceWeights(items []string) map[string]float64 {
+	weights := make(map[string]float64, len(items))
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			logrus.Errorf("ERROR: invalid namespace weight %s", item)
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || weight <= 0 {
+			logrus.Errorf("ERROR: invalid namespace weight %s", item)
+			continue
+		}
+		weights[strings.TrimSpace(kv[0])] = weight
+	}
+	return weights
+}
+
+// 解析各个请求类型的超时时间，格式为 requestType:duration;requestType:duration，比如 buildjob_create:10m
+func parseRequestTimeouts(items []string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(items))
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			logrus.Errorf("ERROR: invalid request timeout %s", item)
+			continue
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || timeout < 0 {
+			logrus.Errorf("ERROR: invalid request timeout %s", item)
+			continue
+		}
+		timeouts[strings.TrimSpace(kv[0])] = timeout
+	}
+	return timeouts
+}
+
+// 解析并发数配置，格式为 name:concurrency;name:concurrency，比如 buildjob_create:80
+func parseConcurrencies(items []string) map[string]int {
+	concurrencies := make(map[string]int, len(items))
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			logrus.Errorf("ERROR: invalid concurrency %s", item)
+			continue
+		}
+		concurrency, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || concurrency <= 0 {
+			logrus.Errorf("ERROR: invalid concurrency %s", item)
+			continue
+		}
+		concurrencies[strings.TrimSpace(kv[0])] = concurrency
+	}
+	return concurrencies
+}
 
-}
\ No newline at end of file
+// 解析时长配置，格式不合法时按0处理
+func parseDuration(key string, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		logrus.Errorf("ERROR: invalid %s %s", key, value)
+		return 0
+	}
+	return d
+}
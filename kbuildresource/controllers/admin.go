@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/election"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/astaxie/beego"
+	"net/http"
+)
+
+const (
+	defaultDeadLetterLimit = 20
+	maxDeadLetterLimit     = 100
+)
+
+// 管理接口
+type AdminController struct {
+	beego.Controller
+}
+
+// @Title GetQueuePosition
+// @Description 查询请求的排队位置和估计的开始执行时间
+// @Param	id		path 	string	true		"请求ID"
+// @Success 200 {object} dto.QueuePositionDTO
+// @Failure 404 request not found
+// @router /requests/:id/queue [get]
+func (a *AdminController) GetQueuePosition() {
+	requestID := a.Ctx.Input.Param(":id")
+	position, err := async.GetRequestController().GetQueuePosition(requestID)
+	if err != nil {
+		serveError(&a.Controller, err)
+		return
+	}
+	if position == nil {
+		serveError(&a.Controller, common.NewNotFoundError("request %s not found", requestID))
+		return
+	}
+	request := position.Request
+	data := &dto.QueuePositionDTO{
+		RequestID:               request.RequestID,
+		Namespace:               request.Namespace,
+		Priority:                request.Priority,
+		Status:                  request.Status,
+		Queued:                  position.Queued,
+		Position:                position.Ahead,
+		NamespacePosition:       position.NamespaceAhead,
+		Backlog:                 position.Backlog,
+		Slots:                   position.Slots,
+		AverageExecutionSeconds: position.AverageExecution.Seconds(),
+		EstimatedStartAt:        position.EstimatedStartAt,
+	}
+	a.Ctx.Output.SetStatus(http.StatusOK)
+	a.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get queue position success", data)
+	a.ServeJSON()
+}
+
+// @Title ListDeadLetters
+// @Description 查询死信，按照进入死信的时间倒序排列
+// @Param	requestType		query 	string	false		"请求类型"
+// @Param	offset		query 	int	false		"偏移量，默认0"
+// @Param	limit		query 	int	false		"每页数量，默认20，最大100"
+// @Success 200 {object} []dto.DeadLetterDTO
+// @Failure 400 invalid query parameters
+// @router /deadletters [get]
+func (a *AdminController) ListDeadLetters() {
+	offset, err := a.GetInt("offset", 0)
+	if err != nil || offset < 0 {
+		serveError(&a.Controller, common.NewBadRequestError("invalid offset %s", a.GetString("offset")))
+		return
+	}
+	limit, err := a.GetInt("limit", defaultDeadLetterLimit)
+	if err != nil || limit <= 0 || limit > maxDeadLetterLimit {
+		serveError(&a.Controller, common.NewBadRequestError("invalid limit %s, must be between 1 and %d", a.GetString("limit"), maxDeadLetterLimit))
+		return
+	}
+	deadLetters, err := models.ListDeadLetters(a.GetString("requestType"), offset, limit)
+	if err != nil {
+		serveError(&a.Controller, err)
+		return
+	}
+	data := make([]*dto.DeadLetterDTO, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		data = append(data, dto.NewDeadLetterDTO(deadLetter))
+	}
+	a.Ctx.Output.SetStatus(http.StatusOK)
+	a.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list dead letters success", data)
+	a.ServeJSON()
+}
+
+// @Title GetDeadLetter
+// @Description 查询请求的死信，包括完整的错误历史
+// @Param	id		path 	string	true		"请求ID"
+// @Success 200 {object} dto.DeadLetterDTO
+// @Failure 404 dead letter not found
+// @router /deadletters/:id [get]
+func (a *AdminController) GetDeadLetter() {
+	requestID := a.Ctx.Input.Param(":id")
+	deadLetter, err := models.GetDeadLetterByRequestID(requestID)
+	if err != nil {
+		serveError(&a.Controller, err)
+		return
+	}
+	if deadLetter == nil {
+		serveError(&a.Controller, common.NewNotFoundError("dead letter of request %s not found", requestID))
+		return
+	}
+	a.Ctx.Output.SetStatus(http.StatusOK)
+	a.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get dead letter success", dto.NewDeadLetterDTO(deadLetter))
+	a.ServeJSON()
+}
+
+// @Title RequeueDeadLetter
+// @Description 把死信中的请求重新入队，请求ID不变，执行次数清零
+// @Param	id		path 	string	true		"请求ID"
+// @Success 202 {object} dto.RequestStatusDTO
+// @Failure 404 dead letter not found
+// @Failure 409 another request of the same resource is in progress
+// @router /deadletters/:id/requeue [post]
+func (a *AdminController) RequeueDeadLetter() {
+	requestID := a.Ctx.Input.Param(":id")
+	request, err := async.GetRequestController().RequeueDeadLetter(requestID)
+	if err != nil {
+		serveError(&a.Controller, err)
+		return
+	}
+	if request == nil {
+		serveError(&a.Controller, common.NewNotFoundError("dead letter of request %s not found", requestID))
+		return
+	}
+	a.Ctx.Output.Header("Location", requestLocation(request.RequestID))
+	a.Ctx.Output.SetStatus(http.StatusAccepted)
+	a.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "requeue dead letter accepted", dto.NewRequestStatusDTO(request))
+	a.ServeJSON()
+}
+
+// @Title ListElections
+// @Description 查询本实例参与的选主，包括当前的leader和选主的统计
+// @Success 200 {object} []dto.ElectionDTO
+// @router /elections [get]
+func (a *AdminController) ListElections() {
+	electors := election.List()
+	data := make([]*dto.ElectionDTO, 0, len(electors))
+	for _, elector := range electors {
+		leader, err := elector.Leader(a.Ctx.Request.Context())
+		if err != nil {
+			serveError(&a.Controller, err)
+			return
+		}
+		data = append(data, &dto.ElectionDTO{Metrics: elector.Metrics(), Leader: leader})
+	}
+	a.Ctx.Output.SetStatus(http.StatusOK)
+	a.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list elections success", data)
+	a.ServeJSON()
+}
@@ -2,32 +2,187 @@ package controllers
 
 import (
 	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/buildjob"
 	"bryson.foundation/kbuildresource/common"
 	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/models"
 	"encoding/json"
+	"fmt"
 	"github.com/astaxie/beego"
 	"github.com/prometheus/common/log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type BuildJobController struct {
 	beego.Controller
 }
 
+// @Title CreateBuildJob
+// @Description 异步创建构建任务，返回202和Location，通过Location查询请求状态；指定notBefore时到了时间才开始执行
+// @Description 指定cron时创建周期性的计划，返回201和计划
+// @Param	body		body 	dto.BuildJobDTO	true		"构建任务配置"
+// @Param	Idempotency-Key		header 	string	false		"幂等键，重复提交时返回第一次的受理结果"
+// @Param	wait		query 	string	false		"长轮询等待时长，eg: 30s"
+// @Success 201 {object} models.Schedule
+// @Success 202 {object} dto.RequestStatusDTO
+// @Failure 400 invalid request body
+// @Failure 409 request with the same Idempotency-Key is in progress
+// @Failure 422 Idempotency-Key has been used by a different request
+// @Failure 429 server is overloaded, retry after the Retry-After header
+// @router / [post]
 func (b *BuildJobController) CreateBuildJob() {
 	var buildJobDTO dto.BuildJobDTO
-	if err := json.Unmarshal(b.Ctx.Input.RequestBody, &buildJobDTO); err == nil {
-		log.Infof("Create buildJob %s", buildJobDTO.Name)
-		if buildJobDTO,err := async.GetRequestController().AcceptRequest(&buildJobDTO, common.BuildJobCreateRequestType); err == nil {
-			b.Ctx.Output.SetStatus(http.StatusCreated)
-			b.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "create buildJob success",buildJobDTO)
-		} else {
-			b.Ctx.Output.SetStatus(http.StatusOK)
-			b.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, err.Error(), nil)
+	if err := json.Unmarshal(b.Ctx.Input.RequestBody, &buildJobDTO); err != nil {
+		serveError(&b.Controller, common.NewBadRequestError("invalid request body, err: %s", err.Error()))
+		return
+	}
+	wait, err := parseWait(&b.Controller)
+	if err != nil {
+		serveError(&b.Controller, err)
+		return
+	}
+	if buildJobDTO.Cron != "" {
+		log.Infof("Create buildJob schedule %s", buildJobDTO.Name)
+		schedule, err := buildjob.CreateSchedule(&buildJobDTO)
+		if err != nil {
+			serveError(&b.Controller, err)
+			return
 		}
+		b.Ctx.Output.SetStatus(http.StatusCreated)
+		b.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "create buildJob schedule success", schedule)
+		b.ServeJSON()
+		return
+	}
+	log.Infof("Create buildJob %s", buildJobDTO.Name)
+	idempotencyKey := b.Ctx.Input.Header("Idempotency-Key")
+	result, err := async.GetRequestController().AcceptRequest(b.Ctx.Request.Context(), &buildJobDTO, common.BuildJobCreateRequestType, idempotencyKey)
+	if err != nil {
+		serveError(&b.Controller, err)
+		return
+	}
+	serveAcceptResult(&b.Controller, result, wait, "create buildJob accepted")
+}
+
+// @Title GetBuildJob
+// @Description 查询构建任务的状态，包括最近一次创建或者删除请求的状态、所在实例、pod状态等
+// @Param	name		path 	string	true		"构建任务名"
+// @Success 200 {object} dto.BuildJobStatusDTO
+// @Failure 404 buildJob not found
+// @router /:name [get]
+func (b *BuildJobController) GetBuildJob() {
+	name := b.Ctx.Input.Param(":name")
+	status, err := buildjob.GetBuildJobStatus(name)
+	if err != nil {
+		log.Errorf("Get buildJob %s failed, err: %v", name, err)
+		b.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		b.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, err.Error(), nil)
+	} else if status == nil {
+		b.Ctx.Output.SetStatus(http.StatusNotFound)
+		b.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, "buildJob "+name+" not found", nil)
 	} else {
 		b.Ctx.Output.SetStatus(http.StatusOK)
+		b.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get buildJob success", status)
+	}
+	b.ServeJSON()
+}
+
+// @Title DeleteBuildJob
+// @Description 异步删除构建任务，还在排队的同名创建请求会被取消
+// @Param	name		path 	string	true		"构建任务名"
+// @Param	wait		query 	string	false		"长轮询等待时长，eg: 30s"
+// @Success 202 {object} dto.RequestStatusDTO
+// @Failure 404 buildJob not found
+// @Failure 409 buildJob is being created
+// @Failure 429 server is overloaded, retry after the Retry-After header
+// @router /:name [delete]
+func (b *BuildJobController) DeleteBuildJob() {
+	buildJobDTO := &dto.BuildJobDTO{Name: b.Ctx.Input.Param(":name")}
+	wait, err := parseWait(&b.Controller)
+	if err != nil {
+		serveError(&b.Controller, err)
+		return
+	}
+	log.Infof("Delete buildJob %s", buildJobDTO.Name)
+	result, err := async.GetRequestController().AcceptRequest(b.Ctx.Request.Context(), buildJobDTO, common.BuildJobDeleteRequestType, "")
+	if err != nil {
+		serveError(&b.Controller, err)
+		return
+	}
+	serveAcceptResult(&b.Controller, result, wait, "delete buildJob accepted")
+}
+
+// @Title ListBuildJobs
+// @Description 按条件分页查询构建任务
+// @Param	cluster		query 	string	false		"集群名"
+// @Param	namespace		query 	string	false		"命名空间"
+// @Param	status		query 	string	false		"pod状态"
+// @Param	label		query 	string	false		"标签"
+// @Param	createdAfter		query 	string	false		"创建时间下限，RFC3339格式"
+// @Param	createdBefore		query 	string	false		"创建时间上限，RFC3339格式"
+// @Param	includeDeleted		query 	bool	false		"是否包含已删除的构建任务"
+// @Param	sort		query 	string	false		"排序字段：id、name、gmtCreated，加-前缀表示倒序，默认id"
+// @Param	limit		query 	int	false		"每页数量，默认20，最大100"
+// @Param	cursor		query 	string	false		"上一页返回的nextCursor"
+// @Param	expand		query 	string	false		"containers表示同时返回容器配置"
+// @Success 200 {object} dto.BuildJobListDTO
+// @Failure 400 invalid query parameters
+// @router / [get]
+func (b *BuildJobController) ListBuildJobs() {
+	q, err := b.parsePodQuery()
+	if err != nil {
+		b.Ctx.Output.SetStatus(http.StatusBadRequest)
 		b.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, err.Error(), nil)
+		b.ServeJSON()
+		return
+	}
+	result, err := buildjob.ListBuildJobs(q)
+	if err != nil {
+		log.Errorf("List buildJobs failed, err: %v", err)
+		b.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		b.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, err.Error(), nil)
+	} else {
+		b.Ctx.Output.SetStatus(http.StatusOK)
+		b.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list buildJobs success", result)
 	}
 	b.ServeJSON()
-}
\ No newline at end of file
+}
+
+func (b *BuildJobController) parsePodQuery() (*models.PodQuery, error) {
+	q := &models.PodQuery{
+		ClusterName:    b.GetString("cluster"),
+		Namespace:      b.GetString("namespace"),
+		Status:         b.GetString("status"),
+		Label:          b.GetString("label"),
+		SortBy:         "id",
+		WithContainers: b.GetString("expand") == "containers",
+	}
+	var err error
+	for key, t := range map[string]*time.Time{"createdAfter": &q.CreatedAfter, "createdBefore": &q.CreatedBefore} {
+		if value := b.GetString(key); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("invalid %s %s, must be RFC3339", key, value)
+			}
+		}
+	}
+	if q.IncludeDeleted, err = b.GetBool("includeDeleted", false); err != nil {
+		return nil, fmt.Errorf("invalid includeDeleted %s", b.GetString("includeDeleted"))
+	}
+	if sort := b.GetString("sort"); sort != "" {
+		q.Desc = strings.HasPrefix(sort, "-")
+		q.SortBy = strings.TrimPrefix(sort, "-")
+		if _, ok := models.PodSortFields[q.SortBy]; !ok {
+			return nil, fmt.Errorf("invalid sort field %s", q.SortBy)
+		}
+	}
+	if q.Limit, err = b.GetInt("limit", buildjob.DefaultListLimit); err != nil || q.Limit <= 0 || q.Limit > buildjob.MaxListLimit {
+		return nil, fmt.Errorf("invalid limit %s, must between 1 and %d", b.GetString("limit"), buildjob.MaxListLimit)
+	}
+	if cursor := b.GetString("cursor"); cursor != "" {
+		if q.Cursor, err = buildjob.DecodePodCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
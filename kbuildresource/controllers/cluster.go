@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/buildjob"
+	"bryson.foundation/kbuildresource/cluster"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"github.com/astaxie/beego"
+	"net/http"
+)
+
+// 集群注册信息管理
+type ClusterController struct {
+	beego.Controller
+}
+
+// @Title CreateCluster
+// @Description 注册集群
+// @Param	body		body 	models.Cluster	true		"集群配置"
+// @Success 201 {object} models.Cluster
+// @Failure 400 invalid cluster
+// @Failure 409 cluster already exists
+// @router / [post]
+func (c *ClusterController) CreateCluster() {
+	var m models.Cluster
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &m); err != nil {
+		serveError(&c.Controller, common.NewBadRequestError("invalid request body, err: %s", err.Error()))
+		return
+	}
+	if err := cluster.CreateCluster(&m); err != nil {
+		serveError(&c.Controller, err)
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "create cluster success", m)
+	c.ServeJSON()
+}
+
+// @Title ListClusters
+// @Description 查询所有集群
+// @Success 200 {object} models.Cluster
+// @router / [get]
+func (c *ClusterController) ListClusters() {
+	clusters, err := cluster.ListClusters()
+	if err != nil {
+		serveError(&c.Controller, err)
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list clusters success", clusters)
+	c.ServeJSON()
+}
+
+// @Title GetCluster
+// @Description 查询集群
+// @Param	name		path 	string	true		"集群名"
+// @Success 200 {object} models.Cluster
+// @Failure 404 cluster not found
+// @router /:name [get]
+func (c *ClusterController) GetCluster() {
+	m, err := cluster.GetCluster(c.Ctx.Input.Param(":name"))
+	if err != nil {
+		serveError(&c.Controller, err)
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get cluster success", m)
+	c.ServeJSON()
+}
+
+// @Title UpdateCluster
+// @Description 更新集群配置，集群名不能修改
+// @Param	name		path 	string	true		"集群名"
+// @Param	body		body 	models.Cluster	true		"集群配置"
+// @Success 200 {object} models.Cluster
+// @Failure 400 invalid cluster
+// @Failure 404 cluster not found
+// @router /:name [put]
+func (c *ClusterController) UpdateCluster() {
+	var m models.Cluster
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &m); err != nil {
+		serveError(&c.Controller, common.NewBadRequestError("invalid request body, err: %s", err.Error()))
+		return
+	}
+	updated, err := cluster.UpdateCluster(c.Ctx.Input.Param(":name"), &m)
+	if err != nil {
+		serveError(&c.Controller, err)
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "update cluster success", updated)
+	c.ServeJSON()
+}
+
+// @Title DeleteCluster
+// @Description 删除集群，集群中还有构建任务时不允许删除
+// @Param	name		path 	string	true		"集群名"
+// @Success 200 {string} delete success!
+// @Failure 404 cluster not found
+// @Failure 409 cluster still has buildJobs
+// @router /:name [delete]
+func (c *ClusterController) DeleteCluster() {
+	name := c.Ctx.Input.Param(":name")
+	if err := cluster.DeleteCluster(name); err != nil {
+		serveError(&c.Controller, err)
+		return
+	}
+	buildjob.InvalidatePodExecutor(name)
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "delete cluster success", nil)
+	c.ServeJSON()
+}
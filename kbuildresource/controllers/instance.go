@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/coordination"
+	"bryson.foundation/kbuildresource/dto"
+	"context"
+	"github.com/astaxie/beego"
+	"net/http"
+)
+
+// 实例列表的查询，实例的记录由各个实例启动时注册、周期性心跳更新
+type InstanceController struct {
+	beego.Controller
+}
+
+// @Title ListInstances
+// @Description 查询所有实例，按照启动的先后顺序排列
+// @Success 200 {object} []dto.InstanceDTO
+// @router / [get]
+func (i *InstanceController) ListInstances() {
+	ctx := context.Background()
+	members, err := coordination.Default().ListMembers(ctx)
+	if err != nil {
+		serveError(&i.Controller, err)
+		return
+	}
+	detector := coordination.DefaultFailureDetector()
+	instances := make([]*dto.InstanceDTO, 0, len(members))
+	for _, member := range members {
+		state, err := detector.State(ctx, member)
+		if err != nil {
+			serveError(&i.Controller, err)
+			return
+		}
+		instances = append(instances, dto.NewInstanceDTO(member, string(state)))
+	}
+	i.Ctx.Output.SetStatus(http.StatusOK)
+	i.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list instances success", instances)
+	i.ServeJSON()
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"github.com/astaxie/beego"
+	"net/http"
+)
+
+// 异步请求的状态查询
+type RequestController struct {
+	beego.Controller
+}
+
+// @Title GetRequest
+// @Description 查询异步请求的状态，带wait参数时会等待请求结束（最多60s）
+// @Param	id		path 	string	true		"请求ID"
+// @Param	wait		query 	string	false		"长轮询等待时长，eg: 30s"
+// @Success 200 {object} dto.RequestStatusDTO
+// @Failure 404 request not found
+// @router /:id [get]
+func (r *RequestController) GetRequest() {
+	requestID := r.Ctx.Input.Param(":id")
+	wait, err := parseWait(&r.Controller)
+	if err != nil {
+		serveError(&r.Controller, err)
+		return
+	}
+	request, err := async.WaitRequest(requestID, wait)
+	if err != nil {
+		serveError(&r.Controller, err)
+		return
+	}
+	if request == nil {
+		serveError(&r.Controller, common.NewNotFoundError("request %s not found", requestID))
+		return
+	}
+	r.Ctx.Output.SetStatus(http.StatusOK)
+	r.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get request success", dto.NewRequestStatusDTO(request))
+	r.ServeJSON()
+}
+
+// @Title CancelRequest
+// @Description 取消排队中或者正在执行的请求，可以在任意实例上调用；正在执行的请求会被中断并撤销已经完成的部分工作
+// @Param	id		path 	string	true		"请求ID"
+// @Success 200 {object} dto.RequestStatusDTO 请求还没有开始执行，已经取消
+// @Success 202 {object} dto.RequestStatusDTO 请求正在执行，已经通知执行的实例中断
+// @Failure 404 request not found
+// @Failure 409 request has already finished
+// @router /:id/cancel [post]
+func (r *RequestController) CancelRequest() {
+	requestID := r.Ctx.Input.Param(":id")
+	request, err := async.CancelRequest(requestID)
+	if err != nil {
+		serveError(&r.Controller, err)
+		return
+	}
+	if request == nil {
+		serveError(&r.Controller, common.NewNotFoundError("request %s not found", requestID))
+		return
+	}
+	if common.IsTerminalRequestStatus(request.Status) {
+		r.Ctx.Output.SetStatus(http.StatusOK)
+		r.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "request canceled", dto.NewRequestStatusDTO(request))
+	} else {
+		r.Ctx.Output.Header("Location", requestLocation(requestID))
+		r.Ctx.Output.SetStatus(http.StatusAccepted)
+		r.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "cancel request accepted", dto.NewRequestStatusDTO(request))
+	}
+	r.ServeJSON()
+}
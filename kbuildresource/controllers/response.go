@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/dto"
+	"github.com/astaxie/beego"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 根据错误类型返回真实的http状态码，客户端错误为4xx，其他为5xx，错误详情放在data中；过载时带上Retry-After
+func serveError(c *beego.Controller, err error) {
+	if retryAfter := common.RetryAfterOf(err); retryAfter > 0 {
+		c.Ctx.Output.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	c.Ctx.Output.SetStatus(common.StatusCodeOf(err))
+	c.Data["json"] = common.GenerateResponse(common.ResponseFailedResult, err.Error(), common.DetailsOf(err))
+	c.ServeJSON()
+}
+
+// 请求状态资源的地址，异步受理的请求通过它轮询结果
+func requestLocation(requestID string) string {
+	return "/v1/requests/" + requestID
+}
+
+// 解析长轮询参数wait，例如?wait=30s，不传表示不等待
+func parseWait(c *beego.Controller) (time.Duration, error) {
+	value := c.GetString("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, common.NewBadRequestError("invalid wait %s, eg: 30s", value)
+	}
+	return wait, nil
+}
+
+// 返回请求的受理结果：
+// 同步执行完成的返回201；异步受理的返回202和Location，带wait参数时等待请求结束，结束了返回200
+func serveAcceptResult(c *beego.Controller, result *async.AcceptResult, wait time.Duration, message string) {
+	if result.Replayed {
+		c.Ctx.Output.Header("Idempotent-Replayed", "true")
+	}
+	if !result.Async {
+		c.Ctx.Output.SetStatus(http.StatusCreated)
+		c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, message, result.Data)
+		c.ServeJSON()
+		return
+	}
+	c.Ctx.Output.Header("Location", requestLocation(result.RequestID))
+	request := result.Request
+	if wait > 0 {
+		waited, err := async.WaitRequest(result.RequestID, wait)
+		if err != nil {
+			serveError(c, err)
+			return
+		}
+		if waited != nil {
+			request = waited
+		}
+	}
+	if common.IsTerminalRequestStatus(request.Status) {
+		c.Ctx.Output.SetStatus(http.StatusOK)
+	} else {
+		c.Ctx.Output.SetStatus(http.StatusAccepted)
+	}
+	c.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, message, dto.NewRequestStatusDTO(request))
+	c.ServeJSON()
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"bryson.foundation/kbuildresource/buildjob"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/models"
+	"github.com/astaxie/beego"
+	"net/http"
+)
+
+// 周期性构建任务的计划管理，计划通过创建构建任务时指定cron创建
+type ScheduleController struct {
+	beego.Controller
+}
+
+// @Title ListSchedules
+// @Description 查询所有计划
+// @Success 200 {object} []models.Schedule
+// @router / [get]
+func (s *ScheduleController) ListSchedules() {
+	schedules, err := models.ListSchedules()
+	if err != nil {
+		serveError(&s.Controller, err)
+		return
+	}
+	s.Ctx.Output.SetStatus(http.StatusOK)
+	s.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "list schedules success", schedules)
+	s.ServeJSON()
+}
+
+// @Title GetSchedule
+// @Description 查询计划，包括下一次触发的时间和上一次触发的结果
+// @Param	id		path 	int	true		"计划ID"
+// @Success 200 {object} models.Schedule
+// @Failure 404 schedule not found
+// @router /:id [get]
+func (s *ScheduleController) GetSchedule() {
+	id, err := s.GetInt(":id")
+	if err != nil {
+		serveError(&s.Controller, common.NewBadRequestError("invalid schedule id %s", s.Ctx.Input.Param(":id")))
+		return
+	}
+	schedule, err := models.GetScheduleByID(id)
+	if err != nil {
+		serveError(&s.Controller, err)
+		return
+	}
+	if schedule == nil {
+		serveError(&s.Controller, common.NewNotFoundError("schedule %d not found", id))
+		return
+	}
+	s.Ctx.Output.SetStatus(http.StatusOK)
+	s.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "get schedule success", schedule)
+	s.ServeJSON()
+}
+
+// @Title DeleteSchedule
+// @Description 删除计划，已经触发的构建任务不受影响
+// @Param	id		path 	int	true		"计划ID"
+// @Success 200
+// @Failure 404 schedule not found
+// @router /:id [delete]
+func (s *ScheduleController) DeleteSchedule() {
+	id, err := s.GetInt(":id")
+	if err != nil {
+		serveError(&s.Controller, common.NewBadRequestError("invalid schedule id %s", s.Ctx.Input.Param(":id")))
+		return
+	}
+	if err := buildjob.DeleteSchedule(id); err != nil {
+		serveError(&s.Controller, err)
+		return
+	}
+	s.Ctx.Output.SetStatus(http.StatusOK)
+	s.Data["json"] = common.GenerateResponse(common.ResponseSuccessResult, "delete schedule success", nil)
+	s.ServeJSON()
+}
@@ -0,0 +1,156 @@
+package coordination
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 所有协调后端共用的测试，各个后端的测试创建后端后调用
+
+func testBackendLock(t *testing.T, b Backend) {
+	ctx := context.TODO()
+
+	first, err := b.TryLock(ctx, "buildjob/meta", 5*time.Second)
+	if err != nil || first == nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	second, err := b.TryLock(ctx, "buildjob/meta", 5*time.Second)
+	if err != nil || second != nil {
+		t.Fatalf("expect lock held by first, got %v, err: %v", second, err)
+	}
+	if extended, err := first.Extend(ctx, 5*time.Second); err != nil || !extended {
+		t.Fatalf("extend failed: %v, %v", extended, err)
+	}
+	if released, err := first.Release(ctx); err != nil || !released {
+		t.Fatalf("release failed: %v, %v", released, err)
+	}
+	// 已经释放的锁不能再续期和释放
+	if extended, _ := first.Extend(ctx, 5*time.Second); extended {
+		t.Error("expect released lock not to be extended")
+	}
+	if released, _ := first.Release(ctx); released {
+		t.Error("expect released lock not to be released again")
+	}
+
+	second, err = b.TryLock(ctx, "buildjob/meta", 5*time.Second)
+	if err != nil || second == nil {
+		t.Fatalf("lock again failed: %v", err)
+	}
+	if second.Token() <= first.Token() {
+		t.Errorf("expect fencing token to increase, got %d after %d", second.Token(), first.Token())
+	}
+	if second.Key() != "buildjob/meta" {
+		t.Errorf("expect key buildjob/meta, got %s", second.Key())
+	}
+}
+
+func testBackendLease(t *testing.T, b Backend) {
+	ctx := context.TODO()
+
+	if alive, _ := b.Alive(ctx, "a"); alive {
+		t.Fatal("expect instance without lease to be dead")
+	}
+	if renewed, _ := b.Renew(ctx, "a", 5*time.Second); renewed {
+		t.Fatal("expect renew not to create lease")
+	}
+	if err := b.Grant(ctx, "a", 5*time.Second); err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	if alive, err := b.Alive(ctx, "a"); err != nil || !alive {
+		t.Fatalf("expect instance to be alive, err: %v", err)
+	}
+	if renewed, err := b.Renew(ctx, "a", 5*time.Second); err != nil || !renewed {
+		t.Fatalf("renew failed: %v, %v", renewed, err)
+	}
+	if err := b.Revoke(ctx, "a"); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if alive, _ := b.Alive(ctx, "a"); alive {
+		t.Error("expect revoked instance to be dead")
+	}
+	if renewed, _ := b.Renew(ctx, "a", 5*time.Second); renewed {
+		t.Error("expect revoked lease not to be renewed")
+	}
+}
+
+func testBackendMembership(t *testing.T, b Backend) {
+	ctx := context.TODO()
+
+	startedAt := time.Now().Add(-time.Minute)
+	for i, name := range []string{"b", "a", "c"} {
+		member := &Member{Name: name, Host: "host-" + name, Port: 8080, StartedAt: startedAt.Add(time.Duration(i) * time.Second)}
+		if err := b.Join(ctx, member); err != nil {
+			t.Fatalf("join failed: %v", err)
+		}
+	}
+	// 再次加入覆盖记录，不改变启动时间
+	if err := b.Join(ctx, &Member{Name: "a", Host: "host-a2", Port: 8080, StartedAt: startedAt.Add(time.Second)}); err != nil {
+		t.Fatalf("join again failed: %v", err)
+	}
+	if err := b.Leave(ctx, "c"); err != nil {
+		t.Fatalf("leave failed: %v", err)
+	}
+	members, err := b.Members(ctx)
+	if err != nil {
+		t.Fatalf("list members failed: %v", err)
+	}
+	if len(members) != 2 || members[0] != "b" || members[1] != "a" {
+		t.Errorf("expect members [b a], got %v", members)
+	}
+
+	// 心跳时间的精度和后端有关，mysql只精确到秒
+	before := time.Now().Truncate(time.Second)
+	if ok, err := b.Heartbeat(ctx, "a"); err != nil || !ok {
+		t.Fatalf("heartbeat failed: %v, %v", ok, err)
+	}
+	// 已经移除的实例心跳时不会重新加入
+	if ok, err := b.Heartbeat(ctx, "c"); err != nil || ok {
+		t.Fatalf("expect heartbeat of removed instance to fail: %v, %v", ok, err)
+	}
+	records, err := b.ListMembers(ctx)
+	if err != nil {
+		t.Fatalf("list member records failed: %v", err)
+	}
+	if len(records) != 2 || records[1].Name != "a" || records[1].Host != "host-a2" {
+		t.Fatalf("unexpected member records %+v", records)
+	}
+	if records[1].LastHeartbeat.Before(before) {
+		t.Errorf("expect heartbeat of a after %v, got %v", before, records[1].LastHeartbeat)
+	}
+}
+
+func testBackendElection(t *testing.T, b Backend) {
+	ctx := context.TODO()
+	election := "buildjob/masters/test"
+
+	if leader, _ := b.Leader(ctx, election); leader != "" {
+		t.Fatalf("expect no leader, got %s", leader)
+	}
+	if elected, err := b.Campaign(ctx, election, "a", 5*time.Second); err != nil || !elected {
+		t.Fatalf("expect a to be elected: %v, %v", elected, err)
+	}
+	if elected, err := b.Campaign(ctx, election, "b", 5*time.Second); err != nil || elected {
+		t.Fatalf("expect b not to be elected: %v, %v", elected, err)
+	}
+	// leader再次竞选是续期
+	if elected, err := b.Campaign(ctx, election, "a", 5*time.Second); err != nil || !elected {
+		t.Fatalf("expect a to stay leader: %v, %v", elected, err)
+	}
+	if leader, _ := b.Leader(ctx, election); leader != "a" {
+		t.Fatalf("expect leader a, got %s", leader)
+	}
+	// 不是leader时放弃不影响leader
+	if err := b.Resign(ctx, election, "b"); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	if leader, _ := b.Leader(ctx, election); leader != "a" {
+		t.Fatalf("expect leader a, got %s", leader)
+	}
+	if err := b.Resign(ctx, election, "a"); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	if elected, err := b.Campaign(ctx, election, "b", 5*time.Second); err != nil || !elected {
+		t.Fatalf("expect b to be elected after a resigned: %v, %v", elected, err)
+	}
+}
@@ -0,0 +1,136 @@
+package coordination
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/models"
+)
+
+// 多实例协调的后端类型，由配置coordination选择
+const (
+	BackendRedis = "redis"
+	BackendEtcd  = "etcd"
+	BackendMySQL = "mysql"
+)
+
+// 分布式锁，同一时间最多一个持有者
+type Locker interface {
+	// 获取锁，非阻塞，锁被其他持有者持有时返回nil
+	TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, error)
+}
+
+// 持有的锁，每次加锁都有一个比之前所有持有者都大的fencing token，持有锁期间的写入带上token
+type Lock interface {
+	Key() string
+	Token() int64
+	// 续期，锁已经丢失时返回false
+	Extend(ctx context.Context, ttl time.Duration) (bool, error)
+	// 释放，锁已经不属于自己时返回false，不会释放其他持有者的锁
+	Release(ctx context.Context) (bool, error)
+}
+
+// 实例的存活租约，实例在过期之前续期，租约过期或者不存在表示实例已经死亡
+type Leaser interface {
+	// 创建或者覆盖实例的租约
+	Grant(ctx context.Context, name string, ttl time.Duration) error
+	// 续期实例的租约，租约已经过期或者不存在时返回false，不会重新创建
+	Renew(ctx context.Context, name string, ttl time.Duration) (bool, error)
+	// 删除实例的租约
+	Revoke(ctx context.Context, name string) error
+	// 实例的租约是否还有效
+	Alive(ctx context.Context, name string) (bool, error)
+}
+
+// 实例成员的记录：主机名、ip、端口、版本、启动时间和最后一次心跳的时间
+type Member = models.CoordinationMember
+
+// 实例成员列表，死亡实例由存活实例接管后从列表中移除；每次更新都是原子的，不需要加锁
+type Membership interface {
+	// 加入或者覆盖实例的记录
+	Join(ctx context.Context, member *Member) error
+	// 更新实例的心跳时间，实例已经被移除时返回false，不会重新加入
+	Heartbeat(ctx context.Context, name string) (bool, error)
+	Leave(ctx context.Context, name string) error
+	// 所有实例的名字，按照启动的先后顺序排列
+	Members(ctx context.Context) ([]string, error)
+	// 所有实例的记录，按照启动的先后顺序排列
+	ListMembers(ctx context.Context) ([]*Member, error)
+}
+
+// 选主，同一个选举同一时间最多一个leader
+type Elector interface {
+	// candidate成为leader，已经是leader时续期，其他候选者是leader时返回false
+	Campaign(ctx context.Context, election string, candidate string, ttl time.Duration) (bool, error)
+	// candidate是leader时放弃leader身份
+	Resign(ctx context.Context, election string, candidate string) error
+	// 当前的leader，没有leader时返回空字符串
+	Leader(ctx context.Context, election string) (string, error)
+}
+
+type Backend interface {
+	Locker
+	Leaser
+	Membership
+	Elector
+	Close() error
+}
+
+var backend Backend
+
+// 根据配置创建协调后端，需要在models.Init之后调用
+func Init() {
+	b, err := NewBackend(conf.Conf.Coordination)
+	if err != nil {
+		logrus.Fatal("ERROR: init coordination backend failed, err: ", err)
+	}
+	SetBackend(b)
+	logrus.Infof("INFO: use %s as coordination backend", conf.Conf.Coordination)
+}
+
+func NewBackend(backendType string) (Backend, error) {
+	switch backendType {
+	case BackendRedis:
+		return NewRedisBackend(), nil
+	case BackendEtcd:
+		return NewEtcdBackend(conf.Conf.EtcdEndpoints, conf.Conf.EtcdDialTimeout)
+	case BackendMySQL:
+		return NewMySQLBackend()
+	default:
+		return nil, fmt.Errorf("unknown coordination backend %s", backendType)
+	}
+}
+
+// 设置使用的协调后端，缓存中请求的全局查询也改为从这个后端读取实例列表
+func SetBackend(b Backend) {
+	backend = b
+	cache.RegisterInstanceNameLister(func() ([]string, error) {
+		return b.Members(context.Background())
+	})
+}
+
+// 当前使用的协调后端，没有初始化时使用redis
+func Default() Backend {
+	if backend == nil {
+		return NewRedisBackend()
+	}
+	return backend
+}
+
+// 从实例的记录中取出实例名
+func memberNames(m Membership, ctx context.Context) ([]string, error) {
+	members, err := m.ListMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	return names, nil
+}
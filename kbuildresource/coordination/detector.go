@@ -0,0 +1,87 @@
+package coordination
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bryson.foundation/kbuildresource/conf"
+)
+
+// 故障检测中实例的状态
+type MemberState string
+
+const (
+	// 存活租约有效
+	MemberAlive MemberState = "alive"
+	// 存活租约已经过期，但是发现过期还不到一个怀疑期，可能只是短暂的停顿或者网络抖动，不能接管
+	MemberSuspect MemberState = "suspect"
+	// 发现租约过期之后超过一个怀疑期，确认死亡，实例自己已经停止执行，可以接管
+	MemberDead MemberState = "dead"
+)
+
+// 故障检测器：根据存活租约判断实例的状态，怀疑期按照检测者自己的时钟计算，
+// 从检测者第一次发现租约过期开始，不使用被检测实例写入的心跳时间，实例之间的时钟偏差不影响判断
+// 实例自己最晚在最后一次续期之后的 heartbeatTimeout + 2*heartbeatInterval 隔离自己，
+// 租约在最后一次续期之后的heartbeatTimeout过期，怀疑期不小于2*heartbeatInterval时，确认死亡时实例已经停止执行
+type FailureDetector struct {
+	backend        Backend
+	suspectTimeout time.Duration
+	now            func() time.Time
+	lock           sync.Mutex
+	expiredSince   map[string]time.Time // 第一次发现实例的租约过期的时间
+}
+
+func NewFailureDetector(backend Backend, suspectTimeout time.Duration) *FailureDetector {
+	return &FailureDetector{
+		backend:        backend,
+		suspectTimeout: suspectTimeout,
+		now:            time.Now,
+		expiredSince:   make(map[string]time.Time),
+	}
+}
+
+var (
+	defaultDetector     *FailureDetector
+	defaultDetectorOnce sync.Once
+)
+
+// 使用当前的协调后端和配置的怀疑期，进程内共用一个检测器，保留每个实例第一次被发现过期的时间
+func DefaultFailureDetector() *FailureDetector {
+	defaultDetectorOnce.Do(func() {
+		defaultDetector = NewFailureDetector(Default(), conf.Conf.SuspectTimeout)
+	})
+	return defaultDetector
+}
+
+// 实例的状态，查询失败时返回错误，调用方不能把实例当作死亡
+// 第一次发现租约过期时实例处于怀疑状态，之后的检测中过期超过一个怀疑期才确认死亡
+func (d *FailureDetector) State(ctx context.Context, member *Member) (MemberState, error) {
+	alive, err := d.backend.Alive(ctx, member.Name)
+	if err != nil {
+		return "", err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if alive {
+		delete(d.expiredSince, member.Name)
+		return MemberAlive, nil
+	}
+	now := d.now()
+	since, ok := d.expiredSince[member.Name]
+	if !ok {
+		d.expiredSince[member.Name] = now
+		return MemberSuspect, nil
+	}
+	if now.Sub(since) < d.suspectTimeout {
+		return MemberSuspect, nil
+	}
+	return MemberDead, nil
+}
+
+// 实例已经从实例列表中移除，不再记录它的状态
+func (d *FailureDetector) Forget(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.expiredSince, name)
+}
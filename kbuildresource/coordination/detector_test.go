@@ -0,0 +1,53 @@
+package coordination
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorState(t *testing.T) {
+	b := newTestEtcdBackend(t)
+	ctx := context.TODO()
+	now := time.Now()
+	d := NewFailureDetector(b, 10*time.Second)
+	d.now = func() time.Time { return now }
+
+	if err := b.Grant(ctx, "a", 5*time.Second); err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	check := func(name string, expect MemberState) {
+		t.Helper()
+		// 被检测实例写入的心跳时间不影响判断
+		state, err := d.State(ctx, &Member{Name: name, LastHeartbeat: now.Add(-time.Hour)})
+		if err != nil {
+			t.Fatalf("detect state of %s failed: %v", name, err)
+		}
+		if state != expect {
+			t.Errorf("expect %s to be %s, got %s", name, expect, state)
+		}
+	}
+	// 租约有效
+	check("a", MemberAlive)
+	// 第一次发现租约过期，从这时开始计算怀疑期
+	check("b", MemberSuspect)
+	now = now.Add(9 * time.Second)
+	check("b", MemberSuspect)
+	now = now.Add(time.Second)
+	check("b", MemberDead)
+
+	// 租约恢复后重新计算怀疑期
+	if err := b.Grant(ctx, "b", 5*time.Second); err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	check("b", MemberAlive)
+	if err := b.Revoke(ctx, "b"); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	check("b", MemberSuspect)
+
+	// 移除后再出现的同名实例也重新计算
+	d.Forget("b")
+	now = now.Add(time.Minute)
+	check("b", MemberSuspect)
+}
@@ -0,0 +1,319 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/utils"
+)
+
+// 心跳和其他写入冲突时的重试次数
+const etcdHeartbeatRetryTimes = 3
+
+// 基于etcd的协调后端：锁、存活租约和leader都是绑定了etcd lease的key，lease过期后key自动删除
+// etcd lease的有效期在创建时确定，续期时传入的ttl不生效；fencing token使用加锁时etcd的revision
+type etcdBackend struct {
+	client *clientv3.Client
+}
+
+func NewEtcdBackend(endpoints []string, dialTimeout time.Duration) (Backend, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewEtcdBackendWithClient(client), nil
+}
+
+func NewEtcdBackendWithClient(client *clientv3.Client) Backend {
+	return &etcdBackend{client: client}
+}
+
+type etcdLock struct {
+	client *clientv3.Client
+	key    string
+	owner  string
+	lease  clientv3.LeaseID
+	token  int64
+}
+
+func (l *etcdLock) Key() string {
+	return strings.TrimPrefix(l.key, "/")
+}
+
+func (l *etcdLock) Token() int64 {
+	return l.token
+}
+
+func (l *etcdLock) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	owner, _, err := getEtcdValue(ctx, l.client, l.key)
+	if err != nil || owner != l.owner {
+		return false, err
+	}
+	return keepEtcdLeaseAlive(ctx, l.client, l.lease)
+}
+
+func (l *etcdLock) Release(ctx context.Context) (bool, error) {
+	resp, err := l.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(l.key), "=", l.owner)).
+		Then(clientv3.OpDelete(l.key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	revokeEtcdLease(l.client, l.lease)
+	return resp.Succeeded, nil
+}
+
+func (b *etcdBackend) TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, error) {
+	lock := &etcdLock{client: b.client, key: "/" + key, owner: utils.CreateUUID()}
+	created, revision, lease, err := b.createWithLease(ctx, lock.key, lock.owner, ttl)
+	if err != nil || !created {
+		return nil, err
+	}
+	lock.lease = lease
+	lock.token = revision
+	return lock, nil
+}
+
+func (b *etcdBackend) Grant(ctx context.Context, name string, ttl time.Duration) error {
+	key := etcdInstanceKey(name)
+	lease, err := b.client.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return err
+	}
+	_, oldLease, err := getEtcdValue(ctx, b.client, key)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Put(ctx, key, name, clientv3.WithLease(lease.ID))
+	if err != nil {
+		revokeEtcdLease(b.client, lease.ID)
+		return err
+	}
+	if oldLease != clientv3.NoLease {
+		revokeEtcdLease(b.client, oldLease)
+	}
+	return nil
+}
+
+func (b *etcdBackend) Renew(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	value, lease, err := getEtcdValue(ctx, b.client, etcdInstanceKey(name))
+	if err != nil || value == "" {
+		return false, err
+	}
+	return keepEtcdLeaseAlive(ctx, b.client, lease)
+}
+
+func (b *etcdBackend) Revoke(ctx context.Context, name string) error {
+	key := etcdInstanceKey(name)
+	_, lease, err := getEtcdValue(ctx, b.client, key)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	if lease != clientv3.NoLease {
+		revokeEtcdLease(b.client, lease)
+	}
+	return nil
+}
+
+func (b *etcdBackend) Alive(ctx context.Context, name string) (bool, error) {
+	value, _, err := getEtcdValue(ctx, b.client, etcdInstanceKey(name))
+	return value != "", err
+}
+
+func (b *etcdBackend) Join(ctx context.Context, member *Member) error {
+	if member.LastHeartbeat.IsZero() {
+		member.LastHeartbeat = time.Now()
+	}
+	data, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Put(ctx, etcdMemberPrefix()+member.Name, string(data))
+	return err
+}
+
+// 只在记录没有被其他实例修改或者删除时写入，删除后不会重新加入
+func (b *etcdBackend) Heartbeat(ctx context.Context, name string) (bool, error) {
+	key := etcdMemberPrefix() + name
+	for i := 0; i < etcdHeartbeatRetryTimes; i++ {
+		resp, err := b.client.Get(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if len(resp.Kvs) == 0 {
+			return false, nil
+		}
+		member := &Member{}
+		if err = json.Unmarshal(resp.Kvs[0].Value, member); err != nil {
+			return false, err
+		}
+		member.LastHeartbeat = time.Now()
+		data, err := json.Marshal(member)
+		if err != nil {
+			return false, err
+		}
+		txn, err := b.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, string(data))).
+			Commit()
+		if err != nil {
+			return false, err
+		}
+		if txn.Succeeded {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("heartbeat of instance %s conflicts with other writes", name)
+}
+
+func (b *etcdBackend) Leave(ctx context.Context, name string) error {
+	_, err := b.client.Delete(ctx, etcdMemberPrefix()+name)
+	return err
+}
+
+func (b *etcdBackend) Members(ctx context.Context) ([]string, error) {
+	return memberNames(b, ctx)
+}
+
+func (b *etcdBackend) ListMembers(ctx context.Context) ([]*Member, error) {
+	resp, err := b.client.Get(ctx, etcdMemberPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	members := make([]*Member, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		member := &Member{}
+		if err = json.Unmarshal(kv.Value, member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	cache.SortMembers(members)
+	return members, nil
+}
+
+func (b *etcdBackend) Campaign(ctx context.Context, election string, candidate string, ttl time.Duration) (bool, error) {
+	key := "/" + election
+	leader, lease, err := getEtcdValue(ctx, b.client, key)
+	if err != nil {
+		return false, err
+	}
+	if leader == candidate {
+		return keepEtcdLeaseAlive(ctx, b.client, lease)
+	}
+	if leader != "" {
+		return false, nil
+	}
+	created, _, _, err := b.createWithLease(ctx, key, candidate, ttl)
+	return created, err
+}
+
+func (b *etcdBackend) Resign(ctx context.Context, election string, candidate string) error {
+	key := "/" + election
+	leader, lease, err := getEtcdValue(ctx, b.client, key)
+	if err != nil || leader != candidate {
+		return err
+	}
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", candidate)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded && lease != clientv3.NoLease {
+		revokeEtcdLease(b.client, lease)
+	}
+	return nil
+}
+
+func (b *etcdBackend) Leader(ctx context.Context, election string) (string, error) {
+	leader, _, err := getEtcdValue(ctx, b.client, "/"+election)
+	return leader, err
+}
+
+func (b *etcdBackend) Close() error {
+	return b.client.Close()
+}
+
+// key不存在时创建绑定新lease的key，返回是否创建成功、创建时的revision和lease
+func (b *etcdBackend) createWithLease(ctx context.Context, key string, value string, ttl time.Duration) (bool, int64, clientv3.LeaseID, error) {
+	lease, err := b.client.Grant(ctx, ttlSeconds(ttl))
+	if err != nil {
+		return false, 0, clientv3.NoLease, err
+	}
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		revokeEtcdLease(b.client, lease.ID)
+		return false, 0, clientv3.NoLease, err
+	}
+	return true, resp.Header.Revision, lease.ID, nil
+}
+
+// 查询key的值和绑定的lease，key不存在时返回空字符串
+func getEtcdValue(ctx context.Context, client *clientv3.Client, key string) (string, clientv3.LeaseID, error) {
+	resp, err := client.Get(ctx, key)
+	if err != nil {
+		return "", clientv3.NoLease, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", clientv3.NoLease, nil
+	}
+	return string(resp.Kvs[0].Value), clientv3.LeaseID(resp.Kvs[0].Lease), nil
+}
+
+// 续期lease，lease已经过期时返回false
+func keepEtcdLeaseAlive(ctx context.Context, client *clientv3.Client, lease clientv3.LeaseID) (bool, error) {
+	if lease == clientv3.NoLease {
+		return false, nil
+	}
+	_, err := client.KeepAliveOnce(ctx, lease)
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 撤销lease，失败时等待lease自己过期
+func revokeEtcdLease(client *clientv3.Client, lease clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = client.Revoke(ctx, lease)
+}
+
+// etcd lease的有效期以秒为单位，至少1秒
+func ttlSeconds(ttl time.Duration) int64 {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+func etcdInstanceKey(name string) string {
+	return "/" + cache.GenInstanceKey(common.BuildJobPrefix, name)
+}
+
+func etcdMemberPrefix() string {
+	return "/" + cache.GenInstanceRegistryKey(common.BuildJobPrefix) + "/"
+}
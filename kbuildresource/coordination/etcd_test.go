@@ -0,0 +1,58 @@
+package coordination
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// 启动一个嵌入的etcd，返回连接它的协调后端
+func newTestEtcdBackend(t *testing.T) Backend {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd failed: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd is not ready")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("connect etcd failed: %v", err)
+	}
+	b := NewEtcdBackendWithClient(client)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestEtcdLock(t *testing.T) {
+	testBackendLock(t, newTestEtcdBackend(t))
+}
+
+func TestEtcdLease(t *testing.T) {
+	testBackendLease(t, newTestEtcdBackend(t))
+}
+
+func TestEtcdMembership(t *testing.T) {
+	testBackendMembership(t, newTestEtcdBackend(t))
+}
+
+func TestEtcdElection(t *testing.T) {
+	testBackendElection(t, newTestEtcdBackend(t))
+}
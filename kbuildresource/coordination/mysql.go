@@ -0,0 +1,155 @@
+package coordination
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+
+	"bryson.foundation/kbuildresource/models"
+	"bryson.foundation/kbuildresource/utils"
+)
+
+// 基于mysql的协调后端：锁使用GET_LOCK，存活租约和选主使用coordination_lease表中带过期时间的行
+// GET_LOCK的锁属于数据库连接，持有期间独占一个连接，实例死亡后连接断开锁自动释放，ttl不生效
+type mysqlBackend struct {
+	db *sql.DB
+}
+
+func NewMySQLBackend() (Backend, error) {
+	db, err := orm.GetDB("default")
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlBackend{db: db}, nil
+}
+
+type mysqlLock struct {
+	conn   *sql.Conn
+	key    string
+	holder string
+	token  int64
+}
+
+func (l *mysqlLock) Key() string {
+	return l.key
+}
+
+func (l *mysqlLock) Token() int64 {
+	return l.token
+}
+
+// 检查锁是否还被这个连接持有，连接断开后锁已经释放
+func (l *mysqlLock) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	var held sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, `select is_used_lock(?) = connection_id()`, l.key).Scan(&held)
+	if err != nil {
+		return false, err
+	}
+	if !held.Valid || held.Int64 != 1 {
+		return false, nil
+	}
+	// 租约行只用于查看锁的持有者
+	_, err = models.RenewCoordinationLease(mysqlLockLeaseName(l.key), l.holder, ttl)
+	return true, err
+}
+
+func (l *mysqlLock) Release(ctx context.Context) (bool, error) {
+	defer l.conn.Close()
+	var released sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, `select release_lock(?)`, l.key).Scan(&released)
+	if err != nil {
+		return false, err
+	}
+	return released.Valid && released.Int64 == 1, nil
+}
+
+// 锁名最长64个字符
+func (b *mysqlBackend) TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, error) {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, `select get_lock(?, 0)`, key).Scan(&acquired)
+	if err != nil || !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		return nil, err
+	}
+	lock := &mysqlLock{conn: conn, key: key, holder: utils.CreateUUID()}
+	// 持有GET_LOCK时更新token，不会和其他持有者并发
+	lock.token, err = models.IncrCoordinationLeaseToken(mysqlLockLeaseName(key), lock.holder, ttl)
+	if err != nil {
+		_, _ = lock.Release(ctx)
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (b *mysqlBackend) Grant(ctx context.Context, name string, ttl time.Duration) error {
+	return models.GrantCoordinationLease(mysqlInstanceLeaseName(name), name, ttl)
+}
+
+func (b *mysqlBackend) Renew(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return models.RenewCoordinationLease(mysqlInstanceLeaseName(name), name, ttl)
+}
+
+func (b *mysqlBackend) Revoke(ctx context.Context, name string) error {
+	return models.DeleteCoordinationLease(mysqlInstanceLeaseName(name))
+}
+
+func (b *mysqlBackend) Alive(ctx context.Context, name string) (bool, error) {
+	holder, err := models.GetCoordinationLeaseHolder(mysqlInstanceLeaseName(name))
+	return holder != "", err
+}
+
+func (b *mysqlBackend) Join(ctx context.Context, member *Member) error {
+	return models.AddCoordinationMember(member)
+}
+
+func (b *mysqlBackend) Heartbeat(ctx context.Context, name string) (bool, error) {
+	return models.UpdateCoordinationMemberHeartbeat(name)
+}
+
+func (b *mysqlBackend) Leave(ctx context.Context, name string) error {
+	return models.DeleteCoordinationMember(name)
+}
+
+func (b *mysqlBackend) Members(ctx context.Context) ([]string, error) {
+	return memberNames(b, ctx)
+}
+
+func (b *mysqlBackend) ListMembers(ctx context.Context) ([]*Member, error) {
+	return models.ListCoordinationMembers()
+}
+
+func (b *mysqlBackend) Campaign(ctx context.Context, election string, candidate string, ttl time.Duration) (bool, error) {
+	return models.AcquireCoordinationLease(mysqlElectionLeaseName(election), candidate, ttl)
+}
+
+func (b *mysqlBackend) Resign(ctx context.Context, election string, candidate string) error {
+	_, err := models.ReleaseCoordinationLease(mysqlElectionLeaseName(election), candidate)
+	return err
+}
+
+func (b *mysqlBackend) Leader(ctx context.Context, election string) (string, error) {
+	return models.GetCoordinationLeaseHolder(mysqlElectionLeaseName(election))
+}
+
+// 数据库连接由orm管理，不在这里关闭
+func (b *mysqlBackend) Close() error {
+	return nil
+}
+
+func mysqlLockLeaseName(key string) string {
+	return "lock/" + key
+}
+
+func mysqlInstanceLeaseName(name string) string {
+	return "instance/" + name
+}
+
+func mysqlElectionLeaseName(election string) string {
+	return "election/" + election
+}
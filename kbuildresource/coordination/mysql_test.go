@@ -0,0 +1,95 @@
+//go:build mysql
+
+package coordination
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+
+	"bryson.foundation/kbuildresource/models"
+)
+
+// mysql后端的集成测试需要一个真实的mysql，使用 go test -tags mysql ./coordination/ 运行
+// KBUILD_TEST_MYSQL_DSN为测试库的连接串，比如 root:123456@tcp(127.0.0.1:3306)/kbuild_test?charset=utf8&loc=Local
+// 测试会清空测试库中的coordination_lease和coordination_member表
+
+var registerTestMySQL sync.Once
+
+func newTestMySQLBackend(t *testing.T) Backend {
+	dsn := os.Getenv("KBUILD_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("KBUILD_TEST_MYSQL_DSN is not set")
+	}
+	registerTestMySQL.Do(func() {
+		if err := orm.RegisterDataBase("default", "mysql", dsn); err != nil {
+			t.Fatalf("register database failed: %v", err)
+		}
+		orm.RegisterModel(new(models.CoordinationLease), new(models.CoordinationMember))
+		if err := orm.RunSyncdb("default", false, false); err != nil {
+			t.Fatalf("create tables failed: %v", err)
+		}
+	})
+	o := orm.NewOrm()
+	for _, table := range []string{"coordination_lease", "coordination_member"} {
+		if _, err := o.Raw("delete from " + table).Exec(); err != nil {
+			t.Fatalf("clear table %s failed: %v", table, err)
+		}
+	}
+	b, err := NewMySQLBackend()
+	if err != nil {
+		t.Fatalf("create mysql backend failed: %v", err)
+	}
+	return b
+}
+
+func TestMySQLLock(t *testing.T) {
+	testBackendLock(t, newTestMySQLBackend(t))
+}
+
+func TestMySQLLease(t *testing.T) {
+	testBackendLease(t, newTestMySQLBackend(t))
+}
+
+func TestMySQLMembership(t *testing.T) {
+	testBackendMembership(t, newTestMySQLBackend(t))
+}
+
+func TestMySQLElection(t *testing.T) {
+	testBackendElection(t, newTestMySQLBackend(t))
+}
+
+func TestMySQLLeaseExpired(t *testing.T) {
+	b := newTestMySQLBackend(t)
+	ctx := context.TODO()
+	if err := b.Grant(ctx, "a", time.Second); err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	// 再次授予覆盖原来的有效期
+	if err := b.Grant(ctx, "a", 3*time.Second); err != nil {
+		t.Fatalf("grant again failed: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if alive, err := b.Alive(ctx, "a"); err != nil || !alive {
+		t.Fatalf("expect lease to be overwritten, err: %v", err)
+	}
+	time.Sleep(2 * time.Second)
+	if alive, _ := b.Alive(ctx, "a"); alive {
+		t.Error("expect lease to expire")
+	}
+	if renewed, _ := b.Renew(ctx, "a", time.Second); renewed {
+		t.Error("expect expired lease not to be renewed")
+	}
+	// 过期的选举租约可以被其他候选者获取
+	if elected, err := b.Campaign(ctx, "buildjob/masters/test", "a", time.Second); err != nil || !elected {
+		t.Fatalf("expect a to be elected: %v, %v", elected, err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if elected, err := b.Campaign(ctx, "buildjob/masters/test", "b", time.Second); err != nil || !elected {
+		t.Errorf("expect b to be elected after the lease of a expired: %v, %v", elected, err)
+	}
+}
@@ -0,0 +1,100 @@
+package coordination
+
+import (
+	"context"
+	"time"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+)
+
+// 基于redis的协调后端，和请求缓存共用cache.RedisClient
+type redisBackend struct{}
+
+func NewRedisBackend() Backend {
+	return &redisBackend{}
+}
+
+type redisLock struct {
+	lock *cache.Lock
+}
+
+func (l *redisLock) Key() string {
+	return l.lock.Key
+}
+
+func (l *redisLock) Token() int64 {
+	return l.lock.Token
+}
+
+func (l *redisLock) Extend(ctx context.Context, ttl time.Duration) (bool, error) {
+	return l.lock.Extend(ttl)
+}
+
+func (l *redisLock) Release(ctx context.Context) (bool, error) {
+	return l.lock.Release()
+}
+
+func (b *redisBackend) TryLock(ctx context.Context, key string, ttl time.Duration) (Lock, error) {
+	lock, err := cache.AcquireLock(key, ttl)
+	if err != nil || lock == nil {
+		return nil, err
+	}
+	return &redisLock{lock: lock}, nil
+}
+
+func (b *redisBackend) Grant(ctx context.Context, name string, ttl time.Duration) error {
+	return cache.SetKey(cache.GenInstanceKey(common.BuildJobPrefix, name), ttl)
+}
+
+func (b *redisBackend) Renew(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return cache.ExtendExpiration(cache.GenInstanceKey(common.BuildJobPrefix, name), ttl)
+}
+
+func (b *redisBackend) Revoke(ctx context.Context, name string) error {
+	return cache.DelKey(cache.GenInstanceKey(common.BuildJobPrefix, name))
+}
+
+func (b *redisBackend) Alive(ctx context.Context, name string) (bool, error) {
+	return cache.IsInstanceLive(name), nil
+}
+
+func (b *redisBackend) Join(ctx context.Context, member *Member) error {
+	if member.LastHeartbeat.IsZero() {
+		member.LastHeartbeat = time.Now()
+	}
+	return cache.RegisterInstance(member)
+}
+
+func (b *redisBackend) Heartbeat(ctx context.Context, name string) (bool, error) {
+	return cache.HeartbeatInstance(name, time.Now())
+}
+
+func (b *redisBackend) Leave(ctx context.Context, name string) error {
+	return cache.DeregisterInstance(name)
+}
+
+func (b *redisBackend) Members(ctx context.Context) ([]string, error) {
+	return cache.GetInstanceNameList()
+}
+
+func (b *redisBackend) ListMembers(ctx context.Context) ([]*Member, error) {
+	return cache.ListRegisteredInstances()
+}
+
+func (b *redisBackend) Campaign(ctx context.Context, election string, candidate string, ttl time.Duration) (bool, error) {
+	return cache.AcquireLease(election, candidate, ttl)
+}
+
+func (b *redisBackend) Resign(ctx context.Context, election string, candidate string) error {
+	_, err := cache.ReleaseLease(election, candidate)
+	return err
+}
+
+func (b *redisBackend) Leader(ctx context.Context, election string) (string, error) {
+	return cache.GetLeaseOwner(election)
+}
+
+func (b *redisBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package coordination
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+)
+
+// 启动一个进程内的redis，返回使用它的协调后端，测试结束后恢复原来的客户端
+func newTestRedisBackend(t *testing.T) (Backend, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+	return NewRedisBackend(), s
+}
+
+func TestRedisLock(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	testBackendLock(t, b)
+}
+
+func TestRedisLease(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	testBackendLease(t, b)
+}
+
+func TestRedisMembership(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	testBackendMembership(t, b)
+}
+
+func TestRedisElection(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	testBackendElection(t, b)
+}
+
+func TestRedisGrantOverwrites(t *testing.T) {
+	b, s := newTestRedisBackend(t)
+	ctx := context.TODO()
+	key := cache.GenInstanceKey(common.BuildJobPrefix, "a")
+	if err := b.Grant(ctx, "a", time.Second); err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	// 租约还没有过期时再次授予，覆盖原来的有效期
+	s.FastForward(500 * time.Millisecond)
+	if err := b.Grant(ctx, "a", 5*time.Second); err != nil {
+		t.Fatalf("grant again failed: %v", err)
+	}
+	if ttl := s.TTL(key); ttl != 5*time.Second {
+		t.Errorf("expect ttl to be reset to 5s, got %v", ttl)
+	}
+	s.FastForward(time.Second)
+	if alive, err := b.Alive(ctx, "a"); err != nil || !alive {
+		t.Errorf("expect instance to be alive after the first ttl, err: %v", err)
+	}
+	// 续期不会重新创建已经过期的租约
+	s.FastForward(5 * time.Second)
+	if alive, _ := b.Alive(ctx, "a"); alive {
+		t.Error("expect lease to expire")
+	}
+	if renewed, _ := b.Renew(ctx, "a", 5*time.Second); renewed {
+		t.Error("expect expired lease not to be renewed")
+	}
+}
+
+func TestRedisLockExpired(t *testing.T) {
+	b, s := newTestRedisBackend(t)
+	ctx := context.TODO()
+	first, err := b.TryLock(ctx, "buildjob/meta", time.Second)
+	if err != nil || first == nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	// 锁过期后被其他持有者获取，原来的持有者不能续期和释放，token更大
+	s.FastForward(2 * time.Second)
+	second, err := b.TryLock(ctx, "buildjob/meta", time.Second)
+	if err != nil || second == nil {
+		t.Fatalf("expect expired lock to be acquired, err: %v", err)
+	}
+	if extended, _ := first.Extend(ctx, time.Second); extended {
+		t.Error("expect expired lock not to be extended")
+	}
+	if released, _ := first.Release(ctx); released {
+		t.Error("expect expired lock not to release the new holder")
+	}
+	if second.Token() <= first.Token() {
+		t.Errorf("expect fencing token to increase, got %d after %d", second.Token(), first.Token())
+	}
+	if extended, err := second.Extend(ctx, time.Second); err != nil || !extended {
+		t.Errorf("expect new holder to extend, got %v, err: %v", extended, err)
+	}
+}
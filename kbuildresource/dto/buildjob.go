@@ -1,18 +1,46 @@
 package dto
 
-import "bryson.foundation/kbuildresource/models"
+import (
+	"bryson.foundation/kbuildresource/models"
+	"time"
+)
 
 // 少了一些非必要参数，多了一些业务属性配置，比如tuning
 type BuildJobDTO struct {
-	ClusterName string `json:"clusterName" description:"必选，集群名"`
-	NetworkZone string `json:"networkZone" description:"网络区域"`
+	ClusterName string `json:"clusterName" description:"集群名，和networkZone至少指定一个"`
+	NetworkZone string `json:"networkZone" description:"网络区域，只指定网络区域时会在区域内选择一个集群"`
 	Name string `json:"name" description:"等于slavename"`
 	ReName bool `json:"reName" description:"接受重命名"`
 	Labels []string `json:"labels" description:"标签"`
 	Namespace string `json:"namespace" description:"命名空间"`
 	Tuning bool `json:"tuning" description:"是否接受资源参数优化"`
+	Priority int `json:"priority" description:"优先级，1-9，数值越大越先执行，不指定时为5；只在同一个命名空间内生效"`
+	Deadline *time.Time `json:"deadline" description:"截止时间，RFC3339格式，超过后还没有执行完成的请求会被中断并失败；不指定时只受请求类型的超时时间限制"`
+	NotBefore *time.Time `json:"notBefore" description:"最早开始执行的时间，RFC3339格式，不指定时立即排队；指定了cron时是第一次触发的最早时间"`
+	Cron string `json:"cron" description:"标准的5段cron表达式，指定后创建周期性的计划，每次触发创建一个名为 name-触发时间戳 的构建任务"`
 	Containers []*models.Container `json:"containers" description:"容器配置"`
 	InstanceName string `json:"instance_name"`
+	RequestID string `json:"requestId" description:"只读，受理请求时生成的请求ID"`
+	ScheduleReason string `json:"scheduleReason" description:"只读，只指定网络区域时，选择集群的原因"`
+}
+
+// 构建任务的状态视图，合并了redis里面的实时请求状态和mysql里面持久化的pod信息
+type BuildJobStatusDTO struct {
+	Name string `json:"name" description:"等于slavename"`
+	RequestID string `json:"requestId" description:"最近一次请求的ID"`
+	RequestType string `json:"requestType" description:"最近一次请求的类型"`
+	RequestStatus string `json:"requestStatus" description:"请求状态：pending、executing、failed、success、canceled"`
+	InstanceName string `json:"instanceName" description:"正在处理请求的实例，请求结束后为空"`
+	PodStatus string `json:"podStatus" description:"工作负载状态"`
+	NodeIP string `json:"nodeIP" description:"节点ip"`
+	Deleted bool `json:"deleted" description:"构建任务是否已经删除，删除后不再返回pod的状态"`
+	Message string `json:"message" description:"状态运行信息，比如出错原因等"`
+}
+
+// 构建任务列表，NextCursor为空表示没有下一页
+type BuildJobListDTO struct {
+	Items []*models.Pod `json:"items" description:"构建任务对应的pod"`
+	NextCursor string `json:"nextCursor" description:"下一页的游标"`
 }
 
 //type ContainerDTO struct {
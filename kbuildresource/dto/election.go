@@ -0,0 +1,11 @@
+package dto
+
+import (
+	"bryson.foundation/kbuildresource/election"
+)
+
+// 本实例参与的选主的统计，以及当前的leader
+type ElectionDTO struct {
+	election.Metrics
+	Leader string `json:"leader" description:"当前的leader，没有leader时为空"`
+}
@@ -0,0 +1,31 @@
+package dto
+
+import (
+	"bryson.foundation/kbuildresource/models"
+	"time"
+)
+
+// 实例视图，用于查看当前有哪些实例以及它们是否存活
+type InstanceDTO struct {
+	Name string `json:"name" description:"实例名"`
+	Host string `json:"host" description:"实例所在的主机名"`
+	IP string `json:"ip" description:"实例的ip"`
+	Port int `json:"port" description:"实例的http端口"`
+	Version string `json:"version" description:"实例的版本"`
+	StartedAt time.Time `json:"startedAt" description:"实例的启动时间"`
+	LastHeartbeat time.Time `json:"lastHeartbeat" description:"实例最后一次心跳的时间"`
+	State string `json:"state" description:"故障检测的状态：alive、suspect、dead，死亡的实例会被其他实例接管后移除"`
+}
+
+func NewInstanceDTO(member *models.CoordinationMember, state string) *InstanceDTO {
+	return &InstanceDTO{
+		Name:          member.Name,
+		Host:          member.Host,
+		IP:            member.IP,
+		Port:          member.Port,
+		Version:       member.Version,
+		StartedAt:     member.StartedAt,
+		LastHeartbeat: member.LastHeartbeat,
+		State:         state,
+	}
+}
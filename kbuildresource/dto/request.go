@@ -0,0 +1,85 @@
+package dto
+
+import (
+	"bryson.foundation/kbuildresource/models"
+	"encoding/json"
+	"time"
+)
+
+// 请求状态视图，用于客户端轮询异步请求的处理结果
+type RequestStatusDTO struct {
+	RequestID string `json:"requestId" description:"请求ID"`
+	Name string `json:"name" description:"请求对应的资源名"`
+	RequestType string `json:"requestType" description:"请求类型"`
+	Status string `json:"status" description:"请求状态：pending、executing、failed、success、canceled"`
+	InstanceName string `json:"instanceName" description:"正在处理请求的实例，请求结束后为空"`
+	Message string `json:"message" description:"请求处理信息，比如失败原因"`
+	NotBefore *time.Time `json:"notBefore,omitempty" description:"最早开始执行的时间"`
+	Deadline *time.Time `json:"deadline,omitempty" description:"请求的截止时间"`
+	LeaseOwner string `json:"leaseOwner,omitempty" description:"正在执行请求的租约持有者"`
+	LeaseExpireAt *time.Time `json:"leaseExpireAt,omitempty" description:"租约的过期时间，执行者死亡后过期，请求会被其他实例认领"`
+	GmtCreated time.Time `json:"gmtCreated" description:"创建时间"`
+	GmtModified time.Time `json:"gmtModified" description:"更新时间"`
+}
+
+func NewRequestStatusDTO(request *models.Request) *RequestStatusDTO {
+	status := &RequestStatusDTO{
+		RequestID:    request.RequestID,
+		Name:         request.Name,
+		RequestType:  request.RequestType,
+		Status:       request.Status,
+		InstanceName: request.InstanceName,
+		Message:      request.Message,
+		NotBefore:    request.NotBefore,
+		Deadline:     request.Deadline,
+		GmtCreated:   request.GmtCreated,
+		GmtModified:  request.GmtModified,
+		LeaseOwner:   request.LeaseOwner,
+	}
+	if !request.LeaseExpireAt.IsZero() {
+		status.LeaseExpireAt = &request.LeaseExpireAt
+	}
+	return status
+}
+
+// 请求的排队情况，用于管理员查看请求什么时候可以开始执行
+type QueuePositionDTO struct {
+	RequestID string `json:"requestId" description:"请求ID"`
+	Namespace string `json:"namespace" description:"请求所在的命名空间"`
+	Priority int `json:"priority" description:"请求的优先级"`
+	Status string `json:"status" description:"请求状态"`
+	Queued bool `json:"queued" description:"是否还在排队，开始执行或者已经结束的请求为false"`
+	Position int64 `json:"position" description:"估计所有命名空间中排在前面的请求数"`
+	NamespacePosition int64 `json:"namespacePosition" description:"同一个命名空间中排在前面的请求数"`
+	Backlog int64 `json:"backlog" description:"所有命名空间排队的请求数"`
+	Slots int `json:"slots" description:"所有存活实例的并发数之和"`
+	AverageExecutionSeconds float64 `json:"averageExecutionSeconds" description:"请求的平均执行时长"`
+	EstimatedStartAt *time.Time `json:"estimatedStartAt,omitempty" description:"估计的开始执行时间，没有执行记录时为空"`
+}
+
+// 死信视图，重试次数用完之后仍然失败的请求
+type DeadLetterDTO struct {
+	RequestID string `json:"requestId" description:"请求ID"`
+	Name string `json:"name" description:"请求对应的资源名"`
+	RequestType string `json:"requestType" description:"请求类型"`
+	Namespace string `json:"namespace" description:"请求所在的命名空间"`
+	Attempts int `json:"attempts" description:"已经执行的次数"`
+	LastError string `json:"lastError" description:"最后一次执行的错误"`
+	Errors []*models.RequestError `json:"errors" description:"每次执行的错误"`
+	GmtCreated time.Time `json:"gmtCreated" description:"进入死信的时间"`
+}
+
+func NewDeadLetterDTO(deadLetter *models.DeadLetter) *DeadLetterDTO {
+	errors := make([]*models.RequestError, 0)
+	_ = json.Unmarshal([]byte(deadLetter.Errors), &errors)
+	return &DeadLetterDTO{
+		RequestID:   deadLetter.RequestID,
+		Name:        deadLetter.Name,
+		RequestType: deadLetter.RequestType,
+		Namespace:   deadLetter.Namespace,
+		Attempts:    deadLetter.Attempts,
+		LastError:   deadLetter.LastError,
+		Errors:      errors,
+		GmtCreated:  deadLetter.GmtCreated,
+	}
+}
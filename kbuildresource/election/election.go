@@ -0,0 +1,295 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"bryson.foundation/kbuildresource/coordination"
+	"bryson.foundation/kbuildresource/utils"
+)
+
+// 选主的默认配置
+const (
+	DefaultLeaseDuration = 6 * time.Second  // leader租约的有效期
+	DefaultRenewInterval = 3 * time.Second  // leader续期的间隔
+	DefaultRetryInterval = 15 * time.Second // 不是leader时竞选的间隔
+
+	resignTimeout = 5 * time.Second // 退出时放弃leader身份的超时时间
+)
+
+// 选主的配置
+type Options struct {
+	// 选举名，所有实例中唯一，也是保存leader的key
+	Name string
+	// 候选者标识，每个参与选主的对象唯一，默认是随机的uuid
+	Candidate string
+	// leader租约的有效期，leader死亡后最多经过这么久其他候选者才能成为leader
+	LeaseDuration time.Duration
+	// leader续期的间隔，需要小于LeaseDuration
+	RenewInterval time.Duration
+	// 不是leader时竞选的间隔
+	RetryInterval time.Duration
+	// 成为leader时在新的协程中调用，失去leader身份或者停止选主时ctx被取消，取消后需要尽快返回
+	OnStartedLeading func(ctx context.Context)
+	// 失去leader身份或者停止选主时调用，调用之后才会放弃leader身份或者重新竞选
+	OnStoppedLeading func()
+	// 选主的后端，默认使用当前的协调后端
+	Elector coordination.Elector
+}
+
+// 选主的统计，用于查看选主是否稳定
+type Metrics struct {
+	Name             string     `json:"name" description:"选举名"`
+	Candidate        string     `json:"candidate" description:"候选者标识"`
+	IsLeader         bool       `json:"isLeader" description:"当前是否是leader"`
+	Campaigns        int64      `json:"campaigns" description:"竞选的次数"`
+	CampaignFailures int64      `json:"campaignFailures" description:"竞选出错的次数"`
+	Acquired         int64      `json:"acquired" description:"成为leader的次数"`
+	Lost             int64      `json:"lost" description:"续期失败或者被其他候选者取代而失去leader身份的次数"`
+	RenewFailures    int64      `json:"renewFailures" description:"续期出错的次数"`
+	LeaderSince      *time.Time `json:"leaderSince,omitempty" description:"这一次成为leader的时间"`
+	LastRenewed      *time.Time `json:"lastRenewed,omitempty" description:"最后一次续期成功的时间"`
+}
+
+// 基于协调后端的选主：同一个选举同一时间最多一个leader，leader定期续期，
+// 续期失败超过租约有效期或者租约被其他候选者持有时失去leader身份
+type LeaderElector struct {
+	opts Options
+
+	lock    sync.Mutex
+	metrics Metrics
+}
+
+var (
+	registry     = make(map[*LeaderElector]struct{}) // 正在运行的选主
+	registryLock sync.Mutex
+)
+
+// 创建选主，需要调用Run开始选主
+func New(opts Options) (*LeaderElector, error) {
+	if opts.Name == "" {
+		return nil, errors.New("election name is required")
+	}
+	if opts.OnStartedLeading == nil {
+		return nil, errors.New("OnStartedLeading callback is required")
+	}
+	if opts.Candidate == "" {
+		opts.Candidate = utils.CreateUUID()
+	}
+	if opts.LeaseDuration == 0 {
+		opts.LeaseDuration = DefaultLeaseDuration
+	}
+	if opts.RenewInterval == 0 {
+		opts.RenewInterval = DefaultRenewInterval
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	if opts.LeaseDuration < 0 || opts.RenewInterval < 0 || opts.RetryInterval < 0 {
+		return nil, errors.New("durations of election must be positive")
+	}
+	if opts.RenewInterval >= opts.LeaseDuration {
+		return nil, fmt.Errorf("renew interval %v should be less than lease duration %v", opts.RenewInterval, opts.LeaseDuration)
+	}
+	if opts.Elector == nil {
+		opts.Elector = coordination.Default()
+	}
+	return &LeaderElector{
+		opts:    opts,
+		metrics: Metrics{Name: opts.Name, Candidate: opts.Candidate},
+	}, nil
+}
+
+// 参与选主直到ctx被取消，阻塞；是leader时先停止leader的工作再放弃leader身份
+func (e *LeaderElector) Run(ctx context.Context) {
+	register(e)
+	defer unregister(e)
+	logrus.Infof("INFO: start election %s as %s", e.opts.Name, e.opts.Candidate)
+	for e.acquire(ctx) {
+		e.lead(ctx)
+	}
+	logrus.Infof("INFO: stop election %s", e.opts.Name)
+}
+
+// 当前是否是leader
+func (e *LeaderElector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.metrics.IsLeader
+}
+
+// 当前的leader，没有leader时返回空字符串
+func (e *LeaderElector) Leader(ctx context.Context) (string, error) {
+	return e.opts.Elector.Leader(ctx, e.opts.Name)
+}
+
+func (e *LeaderElector) Name() string {
+	return e.opts.Name
+}
+
+func (e *LeaderElector) Candidate() string {
+	return e.opts.Candidate
+}
+
+func (e *LeaderElector) Metrics() Metrics {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.metrics
+}
+
+// 竞选直到成为leader，ctx被取消时返回false
+func (e *LeaderElector) acquire(ctx context.Context) bool {
+	for {
+		elected, err := e.opts.Elector.Campaign(ctx, e.opts.Name, e.opts.Candidate, e.opts.LeaseDuration)
+		e.update(func(m *Metrics) {
+			m.Campaigns++
+			if err != nil {
+				m.CampaignFailures++
+			}
+		})
+		if ctx.Err() != nil {
+			if elected {
+				e.resign()
+			}
+			return false
+		}
+		if err != nil {
+			logrus.Errorf("ERROR: campaign for election %s failed, err: %v", e.opts.Name, err)
+		}
+		if elected {
+			return true
+		}
+		select {
+		case <-time.After(e.opts.RetryInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// 作为leader工作并续期，直到失去leader身份或者ctx被取消
+func (e *LeaderElector) lead(ctx context.Context) {
+	now := time.Now()
+	e.update(func(m *Metrics) {
+		m.IsLeader = true
+		m.Acquired++
+		m.LeaderSince = &now
+		m.LastRenewed = &now
+	})
+	logrus.Infof("INFO: %s become leader of election %s", e.opts.Candidate, e.opts.Name)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.opts.OnStartedLeading(leaderCtx)
+	}()
+	lost := e.renew(leaderCtx, now)
+	cancel()
+
+	e.update(func(m *Metrics) {
+		m.IsLeader = false
+		m.LeaderSince = nil
+		if lost {
+			m.Lost++
+		}
+	})
+	if lost {
+		logrus.Infof("INFO: %s lost leadership of election %s", e.opts.Candidate, e.opts.Name)
+	}
+	if e.opts.OnStoppedLeading != nil {
+		e.opts.OnStoppedLeading()
+	}
+	<-done
+	// leader的工作已经停止，其他候选者可以立即成为leader
+	e.resign()
+}
+
+// 定期续期，失去leader身份时返回true，ctx被取消时返回false
+func (e *LeaderElector) renew(ctx context.Context, lastRenewed time.Time) bool {
+	t := time.NewTicker(e.opts.RenewInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+		// 以发起续期的时间作为租约的起点，比服务端的实际时间早
+		renewedAt := time.Now()
+		// 续期最多等到上一次续期的租约过期，后端卡住时不能一直认为自己是leader
+		campaignCtx, cancel := context.WithTimeout(ctx, e.opts.LeaseDuration-time.Since(lastRenewed))
+		renewed, err := e.opts.Elector.Campaign(campaignCtx, e.opts.Name, e.opts.Candidate, e.opts.LeaseDuration)
+		timedOut := err != nil && errors.Is(campaignCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if ctx.Err() != nil {
+			return false
+		}
+		if timedOut {
+			e.update(func(m *Metrics) { m.RenewFailures++ })
+			logrus.Errorf("ERROR: renew leadership of election %s timed out, lease may have expired", e.opts.Name)
+			return true
+		}
+		if err != nil {
+			e.update(func(m *Metrics) { m.RenewFailures++ })
+			logrus.Errorf("ERROR: renew leadership of election %s failed, err: %v", e.opts.Name, err)
+			// 下一次续期之前租约可能已经过期，不能再认为自己是leader
+			if time.Since(lastRenewed)+e.opts.RenewInterval >= e.opts.LeaseDuration {
+				return true
+			}
+			continue
+		}
+		if !renewed {
+			return true
+		}
+		lastRenewed = renewedAt
+		e.update(func(m *Metrics) { m.LastRenewed = &renewedAt })
+	}
+}
+
+// 放弃leader身份，不是leader时没有影响
+func (e *LeaderElector) resign() {
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+	if err := e.opts.Elector.Resign(ctx, e.opts.Name, e.opts.Candidate); err != nil {
+		logrus.Errorf("ERROR: resign election %s failed, err: %v", e.opts.Name, err)
+	}
+}
+
+func (e *LeaderElector) update(f func(m *Metrics)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	f(&e.metrics)
+}
+
+func register(e *LeaderElector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[e] = struct{}{}
+}
+
+func unregister(e *LeaderElector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, e)
+}
+
+// 本实例上正在运行的选主，按照选举名排序
+func List() []*LeaderElector {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	electors := make([]*LeaderElector, 0, len(registry))
+	for e := range registry {
+		electors = append(electors, e)
+	}
+	sort.Slice(electors, func(i, j int) bool {
+		return electors[i].opts.Name < electors[j].opts.Name
+	})
+	return electors
+}
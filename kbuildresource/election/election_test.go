@@ -0,0 +1,269 @@
+package election
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/coordination"
+)
+
+// 启动一个进程内的redis，协调后端使用它选主
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { cache.RedisClient.Close() })
+	return s
+}
+
+// 测试使用的选主，记录回调的调用
+type testCandidate struct {
+	elector *LeaderElector
+	started chan context.Context
+	stopped chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func startCandidate(t *testing.T, name string, candidate string) *testCandidate {
+	c := &testCandidate{
+		started: make(chan context.Context, 10),
+		stopped: make(chan struct{}, 10),
+		done:    make(chan struct{}),
+	}
+	elector, err := New(Options{
+		Name:             name,
+		Candidate:        candidate,
+		LeaseDuration:    time.Second,
+		RenewInterval:    50 * time.Millisecond,
+		RetryInterval:    20 * time.Millisecond,
+		OnStartedLeading: func(ctx context.Context) { c.started <- ctx },
+		OnStoppedLeading: func() { c.stopped <- struct{}{} },
+		Elector:          coordination.NewRedisBackend(),
+	})
+	if err != nil {
+		t.Fatalf("create elector failed: %v", err)
+	}
+	c.elector = elector
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go func() {
+		defer close(c.done)
+		elector.Run(ctx)
+	}()
+	t.Cleanup(c.stop)
+	return c
+}
+
+// 停止选主，等待Run返回
+func (c *testCandidate) stop() {
+	c.cancel()
+	<-c.done
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, what string, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", what)
+	}
+}
+
+func receiveContext(t *testing.T, what string, ch <-chan context.Context) context.Context {
+	select {
+	case ctx := <-ch:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", what)
+	}
+	return nil
+}
+
+func TestNewValidatesOptions(t *testing.T) {
+	onStarted := func(ctx context.Context) {}
+	if _, err := New(Options{OnStartedLeading: onStarted}); err == nil {
+		t.Error("expect error without name")
+	}
+	if _, err := New(Options{Name: "test"}); err == nil {
+		t.Error("expect error without OnStartedLeading")
+	}
+	if _, err := New(Options{Name: "test", OnStartedLeading: onStarted, LeaseDuration: time.Second, RenewInterval: time.Second}); err == nil {
+		t.Error("expect error when renew interval is not less than lease duration")
+	}
+	e, err := New(Options{Name: "test", OnStartedLeading: onStarted, Elector: coordination.NewRedisBackend()})
+	if err != nil {
+		t.Fatalf("create elector failed: %v", err)
+	}
+	if e.Candidate() == "" || e.opts.LeaseDuration != DefaultLeaseDuration || e.opts.RenewInterval != DefaultRenewInterval {
+		t.Errorf("expect default options, got %+v", e.opts)
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	newTestRedis(t)
+	name := "buildjob/masters/failover"
+
+	a := startCandidate(t, name, "a")
+	ctxA := receiveContext(t, "a to start leading", a.started)
+	b := startCandidate(t, name, "b")
+	// b多次竞选都不能成为leader
+	waitFor(t, "b to campaign", func() bool { return b.elector.Metrics().Campaigns >= 3 })
+	if b.elector.IsLeader() || !a.elector.IsLeader() {
+		t.Fatal("expect a to be the only leader")
+	}
+	if leader, err := b.elector.Leader(context.TODO()); err != nil || leader != "a" {
+		t.Fatalf("expect leader a, got %s, err: %v", leader, err)
+	}
+
+	// a停止选主时先停止工作再放弃leader身份，b立即成为leader
+	a.stop()
+	if ctxA.Err() == nil {
+		t.Error("expect context of a to be cancelled")
+	}
+	receive(t, "a to stop leading", a.stopped)
+	receiveContext(t, "b to start leading", b.started)
+	if leader, _ := b.elector.Leader(context.TODO()); leader != "b" {
+		t.Errorf("expect leader b, got %s", leader)
+	}
+	metrics := a.elector.Metrics()
+	if metrics.IsLeader || metrics.Acquired != 1 || metrics.Lost != 0 || metrics.LeaderSince != nil {
+		t.Errorf("unexpected metrics of a: %+v", metrics)
+	}
+	if len(List()) != 1 || List()[0] != b.elector {
+		t.Errorf("expect only b to be running, got %v", List())
+	}
+}
+
+func TestLeadershipLost(t *testing.T) {
+	s := newTestRedis(t)
+	name := "buildjob/masters/lost"
+
+	a := startCandidate(t, name, "a")
+	ctx := receiveContext(t, "a to start leading", a.started)
+	waitFor(t, "a to renew", func() bool {
+		m := a.elector.Metrics()
+		return m.LastRenewed != nil && m.LastRenewed.After(*m.LeaderSince)
+	})
+
+	// 租约被其他候选者持有，续期时发现失去leader身份
+	s.Set(name, "other")
+	receive(t, "a to stop leading", a.stopped)
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled after leadership lost")
+	}
+	if a.elector.IsLeader() {
+		t.Error("expect a not to be leader")
+	}
+	if leader, _ := s.Get(name); leader != "other" {
+		t.Errorf("expect lease of other not to be released, got %s", leader)
+	}
+
+	// 租约释放后重新成为leader
+	s.Del(name)
+	receiveContext(t, "a to start leading again", a.started)
+	metrics := a.elector.Metrics()
+	if !metrics.IsLeader || metrics.Acquired != 2 || metrics.Lost != 1 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestRenewFailure(t *testing.T) {
+	s := newTestRedis(t)
+	name := "buildjob/masters/renew-failure"
+
+	a := startCandidate(t, name, "a")
+	ctx := receiveContext(t, "a to start leading", a.started)
+
+	// redis不可用，租约可能已经过期时放弃leader身份
+	s.SetError("connection refused")
+	start := time.Now()
+	receive(t, "a to stop leading", a.stopped)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expect a to step down within lease duration, took %v", elapsed)
+	}
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled after renew failed")
+	}
+	if metrics := a.elector.Metrics(); metrics.RenewFailures == 0 || metrics.Lost != 1 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+
+	s.SetError("")
+	receiveContext(t, "a to start leading after redis recovered", a.started)
+}
+
+// 第一次竞选成功，之后的续期一直阻塞到ctx被取消，模拟卡住的后端
+type hangingElector struct {
+	campaigns int
+}
+
+func (e *hangingElector) Campaign(ctx context.Context, election string, candidate string, ttl time.Duration) (bool, error) {
+	e.campaigns++
+	if e.campaigns == 1 {
+		return true, nil
+	}
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func (e *hangingElector) Resign(ctx context.Context, election string, candidate string) error {
+	return nil
+}
+
+func (e *hangingElector) Leader(ctx context.Context, election string) (string, error) {
+	return "", nil
+}
+
+func TestRenewTimeout(t *testing.T) {
+	started := make(chan context.Context, 1)
+	stopped := make(chan struct{}, 1)
+	e, err := New(Options{
+		Name:             "buildjob/masters/renew-timeout",
+		LeaseDuration:    300 * time.Millisecond,
+		RenewInterval:    50 * time.Millisecond,
+		OnStartedLeading: func(ctx context.Context) { started <- ctx },
+		OnStoppedLeading: func() { stopped <- struct{}{} },
+		Elector:          &hangingElector{},
+	})
+	if err != nil {
+		t.Fatalf("create elector failed: %v", err)
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(runCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	ctx := receiveContext(t, "start leading", started)
+	// 续期卡住时最多等到租约过期就放弃leader身份
+	start := time.Now()
+	receive(t, "stop leading", stopped)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect to step down within lease duration, took %v", elapsed)
+	}
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled after renew timed out")
+	}
+	if metrics := e.Metrics(); metrics.IsLeader || metrics.RenewFailures != 1 || metrics.Lost != 1 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
@@ -2,30 +2,35 @@ package instance
 
 import (
 	"bryson.foundation/kbuildresource/async"
+	"bryson.foundation/kbuildresource/buildjob"
 	"bryson.foundation/kbuildresource/cache"
 	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/coordination"
+	"bryson.foundation/kbuildresource/dto"
+	"bryson.foundation/kbuildresource/election"
 	"bryson.foundation/kbuildresource/utils"
 	"context"
-	"encoding/json"
 	"github.com/astaxie/beego"
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	lockLeaseTime = 6 * time.Second // 每次续期6s
-	renewInterval = 3 * time.Second // 每3秒续期一次
+	metaLockLeaseTime     = time.Minute      // meta锁的有效期
+	metaLockRenewInterval = 20 * time.Second // 持有meta锁期间的续期间隔
+
+	joinRetryInterval = 5 * time.Second // 加入实例列表失败时的重试间隔
 )
 
 var (
-	instanceKeyOfSelf   = ""
-	distributeLockKey   = cache.GenMetaDistributeKey(common.BuildJobPrefix)
-	instanceNameListKey = cache.GenInstanceNameListKey(common.BuildJobPrefix)
+	distributeLockKey = cache.GenMetaDistributeKey(common.BuildJobPrefix)
 )
 
 type LivenessProbe interface {
@@ -50,7 +55,14 @@ type instanceWithRedis struct {
 	stopCh            chan struct{}  // 程序自动调用关闭实例
 	signalCh          chan os.Signal // 接收到syscall.SIGINT和syscall.SIGTERM 信号量关闭
 	liveCh            chan struct{}  // 程序存活
+	drainedCh         chan struct{}  // 停机时请求交接完成，之后停止续期存活
+	startedAt         time.Time      // 实例的启动时间，实例列表按照启动时间排序
+	stopOnce          sync.Once      // 信号和自我隔离都会关闭实例
+	joined            atomic.Bool    // 已经加入实例列表，之后才检查心跳
 	requestController *async.RequestController
+	electionCtx       context.Context // 停机时取消，停止所有选主
+	stopElections     context.CancelFunc
+	elections         sync.WaitGroup // 正在运行的选主，停机时等待它们放弃leader身份
 }
 
 var (
@@ -63,38 +75,26 @@ func init() {
 
 func newInstance() Instance {
 	instanceName := utils.CreateRandomString(8)
+	electionCtx, stopElections := context.WithCancel(context.Background())
 	instance := &instanceWithRedis{
 		name:              instanceName,
 		stopCh:            make(chan struct{}),
 		signalCh:          make(chan os.Signal),
 		liveCh:            make(chan struct{}),
+		drainedCh:         make(chan struct{}),
+		startedAt:         time.Now(),
 		requestController: async.NewRequestController(instanceName),
+		electionCtx:       electionCtx,
+		stopElections:     stopElections,
 	}
-	instanceKeyOfSelf = cache.GenInstanceKey(common.BuildJobPrefix, instance.name)
 	return instance
 }
 
 func (instance *instanceWithRedis) collaborate() {
-	// 确保把自己添加到实例列表中
-	result := retrieveAccessOfUpdateInstanceNameList()
-	if !result {
-		logrus.Infof("INFO: retrieveAccessOfUpdateInstanceNameList failed")
-		return
-	}
-	instanceNameList, err := cache.GetInstanceNameList()
-	if err != nil {
-		return
-	}
-	instanceNameList = append(instanceNameList, instance.name)
-	err = setInstanceNameListToCache(instanceNameList)
-	if err != nil {
-		logrus.Error("ERROR: update instanceNameList failed")
+	// 确保把自己添加到实例列表中，失败时重试，不在列表中的实例不会被其他实例接管
+	if !instance.join() {
 		return
 	}
-	logrus.Info("INFO: add self to instanceNameList successful")
-	returnAccessOfUpdateInstanceNameList()
-
-
 
 	// 启动一个协程，周期性获取kbuildresource/meta锁，如果成功，进行扫描接收其他崩溃的instance的job任务
 	go func() {
@@ -113,14 +113,101 @@ func (instance *instanceWithRedis) collaborate() {
 	}()
 }
 
-// 做服务优雅停机
+// 做服务优雅停机：
+// 1. 停止接收新的http请求，等待正在执行的请求在宽限期内完成
+// 2. 把还没有结束的请求交给一个存活的实例，然后从实例列表中移除自己
+// 停机期间继续续期存活，避免其他实例把自己当作死亡实例重复接管
 func (instance *instanceWithRedis) preStop() {
+	defer close(instance.drainedCh)
+	// 先停止只有leader运行的组件，让其他实例尽快成为leader
+	instance.stopElections()
+	instance.elections.Wait()
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	if err := beego.BeeApp.Server.Shutdown(ctx); err != nil {
 		logrus.Fatal("ERROR: server force to shutdown: ", err)
 	}
 	instance.requestController.Shutdown()
+	if instance.requestController.Fenced() {
+		// 已经隔离，请求由确认自己死亡的实例接管
+		logrus.Infof("INFO: instance %s is fenced, skip handing off requests", instance.name)
+		return
+	}
+	peer := pickLivePeer(instance.name)
+	if peer == "" {
+		// 没有其他存活的实例，保留在实例列表中，之后启动的实例会把自己当作死亡实例接管
+		logrus.Infof("INFO: no live peer to hand off requests of %s", instance.name)
+		return
+	}
+	if err := instance.requestController.HandOff(peer); err != nil {
+		// 保留在实例列表中，停止续期后其他实例把自己当作死亡实例接管
+		logrus.Errorf("ERROR: hand off requests to %s failed, err: %v", peer, err)
+		return
+	}
+	instance.deregister()
+}
+
+// 把自己的记录加入实例列表，直到成功或者实例关闭
+func (instance *instanceWithRedis) join() bool {
+	for {
+		err := coordination.Default().Join(context.Background(), instance.member())
+		if err == nil {
+			instance.joined.Store(true)
+			logrus.Info("INFO: add self to instanceNameList successful")
+			return true
+		}
+		logrus.Error("ERROR: add self to instanceNameList failed, err: ", err)
+		select {
+		case <-time.After(joinRetryInterval):
+		case <-instance.stopCh:
+			return false
+		}
+	}
+}
+
+// 实例在实例列表中的记录
+func (instance *instanceWithRedis) member() *coordination.Member {
+	host, err := os.Hostname()
+	if err != nil {
+		logrus.Error("ERROR: get hostname failed, err: ", err)
+	}
+	return &coordination.Member{
+		Name:          instance.name,
+		Host:          host,
+		IP:            utils.GetLocalIP(),
+		Port:          beego.BConfig.Listen.HTTPPort,
+		Version:       common.Version,
+		StartedAt:     instance.startedAt,
+		LastHeartbeat: time.Now(),
+	}
+}
+
+// 从实例列表中移除自己
+func (instance *instanceWithRedis) deregister() {
+	if err := coordination.Default().Leave(context.Background(), instance.name); err != nil {
+		logrus.Error("ERROR: update instanceNameList failed, err: ", err)
+		return
+	}
+	logrus.Infof("INFO: remove %s from instanceNameList", instance.name)
+}
+
+// 随机选择一个存活的其他实例，没有时返回空字符串
+func pickLivePeer(self string) string {
+	instanceNameList, err := coordination.Default().Members(context.Background())
+	if err != nil {
+		logrus.Error("ERROR: get instanceNameList failed, err: ", err)
+		return ""
+	}
+	peers := make([]string, 0, len(instanceNameList))
+	for _, instanceName := range instanceNameList {
+		if instanceName != self && checkLive(instanceName) {
+			peers = append(peers, instanceName)
+		}
+	}
+	if len(peers) == 0 {
+		return ""
+	}
+	return peers[rand.Intn(len(peers))]
 }
 
 func (instance *instanceWithRedis) Name() string {
@@ -129,13 +216,49 @@ func (instance *instanceWithRedis) Name() string {
 
 // Shutdown 提供外部调用，用于关闭应用
 func (instance *instanceWithRedis) Shutdown() {
-	close(instance.stopCh)
+	instance.stopOnce.Do(func() {
+		close(instance.stopCh)
+	})
 }
 
 // 这里如果有多个是要做成注册制的，类似kubeedge
 func (instance *instanceWithRedis) runController() {
 	// 启动requestController
 	go instance.requestController.StartUp()
+	// 启动pod状态同步，只有master实例运行
+	reconciler := buildjob.NewPodReconciler()
+	instance.runElection("pod-reconciler", reconciler.Start, reconciler.Stop)
+	// 触发周期性的构建任务，只有master实例运行，保证每次触发只创建一个构建任务
+	scheduleRunner := buildjob.NewScheduleRunner(submitScheduledBuildJob)
+	instance.runElection("schedule-runner", scheduleRunner.Start, scheduleRunner.Stop)
+}
+
+// 参与选主，成为master时调用start，失去master身份或者停机时取消start的ctx并调用stop
+func (instance *instanceWithRedis) runElection(jobName string, start func(ctx context.Context), stop func()) {
+	elector, err := election.New(election.Options{
+		Name:             cache.GenMasterKey(common.BuildJobPrefix, jobName),
+		Candidate:        instance.name,
+		OnStartedLeading: start,
+		OnStoppedLeading: stop,
+	})
+	if err != nil {
+		logrus.Errorf("ERROR: create election of %s failed, err: %v", jobName, err)
+		return
+	}
+	instance.elections.Add(1)
+	go func() {
+		defer instance.elections.Done()
+		elector.Run(instance.electionCtx)
+	}()
+}
+
+// 以幂等键提交计划触发的构建任务，返回请求ID
+func submitScheduledBuildJob(ctx context.Context, buildJobDTO *dto.BuildJobDTO, idempotencyKey string) (string, error) {
+	result, err := async.GetRequestController().AcceptRequest(ctx, buildJobDTO, common.BuildJobCreateRequestType, idempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	return result.RequestID, nil
 }
 
 // StartUp 这个函数需要传入一个finishCh来通知外部调用者，内部已经初始化完成
@@ -173,26 +296,46 @@ func (instance *instanceWithRedis) StartUp() {
 	}
 }
 
-// 基于redis 来实现存活性验证
+// 基于协调后端的存活租约来实现存活性验证
+// 租约丢失后不再重新获取：其他实例可能正在接管自己的请求，这时隔离自己并退出
 func (instance *instanceWithRedis) keepalive() {
 	// 不断续期，直到死亡
-	_, err := cache.LockKey(instanceKeyOfSelf, lockLeaseTime)
+	err := coordination.Default().Grant(context.Background(), instance.name, conf.Conf.HeartbeatTimeout)
 	if err != nil {
-		logrus.Errorf("ERROR: instance %s get lock failed, err: ", instance.name, err)
+		logrus.Errorf("ERROR: instance %s get lock failed, err: %v", instance.name, err)
 		return
 	}
-	ticker := time.NewTicker(renewInterval)
+	lastRenewed := time.Now()
+	ticker := time.NewTicker(conf.Conf.HeartbeatInterval)
 	go func() {
 		defer ticker.Stop()
 		for {
 			select {
 			case t := <-ticker.C:
-				err := cache.RenewExpiration(instanceKeyOfSelf, lockLeaseTime)
+				// 以发起续期的时间作为租约的起点，比服务端的实际时间早
+				renewedAt := time.Now()
+				ctx, cancel := context.WithTimeout(context.Background(), conf.Conf.HeartbeatInterval)
+				renewed, err := coordination.Default().Renew(ctx, instance.name, conf.Conf.HeartbeatTimeout)
+				cancel()
 				if err != nil {
-					logrus.Infof("INFO: instance %s renew lock failed at %s", instance.name, t)
+					logrus.Infof("INFO: instance %s renew lock failed at %s, err: %v", instance.name, t, err)
+					if time.Since(lastRenewed) >= conf.Conf.HeartbeatTimeout {
+						// 租约可能已经过期，不能确认自己还存活
+						instance.fence("lease not renewed since " + lastRenewed.String())
+						return
+					}
 					continue
 				}
-			case <-instance.stopCh:
+				if !renewed {
+					instance.fence("lease expired")
+					return
+				}
+				lastRenewed = renewedAt
+				if instance.joined.Load() && !instance.heartbeat() {
+					instance.fence("removed from instanceNameList")
+					return
+				}
+			case <-instance.drainedCh:
 				return
 
 			}
@@ -200,121 +343,177 @@ func (instance *instanceWithRedis) keepalive() {
 	}()
 }
 
+// 更新实例列表中自己的心跳时间，已经被其他实例当作死亡实例移除时返回false
+func (instance *instanceWithRedis) heartbeat() bool {
+	ok, err := coordination.Default().Heartbeat(context.Background(), instance.name)
+	if err != nil {
+		logrus.Errorf("ERROR: heartbeat of instance %s failed, err: %v", instance.name, err)
+		return true
+	}
+	if !ok {
+		select {
+		case <-instance.stopCh:
+			// 停机时已经主动从实例列表中移除自己
+			return true
+		default:
+		}
+	}
+	return ok
+}
+
+// 存活租约丢失后隔离自己：立即停止执行请求，然后关闭实例
+// 自己的请求由确认自己死亡的实例接管，停机时不再交接请求，也不从实例列表中移除自己
+func (instance *instanceWithRedis) fence(reason string) {
+	logrus.Errorf("ERROR: instance %s lost its lease (%s), fence itself and shutdown", instance.name, reason)
+	instance.requestController.Fence()
+	instance.Shutdown()
+}
+
 func (instance *instanceWithRedis) clear() {
-	logrus.Info("INFO: delete redis key ", instanceKeyOfSelf)
-	err := cache.DelKey(instanceKeyOfSelf)
+	logrus.Info("INFO: revoke lease of instance ", instance.name)
+	err := coordination.Default().Revoke(context.Background(), instance.name)
 	if err != nil {
-		logrus.Errorf("INFO: clear instanceKeyOfSelf %s failed, err :", instanceKeyOfSelf, err)
+		logrus.Errorf("INFO: revoke lease of instance %s failed, err: %v", instance.name, err)
 		return
 	}
-	logrus.Infof("INFO: clear instanceKeyOfSelf %s success", instanceKeyOfSelf)
+	logrus.Infof("INFO: revoke lease of instance %s success", instance.name)
 }
 
 func (instance *instanceWithRedis) startClearDeadInstances() {
 	logrus.Info("INFO: collaborate to retrieve access of takeover job of other instance")
-	isSuccess := retrieveAccessOfTakeOver()
-	if !isSuccess {
+	lock := retrieveAccessOfTakeOver()
+	if lock == nil {
 		logrus.Infof("INFO: retrieveAccessOfTakeOver failed, skip clearDeadInstances")
 		return
 	}
 	// 释放锁
-	defer returnAccessOfTakeOver()
+	defer returnAccessOfTakeOver(lock)
+	// 接管的时间可能比较长，持有期间续期；锁过期后的写入会因为fencing token过期被拒绝
+	stopExtending := keepExtending(lock)
+	defer stopExtending()
 
 	// 获取没成功，开始检索任务
 	logrus.Infof("INFO: retrieveAccessOfTakeOver successful, collaborate clearDeadInstance")
-	instanceNameList, err := cache.GetInstanceNameList()
+	members, err := coordination.Default().ListMembers(context.Background())
 	if err != nil {
 		return
 	}
-	liveInstances := make([]string, 0)
+	detector := coordination.DefaultFailureDetector()
+	deadInstances := make([]string, 0)
 	wg := sync.WaitGroup{} // 用于保存老实例的任务全部接管完毕后才更新instance列表
-	for _, instanceName := range instanceNameList {
-		// 不存活需要重新提取出它的job
-		if instanceName != instance.name && !checkLive(instanceName) {
-			wg.Add(1)
+	for _, member := range members {
+		instanceName := member.Name
+		if instanceName == instance.name {
+			continue
+		}
+		state, err := detector.State(context.Background(), member)
+		if err != nil {
+			// 查询失败时当作存活，避免误接管
+			logrus.Errorf("ERROR: detect state of instance %s failed, err: %v", instanceName, err)
+			continue
+		}
+		if state == coordination.MemberSuspect {
+			logrus.Infof("INFO: instance %s is suspected, last heartbeat at %s", instanceName, member.LastHeartbeat)
+			continue
+		}
+		// 确认死亡需要重新提取出它的job
+		if state == coordination.MemberDead {
 			logrus.Infof("INFO: instance %s is dead", instanceName)
+			deadInstances = append(deadInstances, instanceName)
+			// 持久化队列中死亡实例的请求由各个实例通过认领接管，这里只需要从实例列表中移除
+			if instance.requestController.QueueDurable() {
+				continue
+			}
+			wg.Add(1)
 			go func(instanceName string) {
 				defer wg.Done()
-				err := instance.requestController.TakeOverRequest(instanceName, instance.name)
+				err := instance.requestController.TakeOverRequest(instanceName, instance.name, lock.Token())
 				if err != nil {
 					logrus.Error("ERROR: ", err)
 				}
 			}(instanceName)
-		} else {
-			liveInstances = append(liveInstances, instanceName)
 		}
 	}
 	wg.Wait()
-	err = setInstanceNameListToCache(liveInstances)
-	if err != nil {
-		logrus.Error("ERROR: update instance name list failed")
-		return
+	for _, instanceName := range deadInstances {
+		err = coordination.Default().Leave(context.Background(), instanceName)
+		if err != nil {
+			logrus.Error("ERROR: update instance name list failed, err: ", err)
+			return
+		}
+		detector.Forget(instanceName)
 	}
 	logrus.Info("INFO: finish clearDeadInstance Job")
 }
 
 func (instance *instanceWithRedis) isLive() bool {
-	return !cache.IsExpire(instanceKeyOfSelf)
+	return checkLive(instance.name)
 }
 
 func checkLive(instanceName string) bool {
-	key := cache.GenInstanceKey(common.BuildJobPrefix, instanceName)
-	return !cache.IsExpire(key)
-}
-
-// 获取分布式锁，如果占用需要等待
-func retrieveAccessOfUpdateInstanceNameList() bool {
-	result := true
-	var err error
-	for i := 0; i < 10; i++ {
-		result, err = cache.LockKey(distributeLockKey, time.Minute)
-		// 网络问题进行重试
-		if err != nil {
-			logrus.Error("ERROR: ", err)
-			continue
-		} else if !result {
-			// 获取不到，重新随机等待，再重新获取
-			time.Sleep(time.Duration(200+rand.Int63n(1000)) * time.Millisecond)
-			continue
-		}
-		// 成功直接break
-		break
+	alive, err := coordination.Default().Alive(context.Background(), instanceName)
+	if err != nil {
+		// 查询失败时当作存活，避免误接管
+		logrus.Errorf("ERROR: check live of instance %s failed, err: %v", instanceName, err)
+		return true
 	}
-	return result
-}
-
-func returnAccessOfUpdateInstanceNameList() bool {
-	return releaseDistributeKey()
+	return alive
 }
 
-// 获取 分布式锁，非网络原因，直接返回结果
-func retrieveAccessOfTakeOver() bool {
-	result := true
-	var err error
+// 获取 分布式锁，非网络原因，直接返回结果，获取失败返回nil
+func retrieveAccessOfTakeOver() coordination.Lock {
 	for i := 0; i < 3; i++ {
-		result, err = cache.LockKey(distributeLockKey, time.Minute)
+		lock, err := coordination.Default().TryLock(context.Background(), distributeLockKey, metaLockLeaseTime)
 		// 网络问题进行重试
 		if err != nil {
 			continue
 		}
-		break
+		return lock
 	}
-	return result
+	return nil
 }
 
-func returnAccessOfTakeOver() bool {
-	return releaseDistributeKey()
+func returnAccessOfTakeOver(lock coordination.Lock) bool {
+	return releaseDistributeKey(lock)
 }
 
-func releaseDistributeKey() bool {
-	return cache.RedisReleaseLock(distributeLockKey)
+// 只释放自己持有的锁，锁已经过期并被其他实例获取时不会删除
+func releaseDistributeKey(lock coordination.Lock) bool {
+	released, err := lock.Release(context.Background())
+	if err != nil {
+		logrus.Error("ERROR: release distribute lock failed, err: ", err)
+		return false
+	}
+	if !released {
+		logrus.Infof("INFO: distribute lock %s with token %d has expired", lock.Key(), lock.Token())
+	}
+	return released
 }
 
-func setInstanceNameListToCache(liveInstances []string) error {
-	instanceNameListJsonData, err := json.Marshal(liveInstances)
-	if err != nil {
-		logrus.Error("ERROR: setInstanceNameListToCache unmarshal failed")
-		return err
+// 持有锁期间定期续期，返回停止续期的函数；锁已经丢失时停止续期
+func keepExtending(lock coordination.Lock) func() {
+	stopCh := make(chan struct{})
+	go func() {
+		t := time.NewTicker(metaLockRenewInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				extended, err := lock.Extend(context.Background(), metaLockLeaseTime)
+				if err != nil {
+					logrus.Error("ERROR: extend distribute lock failed, err: ", err)
+					continue
+				}
+				if !extended {
+					logrus.Infof("INFO: distribute lock %s with token %d has been lost", lock.Key(), lock.Token())
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
 	}
-	return cache.RedisClient.Set(instanceNameListKey, instanceNameListJsonData, 0).Err()
 }
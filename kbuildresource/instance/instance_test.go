@@ -0,0 +1,92 @@
+package instance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+
+	"bryson.foundation/kbuildresource/cache"
+	"bryson.foundation/kbuildresource/common"
+	"bryson.foundation/kbuildresource/conf"
+	"bryson.foundation/kbuildresource/coordination"
+)
+
+// 使用进程内的redis作为协调后端，缩短续期间隔，创建一个已经加入实例列表的实例
+func newTestInstance(t *testing.T) (*instanceWithRedis, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	old := conf.Conf
+	conf.Conf.HeartbeatInterval = 20 * time.Millisecond
+	conf.Conf.HeartbeatTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		conf.Conf = old
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+	coordination.SetBackend(coordination.NewRedisBackend())
+
+	instance := newInstance().(*instanceWithRedis)
+	if err := coordination.Default().Join(context.TODO(), instance.member()); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	instance.joined.Store(true)
+	t.Cleanup(instance.Shutdown)
+	return instance, s
+}
+
+// 等待实例隔离自己并关闭
+func waitFenced(t *testing.T, instance *instanceWithRedis) {
+	select {
+	case <-instance.stopCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect instance to shutdown")
+	}
+	if !instance.requestController.Fenced() {
+		t.Error("expect request controller to be fenced")
+	}
+}
+
+func TestKeepaliveRenews(t *testing.T) {
+	instance, _ := newTestInstance(t)
+	instance.keepalive()
+	defer close(instance.drainedCh)
+	// 持续续期超过租约的有效期，实例一直存活
+	time.Sleep(5 * conf.Conf.HeartbeatTimeout)
+	select {
+	case <-instance.stopCh:
+		t.Fatal("expect instance to keep running")
+	default:
+	}
+	if !instance.isLive() {
+		t.Error("expect instance to be alive")
+	}
+}
+
+func TestKeepaliveFencesWhenLeaseLost(t *testing.T) {
+	instance, s := newTestInstance(t)
+	instance.keepalive()
+	// 租约已经过期被删除，续期不会重新创建，实例隔离自己
+	s.Del(cache.GenInstanceKey(common.BuildJobPrefix, instance.name))
+	waitFenced(t, instance)
+	if instance.isLive() {
+		t.Error("expect lease not to be recreated")
+	}
+}
+
+func TestKeepaliveFencesWhenRemovedFromMembers(t *testing.T) {
+	instance, _ := newTestInstance(t)
+	instance.keepalive()
+	// 其他实例把自己当作死亡实例接管后从实例列表中移除，租约还有效也要隔离
+	if err := coordination.Default().Leave(context.TODO(), instance.name); err != nil {
+		t.Fatalf("leave failed: %v", err)
+	}
+	waitFenced(t, instance)
+	members, err := coordination.Default().Members(context.TODO())
+	if err != nil || len(members) != 0 {
+		t.Errorf("expect fenced instance not to join again, got %v, err: %v", members, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	_ "bryson.foundation/kbuildresource/async/handler" //注入处理器
+	"bryson.foundation/kbuildresource/coordination"
 	"bryson.foundation/kbuildresource/instance"
 	"bryson.foundation/kbuildresource/models"
 	_ "bryson.foundation/kbuildresource/routers"
@@ -11,6 +12,7 @@ import (
 
 func main() {
 	models.Init()
+	coordination.Init()
 
 	if beego.BConfig.RunMode == "dev" {
 		beego.BConfig.WebConfig.DirectoryIndex = true
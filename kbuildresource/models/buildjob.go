@@ -1,8 +1,10 @@
 package models
 
 import (
+	"fmt"
 	"github.com/astaxie/beego/orm"
 	"github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
@@ -18,7 +20,9 @@ type Pod struct {
 	GmtCreated time.Time `orm:"column(gmt_created);type(timestamp);auto_now_add;" description:"创建时间"`
 	GmtModified time.Time `orm:"column(gmt_modified);type(timestamp);auto_now;" description:"更新更新"`
 	Message string `orm:"column(message);" description:"状态运行信息，比如出错原因等，一般是最后一条事件信息"`
-	Containers []*Container `orm:"reverse(many)",json:"containers" description:"绑定的containers"`
+	ScheduleReason string `orm:"column(schedule_reason);size(1024);null" description:"选择集群的原因"`
+	RequestID string `orm:"column(request_id);size(64);null" description:"创建pod的请求ID，同一个请求重复执行时复用pod"`
+	Containers []*Container `orm:"reverse(many)" json:"containers" description:"绑定的containers"`
 }
 
 type Container struct {
@@ -29,8 +33,9 @@ type Container struct {
 	Image string `json:"image" description:"容器镜像"`
 	RequestCPU string`json:"requestCPU" description:"请求cpu大小"`
 	RequestMem string`json:"requestMem" description:"请求内存大小"`
-	LimitCPU string`json:"requestCPU" description:"最大可用cpu大小"`
-	LimitMem string`json:"requestCPU" description:"最大可用内存大小"`
+	LimitCPU string`json:"limitCPU" description:"最大可用cpu大小"`
+	LimitMem string`json:"limitMem" description:"最大可用内存大小"`
+	State string `orm:"column(state);size(512);null" json:"state" description:"只读，容器的运行状态，由reconciler从集群同步"`
 	GmtCreated time.Time `orm:"column(gmt_created);type(timestamp);auto_now_add;" description:"创建时间"`
 	GmtModified time.Time `orm:"column(gmt_modified);type(timestamp);auto_now;" description:"更新更新"`
 }
@@ -71,22 +76,191 @@ func GetPodByID(id int) (v *Pod, err error) {
 	return nil, err
 }
 
+// 同名pod可能被删除后重新创建，取最新的一条
 func GetPodByName(name string) (v *Pod, err error) {
 	o := orm.NewOrm()
-	SQLStr := `select * from pod where name= ? `
-	err = o.Raw(SQLStr, name).QueryRow(&v)
-	if err = o.Read(v); err == nil {
+	v = &Pod{}
+	SQLStr := `select * from pod where name = ? order by id desc limit 1`
+	err = o.Raw(SQLStr, name).QueryRow(v)
+	if err == nil {
 		return v, nil
 	}
 	if err == orm.ErrNoRows {
-		return nil,nil
+		return nil, nil
 	}
 	return nil, err
 }
 
+// pod列表查询条件，字符串条件为空表示不过滤
+type PodQuery struct {
+	ClusterName    string
+	Namespace      string
+	Status         string
+	Label          string    // 标签，匹配labels里面的任意一个
+	CreatedAfter   time.Time // 创建时间下限（包含），零值不过滤
+	CreatedBefore  time.Time // 创建时间上限（不包含），零值不过滤
+	IncludeDeleted bool      // 是否包含已经逻辑删除的pod
+	SortBy         string    // 排序字段，只能是PodSortFields里面的字段
+	Desc           bool
+	Limit          int
+	Cursor         *PodCursor // 上一页最后一条记录的位置，nil表示第一页
+	WithContainers bool       // 是否通过反向关系加载containers
+}
+
+// 游标分页的位置，SortValue是排序字段的值，排序字段相同时用ID区分
+type PodCursor struct {
+	SortValue string `json:"v"`
+	ID        int    `json:"id"`
+}
+
+// 允许排序的字段：api字段名 -> 数据库列名
+var PodSortFields = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"gmtCreated": "gmt_created",
+}
+
+const podTimeLayout = "2006-01-02 15:04:05"
+
+// 按条件查询pod列表，使用游标分页
+func ListPods(q *PodQuery) ([]*Pod, error) {
+	sortColumn, ok := PodSortFields[q.SortBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort field %s", q.SortBy)
+	}
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if !q.IncludeDeleted {
+		conditions = append(conditions, "is_delete = '0'")
+	}
+	if q.ClusterName != "" {
+		conditions = append(conditions, "cluster_name = ?")
+		args = append(args, q.ClusterName)
+	}
+	if q.Namespace != "" {
+		conditions = append(conditions, "namespace = ?")
+		args = append(args, q.Namespace)
+	}
+	if q.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, q.Status)
+	}
+	if q.Label != "" {
+		// labels以逗号分隔保存
+		conditions = append(conditions, "find_in_set(?, labels) > 0")
+		args = append(args, q.Label)
+	}
+	if !q.CreatedAfter.IsZero() {
+		conditions = append(conditions, "gmt_created >= ?")
+		args = append(args, q.CreatedAfter.In(orm.DefaultTimeLoc).Format(podTimeLayout))
+	}
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, "gmt_created < ?")
+		args = append(args, q.CreatedBefore.In(orm.DefaultTimeLoc).Format(podTimeLayout))
+	}
+	order := "asc"
+	compare := ">"
+	if q.Desc {
+		order = "desc"
+		compare = "<"
+	}
+	if q.Cursor != nil {
+		if sortColumn == "id" {
+			conditions = append(conditions, fmt.Sprintf("id %s ?", compare))
+			args = append(args, q.Cursor.ID)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? or (%s = ? and id %s ?))", sortColumn, compare, sortColumn, compare))
+			args = append(args, q.Cursor.SortValue, q.Cursor.SortValue, q.Cursor.ID)
+		}
+	}
+
+	SQLStr := "select * from pod"
+	if len(conditions) > 0 {
+		SQLStr += " where " + strings.Join(conditions, " and ")
+	}
+	if sortColumn == "id" {
+		SQLStr += fmt.Sprintf(" order by id %s limit ?", order)
+	} else {
+		SQLStr += fmt.Sprintf(" order by %s %s, id %s limit ?", sortColumn, order, order)
+	}
+	args = append(args, q.Limit)
+
+	o := orm.NewOrm()
+	pods := make([]*Pod, 0)
+	if _, err := o.Raw(SQLStr, args...).QueryRows(&pods); err != nil {
+		return nil, err
+	}
+	if q.WithContainers {
+		for _, pod := range pods {
+			if _, err := o.LoadRelated(pod, "Containers"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pods, nil
+}
+
+// 根据pod和排序字段生成下一页的游标
+func NewPodCursor(pod *Pod, sortBy string) *PodCursor {
+	cursor := &PodCursor{ID: pod.ID}
+	switch PodSortFields[sortBy] {
+	case "name":
+		cursor.SortValue = pod.Name
+	case "gmt_created":
+		cursor.SortValue = pod.GmtCreated.In(orm.DefaultTimeLoc).Format(podTimeLayout)
+	}
+	return cursor
+}
+
 // Container
 func AddPodContainer(c *Container) (id int64, err error) {
 	o := orm.NewOrm()
 	id, err = o.Insert(c)
 	return
-}
\ No newline at end of file
+}
+// 逻辑删除pod，只会更新还没有被删除的记录，重复调用是安全的
+func DeletePodByName(name string) (int64, error) {
+	o := orm.NewOrm()
+	SQLStr := `update pod set is_delete = '1' where name = ? and is_delete = '0'`
+	result, err := o.Raw(SQLStr, name).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 更新pod的运行状态
+func UpdatePodStatus(m *Pod) error {
+	o := orm.NewOrm()
+	_, err := o.Update(m, "Status", "NodeIP", "Message", "GmtModified")
+	return err
+}
+
+// 统计集群中还没有删除的pod数量
+func CountActivePodsByCluster(clusterName string) (int64, error) {
+	o := orm.NewOrm()
+	return o.QueryTable(new(Pod)).Filter("cluster_name", clusterName).Filter("is_delete", "0").Count()
+}
+
+// 查询集群中还没有删除的pod，不存在时返回nil
+func GetActivePod(clusterName string, namespace string, name string) (*Pod, error) {
+	o := orm.NewOrm()
+	v := &Pod{}
+	SQLStr := `select * from pod where cluster_name = ? and namespace = ? and name = ? and is_delete = '0' order by id desc limit 1`
+	err := o.Raw(SQLStr, clusterName, namespace, name).QueryRow(v)
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// 更新容器的运行状态
+func UpdateContainerState(podID int, containerName string, state string) error {
+	o := orm.NewOrm()
+	SQLStr := `update container set state = ? where pod_id = ? and name = ?`
+	_, err := o.Raw(SQLStr, state, podID, containerName).Exec()
+	return err
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+	"time"
+)
+
+// 集群注册信息，构建任务只能创建到已注册并且启用的集群中
+type Cluster struct {
+	ID int `json:"id" orm:"column(id);auto" description:"只读，主键字段，由后台数据库自动生成"`
+	Name string `json:"name" orm:"column(name);size(128);unique" description:"必选，集群名"`
+	APIEndpoint string `json:"apiEndpoint" orm:"column(api_endpoint);size(256)" description:"apiserver地址，为空时使用kubeconfig中的地址"`
+	CredentialsRef string `json:"credentialsRef" orm:"column(credentials_ref);size(512)" description:"凭证引用，kubeconfig文件路径，和apiEndpoint都为空时使用in-cluster配置"`
+	ExecutorType string `json:"executorType" orm:"column(executor_type);size(32)" description:"pod执行器：kubernetes、simulated，默认kubernetes"`
+	NetworkZone string `json:"networkZone" orm:"column(network_zone);size(128)" description:"网络区域"`
+	Capacity int `json:"capacity" orm:"column(capacity)" description:"可以同时运行的构建任务数"`
+	Enabled bool `json:"enabled" orm:"column(enabled)" description:"是否启用，禁用后不能再创建构建任务"`
+	GmtCreated time.Time `json:"gmtCreated" orm:"column(gmt_created);type(timestamp);auto_now_add" description:"创建时间"`
+	GmtModified time.Time `json:"gmtModified" orm:"column(gmt_modified);type(timestamp);auto_now" description:"更新时间"`
+}
+
+func (t *Cluster) TableName() string {
+	return "cluster"
+}
+
+func AddCluster(m *Cluster) (int64, error) {
+	o := orm.NewOrm()
+	return o.Insert(m)
+}
+
+// 不存在时返回nil
+func GetClusterByName(name string) (*Cluster, error) {
+	o := orm.NewOrm()
+	m := &Cluster{Name: name}
+	err := o.Read(m, "Name")
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ListClusters() ([]*Cluster, error) {
+	o := orm.NewOrm()
+	clusters := make([]*Cluster, 0)
+	_, err := o.QueryTable(new(Cluster)).OrderBy("id").All(&clusters)
+	return clusters, err
+}
+
+// 查询网络区域中启用的集群
+func ListEnabledClustersByZone(networkZone string) ([]*Cluster, error) {
+	o := orm.NewOrm()
+	clusters := make([]*Cluster, 0)
+	_, err := o.QueryTable(new(Cluster)).Filter("network_zone", networkZone).Filter("enabled", true).OrderBy("id").All(&clusters)
+	return clusters, err
+}
+
+func UpdateCluster(m *Cluster) error {
+	o := orm.NewOrm()
+	_, err := o.Update(m, "APIEndpoint", "CredentialsRef", "ExecutorType", "NetworkZone", "Capacity", "Enabled", "GmtModified")
+	return err
+}
+
+func DeleteClusterByName(name string) (int64, error) {
+	o := orm.NewOrm()
+	return o.QueryTable(new(Cluster)).Filter("name", name).Delete()
+}
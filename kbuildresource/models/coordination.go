@@ -0,0 +1,166 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+	"time"
+)
+
+// mysql当前时间的毫秒时间戳，租约的过期时间都使用mysql的时钟，避免实例之间的时钟偏差
+const nowMillis = `ROUND(UNIX_TIMESTAMP(NOW(3)) * 1000)`
+
+// 协调后端为mysql时的租约，用于实例存活、选主和锁的fencing token
+type CoordinationLease struct {
+	Name string `json:"name" orm:"column(name);size(255);pk" description:"租约名，实例存活为instance/实例名，选主为election/选举名，锁为lock/锁名"`
+	Holder string `json:"holder" orm:"column(holder);size(255)" description:"租约的持有者"`
+	Token int64 `json:"token" orm:"column(token);default(0)" description:"锁的fencing token，每次加锁加1"`
+	ExpireAt int64 `json:"expireAt" orm:"column(expire_at);index" description:"过期时间，mysql时钟的毫秒时间戳"`
+}
+
+func (t *CoordinationLease) TableName() string {
+	return "coordination_lease"
+}
+
+// 实例成员的记录，协调后端为mysql时保存在coordination_member表中，其他后端序列化为json保存
+// 表由models.Init中的orm.RunSyncdb创建，表已经存在时RunSyncdb只添加缺少的列，不会删除和修改已有的列
+// 从只记录name和gmt_created的旧版本升级时，先停止所有实例，再执行下面的ddl，新版本启动时实例重新加入：
+//   alter table coordination_member drop column gmt_created,
+//     add column host varchar(255) not null default '',
+//     add column ip varchar(64) not null default '',
+//     add column port integer not null default 0,
+//     add column version varchar(64) not null default '',
+//     add column started_at datetime not null default current_timestamp,
+//     add column last_heartbeat datetime not null default current_timestamp;
+type CoordinationMember struct {
+	Name string `json:"name" orm:"column(name);size(255);pk" description:"实例名"`
+	Host string `json:"host" orm:"column(host);size(255)" description:"实例所在的主机名"`
+	IP string `json:"ip" orm:"column(ip);size(64)" description:"实例的ip"`
+	Port int `json:"port" orm:"column(port)" description:"实例的http端口"`
+	Version string `json:"version" orm:"column(version);size(64)" description:"实例的版本"`
+	StartedAt time.Time `json:"startedAt" orm:"column(started_at);type(datetime)" description:"实例的启动时间"`
+	LastHeartbeat time.Time `json:"lastHeartbeat" orm:"column(last_heartbeat);type(datetime)" description:"实例最后一次心跳的时间"`
+}
+
+func (t *CoordinationMember) TableName() string {
+	return "coordination_member"
+}
+
+// 创建或者覆盖租约
+func GrantCoordinationLease(name string, holder string, ttl time.Duration) error {
+	o := orm.NewOrm()
+	_, err := o.Raw(`insert into coordination_lease (name, holder, token, expire_at) values (?, ?, 0, `+nowMillis+` + ?)
+on duplicate key update holder = values(holder), expire_at = values(expire_at)`, name, holder, ttl.Milliseconds()).Exec()
+	return err
+}
+
+// 续期holder持有的租约，租约已经过期、不存在或者属于其他holder时返回false
+func RenewCoordinationLease(name string, holder string, ttl time.Duration) (bool, error) {
+	o := orm.NewOrm()
+	result, err := o.Raw(`update coordination_lease set expire_at = `+nowMillis+` + ? where name = ? and holder = ? and expire_at > `+nowMillis,
+		ttl.Milliseconds(), name, holder).Exec()
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// 租约不存在、已经过期或者属于holder时由holder持有并续期，返回holder是否持有租约
+func AcquireCoordinationLease(name string, holder string, ttl time.Duration) (bool, error) {
+	o := orm.NewOrm()
+	_, err := o.Raw(`update coordination_lease set holder = ?, expire_at = `+nowMillis+` + ? where name = ? and (holder = ? or expire_at <= `+nowMillis+`)`,
+		holder, ttl.Milliseconds(), name, holder).Exec()
+	if err != nil {
+		return false, err
+	}
+	_, err = o.Raw(`insert ignore into coordination_lease (name, holder, token, expire_at) values (?, ?, 0, `+nowMillis+` + ?)`,
+		name, holder, ttl.Milliseconds()).Exec()
+	if err != nil {
+		return false, err
+	}
+	current, err := GetCoordinationLeaseHolder(name)
+	return current == holder, err
+}
+
+// 删除holder持有的租约，租约已经属于其他holder时返回false
+func ReleaseCoordinationLease(name string, holder string) (bool, error) {
+	o := orm.NewOrm()
+	result, err := o.Raw(`delete from coordination_lease where name = ? and holder = ?`, name, holder).Exec()
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func DeleteCoordinationLease(name string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw(`delete from coordination_lease where name = ?`, name).Exec()
+	return err
+}
+
+// 有效租约的持有者，租约不存在或者已经过期时返回空字符串
+func GetCoordinationLeaseHolder(name string) (string, error) {
+	o := orm.NewOrm()
+	var holder string
+	err := o.Raw(`select holder from coordination_lease where name = ? and expire_at > `+nowMillis, name).QueryRow(&holder)
+	if err == orm.ErrNoRows {
+		return "", nil
+	}
+	return holder, err
+}
+
+// 由holder持有租约并把fencing token加1，返回新的token；调用方需要持有互斥锁
+func IncrCoordinationLeaseToken(name string, holder string, ttl time.Duration) (int64, error) {
+	o := orm.NewOrm()
+	_, err := o.Raw(`insert into coordination_lease (name, holder, token, expire_at) values (?, ?, 1, `+nowMillis+` + ?)
+on duplicate key update holder = values(holder), token = token + 1, expire_at = values(expire_at)`, name, holder, ttl.Milliseconds()).Exec()
+	if err != nil {
+		return 0, err
+	}
+	var token int64
+	err = o.Raw(`select token from coordination_lease where name = ?`, name).QueryRow(&token)
+	return token, err
+}
+
+// 加入或者覆盖实例的记录
+func AddCoordinationMember(m *CoordinationMember) error {
+	o := orm.NewOrm()
+	_, err := o.Raw(`insert into coordination_member (name, host, ip, port, version, started_at, last_heartbeat) values (?, ?, ?, ?, ?, ?, now())
+on duplicate key update host = values(host), ip = values(ip), port = values(port), version = values(version), started_at = values(started_at), last_heartbeat = values(last_heartbeat)`,
+		m.Name, m.Host, m.IP, m.Port, m.Version, m.StartedAt).Exec()
+	return err
+}
+
+// 更新实例的心跳时间，实例不存在时返回false
+func UpdateCoordinationMemberHeartbeat(name string) (bool, error) {
+	o := orm.NewOrm()
+	result, err := o.Raw(`update coordination_member set last_heartbeat = now() where name = ?`, name).Exec()
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return affected > 0, err
+	}
+	// 同一秒内的心跳没有修改任何行，需要确认实例是否存在
+	var count int
+	err = o.Raw(`select count(*) from coordination_member where name = ?`, name).QueryRow(&count)
+	return count > 0, err
+}
+
+func DeleteCoordinationMember(name string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw(`delete from coordination_member where name = ?`, name).Exec()
+	return err
+}
+
+// 按照启动的先后顺序返回实例的记录
+func ListCoordinationMembers() ([]*CoordinationMember, error) {
+	o := orm.NewOrm()
+	members := make([]*CoordinationMember, 0)
+	_, err := o.Raw(`select name, host, ip, port, version, started_at, last_heartbeat from coordination_member order by started_at, name`).QueryRows(&members)
+	if err != nil && err != orm.ErrNoRows {
+		return nil, err
+	}
+	return members, nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+	"time"
+)
+
+// 死信，重试次数用完之后仍然失败的请求，保存完整的错误历史，可以重新入队
+type DeadLetter struct {
+	ID int `json:"id" orm:"column(id);auto"`
+	RequestID string `json:"requestId" orm:"column(request_id);size(64);unique" description:"请求ID"`
+	Name string `json:"name" orm:"column(name)"`
+	RequestType string `json:"requestType" orm:"column(request_type);size(64)"`
+	Namespace string `json:"namespace" orm:"column(namespace);size(256);null"`
+	Attempts int `json:"attempts" orm:"column(attempts)" description:"已经执行的次数"`
+	LastError string `json:"lastError" orm:"column(last_error);type(text)" description:"最后一次执行的错误"`
+	Errors string `json:"errors" orm:"column(errors);type(text)" description:"每次执行的错误，json数组"`
+	GmtCreated time.Time `json:"gmtCreated" orm:"column(gmt_created);type(timestamp);auto_now_add" description:"创建时间"`
+}
+
+func (t *DeadLetter) TableName() string {
+	return "dead_letter"
+}
+
+func AddDeadLetter(m *DeadLetter) (int64, error) {
+	o := orm.NewOrm()
+	return o.Insert(m)
+}
+
+// 不存在时返回nil
+func GetDeadLetterByRequestID(requestID string) (*DeadLetter, error) {
+	sqlStr := `select * from dead_letter where request_id = ? `
+	o := orm.NewOrm()
+	m := &DeadLetter{}
+	err := o.Raw(sqlStr, requestID).QueryRow(m)
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 按照进入死信的时间倒序分页查询，requestType为空时查询所有类型
+func ListDeadLetters(requestType string, offset int, limit int) ([]*DeadLetter, error) {
+	o := orm.NewOrm()
+	deadLetters := make([]*DeadLetter, 0)
+	var err error
+	if requestType == "" {
+		_, err = o.Raw(`select * from dead_letter order by id desc limit ?, ?`, offset, limit).QueryRows(&deadLetters)
+	} else {
+		_, err = o.Raw(`select * from dead_letter where request_type = ? order by id desc limit ?, ?`, requestType, offset, limit).QueryRows(&deadLetters)
+	}
+	if err != nil && err != orm.ErrNoRows {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func DeleteDeadLetterByRequestID(requestID string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw(`delete from dead_letter where request_id = ?`, requestID).Exec()
+	return err
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+	"time"
+)
+
+// 幂等键记录，同一个请求类型下，相同的幂等键只会受理一次
+type IdempotencyKey struct {
+	ID int `json:"id" orm:"column(id);auto"`
+	Key string `json:"key" orm:"column(idempotency_key);size(128)" description:"客户端传入的Idempotency-Key"`
+	RequestType string `json:"requestType" orm:"column(request_type);size(64)" description:"请求类型"`
+	Fingerprint string `json:"fingerprint" orm:"column(fingerprint);size(64)" description:"请求内容的sha256，用于判断是否重复使用了幂等键"`
+	RequestID string `json:"requestId" orm:"column(request_id);size(64)" description:"第一次受理时生成的请求ID，为空表示正在受理中"`
+	Async bool `json:"async" orm:"column(async)" description:"第一次是否是异步受理"`
+	Response string `json:"response" orm:"column(response);type(text)" description:"第一次受理时返回给客户端的数据"`
+	GmtCreated time.Time `json:"gmtCreated" orm:"column(gmt_created);type(timestamp);auto_now_add" description:"创建时间"`
+}
+
+func (t *IdempotencyKey) TableName() string {
+	return "idempotency_key"
+}
+
+func (t *IdempotencyKey) TableUnique() [][]string {
+	return [][]string{
+		{"RequestType", "Key"},
+	}
+}
+
+func AddIdempotencyKey(m *IdempotencyKey) (int64, error) {
+	o := orm.NewOrm()
+	return o.Insert(m)
+}
+
+// 不存在时返回nil
+func GetIdempotencyKey(requestType string, key string) (*IdempotencyKey, error) {
+	sqlStr := `select * from idempotency_key where request_type = ? and idempotency_key = ? `
+	o := orm.NewOrm()
+	m := &IdempotencyKey{}
+	err := o.Raw(sqlStr, requestType, key).QueryRow(m)
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -17,7 +17,7 @@ func Init() {
 		logrus.Fatal(err)
 	}
 	//orm.RegisterModel(new(Object))
-	orm.RegisterModel(new(Container), new(Pod), new(Request))
+	orm.RegisterModel(new(Container), new(Pod), new(Request), new(IdempotencyKey), new(Cluster), new(DeadLetter), new(Schedule), new(CoordinationLease), new(CoordinationMember))
 	err := orm.RunSyncdb("default", false, true)
 	if err != nil {
 		logrus.Error("ERROR: Init create tables failed, err: ", err)
@@ -25,4 +25,10 @@ func Init() {
 	}
 	orm.SetMaxIdleConns("default", 20)
 	orm.SetMaxOpenConns("default", 100)
-}
\ No newline at end of file
+}
+// 检查mysql是否可用
+func Ping() error {
+	o := orm.NewOrm()
+	_, err := o.Raw("select 1").Exec()
+	return err
+}
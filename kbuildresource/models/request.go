@@ -3,16 +3,39 @@ package models
 import (
 	"bryson.foundation/kbuildresource/common"
 	"github.com/astaxie/beego/orm"
+	"time"
 )
 
 type Request struct {
-	ID int `json:"id"orm:"column(id)"`
-	Name string `json:"name"orm:"column(name)"`
-	Message string `json:"message"orm:"column(message)"`
-	Status string `json:"status"orm:"column(status)"`
-	RequestType string `json:"requestType"orm:"column(request_type)"`
-	RequestDTO string `json:"request_dto"orm:"column(request);type(text)"`
-	InstanceName string `json:"instance_name"orm:"-"`
+	ID int `json:"id" orm:"column(id);auto"`
+	RequestID string `json:"requestId" orm:"column(request_id);size(64);index" description:"请求的全局唯一标识，用于查询请求状态"`
+	Name string `json:"name" orm:"column(name)"`
+	Message string `json:"message" orm:"column(message)"`
+	Status string `json:"status" orm:"column(status)"`
+	RequestType string `json:"requestType" orm:"column(request_type)"`
+	ClusterName string `json:"clusterName" orm:"column(cluster_name);size(128);null" description:"请求对应的集群，用于统计集群中排队的请求数"`
+	Namespace string `json:"namespace" orm:"column(namespace);size(256);null" description:"请求对应的命名空间，不同命名空间之间按照权重公平调度"`
+	Priority int `json:"priority" orm:"column(priority);default(5)" description:"优先级，同一个命名空间中优先级高的请求先执行"`
+	NotBefore *time.Time `json:"notBefore" orm:"column(not_before);type(datetime);null" description:"最早开始执行的时间，之前在延迟队列中等待"`
+	Deadline *time.Time `json:"deadline" orm:"column(deadline);type(datetime);null" description:"请求的截止时间，超过后还没有执行完成的请求会被中断并失败"`
+	Attempts int `json:"attempts" orm:"column(attempts);default(0)" description:"已经失败的执行次数，可以重试的错误会重新执行"`
+	Errors []*RequestError `json:"errors,omitempty" orm:"-" description:"每次执行失败的错误，随请求一起保存在缓存和队列中"`
+	RequestDTO string `json:"request_dto" orm:"column(request);type(text)"`
+	InstanceName string `json:"instance_name" orm:"-"`
+	LeaseOwner string `json:"lease_owner" orm:"-" description:"正在执行请求的租约持有者，租约保存在redis中"`
+	LeaseExpireAt time.Time `json:"lease_expire_at" orm:"-" description:"租约的过期时间，只在查询请求状态时填充"`
+	FencingToken int64 `json:"-" orm:"-" description:"持有分布式锁时写缓存带上的fencing token，0表示不检查，不保存"`
+	RetryAt *time.Time `json:"-" orm:"-" description:"可以重试的错误失败后重新执行的时间，处理器返回后由请求控制器放入延迟队列，不保存"`
+	GmtCreated time.Time `json:"gmtCreated" orm:"column(gmt_created);type(timestamp);auto_now_add" description:"创建时间"`
+	GmtModified time.Time `json:"gmtModified" orm:"column(gmt_modified);type(timestamp);auto_now" description:"更新时间"`
+}
+
+// 请求一次执行失败的错误
+type RequestError struct {
+	Attempt int `json:"attempt" description:"第几次执行"`
+	Error string `json:"error" description:"错误信息"`
+	Retryable bool `json:"retryable" description:"是否可以重试"`
+	Time time.Time `json:"time" description:"失败的时间"`
 }
 
 func (t *Request) TableName() string {
@@ -24,13 +47,49 @@ func AddRequest(m *Request) (int64, error) {
 	return o.Insert(m)
 }
 
-func GetBuildJobCreationRequestByName(name string) (*Request, error) {
-	sqlStr := `select * from request where name = ? and type = ? `
+// 更新请求的状态和信息
+func UpdateRequestStatus(m *Request) error {
+	o := orm.NewOrm()
+	_, err := o.Update(m, "Status", "Message", "GmtModified")
+	return err
+}
+
+// 更新请求的状态、信息和执行次数
+func UpdateRequestAttempts(m *Request) error {
+	o := orm.NewOrm()
+	_, err := o.Update(m, "Status", "Message", "Attempts", "GmtModified")
+	return err
+}
+
+// 统计集群中还没有结束的请求数
+func CountUnfinishedRequestsByCluster(clusterName string) (int64, error) {
+	o := orm.NewOrm()
+	return o.QueryTable(new(Request)).Filter("cluster_name", clusterName).
+		Filter("status__in", common.RequestStatusPending, common.RequestStatusExecuting).Count()
+}
+
+func GetRequestByRequestID(requestID string) (*Request, error) {
+	sqlStr := `select * from request where request_id = ? `
 	o := orm.NewOrm()
 	r := &Request{}
-	err := o.Raw(sqlStr, name, common.BuildJobCreateRequestType).QueryRow(&r)
+	err := o.Raw(sqlStr, requestID).QueryRow(r)
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 查询构建任务最近一次的创建或者删除请求
+func GetLatestBuildJobRequestByName(name string) (*Request, error) {
+	sqlStr := `select * from request where name = ? and request_type in (?, ?) order by id desc limit 1`
+	o := orm.NewOrm()
+	r := &Request{}
+	err := o.Raw(sqlStr, name, common.BuildJobCreateRequestType, common.BuildJobDeleteRequestType).QueryRow(r)
 	if err != nil {
 		return nil, err
 	}
 	return r, nil
-}
\ No newline at end of file
+}
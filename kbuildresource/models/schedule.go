@@ -0,0 +1,101 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+	"time"
+)
+
+// 周期性的构建任务，按照cron表达式定期创建构建任务，由master实例触发
+type Schedule struct {
+	ID int `json:"id" orm:"column(id);auto" description:"只读，主键字段，由后台数据库自动生成"`
+	Name string `json:"name" orm:"column(name);size(128);unique" description:"计划名，每次创建的构建任务名为 计划名-触发时间戳"`
+	Cron string `json:"cron" orm:"column(cron);size(128)" description:"标准的5段cron表达式，eg: 0 2 * * *"`
+	Namespace string `json:"namespace" orm:"column(namespace);size(256);null" description:"构建任务的命名空间"`
+	RequestDTO string `json:"requestDto" orm:"column(request);type(text)" description:"创建构建任务的参数"`
+	NextRunAt time.Time `json:"nextRunAt" orm:"column(next_run_at);type(datetime);index" description:"下一次触发的时间"`
+	LastRunAt *time.Time `json:"lastRunAt" orm:"column(last_run_at);type(datetime);null" description:"上一次触发的时间"`
+	LastRequestID string `json:"lastRequestId" orm:"column(last_request_id);size(64);null" description:"上一次触发创建的请求ID"`
+	LastError string `json:"lastError" orm:"column(last_error);type(text);null" description:"上一次触发失败的原因"`
+	GmtCreated time.Time `json:"gmtCreated" orm:"column(gmt_created);type(timestamp);auto_now_add" description:"创建时间"`
+	GmtModified time.Time `json:"gmtModified" orm:"column(gmt_modified);type(timestamp);auto_now" description:"更新时间"`
+}
+
+func (t *Schedule) TableName() string {
+	return "schedule"
+}
+
+func AddSchedule(m *Schedule) (int64, error) {
+	o := orm.NewOrm()
+	return o.Insert(m)
+}
+
+// 不存在时返回nil
+func GetScheduleByID(id int) (*Schedule, error) {
+	o := orm.NewOrm()
+	m := &Schedule{ID: id}
+	err := o.Read(m)
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 不存在时返回nil
+func GetScheduleByName(name string) (*Schedule, error) {
+	o := orm.NewOrm()
+	m := &Schedule{Name: name}
+	err := o.Read(m, "Name")
+	if err == orm.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ListSchedules() ([]*Schedule, error) {
+	o := orm.NewOrm()
+	schedules := make([]*Schedule, 0)
+	_, err := o.Raw(`select * from schedule order by id`).QueryRows(&schedules)
+	if err != nil && err != orm.ErrNoRows {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// 查询到了触发时间的计划
+func ListDueSchedules(now time.Time) ([]*Schedule, error) {
+	o := orm.NewOrm()
+	schedules := make([]*Schedule, 0)
+	_, err := o.Raw(`select * from schedule where next_run_at <= ? order by next_run_at`, now).QueryRows(&schedules)
+	if err != nil && err != orm.ErrNoRows {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// 记录一次触发的结果，并设置下一次触发的时间
+// 只有next_run_at还是runAt时才更新，返回false表示这次触发已经被其他实例处理过
+func FinishScheduleRun(m *Schedule, runAt time.Time, nextRunAt time.Time) (bool, error) {
+	sqlStr := `update schedule set next_run_at = ?, last_run_at = ?, last_request_id = ?, last_error = ?, gmt_modified = ? where id = ? and next_run_at = ?`
+	o := orm.NewOrm()
+	result, err := o.Raw(sqlStr, nextRunAt, runAt, m.LastRequestID, m.LastError, time.Now(), m.ID, runAt).Exec()
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func DeleteSchedule(id int) error {
+	o := orm.NewOrm()
+	_, err := o.Delete(&Schedule{ID: id})
+	return err
+}
@@ -15,6 +15,20 @@ import (
 func init() {
 	ns := beego.NewNamespace("/v1",
 		beego.NSRouter("/buildjob", &controllers.BuildJobController{}, "post:CreateBuildJob"),
+		beego.NSRouter("/buildjob/:name", &controllers.BuildJobController{}, "get:GetBuildJob;delete:DeleteBuildJob"),
+		beego.NSRouter("/buildjobs", &controllers.BuildJobController{}, "get:ListBuildJobs"),
+		beego.NSRouter("/requests/:id", &controllers.RequestController{}, "get:GetRequest"),
+		beego.NSRouter("/requests/:id/cancel", &controllers.RequestController{}, "post:CancelRequest"),
+		beego.NSRouter("/admin/requests/:id/queue", &controllers.AdminController{}, "get:GetQueuePosition"),
+		beego.NSRouter("/admin/deadletters", &controllers.AdminController{}, "get:ListDeadLetters"),
+		beego.NSRouter("/admin/deadletters/:id", &controllers.AdminController{}, "get:GetDeadLetter"),
+		beego.NSRouter("/admin/deadletters/:id/requeue", &controllers.AdminController{}, "post:RequeueDeadLetter"),
+		beego.NSRouter("/admin/elections", &controllers.AdminController{}, "get:ListElections"),
+		beego.NSRouter("/schedules", &controllers.ScheduleController{}, "get:ListSchedules"),
+		beego.NSRouter("/schedules/:id", &controllers.ScheduleController{}, "get:GetSchedule;delete:DeleteSchedule"),
+		beego.NSRouter("/clusters", &controllers.ClusterController{}, "get:ListClusters;post:CreateCluster"),
+		beego.NSRouter("/clusters/:name", &controllers.ClusterController{}, "get:GetCluster;put:UpdateCluster;delete:DeleteCluster"),
+		beego.NSRouter("/instances", &controllers.InstanceController{}, "get:ListInstances"),
 	)
 	beego.AddNamespace(ns)
 }
@@ -3,7 +3,9 @@ package utils
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"math/big"
+	"net"
 )
 
 const (
@@ -25,3 +27,31 @@ func CreateRandomString(len int) string {
 	return result
 }
 
+// 生成随机的uuid(v4)，用作请求ID等全局唯一标识
+func CreateUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return CreateRandomString(32)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// 本机第一个非回环的ipv4地址，没有时返回空字符串
+func GetLocalIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}